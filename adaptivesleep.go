@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// velocityWindow is how far back pick velocity is measured.
+	velocityWindow = time.Hour
+	// shortRunway is the runway below which sleeps shorten: a pool that
+	// empties within it is polled proportionally more often.
+	shortRunway = time.Hour
+	// idleAfter is how long without a pick before a full pool sleeps
+	// SLEEP_MAX.
+	idleAfter = 3 * time.Hour
+)
+
+// pickSample is a pattern's picked count at a fill cycle's sleep.
+type pickSample struct {
+	at     time.Time
+	picked int64
+}
+
+// sleepTuner chooses the fill loop's sleep between SLEEP_MIN and SLEEP_MAX
+// from recent pick velocity and pool runway, instead of the fixed SLEEP. A
+// pool that would run dry within shortRunway at the picks of the last
+// velocityWindow sleeps in proportion to its runway, down to SLEEP_MIN; a
+// pool nothing was picked from for idleAfter sleeps SLEEP_MAX; any other
+// sleeps SLEEP. Velocities are measured from the picked counts at each
+// sleep, so the first sleeps after a restart are SLEEP.
+type sleepTuner struct {
+	store    *gormStore
+	min, max time.Duration
+
+	mu       sync.Mutex
+	samples  map[string][]pickSample
+	lastPick map[string]time.Time
+	chosen   map[string]time.Duration
+}
+
+func newSleepTuner(store *gormStore, min, max time.Duration) *sleepTuner {
+	return &sleepTuner{store: store, min: min, max: max,
+		samples: map[string][]pickSample{}, lastPick: map[string]time.Time{}, chosen: map[string]time.Duration{}}
+}
+
+// Next is the sleep of loop, whose patterns have the given unpicked counts,
+// all at target. A nil tuner, or one that cannot count picks, returns base.
+func (t *sleepTuner) Next(ctx context.Context, loop string, counts map[string]int64, base time.Duration) time.Duration {
+	if t == nil {
+		return base
+	}
+	d, reason := base, "steady picking"
+	picked, err := t.store.PickedCounts(ctx)
+	if err != nil {
+		log.Println("Error counting picks for the adaptive sleep:", err)
+		reason = "pick velocity unknown"
+	} else {
+		d, reason = t.choose(counts, picked, base)
+	}
+	fillSleepSeconds.WithLabelValues(loop).Set(d.Seconds())
+
+	t.mu.Lock()
+	changed := t.chosen[loop] != d
+	t.chosen[loop] = d
+	t.mu.Unlock()
+	if changed {
+		log.Printf("Fill loop %q now sleeps %v between cycles (%s)\n", loop, d, reason)
+	}
+	return d
+}
+
+// choose records picked and returns the sleep for counts, and why.
+func (t *sleepTuner) choose(counts, picked map[string]int64, base time.Duration) (time.Duration, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := clock.Now()
+	runway := time.Duration(-1)
+	idle := true
+	for pattern, unpicked := range counts {
+		samples := t.samples[pattern]
+		if n := len(samples); n == 0 || picked[pattern] != samples[n-1].picked {
+			t.lastPick[pattern] = now
+		}
+		samples = append(samples, pickSample{at: now, picked: picked[pattern]})
+		for len(samples) > 2 && now.Sub(samples[1].at) >= velocityWindow {
+			samples = samples[1:]
+		}
+		t.samples[pattern] = samples
+		// A restart or first sample counts as a pick: idleness is only
+		// claimed once observed
+		if now.Sub(t.lastPick[pattern]) < idleAfter {
+			idle = false
+		}
+
+		oldest := samples[0]
+		elapsed := now.Sub(oldest.at)
+		if elapsed <= 0 || picked[pattern] <= oldest.picked {
+			continue
+		}
+		perSecond := float64(picked[pattern]-oldest.picked) / elapsed.Seconds()
+		r := time.Duration(float64(unpicked) / perSecond * float64(time.Second))
+		if runway < 0 || r < runway {
+			runway = r
+		}
+	}
+
+	switch {
+	case runway >= 0 && runway < shortRunway:
+		d := time.Duration(float64(base) * float64(runway) / float64(shortRunway)).Round(time.Second)
+		return max(t.min, min(base, d)), "runway " + runway.Round(time.Second).String()
+	case idle:
+		return t.max, "no picks for over " + idleAfter.String()
+	default:
+		return max(t.min, min(t.max, base)), "steady picking"
+	}
+}
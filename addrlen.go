@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"strings"
+
+	"solana-key-gen/keygen"
+)
+
+// Addresses are the base58 encoding of a 32-byte public key: 44
+// characters, or 43 for the ~6% of keys below 58^43 (shorter still only
+// for keys with leading zero bytes, each of which encodes as a leading
+// '1'). Patterns never assume either length:
+//
+//   - A prefix anchors at the first character and a suffix at the last,
+//     whatever the length. A suffix of n characters therefore starts at
+//     index 43-n of a 43-character address and 44-n of a 44-character one;
+//     nothing is matched at an absolute index, so the shorter address has
+//     no missing character for a pattern to land on.
+//   - A pattern longer than an address never matches it, rather than
+//     matching a truncated text.
+//   - Prefixes are the exception in difficulty, not in matching: since
+//     2^256 < 18·58^43, a 44-character address can only start with '1' to
+//     'J', so a prefix starting with a later character only ever matches
+//     43-character addresses, and is some 17 times rarer than its length
+//     suggests. prefixFraction accounts for this.
+//   - display.go's short form and match range are taken from the address's
+//     own ends, so they hold for either length.
+
+// keyBytes is the length of a public key.
+const keyBytes = 32
+
+// prefixFraction is the share of uniformly random public keys whose
+// address starts with prefix and, unless length is 0, is length
+// characters long. It is exact for the base58 encoding, leading zero bytes
+// included.
+func prefixFraction(prefix string, length int) float64 {
+	f, _ := prefixShare(prefix, length, keyBytes).Float64()
+	return f
+}
+
+// prefixShare is prefixFraction for n-byte keys, as an exact fraction.
+func prefixShare(prefix string, length, n int) *big.Rat {
+	if prefix == "" && length == 0 {
+		return big.NewRat(1, 1)
+	}
+	share := new(big.Rat)
+	if n == 0 {
+		return share
+	}
+	// A zero first byte encodes as a leading '1'. A length of 1 leaves no
+	// character for the other n-1 bytes, so only the one-byte zero key has it.
+	rest, one := strings.CutPrefix(prefix, "1")
+	switch {
+	case !one && prefix != "":
+	case length == 1:
+		if n == 1 && rest == "" {
+			share.Add(share, big.NewRat(1, 256))
+		}
+	default:
+		inner := prefixShare(rest, max(0, length-1), n-1)
+		share.Add(share, inner.Quo(inner, big.NewRat(256, 1)))
+	}
+	if one {
+		return share
+	}
+
+	// Otherwise the key is a value in [256^(n-1), 256^n), and those whose l
+	// base58 digits start with prefix's k lie in [v·58^(l-k), (v+1)·58^(l-k))
+	total := new(big.Int).Lsh(big.NewInt(1), uint(8*n))
+	lo := new(big.Int).Rsh(total, 8)
+	v := big.NewInt(0)
+	for _, c := range prefix {
+		i := strings.IndexRune(keygen.Alphabet, c)
+		if i < 0 {
+			return share
+		}
+		v.Mul(v, big.NewInt(58)).Add(v, big.NewInt(int64(i)))
+	}
+	count := new(big.Int)
+	k := len(prefix)
+	for l := max(1, k); l <= maxAddressLen; l++ {
+		if length != 0 && l != length {
+			continue
+		}
+		scale := new(big.Int).Exp(big.NewInt(58), big.NewInt(int64(l-k)), nil)
+		from := new(big.Int).Mul(v, scale)
+		to := new(big.Int).Add(from, scale)
+		if prefix == "" {
+			// Every value of exactly l digits
+			from.Div(scale, big.NewInt(58))
+			to.Set(scale)
+		}
+		if from.Cmp(lo) < 0 {
+			from.Set(lo)
+		}
+		if to.Cmp(total) > 0 {
+			to.Set(total)
+		}
+		if to.Cmp(from) > 0 {
+			count.Add(count, to.Sub(to, from))
+		}
+	}
+	return share.Add(share, new(big.Rat).SetFrac(count, total))
+}
+
+// attemptsAt is the expected attempts for p among candidates generated
+// with ADDRESS_LENGTH addrLen (0 = any): infinite if no address of that
+// length can match it.
+func (p pattern) attemptsAt(addrLen int) float64 {
+	if addrLen > 0 && len(p.text()) > addrLen {
+		return math.Inf(1)
+	}
+	if p.Prefix != "" && !p.Contains && p.equiv == (keygen.Equivalence{}) {
+		// Candidates of other lengths are attempts too, as in lengthFraction
+		f := prefixFraction(p.Prefix, addrLen)
+		if f == 0 {
+			return math.Inf(1)
+		}
+		return 1 / f
+	}
+	return p.expectedAttempts() / lengthFraction(addrLen)
+}
+
+// checkAddressLengths rejects patterns no address of ADDRESS_LENGTH addrLen
+// (0 = any) can match, and warns about prefixes that only 43-character
+// addresses can start with.
+func checkAddressLengths(patterns []pattern, addrLen int) error {
+	for _, p := range patterns {
+		if math.IsInf(p.attemptsAt(addrLen), 1) {
+			why := "it is longer"
+			if len(p.text()) <= addrLen {
+				why = "44-character addresses only start with 1 to J"
+			}
+			return fmt.Errorf("pattern %q (%s) can never match a %d-character address: %s", p.Name(), p.Source, addrLen, why)
+		}
+		if p.Prefix == "" || addrLen != 0 || prefixFraction(p.Prefix, maxAddressLen) > 0 {
+			continue
+		}
+		log.Printf("WARN prefix %q can only start a 43-character address, so it needs ~%.3g attempts, not the %.3g its length suggests\n",
+			p.Prefix, p.attemptsAt(0), difficulty(p.Prefix))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/mr-tron/base58/base58"
+
+	"solana-key-gen/keygen"
+)
+
+// TestPrefixShareBruteForce checks prefixShare against every key of one
+// and two bytes, leading zero bytes included.
+func TestPrefixShareBruteForce(t *testing.T) {
+	for n := 1; n <= 2; n++ {
+		var addrs []string
+		for v := range 1 << (8 * n) {
+			b := make([]byte, n)
+			for i := range b {
+				b[n-1-i] = byte(v >> (8 * i))
+			}
+			addrs = append(addrs, base58.Encode(b))
+		}
+		prefixes := []string{"", "11", "111", "5Q", "1z", "zz"}
+		for _, c := range keygen.Alphabet {
+			prefixes = append(prefixes, string(c))
+		}
+		for _, prefix := range prefixes {
+			for length := range 5 {
+				var count int64
+				for _, a := range addrs {
+					if strings.HasPrefix(a, prefix) && (length == 0 || len(a) == length) {
+						count++
+					}
+				}
+				want := big.NewRat(count, int64(len(addrs)))
+				if got := prefixShare(prefix, length, n); got.Cmp(want) != 0 {
+					t.Errorf("prefixShare(%q, %d, %d) = %v, want %v", prefix, length, n, got, want)
+				}
+			}
+		}
+	}
+}
+
+// addressesOfLength returns a 43- and a 44-character address.
+func addressesOfLength(t *testing.T) map[int]string {
+	t.Helper()
+	out := map[int]string{}
+	for i := 0; len(out) < 2; i++ {
+		if i > 10000 {
+			t.Fatalf("no address of each length in %d keys", i)
+		}
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := base58.Encode(pub)
+		if len(a) == 43 || len(a) == 44 {
+			out[len(a)] = a
+		}
+	}
+	return out
+}
+
+// TestAnchorsByLength checks prefixes and suffixes anchor at each address's
+// own ends, whether it has 43 characters or 44, and that a pattern longer
+// than an address never matches it.
+func TestAnchorsByLength(t *testing.T) {
+	for n, addr := range addressesOfLength(t) {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			cases := []struct {
+				name string
+				p    pattern
+				want bool
+			}{
+				{"suffix", pattern{Suffix: addr[n-4:]}, true},
+				{"prefix", pattern{Prefix: addr[:4]}, true},
+				{"whole address as suffix", pattern{Suffix: addr}, true},
+				{"whole address as prefix", pattern{Prefix: addr}, true},
+				{"suffix one character in", pattern{Suffix: addr[n-5 : n-1]}, false},
+				{"suffix longer than the address", pattern{Suffix: "1" + addr}, false},
+				{"prefix longer than the address", pattern{Prefix: addr + "1"}, false},
+			}
+			for _, c := range cases {
+				if got := c.p.matches(addr); got != c.want {
+					t.Errorf("%s: %s matches %s = %v, want %v", c.name, c.p.Name(), addr, got, c.want)
+				}
+			}
+		})
+	}
+	// A 44-character address only starts with 1 to J
+	if f := prefixFraction("K", 44); f != 0 {
+		t.Errorf("prefixFraction(K, 44) = %v, want 0", f)
+	}
+	if f := prefixFraction("K", 43); f == 0 {
+		t.Error("prefixFraction(K, 43) = 0, want a share")
+	}
+}
+
+// TestMatchersRandomKeys runs every kind of matcher over random keys of
+// both lengths: none may panic, and anchors hold as addrlen.go documents.
+func TestMatchersRandomKeys(t *testing.T) {
+	lengths := map[int]int{}
+	for range 5000 {
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := base58.Encode(pub)
+		n := len(addr)
+		lengths[n]++
+		for _, k := range []int{1, 4, n - 1, n, n + 1} {
+			end, start := addr[max(0, n-k):], addr[:min(n, k)]
+			if k > n {
+				end, start = "1"+addr, addr+"1"
+			}
+			if got := (pattern{Suffix: end}).matches(addr); got != (k <= n) {
+				t.Fatalf("suffix %q of %s: %v", end, addr, got)
+			}
+			if got := (pattern{Prefix: start}).matches(addr); got != (k <= n) {
+				t.Fatalf("prefix %q of %s: %v", start, addr, got)
+			}
+		}
+		for _, p := range []pattern{
+			{Suffix: "ponz", Contains: true},
+			{Suffix: addr[n-3:], Fuzzy: true, MaxEdit: 1},
+			{Suffix: strings.Repeat("z", 45), Fuzzy: true, MaxEdit: 2},
+			{Suffix: strings.Repeat("z", 45)},
+			{Prefix: strings.Repeat("1", 45)},
+		} {
+			p.matches(addr)
+		}
+		keygen.TrailingDigits(n+2, 3)(addr)
+		shortForm(addr)
+	}
+	if lengths[43] == 0 || lengths[44] == 0 {
+		t.Logf("lengths seen: %v", lengths)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58/base58"
+
+	"solana-key-gen/keygen"
+)
+
+// maxPendingFinds bounds how many unsubmitted keys an agent holds while the
+// coordinator is unreachable.
+const maxPendingFinds = 1000
+
+// errAgentUnknown means the coordinator no longer knows this agent, e.g.
+// after a restart or a missed heartbeat, and it must register again.
+var errAgentUnknown = errors.New("agent not registered with coordinator")
+
+// agentClient talks to a coordinator's /v1/agents API.
+type agentClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newAgentClient(base, token string) *agentClient {
+	return &agentClient{base: strings.TrimRight(base, "/"), token: token, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *agentClient) do(ctx context.Context, method, path string, in, out any) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errAgentUnknown
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s %s: %s: %s %s", method, path, resp.Status, e.Error.Code, e.Error.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// agent grinds the coordinator's patterns locally and submits what it finds.
+type agent struct {
+	client  *agentClient
+	name    string
+	workers int
+	duty    float64
+
+	mu      sync.Mutex
+	id      string
+	pending []agentFind
+}
+
+func newAgent(client *agentClient, name string, workers int, duty float64) *agent {
+	return &agent{client: client, name: name, workers: workers, duty: duty}
+}
+
+// Run registers with the coordinator and grinds until ctx is cancelled,
+// registering again whenever the coordinator forgets the agent.
+func (a *agent) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		var reg agentRegisterResponse
+		err := a.client.do(ctx, http.MethodPost, "/v1/agents", agentRegisterRequest{Name: a.name}, &reg)
+		if err != nil {
+			log.Println("Error registering with coordinator:", err)
+			select {
+			case <-ctx.Done():
+			case <-clock.After(10 * time.Second):
+			}
+			continue
+		}
+		interval, err := time.ParseDuration(reg.HeartbeatInterval)
+		if err != nil || interval <= 0 {
+			interval = 15 * time.Second
+		}
+		a.mu.Lock()
+		a.id = reg.AgentID
+		a.mu.Unlock()
+		log.Printf("Registered with coordinator as %s, patterns %q (config %s)\n", reg.AgentID, reg.Config.Patterns, reg.Config.Version)
+
+		a.session(ctx, reg.Config, interval)
+	}
+}
+
+// session grinds cfg, heartbeating every interval and restarting the
+// generator when the coordinator's config changes. It returns when ctx is
+// done (after deregistering) or when the agent must register again.
+func (a *agent) session(ctx context.Context, cfg agentConfig, interval time.Duration) {
+	var (
+		gen       *keygen.Generator
+		stopGen   func()
+		prevTotal int64 // attempts of generators already stopped
+	)
+	start := func() {
+		opts := append([]keygen.Option{keygen.WithWorkers(a.workers), keygen.WithDutyCycle(a.duty)}, cfg.options()...)
+		gen = keygen.NewGenerator(opts...)
+		genCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			err := gen.Run(genCtx, func(k keygen.Key) error {
+				a.submit(ctx, agentFind{PrivateKey: base58.Encode(k.PrivateKey), Attempts: k.Attempts})
+				return nil
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Println("Error generating vanity key:", err)
+			}
+		}()
+		stopGen = func() {
+			cancel()
+			<-done
+			prevTotal += gen.Attempts()
+		}
+	}
+	start()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastBeat, lastTotal := clock.Now(), int64(0)
+	for {
+		select {
+		case <-ctx.Done():
+			stopGen()
+			a.deregister()
+			return
+		case <-ticker.C:
+		}
+
+		now, total := clock.Now(), prevTotal+gen.Attempts()
+		rate := float64(total-lastTotal) / now.Sub(lastBeat).Seconds()
+		lastBeat, lastTotal = now, total
+
+		var resp agentHeartbeatResponse
+		err := a.client.do(ctx, http.MethodPost, "/v1/agents/"+a.agentID()+"/heartbeat",
+			agentHeartbeatRequest{Attempts: total, Rate: rate}, &resp)
+		if errors.Is(err, errAgentUnknown) {
+			log.Println("Coordinator no longer knows this agent, registering again")
+			stopGen()
+			return
+		}
+		if err != nil {
+			log.Println("Error sending heartbeat:", err)
+			continue
+		}
+		if resp.Config.Version != cfg.Version {
+			log.Printf("Coordinator config changed (%s -> %s), now grinding %q\n", cfg.Version, resp.Config.Version, resp.Config.Patterns)
+			stopGen()
+			cfg = resp.Config
+			start()
+		}
+		a.flush(ctx)
+	}
+}
+
+func (a *agent) agentID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.id
+}
+
+// submit queues a find and tries to deliver everything queued.
+func (a *agent) submit(ctx context.Context, f agentFind) {
+	a.mu.Lock()
+	if len(a.pending) >= maxPendingFinds {
+		log.Println("Too many unsubmitted finds, dropping the oldest")
+		a.pending = a.pending[1:]
+	}
+	a.pending = append(a.pending, f)
+	a.mu.Unlock()
+	a.flush(ctx)
+}
+
+// flush submits queued finds. They stay queued if the coordinator cannot
+// be reached, and are dropped once it has answered for each of them.
+func (a *agent) flush(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) == 0 {
+		return
+	}
+
+	var resp struct {
+		Results []importResult `json:"results"`
+	}
+	err := a.client.do(ctx, http.MethodPost, "/v1/agents/"+a.id+"/finds", agentFindsRequest{Keys: a.pending}, &resp)
+	if err != nil {
+		log.Printf("Error submitting %d finds, will retry: %v\n", len(a.pending), err)
+		return
+	}
+	var retry []agentFind
+	for i, res := range resp.Results {
+		switch res.Status {
+		case "imported":
+			log.Printf("Submitted key: %s\n", res.PublicKey)
+		case "duplicate":
+			log.Printf("Coordinator already had key: %s\n", res.PublicKey)
+		case "rejected":
+			log.Printf("Coordinator rejected key %s: %v\n", res.PublicKey, res.Error)
+		default:
+			if i < len(a.pending) {
+				retry = append(retry, a.pending[i])
+			}
+		}
+	}
+	a.pending = retry
+}
+
+// deregister flushes outstanding finds and tells the coordinator the agent
+// is leaving. It runs after ctx is cancelled, so it uses its own deadline.
+func (a *agent) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a.flush(ctx)
+	if err := a.client.do(ctx, http.MethodDelete, "/v1/agents/"+a.agentID(), nil, nil); err != nil && !errors.Is(err, errAgentUnknown) {
+		log.Println("Error deregistering from coordinator:", err)
+		return
+	}
+	log.Println("Deregistered from coordinator")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// auditExportSignature is the action of an export's signature records.
+const auditExportSignature = "signature"
+
+// auditExportRecord is one line of an audit export: an AUDIT_LOG_FILE
+// entry replayed under the export's own hash chain, or a signature record
+// closing a run of the exporter. Only public data is exported.
+type auditExportRecord struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	PrevHash  string    `json:"prev_hash"`
+	Action    string    `json:"action"` // an audit event, or signature
+	PublicKey string    `json:"public_key,omitempty"`
+	Pattern   string    `json:"pattern,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	// LogSeq is the audit log entry an event record replays.
+	LogSeq int64 `json:"log_seq,omitempty"`
+	// Signature, on a signature record, is the base64 Ed25519 signature of
+	// PrevHash, and so of every record before it.
+	Signature string `json:"signature,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+func (r auditExportRecord) digest() string {
+	r.Hash = ""
+	body, _ := json.Marshal(r)
+	sum := sha256.Sum256(append([]byte(r.PrevHash), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditExportState is where an export's chain ends.
+type auditExportState struct {
+	seq    int64
+	last   string
+	logSeq int64
+}
+
+// parseAuditKey decodes a hex or base64 Ed25519 key of n bytes, named for
+// errors.
+func parseAuditKey(name, s string, n int) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("%s must be hex or base64", name)
+		}
+	}
+	if len(key) != n {
+		return nil, fmt.Errorf("%s must be %d bytes, got %d", name, n, len(key))
+	}
+	return key, nil
+}
+
+// auditSigningKey is AUDIT_SIGNING_KEY, an Ed25519 seed.
+func auditSigningKey() (ed25519.PrivateKey, error) {
+	val := getenv("AUDIT_SIGNING_KEY")
+	if val == "" {
+		return nil, errors.New("AUDIT_SIGNING_KEY environment variable is not set")
+	}
+	seed, err := parseAuditKey("AUDIT_SIGNING_KEY", val, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// auditVerifyKey is AUDIT_VERIFY_KEY, or the public half of
+// AUDIT_SIGNING_KEY without it.
+func auditVerifyKey() (ed25519.PublicKey, error) {
+	if val := getenv("AUDIT_VERIFY_KEY"); val != "" {
+		key, err := parseAuditKey("AUDIT_VERIFY_KEY", val, ed25519.PublicKeySize)
+		return ed25519.PublicKey(key), err
+	}
+	priv, err := auditSigningKey()
+	if err != nil {
+		return nil, errors.New("set AUDIT_VERIFY_KEY (or AUDIT_SIGNING_KEY) to verify an audit export")
+	}
+	return priv.Public().(ed25519.PublicKey), nil
+}
+
+// verifyAuditExport checks the hash chain and every signature of the audit
+// export at path, which must end with a signature record, and returns
+// where its chain ends. The error names the first record that does not
+// verify.
+func verifyAuditExport(path string, pub ed25519.PublicKey) (auditExportState, error) {
+	var st auditExportState
+	f, err := os.Open(path)
+	if err != nil {
+		return st, err
+	}
+	defer f.Close()
+
+	signed := true
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var r auditExportRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return st, fmt.Errorf("%s:%d: not an audit export record: %w", path, line, err)
+		}
+		switch {
+		case r.Seq != st.seq+1:
+			return st, fmt.Errorf("%s:%d: sequence %d follows %d; records were removed or reordered", path, line, r.Seq, st.seq)
+		case r.PrevHash != st.last:
+			return st, fmt.Errorf("%s:%d: previous hash does not match record %d", path, line, st.seq)
+		case r.Hash != r.digest():
+			return st, fmt.Errorf("%s:%d: hash mismatch; record %d was altered", path, line, r.Seq)
+		}
+		if r.Action == auditExportSignature {
+			sig, err := base64.StdEncoding.DecodeString(r.Signature)
+			if err != nil || !ed25519.Verify(pub, []byte(r.PrevHash), sig) {
+				return st, fmt.Errorf("%s:%d: signature of record %d does not verify with this key", path, line, r.Seq)
+			}
+			signed = true
+		} else {
+			if r.LogSeq <= st.logSeq {
+				return st, fmt.Errorf("%s:%d: audit log entry %d replayed after entry %d", path, line, r.LogSeq, st.logSeq)
+			}
+			st.logSeq, signed = r.LogSeq, false
+		}
+		st.seq, st.last = r.Seq, r.Hash
+	}
+	if err := sc.Err(); err != nil {
+		return st, err
+	}
+	if !signed {
+		return st, fmt.Errorf("%s: records after %d are not signed; the export was cut short or appended to", path, st.seq)
+	}
+	return st, nil
+}
+
+// exportAuditLog replays the entries of the audit log at logPath not yet in
+// the export at path onto its chain, then signs it with key. An existing
+// export is verified first and continued, never rewritten.
+func exportAuditLog(logPath, path string, key ed25519.PrivateKey) (int, error) {
+	if _, _, err := verifyAuditLog(logPath); err != nil {
+		return 0, fmt.Errorf("audit log does not verify: %w", err)
+	}
+	st, err := verifyAuditExport(path, key.Public().(ed25519.PublicKey))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("existing export does not verify: %w", err)
+	}
+
+	src, err := os.Open(logPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	var records []auditExportRecord
+	var logSeq int64
+	sc := bufio.NewScanner(src)
+	for sc.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return 0, err
+		}
+		logSeq = e.Seq
+		if e.Seq <= st.logSeq {
+			continue
+		}
+		records = append(records, auditExportRecord{Time: e.Time, Action: e.Event, PublicKey: e.PublicKey,
+			Pattern: e.Pattern, Actor: e.Actor, LogSeq: e.Seq})
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	if logSeq < st.logSeq {
+		return 0, fmt.Errorf("export has audit log entries up to %d but %s ends at %d; was the log replaced?", st.logSeq, logPath, logSeq)
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	records = append(records, auditExportRecord{Time: clock.Now().UTC(), Action: auditExportSignature})
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	var buf []byte
+	for _, r := range records {
+		r.Seq, r.PrevHash = st.seq+1, st.last
+		if r.Action == auditExportSignature {
+			r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(r.PrevHash)))
+		}
+		r.Hash = r.digest()
+		line, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		buf = append(append(buf, line...), '\n')
+		st.seq, st.last = r.Seq, r.Hash
+	}
+	if _, err := out.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(records) - 1, out.Sync()
+}
+
+// cmdExportAuditLog implements the "export-audit-log" subcommand.
+func cmdExportAuditLog(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: export-audit-log <export-file>")
+	}
+	logPath := getenv("AUDIT_LOG_FILE")
+	if logPath == "" {
+		return errors.New("AUDIT_LOG_FILE environment variable is not set")
+	}
+	key, err := auditSigningKey()
+	if err != nil {
+		return err
+	}
+	n, err := exportAuditLog(logPath, args[0], key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d new audit entries exported and signed\n", args[0], n)
+	return nil
+}
+
+// cmdVerifyAuditExport implements the "verify-audit-export" subcommand.
+func cmdVerifyAuditExport(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: verify-audit-export <export-file>")
+	}
+	pub, err := auditVerifyKey()
+	if err != nil {
+		return err
+	}
+	st, err := verifyAuditExport(args[0], pub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d records verified and signed, through audit log entry %d, last hash %s\n", args[0], st.seq, st.logSeq, st.last)
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// auditEvent is one entry of the compliance audit log. It never carries a
+// private key.
+type auditEvent struct {
+	Event     string `json:"event"` // generate or pick
+	PublicKey string `json:"public_key"`
+	Pattern   string `json:"pattern,omitempty"`
+	Actor     string `json:"actor"`
+}
+
+// AuditLogger records generation and pick events outside the key database.
+type AuditLogger interface {
+	Log(ev auditEvent) error
+}
+
+// nopAuditLogger is the AuditLogger when AUDIT_LOG_FILE is not set.
+type nopAuditLogger struct{}
+
+func (nopAuditLogger) Log(auditEvent) error { return nil }
+
+// auditEntry is one line of a file audit log. Hash is the SHA-256 of the
+// previous entry's hash followed by this entry's JSON without Hash, so
+// changing, dropping or reordering any entry breaks every hash after it.
+type auditEntry struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	PrevHash string    `json:"prev_hash"`
+	auditEvent
+	Hash string `json:"hash,omitempty"`
+}
+
+func (e auditEntry) digest() string {
+	e.Hash = ""
+	body, _ := json.Marshal(e)
+	sum := sha256.Sum256(append([]byte(e.PrevHash), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileAuditLog appends hash-chained JSON lines to a file, syncing each one.
+type fileAuditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	prev string
+}
+
+// openFileAuditLog opens path for appending, first verifying the chain
+// already in it so new entries continue from its last hash.
+func openFileAuditLog(path string) (*fileAuditLog, error) {
+	seq, prev, err := verifyAuditLog(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditLog{f: f, seq: seq, prev: prev}, nil
+}
+
+func (l *fileAuditLog) Log(ev auditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := auditEntry{Seq: l.seq + 1, Time: clock.Now().UTC(), PrevHash: l.prev, auditEvent: ev}
+	e.Hash = e.digest()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.seq, l.prev = e.Seq, e.Hash
+	return nil
+}
+
+func (l *fileAuditLog) Close() error { return l.f.Close() }
+
+// verifyAuditLog checks the hash chain of the audit log at path and returns
+// its last sequence number and hash. The error names the first entry that
+// does not verify.
+func verifyAuditLog(path string) (seq int64, last string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return seq, last, fmt.Errorf("%s:%d: not an audit entry: %w", path, line, err)
+		}
+		switch {
+		case e.Seq != seq+1:
+			return seq, last, fmt.Errorf("%s:%d: sequence %d follows %d; entries were removed or reordered", path, line, e.Seq, seq)
+		case e.PrevHash != last:
+			return seq, last, fmt.Errorf("%s:%d: previous hash does not match entry %d", path, line, seq)
+		case e.Hash != e.digest():
+			return seq, last, fmt.Errorf("%s:%d: hash mismatch; entry %d was altered", path, line, e.Seq)
+		}
+		seq, last = e.Seq, e.Hash
+	}
+	return seq, last, sc.Err()
+}
+
+// readAuditLog returns the entries of the audit log at path. A torn last
+// line, being written as it is read, is left out.
+func readAuditLog(path string) ([]auditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			if !bytes.HasSuffix(sc.Bytes(), []byte("}")) {
+				break
+			}
+			return nil, fmt.Errorf("%s:%d: not an audit entry: %w", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// handleAudit serves GET /v1/audit: the AUDIT_LOG_FILE entries, paged by
+// time and sequence and filtered by the shared list parameters, where
+// source is the entry's actor (the instance, agent or token behind it). A
+// restricted token sees only the entries of its patterns.
+func (s *server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	page, perr := parsePageParams(r.URL.Query(), pageLimits{Default: 100, Max: 10000}, "pattern", "source", "from", "to")
+	if perr != nil {
+		writeError(w, http.StatusBadRequest, perr.Code, perr.Message, nil)
+		return
+	}
+	restrict := tokenFromContext(r.Context()).Restrict
+	if page.Pattern != "" && !s.allowsPattern(restrict, page.Pattern) {
+		writeRestricted(w, restrict)
+		return
+	}
+	entries, err := readAuditLog(s.auditLogPath)
+	if err != nil {
+		log.Println("Error reading audit log:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read the audit log", nil)
+		return
+	}
+	entries = slices.DeleteFunc(entries, func(e auditEntry) bool {
+		return page.Pattern != "" && e.Pattern != page.Pattern || page.Source != "" && e.Actor != page.Source ||
+			page.From != nil && e.Time.Before(*page.From) || page.To != nil && !e.Time.Before(*page.To) ||
+			!s.allowsPattern(restrict, e.Pattern)
+	})
+	entries, next, err := slicePage(entries, func(e auditEntry) (time.Time, uint64) { return e.Time, uint64(e.Seq) }, page)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_cursor", err.Error(), nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "next_cursor": next})
+}
+
+// cmdVerifyAuditLog implements the "verify-audit-log" subcommand.
+func cmdVerifyAuditLog(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: verify-audit-log <file>")
+	}
+	seq, last, err := verifyAuditLog(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d entries verified, last hash %s\n", args[0], seq, last)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAuditLog logs n generate events to a new audit log and returns its
+// lines.
+func writeAuditLog(t *testing.T, path string, n int) []string {
+	t.Helper()
+	l, err := openFileAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		if err := l.Log(auditEvent{Event: "generate", PublicKey: testPub(string(rune('a' + i))), Pattern: "ab", Actor: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	lines := writeAuditLog(t, path, 3)
+	seq, last, err := verifyAuditLog(path)
+	if err != nil || seq != 3 {
+		t.Fatalf("verifyAuditLog = %d, %v; want 3 entries verified", seq, err)
+	}
+	if strings.Contains(strings.Join(lines, ""), "private") {
+		t.Fatal("an audit entry mentions a private key")
+	}
+
+	// Reopening continues the chain from the last entry
+	l, err := openFileAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Log(auditEvent{Event: "pick", PublicKey: testPub("a"), Pattern: "ab", Actor: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	entries, err := readAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[3].Seq != 4 || entries[3].PrevHash != last {
+		t.Fatalf("entry after reopening = %+v, want sequence 4 chained to %s", entries[len(entries)-1], last)
+	}
+	if seq, _, err := verifyAuditLog(path); err != nil || seq != 4 {
+		t.Fatalf("verifyAuditLog after reopening = %d, %v; want 4", seq, err)
+	}
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tamper func(lines []string) []string
+		want   string
+	}{
+		{"altered entry", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"pattern":"ab"`, `"pattern":"cd"`, 1)
+			return lines
+		}, "entry 2 was altered"},
+		{"removed entry", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, "sequence 3 follows 1"},
+		{"reordered entries", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, "sequence 3 follows 1"},
+		{"rehashed entry", func(lines []string) []string {
+			// An entry re-hashed after editing still breaks the next one's link
+			var e auditEntry
+			if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+				t.Fatal(err)
+			}
+			e.Actor = "someone-else"
+			e.Hash = e.digest()
+			b, _ := json.Marshal(e)
+			lines[1] = string(b)
+			return lines
+		}, "previous hash does not match entry 2"},
+		{"not an entry", func(lines []string) []string {
+			return append(lines, "garbage")
+		}, "not an audit entry"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			lines := tc.tamper(writeAuditLog(t, path, 3))
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := verifyAuditLog(path); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("verifyAuditLog = %v, want an error containing %q", err, tc.want)
+			}
+			if _, err := openFileAuditLog(path); err == nil {
+				t.Fatal("a tampered audit log was opened for appending")
+			}
+		})
+	}
+}
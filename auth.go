@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	scopePick   = "pick"
+	scopeImport = "import"
+	scopeRead   = "read"
+	scopeAgent  = "agent"
+	scopeAdmin  = "admin"
+	// scopeExport lets a peer instance pull keys out of the pool.
+	scopeExport = "export"
+)
+
+var knownScopes = []string{scopePick, scopeImport, scopeRead, scopeAgent, scopeAdmin, scopeExport}
+
+type apiToken struct {
+	Name   string
+	Secret string
+	Scopes []string
+	// Restrict, if set, limits the keys the token can pick and see.
+	Restrict *keyRestriction
+}
+
+// keyRestriction limits a token to keys of the listed patterns and of the
+// listed campaigns; an empty list does not restrict that dimension. It is
+// applied in the pick statement itself, so no request can reach past it.
+type keyRestriction struct {
+	Patterns  []string
+	Campaigns []string
+}
+
+// parseKeyRestriction parses "pattern=ponz,campaign=launch" entries.
+func parseKeyRestriction(spec string) (*keyRestriction, error) {
+	r := &keyRestriction{}
+	for _, entry := range strings.Split(spec, ",") {
+		kind, name, ok := strings.Cut(entry, "=")
+		switch {
+		case !ok || name == "":
+			return nil, fmt.Errorf("restriction %q is not pattern=name or campaign=name", entry)
+		case kind == "pattern":
+			r.Patterns = append(r.Patterns, name)
+		case kind == "campaign":
+			r.Campaigns = append(r.Campaigns, name)
+		default:
+			return nil, fmt.Errorf("unknown restriction %q, want pattern or campaign", kind)
+		}
+	}
+	return r, nil
+}
+
+// Allows reports whether a key of pattern and campaign is within r. A nil
+// restriction allows every key.
+func (r *keyRestriction) Allows(pattern, campaign string) bool {
+	return r == nil || ((len(r.Patterns) == 0 || slices.Contains(r.Patterns, pattern)) &&
+		(len(r.Campaigns) == 0 || slices.Contains(r.Campaigns, campaign)))
+}
+
+// Excludes reports whether a request filtering on pattern and campaign,
+// either possibly empty, asks for keys outside r.
+func (r *keyRestriction) Excludes(pattern, campaign string) bool {
+	if r == nil {
+		return false
+	}
+	return pattern != "" && len(r.Patterns) > 0 && !slices.Contains(r.Patterns, pattern) ||
+		campaign != "" && len(r.Campaigns) > 0 && !slices.Contains(r.Campaigns, campaign)
+}
+
+// String is r in token file syntax.
+func (r *keyRestriction) String() string {
+	var parts []string
+	for _, p := range r.Patterns {
+		parts = append(parts, "pattern="+p)
+	}
+	for _, c := range r.Campaigns {
+		parts = append(parts, "campaign="+c)
+	}
+	return strings.Join(parts, ",")
+}
+
+// where is the SQL condition r puts on token_key, with "?" placeholders.
+func (r *keyRestriction) where() (string, []any) {
+	var conds []string
+	var args []any
+	for _, dim := range []struct {
+		column string
+		names  []string
+	}{{"matched_pattern", r.Patterns}, {"campaign", r.Campaigns}} {
+		if len(dim.names) == 0 {
+			continue
+		}
+		conds = append(conds, dim.column+" IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(dim.names)), ", ")+")")
+		for _, n := range dim.names {
+			args = append(args, n)
+		}
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// allowsPattern reports whether restrict lets a token see data about the
+// pattern named name, judged by the campaign of the configured pattern.
+func (s *server) allowsPattern(restrict *keyRestriction, name string) bool {
+	if restrict == nil {
+		return true
+	}
+	for _, p := range s.patterns {
+		if p.Name() == name {
+			return restrict.Allows(name, p.Campaign)
+		}
+	}
+	return name != "" && !restrict.Excludes(name, "")
+}
+
+// visiblePatterns names the configured patterns restrict allows, nil for
+// no restriction.
+func (s *server) visiblePatterns(restrict *keyRestriction) []string {
+	if restrict == nil {
+		return nil
+	}
+	names := []string{}
+	for _, p := range s.patterns {
+		if restrict.Allows(p.Name(), p.Campaign) {
+			names = append(names, p.Name())
+		}
+	}
+	return names
+}
+
+// writeRestricted rejects a request reaching outside the token's restriction.
+func writeRestricted(w http.ResponseWriter, r *keyRestriction) {
+	writeError(w, http.StatusForbidden, "token_restricted", "this token is restricted to "+r.String(),
+		map[string]any{"restriction": r.String()})
+}
+
+// Has reports whether the token grants scope. Admin grants every scope.
+func (t apiToken) Has(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, scopeAdmin)
+}
+
+// tokenSet holds the API tokens; it is swapped wholesale on reload.
+type tokenSet struct {
+	path   string
+	legacy string
+
+	mu     sync.RWMutex
+	tokens []apiToken
+}
+
+// newTokenSet loads tokens from path (if set) plus the legacy single
+// API_TOKEN, which keeps its historical all-powerful admin scope.
+func newTokenSet(path, legacy string) (*tokenSet, error) {
+	ts := &tokenSet{path: path, legacy: legacy}
+	if err := ts.Reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Reload re-reads the token file. On error the previous tokens stay active.
+func (ts *tokenSet) Reload() error {
+	var tokens []apiToken
+	if ts.legacy != "" {
+		tokens = append(tokens, apiToken{Name: "default", Secret: ts.legacy, Scopes: []string{scopeAdmin}})
+	}
+	if ts.path != "" {
+		fileTokens, err := parseTokenFile(ts.path)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	ts.mu.Lock()
+	ts.tokens = tokens
+	ts.mu.Unlock()
+	return nil
+}
+
+func (ts *tokenSet) Enabled() bool {
+	return ts.path != "" || ts.legacy != ""
+}
+
+func (ts *tokenSet) Authenticate(secret string) (apiToken, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	var match apiToken
+	ok := false
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(t.Secret)) == 1 {
+			match, ok = t, true
+		}
+	}
+	return match, ok
+}
+
+// parseTokenFile reads lines of "name secret scope[,scope...]", optionally
+// followed by a restriction such as "pattern=ponz,campaign=launch" (see
+// keyRestriction). Blank lines and lines starting with # are ignored.
+func parseTokenFile(path string) ([]apiToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []apiToken
+	names := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: want \"name secret scopes [restriction]\"", path, line)
+		}
+		t := apiToken{Name: fields[0], Secret: fields[1], Scopes: strings.Split(fields[2], ",")}
+		for _, sc := range t.Scopes {
+			if !slices.Contains(knownScopes, sc) {
+				return nil, fmt.Errorf("%s:%d: unknown scope %q", path, line, sc)
+			}
+		}
+		if len(fields) == 4 {
+			// Admin tokens can purge and export the whole pool anyway
+			if slices.Contains(t.Scopes, scopeAdmin) {
+				return nil, fmt.Errorf("%s:%d: admin tokens cannot be restricted", path, line)
+			}
+			var err error
+			if t.Restrict, err = parseKeyRestriction(fields[3]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s:%d: duplicate token name %q", path, line, t.Name)
+		}
+		names[t.Name] = true
+		tokens = append(tokens, t)
+	}
+	return tokens, sc.Err()
+}
+
+type tokenCtxKey struct{}
+
+func tokenFromContext(ctx context.Context) apiToken {
+	t, _ := ctx.Value(tokenCtxKey{}).(apiToken)
+	return t
+}
+
+// require authenticates the bearer token and checks it grants scope.
+func (s *server) require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		tok, ok := s.tokens.Authenticate(secret)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid bearer token", nil)
+			return
+		}
+		if !tok.Has(scope) {
+			writeError(w, http.StatusForbidden, "forbidden", "token lacks required scope "+scope,
+				map[string]any{"missing_scope": scope})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, tok)))
+	}
+}
+
+// audit records an API action together with the acting token and its scopes.
+func audit(ctx context.Context, action string, detail string) {
+	tok := tokenFromContext(ctx)
+	log.Printf("AUDIT action=%s actor=%s scopes=%s %s\n", action, tok.Name, strings.Join(tok.Scopes, ","), detail)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAllowsPattern(t *testing.T) {
+	s := &server{patterns: []pattern{{Suffix: "ponz", Campaign: "launch"}, {Suffix: "pump"}, {Prefix: "moon", Campaign: "launch"}}}
+	byPattern := &keyRestriction{Patterns: []string{"ponz"}}
+	byCampaign := &keyRestriction{Campaigns: []string{"launch"}}
+	for _, c := range []struct {
+		restrict *keyRestriction
+		name     string
+		want     bool
+	}{
+		{nil, "pump", true},
+		{nil, "", true},
+		{byPattern, "ponz", true},
+		{byPattern, "pump", false},
+		{byPattern, "elsewhere", false},
+		{byPattern, "", false},
+		{byCampaign, "ponz", true},
+		{byCampaign, "moon*", true},
+		{byCampaign, "pump", false},
+	} {
+		if got := s.allowsPattern(c.restrict, c.name); got != c.want {
+			t.Errorf("allowsPattern(%v, %q) = %v, want %v", c.restrict, c.name, got, c.want)
+		}
+	}
+
+	if got := s.visiblePatterns(nil); got != nil {
+		t.Errorf("visiblePatterns(nil) = %v, want nil", got)
+	}
+	if got := s.visiblePatterns(byCampaign); !slices.Equal(got, []string{"ponz", "moon*"}) {
+		t.Errorf("visiblePatterns(campaign=launch) = %v", got)
+	}
+	if got := s.visiblePatterns(&keyRestriction{Patterns: []string{"gone"}}); got == nil || len(got) != 0 {
+		t.Errorf("visiblePatterns for an unconfigured pattern = %#v, want empty", got)
+	}
+}
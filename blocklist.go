@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// blocklistMinChecked is how many candidates must have been screened before
+// the rejection rate is judged.
+const blocklistMinChecked = 20
+
+// blocklist rejects addresses containing any of a file's substrings,
+// case-insensitively. It screens candidates that already matched a pattern,
+// so every rejection throws away a find; the rejection rate is watched to
+// catch a list that blocks far more than intended.
+type blocklist struct {
+	path     string
+	patterns []pattern
+	warnRate float64
+	// discards, if set, records every rejected find.
+	discards *discardLedger
+
+	mu    sync.RWMutex
+	terms []string
+
+	checked, rejected atomic.Int64
+	lastWarn          atomic.Int64 // unix seconds
+}
+
+func newBlocklist(path string, patterns []pattern, warnRate float64) (*blocklist, error) {
+	b := &blocklist{path: path, patterns: patterns, warnRate: warnRate}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload re-reads the file: one term per line, blank lines and lines
+// starting with "#" ignored. On error the previous terms stay active.
+func (b *blocklist) Reload() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var terms []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		terms = append(terms, strings.ToLower(line))
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	// A term inside a pattern's own text blocks every key of that pattern
+	for _, p := range b.patterns {
+		for _, t := range terms {
+			if strings.Contains(strings.ToLower(p.text()), t) {
+				log.Printf("WARN blocklist term %q appears in pattern %q, so every key for it will be rejected\n", t, p.Name())
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.terms = terms
+	b.mu.Unlock()
+	b.checked.Store(0)
+	b.rejected.Store(0)
+	log.Printf("Loaded %d blocklist terms from %s\n", len(terms), b.path)
+	return nil
+}
+
+// allows is the generator filter.
+func (b *blocklist) allows(addr string) bool {
+	lower := strings.ToLower(addr)
+	b.mu.RLock()
+	blocked := ""
+	for _, t := range b.terms {
+		if strings.Contains(lower, t) {
+			blocked = t
+			break
+		}
+	}
+	b.mu.RUnlock()
+
+	checked := b.checked.Add(1)
+	blocklistCheckedTotal.Inc()
+	if blocked == "" {
+		return true
+	}
+	rejected := b.rejected.Add(1)
+	blocklistRejectedTotal.Inc()
+	for _, p := range b.patterns {
+		if p.matches(addr) {
+			b.discards.Record(discardBlocklist, p.Name(), addr, 0)
+			break
+		}
+	}
+
+	rate := float64(rejected) / float64(checked)
+	if checked >= blocklistMinChecked && rate > b.warnRate {
+		now := clock.Now().Unix()
+		if last := b.lastWarn.Load(); now-last >= 600 && b.lastWarn.CompareAndSwap(last, now) {
+			log.Printf("WARN blocklist rejected %d of %d matching candidates (%.0f%%, above BLOCKLIST_WARN_RATE %.0f%%), last on %q; check %s\n",
+				rejected, checked, 100*rate, 100*b.warnRate, blocked, b.path)
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := newCircuitBreaker("test", 3, time.Minute)
+	fail := func() error { return errors.New("down") }
+	ok := func() error { return nil }
+	expect := func(want breakerState) {
+		t.Helper()
+		if got := b.State(); got != want {
+			t.Fatalf("state = %s, want %s", got, want)
+		}
+	}
+
+	// Failures below the threshold, or broken by a success, leave it closed
+	b.Do(fail)
+	b.Do(fail)
+	b.Do(ok)
+	b.Do(fail)
+	b.Do(fail)
+	expect(breakerClosed)
+	b.Do(fail)
+	expect(breakerOpen)
+
+	called := false
+	if err := b.Do(func() error { called = true; return nil }); !errors.Is(err, errBreakerOpen) || called {
+		t.Fatalf("open breaker ran fn (called %v, err %v)", called, err)
+	}
+
+	// After the cooldown one probe goes through; a failed probe reopens it
+	c.Advance(time.Minute)
+	if err := b.Do(fail); errors.Is(err, errBreakerOpen) {
+		t.Fatal("no probe after the cooldown")
+	}
+	expect(breakerOpen)
+	c.Advance(59 * time.Second)
+	if err := b.Do(ok); !errors.Is(err, errBreakerOpen) {
+		t.Fatal("a failed probe did not restart the cooldown")
+	}
+
+	// While the probe runs, other calls are refused; its success closes it
+	c.Advance(time.Second)
+	probe := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- b.Do(func() error { <-probe; return nil }) }()
+	for b.State() != breakerHalfOpen {
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Do(ok); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("a second call during the probe = %v, want errBreakerOpen", err)
+	}
+	close(probe)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expect(breakerClosed)
+	if err := b.Do(ok); err != nil {
+		t.Fatalf("closed breaker refused a call: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// parseCampaigns applies CAMPAIGNS entries of the form
+// "pattern=label[@from/until]" to patterns. from and until are RFC 3339
+// times or dates and either may be left empty for an open window.
+func parseCampaigns(spec string, patterns []pattern) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("want pattern=label[@from/until] in %q", entry)
+		}
+		label, window, _ := strings.Cut(rest, "@")
+		if label == "" {
+			return fmt.Errorf("empty campaign label in %q", entry)
+		}
+
+		var from, until *time.Time
+		if window != "" {
+			f, u, ok := strings.Cut(window, "/")
+			if !ok {
+				return fmt.Errorf("window in %q must be from/until", entry)
+			}
+			var err error
+			if from, err = parseCampaignTime(f); err != nil {
+				return fmt.Errorf("invalid valid_from in %q: %w", entry, err)
+			}
+			if until, err = parseCampaignTime(u); err != nil {
+				return fmt.Errorf("invalid valid_until in %q: %w", entry, err)
+			}
+			if from != nil && until != nil && !until.After(*from) {
+				return fmt.Errorf("window in %q ends before it starts", entry)
+			}
+		}
+
+		found := false
+		for i := range patterns {
+			if patterns[i].Name() == name {
+				patterns[i].Campaign, patterns[i].ValidFrom, patterns[i].ValidUntil = label, from, until
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("campaign %q names unknown pattern %q", label, name)
+		}
+	}
+	return nil
+}
+
+func parseCampaignTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, s); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// campaignCount is the number of keys in one campaign and picked state.
+type campaignCount struct {
+	Campaign string
+	IsPicked bool
+	Count    int64
+}
+
+// CampaignCounts breaks the pool down by campaign and picked state. Keys
+// outside any campaign are reported under "".
+func (s *gormStore) CampaignCounts(ctx context.Context) ([]campaignCount, error) {
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var out []campaignCount
+	err := db.Model(&TokenKey{}).
+		Select("COALESCE(campaign, '') AS campaign, is_picked, count(*) AS count").
+		Group("COALESCE(campaign, ''), is_picked").
+		Scan(&out).Error
+	return out, ctxError(ctx, "campaign counts", err)
+}
+
+// handleStats reports each pattern's depth against its target and any
+// prewarm in progress, each
+// campaign's picked and unpicked counts, the discard ledger by reason,
+// since ?discards_since= (default a day ago), what each of this
+// instance's fill loops is doing, how far each table scanner has got and
+// how each maintenance job last ran.
+// A restricted token sees only the patterns and campaigns within its
+// restriction. data_as_of is when the data was current, and stale is set
+// when it comes from a replica that trails too far or has yet to replay
+// the last admin mutation.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	since := clock.Now().Add(-24 * time.Hour)
+	if val := r.URL.Query().Get("discards_since"); val != "" {
+		t, err := parseCampaignTime(val)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_discards_since", "discards_since must be an RFC 3339 time or a date", nil)
+			return
+		}
+		since = *t
+	}
+
+	// Every count comes from one place, and says how current it is
+	ctx := s.store.pinReads(r.Context())
+	asOf, stale, err := s.store.DataAsOf(ctx)
+	if err != nil {
+		log.Println("Error reading replica freshness:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read replica freshness", nil)
+		return
+	}
+
+	// A restricted token sees only its own patterns and campaigns
+	restrict := tokenFromContext(ctx).Restrict
+	prewarms, err := s.store.Prewarms(ctx)
+	if err != nil {
+		log.Println("Error reading prewarms:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read prewarms", nil)
+		return
+	}
+	patterns := make([]map[string]any, 0, len(s.patterns))
+	for _, p := range s.patterns {
+		if !restrict.Allows(p.Name(), p.Campaign) {
+			continue
+		}
+		n, err := s.store.CountUnpicked(ctx, p.Name())
+		if err != nil {
+			log.Println("Error counting unpicked keys:", err)
+			writeError(w, http.StatusInternalServerError, "internal", "failed to count keys", nil)
+			return
+		}
+		entry := map[string]any{
+			"pattern":  p.Name(),
+			"campaign": p.Campaign,
+			"profile":  p.Profile,
+			"unpicked": n,
+			"target":   p.Target,
+		}
+		for _, pw := range prewarms {
+			if pw.Pattern == p.Name() {
+				entry["prewarm"] = map[string]any{"target": pw.Target, "until": pw.Until, "started_at": pw.StartedAt,
+					"status": pw.status(n)}
+			}
+		}
+		patterns = append(patterns, entry)
+	}
+
+	counts, err := s.store.CampaignCounts(ctx)
+	if err != nil {
+		log.Println("Error counting campaigns:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to count keys", nil)
+		return
+	}
+	campaigns := map[string]map[string]int64{}
+	for _, c := range counts {
+		if restrict != nil && (len(restrict.Campaigns) == 0 || !slices.Contains(restrict.Campaigns, c.Campaign)) {
+			continue
+		}
+		if campaigns[c.Campaign] == nil {
+			campaigns[c.Campaign] = map[string]int64{"picked": 0, "unpicked": 0}
+		}
+		if c.IsPicked {
+			campaigns[c.Campaign]["picked"] += c.Count
+		} else {
+			campaigns[c.Campaign]["unpicked"] += c.Count
+		}
+	}
+
+	discarded, err := s.store.DiscardCounts(ctx, since)
+	if err != nil {
+		log.Println("Error counting discards:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to count discards", nil)
+		return
+	}
+	if restrict != nil {
+		discarded = slices.DeleteFunc(discarded, func(c discardCount) bool { return !s.allowsPattern(restrict, c.Pattern) })
+	}
+
+	// The shared loop names no pattern and is shown to every token
+	loops := s.governor.Status()
+	if restrict != nil {
+		loops = slices.DeleteFunc(loops, func(l fillLoopStatus) bool {
+			return l.Name != sharedLoopName && !s.allowsPattern(restrict, l.Name)
+		})
+	}
+
+	scanners, err := s.store.ScanStates(ctx)
+	if err != nil {
+		log.Println("Error reading scanner states:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read scanner states", nil)
+		return
+	}
+	scans := make([]map[string]any, 0, len(scanners))
+	for _, st := range scanners {
+		scans = append(scans, map[string]any{"scanner": st.Scanner, "generation": st.Generation,
+			"started_at": st.StartedAt, "cursor": st.Cursor, "last_completed_generation": st.CompletedGeneration,
+			"last_completed_at": st.CompletedAt})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"patterns": patterns, "campaigns": campaigns,
+		"discards": discardSummary(discarded), "discards_since": since.UTC(), "fill_loops": loops,
+		"scanners": scans, "jobs": s.jobs.Status(), "data_as_of": asOf.UTC(), "stale": stale})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// storeUsage is how much a pool currently holds.
+type storeUsage struct {
+	Rows  int64
+	Bytes int64
+}
+
+// capacityLimits caps how large a fill may grow the pool. Zero limits are
+// off. With Refuse set an exceeding fill is skipped instead of warned about.
+type capacityLimits struct {
+	MaxRows  int64
+	MaxBytes int64
+	Refuse   bool
+}
+
+func (l capacityLimits) enabled() bool { return l.MaxRows > 0 || l.MaxBytes > 0 }
+
+// exceeds describes how adding planned keys to u would break the limits,
+// or returns "" if it would not. Size is projected from the current bytes
+// per row.
+func (l capacityLimits) exceeds(u storeUsage, planned int64) string {
+	if l.MaxRows > 0 && u.Rows+planned > l.MaxRows {
+		return fmt.Sprintf("%d keys stored + %d planned exceeds MAX_TOTAL_KEYS %d", u.Rows, planned, l.MaxRows)
+	}
+	if l.MaxBytes > 0 {
+		projected := u.Bytes
+		if u.Rows > 0 {
+			projected += u.Bytes / u.Rows * planned
+		}
+		if projected > l.MaxBytes {
+			return fmt.Sprintf("pool would grow from %d to about %d bytes, over MAX_DB_SIZE_MB (%d bytes)", u.Bytes, projected, l.MaxBytes)
+		}
+	}
+	return ""
+}
+
+// Usage reports the key count and on-disk size of the token_key table,
+// including its indexes and TOAST data.
+func (s *gormStore) Usage(ctx context.Context) (storeUsage, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Count)
+	defer cancel()
+
+	var u storeUsage
+	err := db.Raw("SELECT count(*), pg_total_relation_size('token_key') FROM token_key").
+		Row().Scan(&u.Rows, &u.Bytes)
+	return u, ctxError(ctx, "usage", err)
+}
+
+// Usage reports the fullest store, since every store receives every key.
+func (m *multiStore) Usage(ctx context.Context) (storeUsage, error) {
+	var worst storeUsage
+	for i, s := range m.stores {
+		u, err := s.Usage(ctx)
+		if err != nil {
+			return storeUsage{}, fmt.Errorf("%s: %w", m.names[i], err)
+		}
+		if u.Rows > worst.Rows {
+			worst.Rows = u.Rows
+		}
+		if u.Bytes > worst.Bytes {
+			worst.Bytes = u.Bytes
+		}
+	}
+	return worst, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gorm.io/gorm/clause"
+)
+
+// CounterCheckpoint is one instance's cumulative attempt and found counts
+// for a pattern, saved every CHECKPOINT_INTERVAL so keygen_attempts_total
+// and keygen_keys_found_total carry on from where a restart or crash left
+// them instead of starting from zero.
+type CounterCheckpoint struct {
+	Instance  string    `gorm:"column:instance;primaryKey"`
+	Pattern   string    `gorm:"column:pattern;primaryKey"`
+	Attempts  int64     `gorm:"column:attempts;not null;default:0"`
+	Found     int64     `gorm:"column:found;not null;default:0"`
+	UpdatedAt time.Time `gorm:"column:updated_at"`
+}
+
+func (CounterCheckpoint) TableName() string { return "counter_checkpoints" }
+
+// counterValue reads a counter's current value.
+func counterValue(c prometheus.Counter) int64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return int64(m.GetCounter().GetValue())
+}
+
+// SaveCheckpoint stores the counters of patterns for instance.
+func (s *gormStore) SaveCheckpoint(ctx context.Context, instance string, patterns []pattern) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+	now := clock.Now().UTC()
+	rows := make([]CounterCheckpoint, len(patterns))
+	for i, p := range patterns {
+		rows[i] = CounterCheckpoint{Instance: instance, Pattern: p.Name(), UpdatedAt: now,
+			Attempts: counterValue(attemptsTotal.WithLabelValues(p.Name())),
+			Found:    counterValue(keysFoundTotal.WithLabelValues(p.Name()))}
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "instance"}, {Name: "pattern"}},
+		DoUpdates: clause.AssignmentColumns([]string{"attempts", "found", "updated_at"}),
+	}).Create(&rows).Error
+	return ctxError(ctx, "save checkpoint", err)
+}
+
+// ResumeCheckpoint adds instance's last checkpoint of each configured
+// pattern to the counters. It must run before anything counts.
+func (s *gormStore) ResumeCheckpoint(ctx context.Context, instance string, patterns []pattern) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	names := make([]string, len(patterns))
+	for i, p := range patterns {
+		names[i] = p.Name()
+	}
+	var rows []CounterCheckpoint
+	if err := db.Where("instance = ? AND pattern IN ?", instance, names).Find(&rows).Error; err != nil {
+		return ctxError(ctx, "load checkpoint", err)
+	}
+	for _, r := range rows {
+		attemptsTotal.WithLabelValues(r.Pattern).Add(float64(r.Attempts))
+		keysFoundTotal.WithLabelValues(r.Pattern).Add(float64(r.Found))
+		log.Printf("Resumed counters for %q from %s: %d attempts, %d found\n", r.Pattern, r.UpdatedAt.Format(time.RFC3339), r.Attempts, r.Found)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the time source of the time-based logic: stall detection, the
+// circuit breaker, retry backoff, write pacing, maintenance and fill loop
+// sleeps and state times, the adaptive sleep, leases, standby takeover,
+// quotas, retention cutoffs, the maintenance job scheduler and the
+// timestamps rows and events are written with. These read clock rather than the time package, so it can be swapped
+// for one advanced on demand. Periodic tickers and the benchmark
+// subcommands' timings keep the time package.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var clock Clock = realClock{}
+
+// sleepCtx waits d on clock, or until ctx is done, and reports whether d
+// passed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-clock.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
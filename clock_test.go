@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	// changed is closed and replaced whenever a waiter is added
+	changed chan struct{}
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, changed: make(chan struct{})}
+}
+
+// useFakeClock installs a fake clock at now for the rest of the test.
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	t.Helper()
+	c := newFakeClock(now)
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return ch
+}
+
+// Advance moves the clock d forward, firing every wait that falls due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// BlockUntil waits, up to a second of real time, for n waits to be
+// pending, so a test advances the clock only once its goroutines sleep.
+func (c *fakeClock) BlockUntil(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		c.mu.Lock()
+		got, changed := len(c.waiters), c.changed
+		c.mu.Unlock()
+		if got >= n {
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("%d waits pending on the fake clock, want %d", got, n)
+		}
+	}
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	c := newFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ch := c.After(time.Minute)
+	c.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("fired early")
+	default:
+	}
+	c.Advance(time.Second)
+	select {
+	case at := <-ch:
+		if want := time.Date(2026, 1, 1, 0, 1, 0, 0, time.UTC); !at.Equal(want) {
+			t.Fatalf("fired at %v, want %v", at, want)
+		}
+	default:
+		t.Fatal("did not fire once due")
+	}
+}
+
+func TestSleepCtx(t *testing.T) {
+	c := useFakeClock(t, time.Now())
+	done := make(chan bool)
+	go func() { done <- sleepCtx(context.Background(), 10*time.Second) }()
+	c.BlockUntil(t, 1)
+	c.Advance(10 * time.Second)
+	if !<-done {
+		t.Fatal("sleep reported cancelled")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- sleepCtx(ctx, 10*time.Second) }()
+	c.BlockUntil(t, 1)
+	cancel()
+	select {
+	case passed := <-done:
+		if passed {
+			t.Fatal("sleep reported passing after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sleep ignored cancellation")
+	}
+}
+
+func TestStallMonitorFakeClock(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := newStallMonitor(10 * time.Minute)
+	m.Start("all")
+	c.Advance(9 * time.Minute)
+	if _, stalled := m.Stalled(); stalled {
+		t.Fatal("stalled before the threshold")
+	}
+	c.Advance(2 * time.Minute)
+	if _, stalled := m.Stalled(); !stalled {
+		t.Fatal("not stalled past the threshold")
+	}
+	m.Found()
+	if _, stalled := m.Stalled(); stalled {
+		t.Fatal("still stalled after a find")
+	}
+	c.Advance(11 * time.Minute)
+	if _, stalled := m.Stalled(); !stalled {
+		t.Fatal("not stalled again past the threshold since the find")
+	}
+	m.Stop("all")
+	if _, stalled := m.Stalled(); stalled {
+		t.Fatal("a stopped loop cannot stall")
+	}
+}
+
+func TestKeyExpiryFakeClock(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+	s := newMemStore()
+	validUntil := clock.Now().Add(time.Hour)
+	if _, err := s.Insert(ctx, &TokenKey{PublicKey: testPub("k1"), PrivateKey: testPriv("k1"), MatchedPattern: "A", ValidUntil: &validUntil}); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(30 * time.Minute)
+	if _, err := s.Insert(ctx, &TokenKey{PublicKey: testPub("k2"), PrivateKey: testPriv("k2"), MatchedPattern: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	const ttl = 2 * time.Hour
+
+	for _, step := range []struct {
+		advance time.Duration
+		want    int64
+	}{
+		{29 * time.Minute, 0}, // k1 is still valid
+		{time.Minute, 1},      // k1 reaches its valid_until
+		{89 * time.Minute, 0}, // k2 is just short of the TTL
+		{2 * time.Minute, 1},  // k2 is past it
+	} {
+		c.Advance(step.advance)
+		expired, err := s.ExpireUnpicked(ctx, clock.Now().Add(-ttl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired["A"] != step.want {
+			t.Fatalf("at %v expired %v, want %d", clock.Now(), expired, step.want)
+		}
+	}
+}
+
+func TestLeaseExpiryFakeClock(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+	s := newMemStore()
+	if ok, err := s.AcquireLease(ctx, "fill", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("AcquireLease = %v, %v", ok, err)
+	}
+	c.Advance(time.Minute)
+	if ok, _ := s.AcquireLease(ctx, "fill", "b", time.Minute); ok {
+		t.Fatal("took over a lease that has not expired")
+	}
+	c.Advance(time.Second)
+	if ok, err := s.AcquireLease(ctx, "fill", "b", time.Minute); err != nil || !ok {
+		t.Fatalf("AcquireLease of an expired lease = %v, %v; want true", ok, err)
+	}
+}
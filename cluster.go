@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// With CLUSTER set every stored key is labelled with the Solana cluster it
+// is for, and a pick must declare the cluster it wants, so a devnet consumer
+// can never burn a mainnet vanity address or the reverse. RPC_URL, if set,
+// is checked at startup to serve CLUSTER, so the generator cannot mislabel
+// the keys it stores.
+
+// clusters are the CLUSTER values understood.
+var clusters = []string{"mainnet-beta", "devnet", "testnet", "localnet"}
+
+// clusterGenesis is each public cluster's genesis hash. A localnet's is
+// made fresh by every test validator, so it is not checked.
+var clusterGenesis = map[string]string{
+	"mainnet-beta": "5eykt4UsFv8P8NJdTREpY1vzqKqZKvdpKuc147dw2N9d",
+	"devnet":       "EtWTRABZaYq6iMfeYKouRu166VU2xqa1wcaWoxPkrZBG",
+	"testnet":      "4uhcVJyU9pJkvQyS88uRDiswHXSCkY3zQawwpjk2NsNY",
+}
+
+// clusterHeader declares the cluster a pick is for, as does a "cluster"
+// field in its body.
+const clusterHeader = "X-Solana-Cluster"
+
+// clusterError is a key or instance on a cluster other than the one a
+// caller declared.
+type clusterError struct {
+	Declared string
+	// Cluster is the instance's cluster, or the key's if Key is set; empty
+	// if it has none.
+	Cluster string
+	Key     string
+}
+
+func (e *clusterError) Error() string {
+	have := cmp.Or(e.Cluster, "no cluster")
+	if e.Key != "" {
+		return fmt.Sprintf("key %s is for %s, not %s", e.Key, have, e.Declared)
+	}
+	return fmt.Sprintf("this instance serves keys for %s, not %s", have, e.Declared)
+}
+
+// writeClusterError refuses a request with a cluster mismatch and counts it.
+func writeClusterError(w http.ResponseWriter, err *clusterError) {
+	check := "request"
+	extra := map[string]any{"declared": err.Declared, "cluster": err.Cluster}
+	if err.Key != "" {
+		check = "key"
+		extra["key"] = err.Key
+	}
+	clusterMismatchesTotal.WithLabelValues(check).Inc()
+	writeError(w, http.StatusConflict, "cluster_mismatch", err.Error(), extra)
+}
+
+// checkClusterName rejects a cluster name that is not one of clusters.
+func checkClusterName(name string) error {
+	if !slices.Contains(clusters, name) {
+		return fmt.Errorf("unknown cluster %q, want one of %s", name, strings.Join(clusters, ", "))
+	}
+	return nil
+}
+
+// requestCluster is the cluster a request declares in its header or its
+// body field, "" if neither. Both may be given only if they agree.
+func requestCluster(header, field string) (string, error) {
+	if header != "" && field != "" && header != field {
+		return "", fmt.Errorf("the %s header %q and the cluster field %q disagree", clusterHeader, header, field)
+	}
+	declared := cmp.Or(header, field)
+	if declared == "" {
+		return "", nil
+	}
+	return declared, checkClusterName(declared)
+}
+
+// declaredCluster checks the cluster r declares, field being its body's,
+// against the instance's and returns it for the pick filter. On a problem
+// it writes the error and returns false. Without CLUSTER nothing need be
+// declared, but a declared cluster is refused: unlabelled keys cannot be
+// vouched for.
+func (s *server) declaredCluster(w http.ResponseWriter, r *http.Request, field string) (string, bool) {
+	declared, err := requestCluster(r.Header.Get(clusterHeader), field)
+	switch {
+	case err != nil:
+		writeError(w, http.StatusBadRequest, "invalid_cluster", err.Error(), nil)
+		return "", false
+	case declared == "" && s.cluster != "":
+		writeError(w, http.StatusBadRequest, "cluster_required",
+			"declare the cluster the key is for with the "+clusterHeader+` header or a "cluster" field`,
+			map[string]any{"cluster": s.cluster})
+		return "", false
+	case declared != s.cluster:
+		writeClusterError(w, &clusterError{Declared: declared, Cluster: s.cluster})
+		return "", false
+	}
+	return declared, true
+}
+
+// ClusterOf returns the cluster of the key f names by public key or label,
+// whatever its state, and false if there is no such key within f's
+// restriction.
+func (s *gormStore) ClusterOf(ctx context.Context, f pickFilter) (string, bool, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	tx := db.Model(&TokenKey{})
+	if f.PublicKey != "" {
+		tx = tx.Where("public_key = ?", f.PublicKey)
+	}
+	if f.Label != "" {
+		tx = tx.Where("label = ?", f.Label)
+	}
+	// A restricted token must not learn of keys outside its reach
+	if f.Restrict != nil {
+		cond, args := f.Restrict.where()
+		tx = tx.Where(cond, args...)
+	}
+	var found []string
+	if err := tx.Limit(1).Pluck("cluster", &found).Error; err != nil {
+		return "", false, ctxError(ctx, "key cluster", err)
+	}
+	if len(found) == 0 {
+		return "", false, nil
+	}
+	return found[0], true, nil
+}
+
+// LabelUnclustered labels the keys stored before CLUSTER was set with it,
+// returning how many there were.
+func (s *gormStore) LabelUnclustered(ctx context.Context) (int64, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	res := db.Model(&TokenKey{}).Where("cluster = '' OR cluster IS NULL").Update("cluster", s.cluster)
+	return res.RowsAffected, ctxError(ctx, "label unclustered keys", res.Error)
+}
+
+// genesisHash asks the JSON-RPC endpoint rpcURL for its cluster's genesis
+// hash.
+func genesisHash(ctx context.Context, rpcURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"getGenesisHash"}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rpcURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getGenesisHash: %s", resp.Status)
+	}
+	var out struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("getGenesisHash: %w", err)
+	}
+	if out.Error != nil {
+		return "", fmt.Errorf("getGenesisHash: %s", out.Error.Message)
+	}
+	if out.Result == "" {
+		return "", errors.New("getGenesisHash: empty result")
+	}
+	return out.Result, nil
+}
+
+// verifyCluster checks that rpcURL serves cluster. A localnet passes
+// whatever its genesis hash.
+func verifyCluster(ctx context.Context, rpcURL, cluster string) error {
+	hash, err := genesisHash(ctx, rpcURL)
+	if err != nil {
+		return fmt.Errorf("cannot check RPC_URL is on %s: %w", cluster, err)
+	}
+	want, known := clusterGenesis[cluster]
+	if !known || hash == want {
+		return nil
+	}
+	clusterMismatchesTotal.WithLabelValues("genesis").Inc()
+	serves := "an unknown cluster"
+	for name, h := range clusterGenesis {
+		if h == hash {
+			serves = name
+		}
+	}
+	return fmt.Errorf("RPC_URL serves %s (genesis hash %s), not CLUSTER %s (%s)", serves, hash, cluster, want)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestDeclaredCluster covers every combination of the instance's cluster
+// with a cluster declared in the header, the body field or both.
+func TestDeclaredCluster(t *testing.T) {
+	tests := []struct {
+		instance, header, field string
+		// want is the cluster returned, or the error code written
+		want string
+		ok   bool
+	}{
+		{instance: "", want: "", ok: true},
+		{instance: "", header: "devnet", want: "cluster_mismatch"},
+		{instance: "", field: "devnet", want: "cluster_mismatch"},
+		{instance: "", header: "bogus", want: "invalid_cluster"},
+
+		{instance: "devnet", want: "cluster_required"},
+		{instance: "devnet", header: "devnet", want: "devnet", ok: true},
+		{instance: "devnet", field: "devnet", want: "devnet", ok: true},
+		{instance: "devnet", header: "devnet", field: "devnet", want: "devnet", ok: true},
+		{instance: "devnet", header: "mainnet-beta", want: "cluster_mismatch"},
+		{instance: "devnet", field: "mainnet-beta", want: "cluster_mismatch"},
+		{instance: "devnet", header: "testnet", field: "testnet", want: "cluster_mismatch"},
+		{instance: "devnet", header: "devnet", field: "mainnet-beta", want: "invalid_cluster"},
+		{instance: "devnet", header: "mainnet-beta", field: "devnet", want: "invalid_cluster"},
+		{instance: "devnet", field: "Devnet", want: "invalid_cluster"},
+
+		{instance: "mainnet-beta", header: "mainnet-beta", want: "mainnet-beta", ok: true},
+		{instance: "mainnet-beta", header: "devnet", want: "cluster_mismatch"},
+		{instance: "mainnet-beta", field: "localnet", want: "cluster_mismatch"},
+		{instance: "localnet", field: "localnet", want: "localnet", ok: true},
+	}
+	for _, tt := range tests {
+		s := &server{cluster: tt.instance}
+		r := httptest.NewRequest(http.MethodPost, "/v1/pick", nil)
+		if tt.header != "" {
+			r.Header.Set(clusterHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		before := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("request"))
+
+		got, ok := s.declaredCluster(w, r, tt.field)
+		name := "instance " + tt.instance + ", header " + tt.header + ", field " + tt.field
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v (%s)", name, ok, tt.ok, w.Body)
+			continue
+		}
+		counted := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("request")) - before
+		if tt.ok {
+			if got != tt.want || w.Body.Len() != 0 {
+				t.Errorf("%s: declared %q and wrote %q, want %q", name, got, w.Body, tt.want)
+			}
+			continue
+		}
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		wantStatus, wantCount := http.StatusBadRequest, 0.0
+		if tt.want == "cluster_mismatch" {
+			wantStatus, wantCount = http.StatusConflict, 1
+		}
+		if body.Error.Code != tt.want || w.Code != wantStatus {
+			t.Errorf("%s: %d %s, want %d %s", name, w.Code, body.Error.Code, wantStatus, tt.want)
+		}
+		if counted != wantCount {
+			t.Errorf("%s: counted %v mismatches, want %v", name, counted, wantCount)
+		}
+	}
+}
+
+func TestPickSQLCluster(t *testing.T) {
+	sql, args := planPick(pickFilter{Pattern: "ab", Cluster: "devnet"}).claim("*")
+	if !strings.Contains(sql, "cluster = ?") || !slices.Contains(args, any("devnet")) {
+		t.Fatalf("pick for devnet = %s %v, want a cluster condition", sql, args)
+	}
+	if sql, _ := planPick(pickFilter{Pattern: "ab"}).claim("*"); strings.Contains(sql, "cluster") {
+		t.Fatalf("pick without a cluster = %s, want no cluster condition", sql)
+	}
+}
+
+// TestPickServesOnlyDeclaredCluster checks a pick for one cluster never
+// claims another's key, whichever the key and the declaration are.
+func TestPickServesOnlyDeclaredCluster(t *testing.T) {
+	ctx := context.Background()
+	for _, key := range []string{"mainnet-beta", "devnet", ""} {
+		for _, declared := range []string{"mainnet-beta", "devnet"} {
+			m := newMemStore()
+			priv, pub := agentKey(t)
+			if _, err := m.Insert(ctx, &TokenKey{ID: uuid.NewString(), PrivateKey: priv, PublicKey: pub, Cluster: key}); err != nil {
+				t.Fatal(err)
+			}
+			_, poolErr := m.Pick(ctx, pickFilter{Cluster: declared})
+			_, keyErr := m.Pick(ctx, pickFilter{PublicKey: pub, Cluster: declared})
+			if key == declared {
+				if poolErr != nil {
+					t.Errorf("a %s pick missed a %s key: %v", declared, key, poolErr)
+				}
+				continue
+			}
+			if !errors.Is(poolErr, ErrPoolEmpty) || !errors.Is(keyErr, ErrKeyNotFound) {
+				t.Errorf("a %s pick of a %q key = %v, %v; want it refused", declared, key, poolErr, keyErr)
+			}
+		}
+	}
+}
+
+func TestStoreTransferRefusesOtherCluster(t *testing.T) {
+	s := newGormStore(dryRunDB(t), dbTimeouts{}, nil)
+	s.cluster = "devnet"
+	priv, pub := agentKey(t)
+	before := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("transfer"))
+
+	_, err := s.StoreTransfer(context.Background(), uuid.NewString(),
+		[]transferredKey{{PrivateKey: priv, PublicKey: pub, MatchedPattern: "ab", Cluster: "mainnet-beta"}})
+	var ce *clusterError
+	if !errors.As(err, &ce) || ce.Cluster != "mainnet-beta" || ce.Key != pub {
+		t.Fatalf("storing a mainnet-beta key on devnet = %v, want a cluster error", err)
+	}
+	if n := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("transfer")) - before; n != 1 {
+		t.Fatalf("counted %v transfer mismatches, want 1", n)
+	}
+}
+
+// rpcServer answers getGenesisHash with result, or fails with status.
+func rpcServer(t *testing.T, status int, result string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "getGenesisHash" {
+			t.Errorf("RPC request for %q (%v), want getGenesisHash", req.Method, err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(result))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestVerifyCluster(t *testing.T) {
+	answer := func(hash string) string { return `{"jsonrpc":"2.0","result":"` + hash + `","id":1}` }
+	tests := []struct {
+		cluster string
+		status  int
+		body    string
+		// wantErr is part of the error expected, "" for none
+		wantErr  string
+		mismatch bool
+	}{
+		{"mainnet-beta", 200, answer(clusterGenesis["mainnet-beta"]), "", false},
+		{"devnet", 200, answer(clusterGenesis["devnet"]), "", false},
+		{"testnet", 200, answer(clusterGenesis["testnet"]), "", false},
+		{"mainnet-beta", 200, answer(clusterGenesis["devnet"]), "serves devnet", true},
+		{"devnet", 200, answer(clusterGenesis["mainnet-beta"]), "serves mainnet-beta", true},
+		{"devnet", 200, answer(clusterGenesis["testnet"]), "serves testnet", true},
+		{"testnet", 200, answer("Localnet1111111111111111111111111111111111"), "serves an unknown cluster", true},
+		{"localnet", 200, answer("Localnet1111111111111111111111111111111111"), "", false},
+		{"localnet", 200, answer(clusterGenesis["mainnet-beta"]), "", false},
+		{"devnet", 200, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":1}`, "Method not found", false},
+		{"devnet", 503, `{}`, "503", false},
+		{"devnet", 200, `not json`, "getGenesisHash", false},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("genesis"))
+		err := verifyCluster(context.Background(), rpcServer(t, tt.status, tt.body), tt.cluster)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s answering %s: %v, want it accepted", tt.cluster, tt.body, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s answering %d %s: %v, want an error with %q", tt.cluster, tt.status, tt.body, err, tt.wantErr)
+		}
+		counted := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("genesis")) - before
+		if mismatched := counted == 1; counted > 1 || mismatched != tt.mismatch {
+			t.Errorf("%s answering %s: counted %v genesis mismatches", tt.cluster, tt.body, counted)
+		}
+	}
+}
+
+// TestPickRefusesKeyOfOtherCluster picks, on a devnet instance, a key
+// stored while the instance served mainnet-beta.
+func TestPickRefusesKeyOfOtherCluster(t *testing.T) {
+	store := testDatabase(t)
+	store.cluster = "mainnet-beta"
+	ctx := context.Background()
+	priv, pub := agentKey(t)
+	if _, err := store.Insert(ctx, &TokenKey{ID: uuid.NewString(), PrivateKey: priv, PublicKey: pub, MatchedPattern: "ab"}); err != nil {
+		t.Fatal(err)
+	}
+	store.cluster = "devnet"
+	s := &server{store: store, cluster: "devnet"}
+	pick := func(body string, restrict *keyRestriction) (int, string) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/pick", strings.NewReader(body))
+		r.Header.Set(clusterHeader, "devnet")
+		r = r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, apiToken{Name: "app", Scopes: []string{scopePick}, Restrict: restrict}))
+		w := httptest.NewRecorder()
+		s.handlePick(w, r)
+		var out struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.NewDecoder(w.Body).Decode(&out)
+		return w.Code, out.Error.Code
+	}
+
+	if status, code := pick(`{}`, nil); status != http.StatusServiceUnavailable || code != "pool_empty" {
+		t.Errorf("a devnet pool pick = %d %s, want pool_empty with only a mainnet-beta key", status, code)
+	}
+	before := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("key"))
+	if status, code := pick(`{"public_key":"`+pub+`"}`, nil); status != http.StatusConflict || code != "cluster_mismatch" {
+		t.Errorf("a devnet pick of the mainnet-beta key = %d %s, want cluster_mismatch", status, code)
+	}
+	// A token restricted away from the key is not told where it is
+	if status, code := pick(`{"public_key":"`+pub+`"}`, &keyRestriction{Patterns: []string{"cd"}}); status != http.StatusNotFound || code != "key_not_found" {
+		t.Errorf("a restricted devnet pick of the mainnet-beta key = %d %s, want key_not_found", status, code)
+	}
+	if n := testutil.ToFloat64(clusterMismatchesTotal.WithLabelValues("key")) - before; n != 1 {
+		t.Errorf("counted %v key mismatches, want 1", n)
+	}
+}
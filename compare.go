@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/blocto/solana-go-sdk/pkg/hdwallet"
+	"github.com/blocto/solana-go-sdk/types"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// generatorAlgo is one way of producing a keypair. gen returns the 64-byte
+// private key and the public key the algorithm itself reports for it.
+type generatorAlgo struct {
+	Name string
+	gen  func() (ed25519.PrivateKey, []byte, error)
+}
+
+// solanaDerivationPath is the path wallets derive a Solana account from a
+// mnemonic seed with.
+const solanaDerivationPath = "m/44'/501'/0'/0'"
+
+var generatorAlgos = []generatorAlgo{
+	// What keygen.Generator grinds with
+	{"ed25519", func() (ed25519.PrivateKey, []byte, error) {
+		var seed [ed25519.SeedSize]byte
+		if _, err := rand.Read(seed[:]); err != nil {
+			return nil, nil, err
+		}
+		priv := ed25519.NewKeyFromSeed(seed[:])
+		return priv, priv[ed25519.SeedSize:], nil
+	}},
+	// The SDK the generator used before keygen
+	{"blocto", func() (ed25519.PrivateKey, []byte, error) {
+		acc := types.NewAccount()
+		return acc.PrivateKey, acc.PublicKey.Bytes(), nil
+	}},
+	// A BIP39-style seed (random entropy stretched with PBKDF2-SHA512 as
+	// BIP39 does, without the wordlist encoding) derived along the wallet path
+	{"mnemonic", func() (ed25519.PrivateKey, []byte, error) {
+		var entropy [16]byte
+		if _, err := rand.Read(entropy[:]); err != nil {
+			return nil, nil, err
+		}
+		seed := pbkdf2.Key(entropy[:], []byte("mnemonic"), 2048, 64, sha512.New)
+		k, err := hdwallet.Derived(solanaDerivationPath, seed)
+		if err != nil {
+			return nil, nil, err
+		}
+		acc, err := types.AccountFromSeed(k.PrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return acc.PrivateKey, acc.PublicKey.Bytes(), nil
+	}},
+}
+
+// algoResult is how one algorithm fared in compareGenerators.
+type algoResult struct {
+	Name       string
+	Keys       int
+	Mismatches int
+	Elapsed    time.Duration
+}
+
+func (r algoResult) rate() float64 { return float64(r.Keys) / r.Elapsed.Seconds() }
+
+// checkKeypair reconstructs the keypair from priv's seed and checks both
+// the embedded public half and the algorithm's reported public key match,
+// and that the result round-trips through the base58 import path.
+func checkKeypair(priv ed25519.PrivateKey, pub []byte) error {
+	if len(priv) != ed25519.PrivateKeySize {
+		return fmt.Errorf("private key is %d bytes, want %d", len(priv), ed25519.PrivateKeySize)
+	}
+	rebuilt := ed25519.NewKeyFromSeed(priv.Seed())
+	if !bytes.Equal(rebuilt, priv) {
+		return errors.New("embedded public half does not match the seed")
+	}
+	if !bytes.Equal(rebuilt[ed25519.SeedSize:], pub) {
+		return errors.New("reported public key does not match the seed")
+	}
+	addr, err := publicKeyFromPrivate(base58.Encode(priv))
+	if err != nil {
+		return err
+	}
+	if addr != base58.Encode(pub) {
+		return errors.New("address does not round-trip through base58")
+	}
+	return nil
+}
+
+// compareGenerators generates n keys with each algorithm, checking every
+// one and timing the generation alone.
+func compareGenerators(algos []generatorAlgo, n int) ([]algoResult, error) {
+	results := make([]algoResult, 0, len(algos))
+	for _, a := range algos {
+		r := algoResult{Name: a.Name, Keys: n}
+		for i := 0; i < n; i++ {
+			start := time.Now()
+			priv, pub, err := a.gen()
+			r.Elapsed += time.Since(start)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", a.Name, err)
+			}
+			if err := checkKeypair(priv, pub); err != nil {
+				if r.Mismatches == 0 {
+					fmt.Printf("%s: key %d: %v\n", a.Name, i, err)
+				}
+				r.Mismatches++
+			}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// cmdCompareGenerators implements the "compare-generators" subcommand. It
+// fails if any algorithm produced an inconsistent keypair. It also reports
+// what each derivation costs and how many candidates the configured derived
+// constraints reject, since both slow every find down.
+func cmdCompareGenerators(args []string, constraints []derivedConstraint) error {
+	fs := flag.NewFlagSet("compare-generators", flag.ContinueOnError)
+	n := fs.Int("n", 1000, "keys to generate per algorithm")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *n < 1 {
+		return errors.New("-n must be positive")
+	}
+
+	results, err := compareGenerators(generatorAlgos, *n)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-10s %8s %10s %12s\n", "ALGORITHM", "KEYS", "MISMATCHES", "KEYS/SEC")
+	bad := 0
+	for _, r := range results {
+		fmt.Printf("%-10s %8d %10d %12.0f\n", r.Name, r.Keys, r.Mismatches, r.rate())
+		bad += r.Mismatches
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d inconsistent keypairs", bad)
+	}
+
+	costs, err := benchDerivations(*n)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n%-10s %14s\n", "DERIVATION", "US/DERIVATION")
+	for name, d := range costs {
+		fmt.Printf("%-10s %14.1f\n", name, float64(d.Nanoseconds())/1e3)
+	}
+	if len(constraints) > 0 {
+		accept, pass := derivedFilter(constraints), 0
+		for i := 0; i < *n; i++ {
+			_, pub, err := generatorAlgos[0].gen()
+			if err != nil {
+				return err
+			}
+			if accept(base58.Encode(pub)) {
+				pass++
+			}
+		}
+		if pass == 0 {
+			fmt.Printf("\nDerived constraints passed 0 of %d candidates; finds would effectively never complete\n", *n)
+		} else {
+			fmt.Printf("\nDerived constraints pass %.1f%% of pattern matches: finds take about %.1fx as many attempts\n",
+				100*float64(pass)/float64(*n), float64(*n)/float64(pass))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// compression is COMPRESS: "" for none or "gzip" to gzip exports and
+// snapshots. Reading needs no setting; gzipped input is recognised by its
+// magic bytes.
+func compression() (string, error) {
+	switch c := getenv("COMPRESS"); c {
+	case "", "none":
+		return "", nil
+	case "gzip":
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown COMPRESS %q, want gzip or none", c)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter wraps w in the given compression. Close must be called,
+// and its error checked, to flush the last block; it does not close w.
+func compressWriter(w io.Writer, compress string) io.WriteCloser {
+	if compress == "gzip" {
+		return gzip.NewWriter(w)
+	}
+	return nopWriteCloser{w}
+}
+
+// decompressReader returns r's contents, gunzipped if they are gzip.
+func decompressReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// compressedPath is path with the extension of compress added if missing.
+func compressedPath(path, compress string) string {
+	if compress == "gzip" && !strings.HasSuffix(path, ".gz") {
+		return path + ".gz"
+	}
+	return path
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// settings are the variables set by Config.Env, or by .env and CONFIG_FILE
+// for those set nowhere else. They are read over the process environment,
+// which is never modified.
+var (
+	settingsMu sync.RWMutex
+	settings   = map[string]string{}
+)
+
+// setSettings replaces the settings with a copy of env.
+func setSettings(env map[string]string) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = maps.Clone(env)
+	if settings == nil {
+		settings = map[string]string{}
+	}
+}
+
+// lookupEnv is os.LookupEnv over the settings.
+func lookupEnv(name string) (string, bool) {
+	settingsMu.RLock()
+	val, ok := settings[name]
+	settingsMu.RUnlock()
+	if ok {
+		return val, true
+	}
+	return os.LookupEnv(name)
+}
+
+// getenv is os.Getenv over the settings.
+func getenv(name string) string {
+	val, _ := lookupEnv(name)
+	return val
+}
+
+// setenv sets a setting.
+func setenv(name, value string) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings[name] = value
+}
+
+// configEntry is one effective setting and the source its value came from:
+// default, env, file (.env), config (CONFIG_FILE), profile (its PROFILE
+// section) or flag.
+type configEntry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Origin string `json:"origin"`
+}
+
+// effectiveConfig records the settings in effect once every source has been
+// merged, for the startup banner and GET /v1/admin/config.
+type effectiveConfig struct {
+	fromFile    map[string]bool
+	fromConfig  map[string]bool
+	fromProfile map[string]bool
+	entries     []configEntry
+}
+
+// loadEnvFile works like godotenv.Load, setting variables from path that are
+// not already in the environment, but remembers which ones it set.
+func loadEnvFile(path string) (*effectiveConfig, error) {
+	c := &effectiveConfig{fromFile: map[string]bool{}, fromConfig: map[string]bool{}, fromProfile: map[string]bool{}}
+	if path == "" {
+		return c, nil
+	}
+	vals, err := godotenv.Read(path)
+	if err != nil {
+		return c, err
+	}
+	for k, v := range vals {
+		if _, set := lookupEnv(k); !set {
+			setenv(k, v)
+			c.fromFile[k] = true
+		}
+	}
+	return c, nil
+}
+
+var configKey = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// loadConfigFile sets variables from the YAML or JSON file at path that
+// the environment does not set. It overrides .env, whose entries are
+// mostly empty defaults, and is overridden by the environment and flags.
+// Keys are the environment variable names. A list value is joined with
+// commas and a map value becomes comma-separated key=value pairs, e.g.
+//
+//	SUFFIXES: [ponz, "moon:20"]
+//	PATTERN_QUOTAS: {ponz: 2000}
+//
+// PROFILES maps names to sets of settings, such as one per environment,
+// and PROFILE (from the environment or the file) selects one, whose
+// settings override the rest of the file:
+//
+//	PROFILES:
+//	  prod: {SUFFIX: ponz, TARGET_UNPICKED: 500}
+//	  dev: {SUFFIX: dev, TARGET_UNPICKED: 5}
+//
+// The whole file, the selected profile included, is checked before
+// anything is set.
+func (c *effectiveConfig) loadConfigFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is YAML, so one decoder reads both
+	var doc map[string]any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	profiles, ok := doc["PROFILES"].(map[string]any)
+	if _, set := doc["PROFILES"]; set && !ok {
+		return fmt.Errorf("%s: PROFILES must map profile names to settings", path)
+	}
+	delete(doc, "PROFILES")
+	profile := getenv("PROFILE")
+	if name, ok := doc["PROFILE"].(string); ok && profile == "" {
+		profile = name
+	}
+	var selected map[string]any
+	if profile != "" {
+		p, ok := profiles[profile]
+		if len(profiles) == 0 {
+			return fmt.Errorf("%s: PROFILE %q is set but there is no PROFILES section", path, profile)
+		}
+		if !ok {
+			return fmt.Errorf("%s: unknown PROFILE %q, want one of %s", path, profile, strings.Join(slices.Sorted(maps.Keys(profiles)), ", "))
+		}
+		if selected, ok = p.(map[string]any); !ok {
+			return fmt.Errorf("%s: profile %q must map settings to values", path, profile)
+		}
+	}
+
+	vals, problems := configValues(doc, "")
+	inProfile, more := configValues(selected, "profile "+profile+": ")
+	problems = append(problems, more...)
+	if _, set := selected["PROFILE"]; set {
+		problems = append(problems, fmt.Sprintf("profile %s: PROFILE cannot be set in a profile", profile))
+	}
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+	maps.Copy(vals, inProfile)
+
+	for k, v := range vals {
+		if _, set := lookupEnv(k); !set || c.fromFile[k] {
+			_, profiled := inProfile[k]
+			setenv(k, v)
+			c.fromFile[k], c.fromConfig[k], c.fromProfile[k] = false, !profiled, profiled
+		}
+	}
+	return nil
+}
+
+// configValues renders the settings of doc, a config file or profile,
+// with the problems found, each prefixed with where.
+func configValues(doc map[string]any, where string) (map[string]string, []string) {
+	vals := make(map[string]string, len(doc))
+	var problems []string
+	for k, v := range doc {
+		if !configKey.MatchString(k) || k == "CONFIG_FILE" || k == "PROFILES" {
+			problems = append(problems, fmt.Sprintf("%s%q is not a setting name", where, k))
+			continue
+		}
+		s, err := configValue(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s%s: %v", where, k, err))
+			continue
+		}
+		vals[k] = s
+	}
+	return vals, problems
+}
+
+// configValue renders a config file value as an environment variable.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			s, ok := configScalar(e)
+			if !ok {
+				return "", fmt.Errorf("list entries must be scalars without commas")
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]any:
+		keys := slices.Sorted(maps.Keys(v))
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			s, ok := configScalar(v[k])
+			if !ok {
+				return "", fmt.Errorf("map values must be scalars without commas")
+			}
+			parts[i] = k + "=" + s
+		}
+		return strings.Join(parts, ","), nil
+	case nil:
+		return "", nil
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// configScalar renders a string, number or boolean without commas.
+func configScalar(v any) (string, bool) {
+	switch v.(type) {
+	case string, bool, int, int64, uint64, float64:
+		s := fmt.Sprint(v)
+		return s, !strings.Contains(s, ",")
+	}
+	return "", false
+}
+
+// parseSleep returns the fill loop's idle sleep from SLEEP, a duration,
+// or else SLEEP_MINUTES, defaulting to a minute. Anything shorter than
+// floor, including zero, is raised to floor.
+func parseSleep(sleep, minutes string, floor time.Duration) (time.Duration, error) {
+	d := time.Minute
+	switch {
+	case sleep != "":
+		v, err := time.ParseDuration(sleep)
+		if err != nil {
+			return 0, fmt.Errorf("SLEEP %q: %w", sleep, err)
+		}
+		d = v
+	case minutes != "":
+		v, err := strconv.ParseFloat(minutes, 64)
+		if err != nil {
+			return 0, fmt.Errorf("SLEEP_MINUTES %q is not a number", minutes)
+		}
+		d = time.Duration(v * float64(time.Minute))
+	}
+	if d < floor {
+		log.Printf("Sleep %v is below the %v minimum, using %v\n", d, floor, floor)
+		d = floor
+	}
+	return d, nil
+}
+
+// origin reports where the environment variable name was taken from.
+func (c *effectiveConfig) origin(name string) string {
+	switch {
+	case getenv(name) == "":
+		return "default"
+	case c.fromFile[name]:
+		return "file"
+	case c.fromConfig[name]:
+		return "config"
+	case c.fromProfile[name]:
+		return "profile"
+	default:
+		return "env"
+	}
+}
+
+// add records the effective value of the environment variable name.
+func (c *effectiveConfig) add(name string, value any) {
+	c.addAs(name, fmt.Sprint(value), c.origin(name))
+}
+
+// addSecret records a sensitive variable, keeping only its last 4 characters.
+func (c *effectiveConfig) addSecret(name, value string) {
+	c.addAs(name, redact(value), c.origin(name))
+}
+
+func (c *effectiveConfig) addAs(name, value, origin string) {
+	c.entries = append(c.entries, configEntry{Name: name, Value: value, Origin: origin})
+}
+
+// String renders one "NAME=value (origin)" line per setting.
+func (c *effectiveConfig) String() string {
+	var b strings.Builder
+	for _, e := range c.entries {
+		fmt.Fprintf(&b, "  %s=%s (%s)\n", e.Name, e.Value, e.Origin)
+	}
+	return b.String()
+}
+
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) <= 4 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// redactDSN masks the password in a URL or key=value Postgres DSN.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if pw, ok := u.User.Password(); ok {
+			// url.UserPassword would percent-encode the asterisks
+			u.User = url.User(u.User.Username())
+			user := u.User.String() + "@"
+			return strings.Replace(u.String(), user, strings.TrimSuffix(user, "@")+":"+redact(pw)+"@", 1)
+		}
+		return dsn
+	}
+	return dsnPassword.ReplaceAllStringFunc(dsn, func(m string) string {
+		return "password=" + redact(strings.TrimPrefix(m, "password="))
+	})
+}
+
+func (s *server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	audit(r.Context(), "admin_config", "")
+	writeJSON(w, http.StatusOK, map[string]any{"config": s.config.entries})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestConfigFileProfiles loads a config file with PROFILES, selecting a
+// profile from the environment or the file, with the environment still
+// overriding both.
+func TestConfigFileProfiles(t *testing.T) {
+	const file = `
+SUFFIX: base
+TARGET_UNPICKED: 100
+SLEEP_SECONDS: 30
+PROFILE: dev
+PROFILES:
+  prod: {SUFFIX: ponz, TARGET_UNPICKED: 500}
+  dev: {SUFFIX: dev, TARGET_UNPICKED: 5}
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		env map[string]string
+		// want is each setting's value and origin after loading
+		want    map[string][2]string
+		wantErr string
+	}{
+		{env: map[string]string{"PROFILE": "prod"}, want: map[string][2]string{
+			"SUFFIX": {"ponz", "profile"}, "TARGET_UNPICKED": {"500", "profile"}, "SLEEP_SECONDS": {"30", "config"}}},
+		{env: nil, want: map[string][2]string{
+			"SUFFIX": {"dev", "profile"}, "TARGET_UNPICKED": {"5", "profile"}, "SLEEP_SECONDS": {"30", "config"}}},
+		{env: map[string]string{"PROFILE": "prod", "TARGET_UNPICKED": "7"}, want: map[string][2]string{
+			"SUFFIX": {"ponz", "profile"}, "TARGET_UNPICKED": {"7", "env"}}},
+		{env: map[string]string{"PROFILE": "staging"}, wantErr: `unknown PROFILE "staging", want one of dev, prod`},
+	}
+	t.Cleanup(func() { setSettings(nil) })
+	for _, tt := range tests {
+		setSettings(tt.env)
+		c := &effectiveConfig{fromFile: map[string]bool{}, fromConfig: map[string]bool{}, fromProfile: map[string]bool{}}
+		err := c.loadConfigFile(path)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("env %v: %v, want an error with %q", tt.env, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("env %v: %v", tt.env, err)
+			continue
+		}
+		for name, want := range tt.want {
+			if got, origin := getenv(name), c.origin(name); got != want[0] || origin != want[1] {
+				t.Errorf("env %v: %s = %q from %s, want %q from %s", tt.env, name, got, origin, want[0], want[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// consistencyPage is how many primary keys are compared at a time.
+const consistencyPage = 1000
+
+// consistencyExamples caps the public keys listed per kind of drift.
+const consistencyExamples = 20
+
+// mirrorDrift is how one secondary pool (DATABASE_URL_n) differs from the
+// primary.
+type mirrorDrift struct {
+	Name    string
+	Checked int
+	// Missing are unpicked primary keys the mirror lacks. Picked keys may
+	// have been expired from a mirror, which never sees the pick.
+	Missing []string
+	// Mismatched rows differ from the primary in the private key or the
+	// pattern, campaign or validity window.
+	Mismatched []string
+	// Extra rows exist only in the mirror, e.g. after a primary-only purge.
+	Extra    []string
+	Repaired int
+	// Unrepairable counts drift --repair could not safely fix.
+	Unrepairable int
+}
+
+func (d *mirrorDrift) drifted() bool {
+	return len(d.Missing)+len(d.Mismatched)+len(d.Extra) > 0
+}
+
+// fix counts one discrepancy for pub as repaired by repairFn, with repair
+// set and if it succeeds, or else as remaining.
+func (d *mirrorDrift) fix(repair bool, pub string, repairFn func() error) {
+	if repair {
+		err := repairFn()
+		if err == nil {
+			d.Repaired++
+			return
+		}
+		log.Printf("Cannot repair %s in %s: %v\n", pub, d.Name, err)
+	}
+	d.Unrepairable++
+}
+
+// note adds pub to list, keeping only the first consistencyExamples.
+func note(list *[]string, pub string) {
+	if len(*list) < consistencyExamples {
+		*list = append(*list, pub)
+	}
+}
+
+// checkConsistency implements MODE=check-consistency: it compares every
+// secondary pool with the primary, row by row in public key order, and
+// looks for outbox events undelivered for longer than stuckAfter. With
+// repair set, missing mirror rows are copied from the primary and
+// mismatched ones rewritten from it, when the primary's private key is
+// intact; extra mirror rows are only reported. It returns an error if
+// drift remains, so the process exits non-zero.
+func checkConsistency(ctx context.Context, primary *gormStore, names []string, mirrors []*gormStore, stuckAfter time.Duration, repair bool) error {
+	var drifts []*mirrorDrift
+	remaining := 0
+	for i, m := range mirrors {
+		d, err := compareMirror(ctx, primary, names[i], m, repair)
+		if err != nil {
+			return fmt.Errorf("compare %s: %w", names[i], err)
+		}
+		drifts = append(drifts, d)
+		remaining += d.Unrepairable
+	}
+
+	var stuck struct {
+		N      int64
+		Oldest *time.Time
+	}
+	err := primary.db.WithContext(ctx).Raw(`SELECT count(*) AS n, min(occurred_at) AS oldest FROM key_event
+		WHERE occurred_at < ?`, clock.Now().Add(-stuckAfter)).Scan(&stuck).Error
+	if err != nil {
+		return fmt.Errorf("check outbox: %w", err)
+	}
+	var dead int64
+	if err := primary.db.WithContext(ctx).Model(&KeyEventDeadLetter{}).Count(&dead).Error; err != nil {
+		return fmt.Errorf("check dead letters: %w", err)
+	}
+	remaining += int(stuck.N)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(mirrors) == 0 {
+		fmt.Fprintln(tw, "mirrors\tnone configured (DATABASE_URL_2, ...)")
+	}
+	for _, d := range drifts {
+		status := "consistent"
+		if d.drifted() {
+			status = fmt.Sprintf("drift, %d repaired, %d remaining", d.Repaired, d.Unrepairable)
+		}
+		fmt.Fprintf(tw, "%s\t%d keys checked: %s\n", d.Name, d.Checked, status)
+		for _, kind := range []struct {
+			name string
+			pubs []string
+		}{{"missing", d.Missing}, {"mismatched", d.Mismatched}, {"extra", d.Extra}} {
+			for _, pub := range kind.pubs {
+				fmt.Fprintf(tw, "\t%s %s\n", kind.name, pub)
+			}
+		}
+	}
+	if stuck.N > 0 {
+		fmt.Fprintf(tw, "outbox\t%d events undelivered for over %v, oldest from %s\n", stuck.N, stuckAfter, stuck.Oldest.UTC().Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(tw, "outbox\tno event undelivered for over %v\n", stuckAfter)
+	}
+	fmt.Fprintf(tw, "dead letters\t%d\n", dead)
+	tw.Flush()
+
+	if remaining > 0 {
+		return fmt.Errorf("pool drift found: %d discrepancies remain", remaining)
+	}
+	return nil
+}
+
+// consistencyRow is what is compared of each key.
+type consistencyRow struct {
+	ID, PublicKey, PrivateKey, MatchedPattern, Campaign, Cluster string
+	IsPicked                                                     bool
+	ValidFrom, ValidUntil                                        *time.Time
+}
+
+// compareMirror walks the primary's keys a page at a time alongside the
+// mirror's keys in the same public key range.
+func compareMirror(ctx context.Context, primary *gormStore, name string, mirror *gormStore, repair bool) (*mirrorDrift, error) {
+	d := &mirrorDrift{Name: name}
+	after := ""
+	for {
+		var page []consistencyRow
+		err := primary.db.WithContext(ctx).Model(&TokenKey{}).Where("public_key > ?", after).
+			Order("public_key").Limit(consistencyPage).Find(&page).Error
+		if err != nil {
+			return nil, err
+		}
+		last := len(page) < consistencyPage
+		tx := mirror.db.WithContext(ctx).Model(&TokenKey{}).Where("public_key > ?", after)
+		if !last {
+			tx = tx.Where("public_key <= ?", page[len(page)-1].PublicKey)
+		}
+		var copies []consistencyRow
+		if err := tx.Find(&copies).Error; err != nil {
+			return nil, err
+		}
+		byPub := make(map[string]consistencyRow, len(copies))
+		for _, c := range copies {
+			byPub[c.PublicKey] = c
+		}
+
+		for _, p := range page {
+			d.Checked++
+			c, ok := byPub[p.PublicKey]
+			delete(byPub, p.PublicKey)
+			switch {
+			case !ok && p.IsPicked:
+			case !ok:
+				note(&d.Missing, p.PublicKey)
+				d.fix(repair, p.PublicKey, func() error { return mirrorRepair(ctx, primary, mirror, p, false) })
+			default:
+				same, err := sameKey(primary, mirror, p, c)
+				if err != nil {
+					return nil, err
+				}
+				if same {
+					continue
+				}
+				note(&d.Mismatched, p.PublicKey)
+				d.fix(repair, p.PublicKey, func() error { return mirrorRepair(ctx, primary, mirror, p, true) })
+			}
+		}
+		for pub := range byPub {
+			note(&d.Extra, pub)
+			d.Unrepairable++
+		}
+		if last {
+			break
+		}
+		after = page[len(page)-1].PublicKey
+	}
+	return d, nil
+}
+
+// sameKey compares a primary row with its mirror copy. Private keys are
+// compared decrypted: each store seals its own copy.
+func sameKey(primary, mirror *gormStore, p, c consistencyRow) (bool, error) {
+	if p.MatchedPattern != c.MatchedPattern || p.Campaign != c.Campaign || p.Cluster != c.Cluster ||
+		!sameTime(p.ValidFrom, c.ValidFrom) || !sameTime(p.ValidUntil, c.ValidUntil) {
+		return false, nil
+	}
+	pp, err := openPrivateKey(primary.encKey, p.PrivateKey)
+	if err != nil {
+		return false, fmt.Errorf("primary key %s: %w", p.PublicKey, err)
+	}
+	cp, err := openPrivateKey(mirror.encKey, c.PrivateKey)
+	if err != nil {
+		return false, nil
+	}
+	return pp == cp, nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// mirrorRepair writes the primary row p to the mirror, replacing the
+// mirror's copy with replace set. It refuses when the primary's own
+// private key does not belong to its public key, as then neither copy can
+// be trusted.
+func mirrorRepair(ctx context.Context, primary, mirror *gormStore, p consistencyRow, replace bool) error {
+	priv, err := openPrivateKey(primary.encKey, p.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if pub, err := publicKeyFromPrivate(priv); err != nil || pub != p.PublicKey {
+		return fmt.Errorf("primary key %s is corrupt", p.PublicKey)
+	}
+	sealed, err := sealPrivateKey(mirror.encKey, priv)
+	if err != nil {
+		return err
+	}
+	db := mirror.db.WithContext(ctx)
+	if replace {
+		return db.Model(&TokenKey{}).Where("public_key = ?", p.PublicKey).Updates(map[string]any{
+			"private_key":        sealed,
+			"private_key_digest": privateKeyDigest(mirror.encKey, priv),
+			"matched_pattern":    p.MatchedPattern,
+			"campaign":           p.Campaign,
+			"cluster":            p.Cluster,
+			"valid_from":         p.ValidFrom,
+			"valid_until":        p.ValidUntil,
+		}).Error
+	}
+	return db.Create(&TokenKey{ID: p.ID, PrivateKey: sealed, PrivateKeyDigest: privateKeyDigest(mirror.encKey, priv), PublicKey: p.PublicKey, MatchedPattern: p.MatchedPattern,
+		AddressLength: len(p.PublicKey), Checksum: keyChecksum(p.PublicKey), QualityScore: qualityScore(p.MatchedPattern),
+		Campaign: p.Campaign, Cluster: p.Cluster, ValidFrom: p.ValidFrom, ValidUntil: p.ValidUntil}).Error
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"solana-key-gen/keygen"
+)
+
+// agentConfig is the work the coordinator hands to remote agents. Version
+// changes whenever the patterns or filters do, so agents know to refresh.
+type agentConfig struct {
+	Version           string   `json:"version"`
+	Patterns          []string `json:"patterns"`
+	MinTrailingDigits int      `json:"min_trailing_digits,omitempty"`
+	TrailingWindow    int      `json:"trailing_window,omitempty"`
+	AddressLength     int      `json:"address_length,omitempty"`
+	// DerivedConstraints are DERIVED_CONSTRAINTS entries.
+	DerivedConstraints []string `json:"derived_constraints,omitempty"`
+	// CharEquiv is CHAR_EQUIV.
+	CharEquiv string `json:"char_equiv,omitempty"`
+}
+
+func newAgentConfig(patterns []pattern, minDigits, window, addrLen int, derived []derivedConstraint, equiv keygen.Equivalence) agentConfig {
+	c := agentConfig{MinTrailingDigits: minDigits, TrailingWindow: window, AddressLength: addrLen, CharEquiv: equiv.String()}
+	for _, d := range derived {
+		c.DerivedConstraints = append(c.DerivedConstraints, d.String())
+	}
+	for _, p := range patterns {
+		c.Patterns = append(c.Patterns, p.Name())
+	}
+	// Longest first, so agents attribute keys the way the coordinator does
+	textLen := func(name string) int { return len(strings.TrimSuffix(name, "*")) }
+	slices.SortFunc(c.Patterns, func(a, b string) int { return textLen(b) - textLen(a) })
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%q|%d|%d|%d|%q|%q", c.Patterns, minDigits, window, addrLen, c.DerivedConstraints, c.CharEquiv)
+	c.Version = hex.EncodeToString(h.Sum(nil))[:16]
+	return c
+}
+
+// options returns the generator options an agent grinds this config with.
+func (c agentConfig) options() []keygen.Option {
+	var opts []keygen.Option
+	for _, s := range c.Patterns {
+		opts = append(opts, keygen.WithPattern(keygenPattern(s)))
+	}
+	if c.MinTrailingDigits > 0 {
+		opts = append(opts, keygen.WithFilter(keygen.TrailingDigits(c.TrailingWindow, c.MinTrailingDigits)))
+	}
+	if c.AddressLength > 0 {
+		opts = append(opts, keygen.WithAddressLength(c.AddressLength))
+	}
+	if c.CharEquiv != "" {
+		if equiv, err := keygen.ParseEquivalence(c.CharEquiv); err != nil {
+			log.Printf("Ignoring char_equiv %q: %v\n", c.CharEquiv, err)
+		} else {
+			opts = append(opts, keygen.WithEquivalence(equiv))
+		}
+	}
+	if check := c.constraintFilter(); check != nil {
+		opts = append(opts, keygen.WithFilter(check))
+	}
+	return opts
+}
+
+// constraintFilter returns the filter for DerivedConstraints, or nil if there
+// are none. The coordinator validated them from DERIVED_CONSTRAINTS, so an
+// entry this build does not know is dropped rather than failing the agent.
+func (c agentConfig) constraintFilter() func(addr string) bool {
+	var constraints []derivedConstraint
+	for _, entry := range c.DerivedConstraints {
+		cs, err := parseDerivedConstraints(entry)
+		if err != nil {
+			log.Printf("Ignoring derived constraint %q: %v\n", entry, err)
+			continue
+		}
+		constraints = append(constraints, cs...)
+	}
+	if len(constraints) == 0 {
+		return nil
+	}
+	return derivedFilter(constraints)
+}
+
+// accepts re-checks an agent's find against the config's filters.
+func (c agentConfig) accepts(addr string) bool {
+	if c.AddressLength > 0 && len(addr) != c.AddressLength {
+		return false
+	}
+	if check := c.constraintFilter(); check != nil && !check(addr) {
+		return false
+	}
+	return c.MinTrailingDigits == 0 || keygen.TrailingDigits(c.TrailingWindow, c.MinTrailingDigits)(addr)
+}
+
+// agentInfo is what the coordinator knows about one registered agent.
+type agentInfo struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Actor        string    `json:"actor"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+	Attempts     int64     `json:"attempts"`
+	Rate         float64   `json:"attempts_per_second"`
+	Finds        int64     `json:"finds"`
+	Rejected     int64     `json:"rejected"`
+}
+
+// agentRegistry tracks registered agents in memory. Agents that miss
+// heartbeats for three intervals are dropped and must register again.
+type agentRegistry struct {
+	config    agentConfig
+	heartbeat time.Duration
+
+	mu     sync.Mutex
+	agents map[string]*agentInfo
+}
+
+func newAgentRegistry(config agentConfig, heartbeat time.Duration) *agentRegistry {
+	return &agentRegistry{config: config, heartbeat: heartbeat, agents: map[string]*agentInfo{}}
+}
+
+// prune drops agents whose last heartbeat is too old. r.mu must be held.
+func (r *agentRegistry) prune(now time.Time) {
+	for id, a := range r.agents {
+		if now.Sub(a.LastSeen) > 3*r.heartbeat {
+			log.Printf("Agent %s (%s) missed its heartbeats, dropping it\n", a.Name, id)
+			delete(r.agents, id)
+		}
+	}
+}
+
+func (r *agentRegistry) register(name, actor string) agentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := clock.Now()
+	r.prune(now)
+	a := &agentInfo{ID: uuid.NewString(), Name: name, Actor: actor, RegisteredAt: now, LastSeen: now}
+	r.agents[a.ID] = a
+	return *a
+}
+
+// update applies fn to agent id and marks it seen. It returns false if the
+// agent is not registered.
+func (r *agentRegistry) update(id string, fn func(*agentInfo)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := clock.Now()
+	r.prune(now)
+	a, ok := r.agents[id]
+	if !ok {
+		return false
+	}
+	a.LastSeen = now
+	fn(a)
+	return true
+}
+
+func (r *agentRegistry) deregister(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.agents[id]
+	delete(r.agents, id)
+	return ok
+}
+
+// list returns the live agents, oldest registration first.
+func (r *agentRegistry) list() []agentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(clock.Now())
+	out := make([]agentInfo, 0, len(r.agents))
+	for _, a := range r.agents {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].RegisteredAt.Before(out[j].RegisteredAt) })
+	return out
+}
+
+type agentRegisterRequest struct {
+	Name string `json:"name"`
+}
+
+type agentRegisterResponse struct {
+	AgentID           string      `json:"agent_id"`
+	HeartbeatInterval string      `json:"heartbeat_interval"`
+	Config            agentConfig `json:"config"`
+}
+
+type agentHeartbeatRequest struct {
+	Attempts int64   `json:"attempts"`
+	Rate     float64 `json:"attempts_per_second"`
+}
+
+type agentHeartbeatResponse struct {
+	Config agentConfig `json:"config"`
+}
+
+type agentFind struct {
+	PrivateKey string `json:"private_key"`
+	Attempts   int64  `json:"attempts"`
+}
+
+type agentFindsRequest struct {
+	Keys []agentFind `json:"keys"`
+}
+
+func (s *server) handleAgentRegister(w http.ResponseWriter, r *http.Request) {
+	var req agentRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid_body", `request body must be JSON with a "name"`, nil)
+		return
+	}
+
+	a := s.agents.register(req.Name, tokenFromContext(r.Context()).Name)
+	audit(r.Context(), "agent_register", "agent_id="+a.ID+" name="+a.Name)
+	writeJSON(w, http.StatusCreated, agentRegisterResponse{
+		AgentID:           a.ID,
+		HeartbeatInterval: s.agents.heartbeat.String(),
+		Config:            s.agents.config,
+	})
+}
+
+func (s *server) handleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var req agentHeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "request body must be JSON", nil)
+		return
+	}
+
+	ok := s.agents.update(r.PathValue("id"), func(a *agentInfo) {
+		a.Attempts, a.Rate = req.Attempts, req.Rate
+	})
+	if !ok {
+		writeError(w, http.StatusNotFound, "agent_not_found", "agent is not registered", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, agentHeartbeatResponse{Config: s.agents.config})
+}
+
+// handleAgentFinds validates and stores keys found by an agent. Keys must
+// match a configured pattern, pass the filters the agent was given and the
+// blocklist, and fall within their pattern's lifetime quota.
+func (s *server) handleAgentFinds(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req agentFindsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "request body must be JSON", nil)
+		return
+	}
+	if !s.agents.update(id, func(*agentInfo) {}) {
+		writeError(w, http.StatusNotFound, "agent_not_found", "agent is not registered", nil)
+		return
+	}
+
+	// Agents may run while no fill loop does, so the caps are read afresh
+	if err := s.quotas.Refresh(r.Context()); err != nil {
+		log.Println("Error reading pattern quotas:", err)
+		writeError(w, http.StatusServiceUnavailable, "quotas_unavailable", "failed to read pattern quotas", nil)
+		return
+	}
+
+	var accepted, rejected int64
+	results := make([]importResult, 0, len(req.Keys))
+	for _, k := range req.Keys {
+		var res importResult
+		pub, err := publicKeyFromPrivate(k.PrivateKey)
+		matched := ""
+		if err == nil {
+			res.PublicKey = pub
+			matched = matchPattern(pub, s.patterns)
+		}
+		switch {
+		case err != nil:
+			res.Status = "rejected"
+			res.Error = map[string]any{"code": "invalid_private_key", "problem": err.Error()}
+		case matched == "":
+			res.Status = "rejected"
+			res.Error = map[string]any{"code": "no_pattern", "problem": "does not match any configured pattern"}
+		case !s.agents.config.accepts(pub):
+			res.Status = "rejected"
+			res.Error = map[string]any{"code": "filtered", "problem": "does not pass the configured filters"}
+		case s.blocks != nil && !s.blocks.allows(pub):
+			res.Status = "rejected"
+			res.Error = map[string]any{"code": "blocklisted", "problem": "contains a blocklisted term"}
+		case !s.quotas.Admit(r.Context(), matched):
+			res.Status = "rejected"
+			res.Error = map[string]any{"code": "quota_reached", "problem": "the pattern has reached its lifetime quota"}
+		}
+		if res.Status == "rejected" {
+			rejected++
+			results = append(results, res)
+			continue
+		}
+
+		_, inserted, err := s.store.Import(r.Context(), k.PrivateKey, pub, nil, s.patterns)
+		if !inserted {
+			s.quotas.Uncount(matched)
+		}
+		switch {
+		case err != nil:
+			log.Println("Error storing agent find:", err)
+			res.Status = "error"
+		case inserted:
+			res.Status = "imported"
+			if src, ok := s.watch.Listed(r.Context(), pub); ok {
+				s.watch.Hit(r.Context(), pub, src, "generated")
+				if _, err := s.store.Quarantine(r.Context(), pub); err != nil {
+					log.Printf("Error quarantining watchlisted key %s: %v\n", pub, err)
+				}
+			}
+			keysFoundTotal.WithLabelValues(matched).Inc()
+			s.stall.Found()
+			if err := s.store.CountGenerated(r.Context(), matched); err != nil {
+				log.Println("Error counting agent find:", err)
+			}
+			ev := auditEvent{Event: "generate", PublicKey: pub, Pattern: matched, Actor: tokenFromContext(r.Context()).Name}
+			if err := s.auditLog.Log(ev); err != nil {
+				log.Println("Error writing audit log:", err)
+			}
+			audit(r.Context(), "agent_find", "agent_id="+id+" public_key="+pub)
+		default:
+			res.Status = "duplicate"
+			insertConflictsTotal.WithLabelValues(matched).Inc()
+		}
+		if err == nil {
+			accepted++
+			attemptsTotal.WithLabelValues(matched).Add(float64(k.Attempts))
+		}
+		results = append(results, res)
+	}
+
+	s.agents.update(id, func(a *agentInfo) {
+		a.Finds += accepted
+		a.Rejected += rejected
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+func (s *server) handleAgentDeregister(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.agents.deregister(id) {
+		writeError(w, http.StatusNotFound, "agent_not_found", "agent is not registered", nil)
+		return
+	}
+	audit(r.Context(), "agent_deregister", "agent_id="+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAgentList reports each live agent and the team's combined rate.
+func (s *server) handleAgentList(w http.ResponseWriter, r *http.Request) {
+	agents := s.agents.list()
+	var rate float64
+	for _, a := range agents {
+		rate += a.Rate
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"config_version":            s.agents.config.Version,
+		"agents":                    agents,
+		"total_attempts_per_second": rate,
+	})
+}
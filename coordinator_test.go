@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-tron/base58/base58"
+)
+
+// agentKey is a fresh base58 private key and its public key.
+func agentKey(t *testing.T) (string, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base58.Encode(priv), base58.Encode(pub)
+}
+
+// postAgentFinds sends keys as agent id's finds and returns the results.
+func postAgentFinds(t *testing.T, s *server, id string, keys ...string) []importResult {
+	t.Helper()
+	var req agentFindsRequest
+	for _, k := range keys {
+		req.Keys = append(req.Keys, agentFind{PrivateKey: k, Attempts: 1})
+	}
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest(http.MethodPost, "/v1/agents/"+id+"/finds", strings.NewReader(string(body)))
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	s.handleAgentFinds(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Results []importResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Results
+}
+
+func TestAgentFindsBlocklisted(t *testing.T) {
+	priv, pub := agentKey(t)
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte(pub[10:16]+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	patterns := []pattern{{Any: true}}
+	blocks, err := newBlocklist(path, patterns, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{patterns: patterns, agents: newAgentRegistry(agentConfig{}, time.Minute), blocks: blocks}
+	agent := s.agents.register("test", "test")
+
+	results := postAgentFinds(t, s, agent.ID, priv)
+	if len(results) != 1 || results[0].Status != "rejected" || results[0].Error["code"] != "blocklisted" {
+		t.Fatalf("results = %+v, want one blocklisted rejection", results)
+	}
+	if a := s.agents.list()[0]; a.Rejected != 1 || a.Finds != 0 {
+		t.Errorf("agent counts finds=%d rejected=%d, want 0 and 1", a.Finds, a.Rejected)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks a private_key column value sealed with the pool's
+// ENCRYPTION_KEY, followed by base64 of nonce||ciphertext.
+const encryptedPrefix = "enc:v1:"
+
+// keyedDigestPrefix marks a private_key_digest keyed with ENCRYPTION_KEY,
+// plainDigestPrefix one taken without it.
+const (
+	keyedDigestPrefix = "hmac:"
+	plainDigestPrefix = "sha256:"
+)
+
+var errEncryptionKeyMissing = errors.New("private key is encrypted but no ENCRYPTION_KEY is configured")
+
+// parseEncryptionKey accepts a 32-byte AES-256 key as hex or base64.
+func parseEncryptionKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("encryption key is empty")
+	}
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("encryption key must be hex or base64")
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// seal encrypts plaintext with AES-256-GCM, returning nonce||ciphertext.
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal reverses seal.
+func unseal(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ct := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealPrivateKey encrypts a stored private key. A nil key stores it as is.
+func sealPrivateKey(key []byte, priv string) (string, error) {
+	if key == nil {
+		return priv, nil
+	}
+	sealed, err := seal(key, []byte(priv))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openPrivateKey reverses sealPrivateKey. Values without the prefix were
+// stored before encryption was enabled and are returned unchanged.
+func openPrivateKey(key []byte, stored string) (string, error) {
+	enc, ok := strings.CutPrefix(stored, encryptedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if key == nil {
+		return "", errEncryptionKeyMissing
+	}
+	sealed, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", err
+	}
+	priv, err := unseal(key, sealed)
+	if err != nil {
+		return "", fmt.Errorf("decrypt private key (wrong ENCRYPTION_KEY?): %w", err)
+	}
+	return string(priv), nil
+}
+
+// privateKeyDigest is the private_key_digest of priv, in plaintext. Sealing
+// draws a fresh nonce each time, so the digest is what keeps private keys
+// unique: an HMAC-SHA256 under a key derived from key, which does not let
+// anyone reading the table test guesses, or SHA-256 with a nil key.
+func privateKeyDigest(key []byte, priv string) *string {
+	if key == nil {
+		sum := sha256.Sum256([]byte(priv))
+		d := plainDigestPrefix + hex.EncodeToString(sum[:])
+		return &d
+	}
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("private_key_digest"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(priv))
+	d := keyedDigestPrefix + hex.EncodeToString(mac.Sum(nil))
+	return &d
+}
+
+// digestPrefix is the prefix of the digests privateKeyDigest takes with key.
+func digestPrefix(key []byte) string {
+	if key == nil {
+		return plainDigestPrefix
+	}
+	return keyedDigestPrefix
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// ctlClient talks to a running instance's /v1 API for the ctl subcommand,
+// so operators never need database credentials.
+type ctlClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// ctlAPIError is an error response from the API.
+type ctlAPIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *ctlAPIError) Error() string {
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+// do sends body as JSON, if set, and decodes the response into out.
+func (c *ctlClient) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return &ctlAPIError{Status: resp.StatusCode, Code: e.Error.Code, Message: e.Error.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ctlOptions are the flags every ctl subcommand accepts.
+type ctlOptions struct {
+	json bool
+	yes  bool
+}
+
+func ctlFlags(name string, o *ctlOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("ctl "+name, flag.ContinueOnError)
+	fs.BoolVar(&o.json, "json", false, "print JSON instead of a table")
+	fs.BoolVar(&o.yes, "yes", false, "do not ask for confirmation")
+	return fs
+}
+
+// confirm asks before a mutating subcommand unless -yes was given. It
+// refuses when there is no terminal to ask on.
+func (o ctlOptions) confirm(what string) error {
+	if o.yes {
+		return nil
+	}
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("refusing to %s without -yes when not run interactively", what)
+	}
+	fmt.Fprintf(os.Stderr, "About to %s. Continue? [y/N] ", what)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return errors.New("aborted")
+	}
+	return nil
+}
+
+func printJSON(v any) error { return writeJSONTo(os.Stdout, v) }
+
+func writeJSONTo(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// ctlConfigPath is where the ctl subcommand reads KEYGENCTL_URL and
+// KEYGENCTL_TOKEN from when they are not in the environment.
+func ctlConfigPath() string {
+	if p := getenv("KEYGENCTL_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "keygenctl", "config")
+}
+
+const ctlUsage = `usage: solana-key-gen ctl [-url URL] [-token TOKEN] <command> [flags]
+
+commands:
+  stats                              pool depth per pattern and campaign
+  pick [-pattern P] [-campaign C]    pick a key (prints its private key)
+  release PUBLIC_KEY                 return a picked key to the pool
+  quarantine PUBLIC_KEY [-reason R]  take a key out of the pool for good
+  import FILE                        import private keys, one per line (- for stdin, may be gzipped)
+  export [-picked B] [-pattern P] [-o FILE]
+                                     print keys, add -include-secrets for private keys;
+                                     gzipped with COMPRESS=gzip
+  freeze [-reason R] | unfreeze      stop or resume key issuance
+  prewarm -count N | -add N [-until T] PATTERN
+                                     fill a pattern past its target once, e.g. before a launch;
+                                     prewarm -cancel PATTERN stops it
+  config get [NAME]                  show the effective configuration
+  config set NAME VALUE              change a runtime setting (MAINTENANCE_MODE)
+  stress [-concurrency N] [-duration D] [-pattern P]
+                                     pick concurrently (consuming the keys), report throughput,
+                                     errors and any key handed out twice
+
+Every command takes -json; mutating ones ask for confirmation unless -yes is given.
+The URL and token default to KEYGENCTL_URL and KEYGENCTL_TOKEN, from the
+environment or the file named by KEYGENCTL_CONFIG (default ~/.config/keygenctl/config).
+`
+
+// cmdCtl implements the "ctl" subcommand.
+func cmdCtl(ctx context.Context, args []string) error {
+	file := map[string]string{}
+	if p := ctlConfigPath(); p != "" {
+		if vals, err := godotenv.Read(p); err == nil {
+			file = vals
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("reading %s: %w", p, err)
+		}
+	}
+	setting := func(name, def string) string {
+		if v := getenv(name); v != "" {
+			return v
+		}
+		if v := file[name]; v != "" {
+			return v
+		}
+		return def
+	}
+
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, ctlUsage) }
+	base := fs.String("url", setting("KEYGENCTL_URL", "http://localhost:8080"), "instance base URL")
+	token := fs.String("token", setting("KEYGENCTL_TOKEN", ""), "API token")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no command given")
+	}
+	if *token == "" {
+		return errors.New("no API token: set KEYGENCTL_TOKEN or pass -token")
+	}
+	c := &ctlClient{base: strings.TrimRight(*base, "/"), token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "stats":
+		return ctlStats(ctx, c, rest)
+	case "pick":
+		return ctlPick(ctx, c, rest)
+	case "release", "quarantine":
+		return ctlKeyAction(ctx, c, cmd, rest)
+	case "import":
+		return ctlImport(ctx, c, rest)
+	case "export":
+		return ctlExport(ctx, c, rest)
+	case "freeze", "unfreeze":
+		return ctlFreeze(ctx, c, cmd, rest)
+	case "prewarm":
+		return ctlPrewarm(ctx, c, rest)
+	case "config":
+		return ctlConfig(ctx, c, rest)
+	case "stress":
+		return ctlStress(ctx, c, rest)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown ctl command %q", cmd)
+	}
+}
+
+func ctlStats(ctx context.Context, c *ctlClient, args []string) error {
+	var o ctlOptions
+	if err := ctlFlags("stats", &o).Parse(args); err != nil {
+		return err
+	}
+	var resp struct {
+		Patterns []struct {
+			Pattern  string `json:"pattern"`
+			Campaign string `json:"campaign"`
+			Unpicked int64  `json:"unpicked"`
+			Target   int    `json:"target"`
+			Prewarm  *struct {
+				Status string `json:"status"`
+			} `json:"prewarm"`
+		} `json:"patterns"`
+		Campaigns map[string]map[string]int64 `json:"campaigns"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/stats", nil, &resp); err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATTERN\tCAMPAIGN\tUNPICKED\tTARGET\tPREWARM")
+	for _, p := range resp.Patterns {
+		prewarm := ""
+		if p.Prewarm != nil {
+			prewarm = p.Prewarm.Status
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", p.Pattern, p.Campaign, p.Unpicked, p.Target, prewarm)
+	}
+	fmt.Fprintln(tw, "\nCAMPAIGN\tPICKED\tUNPICKED\t")
+	for name, n := range resp.Campaigns {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t\n", cmp.Or(name, "(none)"), n["picked"], n["unpicked"])
+	}
+	return tw.Flush()
+}
+
+func ctlPick(ctx context.Context, c *ctlClient, args []string) error {
+	var o ctlOptions
+	fs := ctlFlags("pick", &o)
+	var req pickRequest
+	fs.StringVar(&req.Pattern, "pattern", "", "pick from this pattern")
+	fs.StringVar(&req.Campaign, "campaign", "", "pick from this campaign")
+	fs.StringVar(&req.Order, "order", "", `"oldest" (default) or "quality"`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.confirm("pick a key and print its private key"); err != nil {
+		return err
+	}
+	var resp map[string]any
+	if err := c.do(ctx, http.MethodPost, "/v1/pick", req, &resp); err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, k := range []string{"public_key", "private_key", "matched_pattern", "campaign", "remaining_unpicked", "low_pool"} {
+		if v, ok := resp[k]; ok && v != nil {
+			fmt.Fprintf(tw, "%s\t%v\n", k, v)
+		}
+	}
+	return tw.Flush()
+}
+
+func ctlKeyAction(ctx context.Context, c *ctlClient, action string, args []string) error {
+	var o ctlOptions
+	fs := ctlFlags(action, &o)
+	reason := fs.String("reason", "", "reason recorded in the audit log")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: ctl %s PUBLIC_KEY", action)
+	}
+	pub := fs.Arg(0)
+	if err := o.confirm(action + " " + pub); err != nil {
+		return err
+	}
+	var resp map[string]any
+	body := map[string]string{"public_key": pub, "reason": *reason}
+	if err := c.do(ctx, http.MethodPost, "/v1/keys/"+action, body, &resp); err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+	fmt.Printf("%s %v\n", pub, resp["status"])
+	return nil
+}
+
+func ctlImport(ctx context.Context, c *ctlClient, args []string) error {
+	var o ctlOptions
+	fs := ctlFlags("import", &o)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: ctl import FILE (- for stdin)")
+	}
+	in := os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	r, err := decompressReader(in)
+	if err != nil {
+		return err
+	}
+
+	var req importRequest
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			req.Keys = append(req.Keys, importKey{PrivateKey: line})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if err := o.confirm(fmt.Sprintf("import %d keys", len(req.Keys))); err != nil {
+		return err
+	}
+
+	var resp struct {
+		Results []importResult `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/import", req, &resp); err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PUBLIC KEY\tSTATUS\tPROBLEM")
+	for _, r := range resp.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%v\n", r.PublicKey, r.Status, r.Error["problem"])
+	}
+	return tw.Flush()
+}
+
+func ctlExport(ctx context.Context, c *ctlClient, args []string) error {
+	var o ctlOptions
+	fs := ctlFlags("export", &o)
+	picked := fs.String("picked", "", "filter by is_picked (true or false)")
+	pattern := fs.String("pattern", "", "filter by matched pattern")
+	after := fs.String("created-after", "", "only keys created after this RFC3339 time")
+	secrets := fs.Bool("include-secrets", false, "include private keys in the output")
+	output := fs.String("o", "", "write to this file instead of stdout (.gz added with COMPRESS=gzip)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	compress, err := compression()
+	if err != nil {
+		return err
+	}
+	if *secrets {
+		if err := o.confirm("export private keys"); err != nil {
+			return err
+		}
+	}
+
+	q := url.Values{"limit": {"1000"}}
+	for k, v := range map[string]string{"picked": *picked, "pattern": *pattern, "created_after": *after} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if *secrets {
+		q.Set("include_private_key", "true")
+	}
+
+	// Follow the cursor until every page has been read
+	var keys []keyResponse
+	for {
+		var page struct {
+			Keys       []keyResponse `json:"keys"`
+			NextCursor string        `json:"next_cursor"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/v1/keys?"+q.Encode(), nil, &page); err != nil {
+			return err
+		}
+		keys = append(keys, page.Keys...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Set("cursor", page.NextCursor)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.OpenFile(compressedPath(*output, compress), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	zw := compressWriter(out, compress)
+	if err := writeExport(zw, keys, o.json, *secrets); err != nil {
+		return err
+	}
+	// Closing writes the gzip trailer; without it the output is truncated
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
+
+func writeExport(w io.Writer, keys []keyResponse, asJSON, secrets bool) error {
+	if asJSON {
+		return writeJSONTo(w, map[string]any{"keys": keys})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := "PUBLIC KEY\tPATTERN\tCREATED"
+	if secrets {
+		header += "\tPRIVATE KEY"
+	}
+	fmt.Fprintln(tw, header)
+	for _, k := range keys {
+		line := fmt.Sprintf("%s\t%s\t%s", k.PublicKey, k.MatchedPattern, k.CreatedAt.Format(time.RFC3339))
+		if secrets {
+			line += "\t" + k.PrivateKey
+		}
+		fmt.Fprintln(tw, line)
+	}
+	return tw.Flush()
+}
+
+func ctlFreeze(ctx context.Context, c *ctlClient, action string, args []string) error {
+	var o ctlOptions
+	fs := ctlFlags(action, &o)
+	reason := fs.String("reason", "", "reason recorded with the freeze flag")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.confirm(action + " key issuance on every replica"); err != nil {
+		return err
+	}
+	var resp map[string]any
+	if err := c.do(ctx, http.MethodPost, "/v1/admin/"+action, map[string]string{"reason": *reason}, &resp); err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+	fmt.Printf("frozen: %v\n", resp["frozen"])
+	return nil
+}
+
+func ctlPrewarm(ctx context.Context, c *ctlClient, args []string) error {
+	var o ctlOptions
+	fs := ctlFlags("prewarm", &o)
+	var req prewarmRequest
+	fs.Int64Var(&req.Count, "count", 0, "unpicked keys to build up to")
+	fs.Int64Var(&req.Add, "add", 0, "keys to build on top of the pattern's target")
+	fs.StringVar(&req.Until, "until", "", "RFC3339 time or date the prewarm expires (default the campaign's end)")
+	cancel := fs.Bool("cancel", false, "cancel the pattern's prewarm")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: ctl prewarm -count N | -add N [-until T] PATTERN, or ctl prewarm -cancel PATTERN")
+	}
+	req.Pattern = fs.Arg(0)
+
+	var resp map[string]any
+	if *cancel {
+		if err := o.confirm("cancel the prewarm of " + req.Pattern); err != nil {
+			return err
+		}
+		if err := c.do(ctx, http.MethodDelete, "/v1/admin/prewarm?"+url.Values{"pattern": {req.Pattern}}.Encode(), nil, &resp); err != nil {
+			return err
+		}
+	} else {
+		if err := o.confirm("prewarm " + req.Pattern); err != nil {
+			return err
+		}
+		if err := c.do(ctx, http.MethodPost, "/v1/admin/prewarm", req, &resp); err != nil {
+			return err
+		}
+	}
+	if o.json {
+		return printJSON(resp)
+	}
+	fmt.Printf("%s: %v\n", req.Pattern, resp["status"])
+	return nil
+}
+
+// ctlSettable maps the settings config set can change at runtime to the
+// endpoint that changes them.
+var ctlSettable = map[string]func(ctx context.Context, c *ctlClient, value string) (any, error){
+	"MAINTENANCE_MODE": func(ctx context.Context, c *ctlClient, value string) (any, error) {
+		var resp map[string]any
+		enabled := value == "true"
+		if !enabled && value != "false" {
+			return nil, errors.New("MAINTENANCE_MODE must be true or false")
+		}
+		err := c.do(ctx, http.MethodPost, "/v1/admin/maintenance", map[string]any{"enabled": enabled}, &resp)
+		return resp, err
+	},
+}
+
+func ctlConfig(ctx context.Context, c *ctlClient, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ctl config get [NAME] | config set NAME VALUE")
+	}
+	var o ctlOptions
+	fs := ctlFlags("config "+args[0], &o)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "get":
+		var resp struct {
+			Config []configEntry `json:"config"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/v1/admin/config", nil, &resp); err != nil {
+			return err
+		}
+		entries := resp.Config
+		if name := fs.Arg(0); name != "" {
+			entries = nil
+			for _, e := range resp.Config {
+				if e.Name == name {
+					entries = append(entries, e)
+				}
+			}
+			if len(entries) == 0 {
+				return fmt.Errorf("no setting named %q", name)
+			}
+		}
+		if o.json {
+			return printJSON(entries)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVALUE\tORIGIN")
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Name, e.Value, e.Origin)
+		}
+		return tw.Flush()
+
+	case "set":
+		if fs.NArg() != 2 {
+			return errors.New("usage: ctl config set NAME VALUE")
+		}
+		name, value := fs.Arg(0), fs.Arg(1)
+		set, ok := ctlSettable[name]
+		if !ok {
+			return fmt.Errorf("%s cannot be changed at runtime; only MAINTENANCE_MODE can", name)
+		}
+		if err := o.confirm("set " + name + "=" + value); err != nil {
+			return err
+		}
+		resp, err := set(ctx, c, value)
+		if err != nil {
+			return err
+		}
+		if o.json {
+			return printJSON(resp)
+		}
+		fmt.Printf("%s=%s\n", name, value)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown config command %q, want get or set", args[0])
+	}
+}
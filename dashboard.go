@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dashboard builds a Grafana dashboard with one panel per metric family in
+// the registry, so it cannot reference a metric the app does not expose.
+func dashboard() (map[string]any, error) {
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	panels := make([]map[string]any, 0, len(families))
+	for i, mf := range families {
+		name := mf.GetName()
+		by := labelNames(mf)
+		expr := name
+		unit := "short"
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			expr = "rate(" + name + "[5m])"
+			unit = "ops"
+		case dto.MetricType_HISTOGRAM:
+			expr = "histogram_quantile(0.95, sum by (" + strings.Join(append(by, "le"), ", ") + ") (rate(" + name + "_bucket[5m])))"
+			by = nil
+		}
+		if len(by) > 0 {
+			expr = "sum by (" + strings.Join(by, ", ") + ") (" + expr + ")"
+		}
+		legend := "__auto"
+		if len(by) > 0 {
+			legend = "{{" + strings.Join(by, "}} {{") + "}}"
+		}
+
+		panels = append(panels, map[string]any{
+			"id":          i + 1,
+			"type":        "timeseries",
+			"title":       name,
+			"description": mf.GetHelp(),
+			"datasource":  map[string]any{"type": "prometheus", "uid": "${datasource}"},
+			"gridPos":     map[string]any{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8},
+			"fieldConfig": map[string]any{"defaults": map[string]any{"unit": unit}, "overrides": []any{}},
+			"targets": []map[string]any{{
+				"refId":        "A",
+				"expr":         expr,
+				"legendFormat": legend,
+			}},
+		})
+	}
+
+	return map[string]any{
+		"title":         "solana-key-gen",
+		"uid":           "solana-key-gen",
+		"schemaVersion": 39,
+		"time":          map[string]any{"from": "now-6h", "to": "now"},
+		"refresh":       "30s",
+		"templating": map[string]any{"list": []map[string]any{{
+			"name":  "datasource",
+			"type":  "datasource",
+			"query": "prometheus",
+		}}},
+		"panels": panels,
+	}, nil
+}
+
+// labelNames returns the label names used by a family's series.
+func labelNames(mf *dto.MetricFamily) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if !seen[lp.GetName()] {
+				seen[lp.GetName()] = true
+				names = append(names, lp.GetName())
+			}
+		}
+	}
+	return names
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	d, err := dashboard()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", "failed to gather metrics", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// cmdDashboard implements the "dashboard" subcommand, printing the JSON for
+// importing into Grafana.
+func cmdDashboard() error {
+	d, err := dashboard()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
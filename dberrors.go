@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Categories of failure to connect to Postgres, as logged at startup.
+const (
+	connDNS       = "dns"
+	connRefused   = "connection_refused"
+	connTimeout   = "timeout"
+	connAuth      = "auth"
+	connSSL       = "ssl"
+	connNoDB      = "database_does_not_exist"
+	connUncertain = "unknown"
+)
+
+// connHints are the remediation hints logged for each category.
+var connHints = map[string]string{
+	connDNS:       "the host in the DSN does not resolve; check it for typos and that this machine can resolve it (container network, VPN)",
+	connRefused:   "nothing is listening at that host and port; check the port and that Postgres is running and listening on a reachable address (listen_addresses)",
+	connTimeout:   "the host did not answer; check firewalls and security groups between this machine and the database",
+	connAuth:      "the server rejected the credentials; check the user and password in the DSN and pg_hba.conf",
+	connSSL:       "the TLS handshake failed; set sslmode to match the server (e.g. sslmode=disable for a local Postgres without TLS) or fix sslrootcert",
+	connNoDB:      "the database named in the DSN does not exist; create it or fix the name",
+	connUncertain: "see the error above",
+}
+
+// classifyConnError maps a driver error from connecting to Postgres to one
+// of the conn* categories.
+func classifyConnError(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "28P01", "28000": // invalid_password, invalid_authorization_specification
+			return connAuth
+		case "3D000": // invalid_catalog_name
+			return connNoDB
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return connDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return connRefused
+	}
+	var (
+		recordErr    *tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	// pgconn reports a server without TLS only as text
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || strings.Contains(err.Error(), "server refused TLS connection") {
+		return connSSL
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return connTimeout
+	}
+	return connUncertain
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"gorm.io/gorm"
+)
+
+// dbStatsPool is one connection pool the collector reports: role is
+// primary for DATABASE_URL and secondary for DATABASE_URL_2 and on, pool
+// the variable it was configured by.
+type dbStatsPool struct {
+	role, pool string
+	db         *gorm.DB
+}
+
+// dbStatsCollector snapshots each pool's sql.DBStats on scrape. The stats
+// are the driver's own bookkeeping, so they are reported even while the
+// database is down; a pool whose *sql.DB cannot be had is skipped rather
+// than failing the scrape.
+type dbStatsCollector struct {
+	pools []dbStatsPool
+
+	open, inUse, idle, maxOpen                     *prometheus.Desc
+	waitCount, waitSeconds, idleClosed, lifeClosed *prometheus.Desc
+}
+
+func newDBStatsCollector(pools []dbStatsPool) *dbStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("keygen_db_"+name, help, []string{"role", "pool"}, nil)
+	}
+	return &dbStatsCollector{
+		pools:       pools,
+		open:        desc("open_connections", "Established connections, in use or idle."),
+		inUse:       desc("in_use_connections", "Connections currently in use."),
+		idle:        desc("idle_connections", "Idle connections."),
+		maxOpen:     desc("max_open_connections", "Maximum open connections, 0 for unlimited."),
+		waitCount:   desc("wait_count_total", "Connections waited for because the pool was exhausted."),
+		waitSeconds: desc("wait_duration_seconds_total", "Time spent waiting for a connection."),
+		idleClosed:  desc("max_idle_closed_total", "Connections closed for exceeding the idle limit."),
+		lifeClosed:  desc("max_lifetime_closed_total", "Connections closed for exceeding their maximum lifetime."),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.open, c.inUse, c.idle, c.maxOpen, c.waitCount, c.waitSeconds, c.idleClosed, c.lifeClosed} {
+		ch <- d
+	}
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range c.pools {
+		sqlDB, err := p.db.DB()
+		if err != nil {
+			log.Printf("Error reading %s pool stats: %v\n", p.pool, err)
+			continue
+		}
+		st := sqlDB.Stats()
+		gauge := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, p.role, p.pool)
+		}
+		counter := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, p.role, p.pool)
+		}
+		gauge(c.open, float64(st.OpenConnections))
+		gauge(c.inUse, float64(st.InUse))
+		gauge(c.idle, float64(st.Idle))
+		gauge(c.maxOpen, float64(st.MaxOpenConnections))
+		counter(c.waitCount, float64(st.WaitCount))
+		counter(c.waitSeconds, st.WaitDuration.Seconds())
+		counter(c.idleClosed, float64(st.MaxIdleClosed))
+		counter(c.lifeClosed, float64(st.MaxLifetimeClosed))
+	}
+}
+
+// registerRuntimeMetrics adds the standard go_* and process_* collectors
+// and the connection pool stats of pools to /metrics.
+func registerRuntimeMetrics(pools []dbStatsPool) {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newDBStatsCollector(pools),
+	)
+}
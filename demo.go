@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// demoPattern is what --demo grinds for: one character, found in about 58
+// attempts, so the pool fills in moments.
+var demoPattern = pattern{Suffix: "z", Target: 5, Source: "demo"}
+
+// runDemo implements --demo: the whole generate, pool and pick flow with
+// nothing to set up. Keys go to a memStore and are lost on exit, so it
+// refuses to start with DATABASE_URL set, where one could mistake them for
+// stored keys. The API, without authentication, listens on a random local
+// port printed to stdout; cancelling ctx (Ctrl-C) stops it and prints a
+// summary.
+func runDemo(ctx context.Context) error {
+	if getenv("DATABASE_URL") != "" {
+		return errors.New("--demo keeps keys in memory only and will not start with DATABASE_URL set; unset it to run the demo")
+	}
+
+	store := newMemStore()
+	name := demoPattern.Name()
+	refill := make(chan struct{}, 1)
+	var generated, picked atomic.Int64
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metricsHandler())
+	mux.HandleFunc("GET /dashboard.json", handleDashboard)
+	mux.HandleFunc("GET /v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := store.CountUnpicked(r.Context(), name)
+		writeJSON(w, http.StatusOK, map[string]any{"patterns": []map[string]any{
+			{"pattern": name, "unpicked": n, "target": demoPattern.Target}}})
+	})
+	mux.HandleFunc("POST /v1/pick", func(w http.ResponseWriter, r *http.Request) {
+		key, err := store.Pick(r.Context(), pickFilter{Pattern: name})
+		if errors.Is(err, ErrPoolEmpty) {
+			writeError(w, http.StatusServiceUnavailable, "pool_empty", err.Error(), nil)
+			return
+		}
+		picked.Add(1)
+		select {
+		case refill <- struct{}{}:
+		default:
+		}
+		log.Printf("Demo: picked %s\n", key.PublicKey)
+		writeJSON(w, http.StatusOK, newKeyResponse(key))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("demo listener: %w", err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go srv.Serve(ln)
+	base := "http://" + ln.Addr().String()
+	fmt.Printf("Demo API at %s (keys live in memory and are discarded on exit)\n", base)
+	fmt.Printf("  curl -X POST %s/v1/pick\n  curl %s/v1/stats\n  curl %s/dashboard.json\n", base, base, base)
+
+	start := time.Now()
+	for ctx.Err() == nil {
+		n, _ := store.CountUnpicked(ctx, name)
+		if n >= int64(demoPattern.Target) {
+			select {
+			case <-refill:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		kp, err := generateVanityKeypair(ctx, []string{name}, runtime.NumCPU())
+		if err != nil {
+			break
+		}
+		if _, err := store.Insert(ctx, &TokenKey{PrivateKey: kp.Priv, PublicKey: kp.Pub, MatchedPattern: kp.Pattern,
+			QualityScore: qualityScore(kp.Pattern)}); err != nil {
+			log.Println("Demo: error storing key:", err)
+			continue
+		}
+		generated.Add(1)
+		log.Printf("Demo: generated %s after %d attempts, pool %d/%d\n", kp.Pub, kp.Attempts, n+1, demoPattern.Target)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	left, _ := store.CountUnpicked(context.Background(), name)
+	summary, _ := json.MarshalIndent(map[string]any{"ran_for": time.Since(start).Round(time.Second).String(),
+		"generated": generated.Load(), "picked": picked.Load(), "unpicked_discarded": left}, "", "  ")
+	fmt.Printf("Demo summary:\n%s\n", summary)
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/blocto/solana-go-sdk/common"
+	"github.com/mr-tron/base58/base58"
+)
+
+// derivations are the addresses a secondary constraint can be put on, each
+// derived from a candidate mint address.
+var derivations = map[string]func(mint common.PublicKey) (common.PublicKey, error){
+	// The Metaplex token metadata account of the mint
+	"metadata": func(mint common.PublicKey) (common.PublicKey, error) {
+		pda, _, err := common.FindProgramAddress([][]byte{
+			[]byte("metadata"),
+			common.MetaplexTokenMetaProgramID.Bytes(),
+			mint.Bytes(),
+		}, common.MetaplexTokenMetaProgramID)
+		return pda, err
+	},
+}
+
+// derivedConstraint requires the address derived from a candidate by the
+// named derivation to match (or with Negate, not match) a prefix, suffix
+// or regex.
+type derivedConstraint struct {
+	Derivation string
+	Kind       string
+	Value      string
+	Negate     bool
+
+	derive func(common.PublicKey) (common.PublicKey, error)
+	re     *regexp.Regexp
+}
+
+// parseDerivedConstraints parses comma-separated "derivation:kind:value"
+// entries, kind being prefix, suffix or regex, optionally negated with a
+// leading "!", e.g. "metadata:!prefix:1" or "metadata:regex:^[^123]".
+func parseDerivedConstraints(spec string) ([]derivedConstraint, error) {
+	var out []derivedConstraint
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			return nil, fmt.Errorf("want derivation:kind:value in %q", entry)
+		}
+		c := derivedConstraint{Derivation: parts[0], Kind: strings.TrimPrefix(parts[1], "!"), Value: parts[2], Negate: strings.HasPrefix(parts[1], "!")}
+		var ok bool
+		if c.derive, ok = derivations[c.Derivation]; !ok {
+			return nil, fmt.Errorf("unknown derivation %q in %q", c.Derivation, entry)
+		}
+		switch c.Kind {
+		case "prefix", "suffix":
+		case "regex":
+			re, err := regexp.Compile(c.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex in %q: %w", entry, err)
+			}
+			c.re = re
+		default:
+			return nil, fmt.Errorf("kind in %q must be prefix, suffix or regex", entry)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (c derivedConstraint) String() string {
+	kind := c.Kind
+	if c.Negate {
+		kind = "!" + kind
+	}
+	return c.Derivation + ":" + kind + ":" + c.Value
+}
+
+func (c derivedConstraint) matches(derived string) bool {
+	var ok bool
+	switch c.Kind {
+	case "prefix":
+		ok = strings.HasPrefix(derived, c.Value)
+	case "suffix":
+		ok = strings.HasSuffix(derived, c.Value)
+	case "regex":
+		ok = c.re.MatchString(derived)
+	}
+	return ok != c.Negate
+}
+
+var errDerivationHalted = errors.New("derivations keep failing, halting the burst")
+
+// derivedCheck returns a generator check applying every constraint to the
+// addresses derived from a candidate. Checks only run once the primary
+// pattern has matched, so the derivations cost nothing on most attempts.
+// A failed derivation rejects the candidate; with breaker set, enough of
+// them in a row open it and the check fails with errDerivationHalted
+// instead, stopping the generator rather than grinding for nothing.
+func derivedCheck(constraints []derivedConstraint, breaker *circuitBreaker) func(addr string) (bool, error) {
+	return func(addr string) (bool, error) {
+		b, err := base58.Decode(addr)
+		if err != nil {
+			return false, nil
+		}
+		mint := common.PublicKeyFromBytes(b)
+		derived := map[string]string{}
+		for _, c := range constraints {
+			d, ok := derived[c.Derivation]
+			if !ok {
+				var pda common.PublicKey
+				derive := func() (err error) {
+					pda, err = c.derive(mint)
+					return err
+				}
+				if breaker != nil {
+					err = breaker.Do(derive)
+				} else {
+					err = derive()
+				}
+				if errors.Is(err, errBreakerOpen) {
+					return false, errDerivationHalted
+				}
+				if err != nil {
+					derivationFailuresTotal.WithLabelValues(c.Derivation).Inc()
+					return false, nil
+				}
+				d = pda.ToBase58()
+				derived[c.Derivation] = d
+			}
+			if !c.matches(d) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// derivedFilter is derivedCheck without a breaker, as a plain filter.
+func derivedFilter(constraints []derivedConstraint) func(addr string) bool {
+	check := derivedCheck(constraints, nil)
+	return func(addr string) bool {
+		ok, _ := check(addr)
+		return ok
+	}
+}
+
+// checkDerivations runs a random candidate through every constrained
+// derivation, so a broken one fails at startup instead of rejecting every
+// key later.
+func checkDerivations(constraints []derivedConstraint) error {
+	_, pub, err := generatorAlgos[0].gen()
+	if err != nil {
+		return err
+	}
+	mint := common.PublicKeyFromBytes(pub)
+	for _, c := range constraints {
+		if _, err := c.derive(mint); err != nil {
+			return fmt.Errorf("derivation %q failed for %s: %w", c.Derivation, mint.ToBase58(), err)
+		}
+	}
+	return nil
+}
+
+// benchDerivations times each derivation over n random mints, for the
+// compare-generators report.
+func benchDerivations(n int) (map[string]time.Duration, error) {
+	out := map[string]time.Duration{}
+	for name, derive := range derivations {
+		var total time.Duration
+		for i := 0; i < n; i++ {
+			_, pub, err := generatorAlgos[0].gen()
+			if err != nil {
+				return nil, err
+			}
+			start := time.Now()
+			if _, err := derive(common.PublicKeyFromBytes(pub)); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			total += time.Since(start)
+		}
+		out[name] = total / time.Duration(n)
+	}
+	return out, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reasons a key that was paid for ends up unused.
+const (
+	discardFrozen      = "frozen"      // found after issuance was frozen mid-fill
+	discardMaintenance = "maintenance" // found after maintenance mode began mid-fill
+	discardLeaseLost   = "lease_lost"  // found after the generation lease was lost
+	discardShutdown    = "shutdown"    // found after shutdown began mid-fill
+	discardSurplus     = "surplus"     // another instance filled the pool first
+	discardDuplicate   = "duplicate"   // already stored
+	discardBlocklist   = "blocklist"   // contained a BLOCKLIST_FILE term
+	discardExpired     = "expired"     // deleted unpicked by MAX_KEY_AGE or its campaign window
+	discardCorrupt     = "corrupt"     // quarantined because it no longer decrypts to its public key
+	discardQuarantine  = "quarantine"  // quarantined by an admin, a swap or the watchlist
+	discardUnscheduled = "unscheduled" // found after its pattern's PATTERN_SCHEDULE window closed
+)
+
+var discardReasons = []string{discardFrozen, discardMaintenance, discardLeaseLost, discardSurplus,
+	discardDuplicate, discardBlocklist, discardExpired, discardCorrupt, discardQuarantine}
+
+// DiscardedKey is one ledger entry for a key that was found but never used.
+// Only the public key is kept. Attempts is the candidates spent finding it,
+// 0 when unknown.
+type DiscardedKey struct {
+	ID          uint      `gorm:"primaryKey" json:"-"`
+	DiscardedAt time.Time `gorm:"column:discarded_at;not null;index" json:"discarded_at"`
+	Reason      string    `gorm:"column:reason;not null;index" json:"reason"`
+	Pattern     string    `gorm:"column:pattern" json:"pattern"`
+	PublicKey   string    `gorm:"column:public_key" json:"public_key,omitempty"`
+	Attempts    int64     `gorm:"column:attempts;not null;default:0" json:"attempts"`
+}
+
+func (DiscardedKey) TableName() string { return "discarded_key" }
+
+// discardLedger queues DiscardedKey rows and writes them in batches, so the
+// generator workers and pick paths that discard keys never wait on the
+// database. Entries are dropped, with a log line, if the queue is full. A
+// nil ledger records nothing.
+type discardLedger struct {
+	store     *gormStore
+	retention time.Duration
+	queue     chan DiscardedKey
+}
+
+func newDiscardLedger(store *gormStore, retention time.Duration) *discardLedger {
+	return &discardLedger{store: store, retention: retention, queue: make(chan DiscardedKey, 4096)}
+}
+
+// Record notes that the key pub of pattern was discarded for reason after
+// attempts candidates (0 if unknown).
+func (l *discardLedger) Record(reason, pattern, pub string, attempts int64) {
+	keysDiscardedTotal.WithLabelValues(reason).Inc()
+	if attempts == 0 && pattern != "" {
+		discardedAttemptsTotal.WithLabelValues(reason).Add(nameDifficulty(pattern))
+	} else {
+		discardedAttemptsTotal.WithLabelValues(reason).Add(float64(attempts))
+	}
+	if l == nil {
+		return
+	}
+	select {
+	case l.queue <- DiscardedKey{DiscardedAt: clock.Now().UTC(), Reason: reason, Pattern: pattern, PublicKey: pub, Attempts: attempts}:
+	default:
+		log.Printf("Discard ledger queue full, not recording %s key %s\n", reason, pub)
+	}
+}
+
+// Run writes queued entries every few seconds until ctx is done.
+func (l *discardLedger) Run(ctx context.Context, maint *maintenanceSwitch) {
+	flush := time.NewTicker(5 * time.Second)
+	defer flush.Stop()
+
+	var batch []DiscardedKey
+	write := func(ctx context.Context) {
+		if len(batch) == 0 || maint.Active() {
+			return
+		}
+		if err := l.store.AddDiscards(ctx, batch); err != nil {
+			log.Println("Error writing discard ledger:", err)
+			return
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			write(context.WithoutCancel(ctx))
+			return
+		case d := <-l.queue:
+			if batch = append(batch, d); len(batch) >= 500 {
+				write(ctx)
+			}
+		case <-flush.C:
+			write(ctx)
+		}
+	}
+}
+
+// Prune is the discard_prune job: it deletes entries older than the
+// retention.
+func (l *discardLedger) Prune(ctx context.Context) error {
+	n, err := l.store.PruneDiscards(ctx, clock.Now().Add(-l.retention))
+	if err == nil && n > 0 {
+		log.Printf("Discard ledger: %d expired entries deleted\n", n)
+	}
+	return err
+}
+
+func (s *gormStore) AddDiscards(ctx context.Context, rows []DiscardedKey) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+	return ctxError(ctx, "add discards", db.CreateInBatches(rows, 500).Error)
+}
+
+func (s *gormStore) PruneDiscards(ctx context.Context, before time.Time) (int64, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	res := db.Where("discarded_at < ?", before).Delete(&DiscardedKey{})
+	return res.RowsAffected, ctxError(ctx, "prune discards", res.Error)
+}
+
+// discardCount is the ledger total for one reason and pattern. Unknown is
+// how many of its keys have no recorded attempts.
+type discardCount struct {
+	Reason   string
+	Pattern  string
+	Keys     int64
+	Attempts int64
+	Unknown  int64
+}
+
+// DiscardCounts totals the ledger by reason and pattern since since.
+func (s *gormStore) DiscardCounts(ctx context.Context, since time.Time) ([]discardCount, error) {
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var out []discardCount
+	err := db.Model(&DiscardedKey{}).
+		Select("reason, COALESCE(pattern, '') AS pattern, count(*) AS keys, COALESCE(sum(attempts), 0) AS attempts, "+
+			"count(*) FILTER (WHERE attempts = 0) AS unknown").
+		Where("discarded_at >= ?", since).
+		Group("reason, COALESCE(pattern, '')").
+		Scan(&out).Error
+	return out, ctxError(ctx, "discard counts", err)
+}
+
+// DiscardReport pages the ledger by discard time, filtered by page, whose
+// source is the discard reason.
+func (s *gormStore) DiscardReport(ctx context.Context, page pageParams) ([]DiscardedKey, string, error) {
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Query)
+	defer cancel()
+
+	tx := pageRange(db.Model(&DiscardedKey{}), "discarded_at", page.From, page.To)
+	if page.Pattern != "" {
+		tx = tx.Where("pattern = ?", page.Pattern)
+	}
+	if page.Patterns != nil {
+		tx = tx.Where("pattern IN ?", page.Patterns)
+	}
+	if page.Source != "" {
+		tx = tx.Where("reason = ?", page.Source)
+	}
+	tx, err := keysetPage(tx, "discarded_at", "id", page.Cursor, page.Desc, page.Limit, intID)
+	if err != nil {
+		return nil, "", err
+	}
+	var rows []DiscardedKey
+	if err := tx.Find(&rows).Error; err != nil {
+		return nil, "", ctxError(ctx, "discard report", err)
+	}
+	next := ""
+	if len(rows) == page.Limit {
+		last := rows[len(rows)-1]
+		next = pageCursor{Key: last.DiscardedAt, ID: strconv.FormatUint(uint64(last.ID), 10), Desc: page.Desc}.String()
+	}
+	return rows, next, nil
+}
+
+// handleReport serves GET /v1/report: the discard ledger one key at a
+// time, paged and filtered by the shared list parameters, where source is
+// the discard reason (surplus, blocklist, expired...). A restricted token
+// sees only the patterns within its restriction.
+func (s *server) handleReport(w http.ResponseWriter, r *http.Request) {
+	page, perr := parsePageParams(r.URL.Query(), pageLimits{Default: 100, Max: 10000}, "pattern", "source", "from", "to")
+	if perr != nil {
+		writeError(w, http.StatusBadRequest, perr.Code, perr.Message, nil)
+		return
+	}
+	restrict := tokenFromContext(r.Context()).Restrict
+	if page.Pattern != "" && !s.allowsPattern(restrict, page.Pattern) {
+		writeRestricted(w, restrict)
+		return
+	}
+	page.Patterns = s.visiblePatterns(restrict)
+
+	rows, next, err := s.store.DiscardReport(r.Context(), page)
+	if errors.Is(err, errInvalidCursor) {
+		writeError(w, http.StatusBadRequest, "invalid_cursor", err.Error(), nil)
+		return
+	}
+	if err != nil {
+		log.Println("Error reading the discard report:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read the discard report", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"discards": rows, "next_cursor": next})
+}
+
+// discardSummary rolls discard counts up by reason. EstimatedAttempts adds
+// the pattern's expected attempts for every key whose attempts are unknown,
+// so reasons can be compared by the compute they cost.
+func discardSummary(counts []discardCount) map[string]map[string]any {
+	out := map[string]map[string]any{}
+	for _, c := range counts {
+		r := out[c.Reason]
+		if r == nil {
+			r = map[string]any{"keys": int64(0), "attempts": int64(0), "estimated_attempts": 0.0}
+			out[c.Reason] = r
+		}
+		estimated := float64(c.Attempts)
+		if c.Pattern != "" {
+			estimated += float64(c.Unknown) * nameDifficulty(c.Pattern)
+		}
+		r["keys"] = r["keys"].(int64) + c.Keys
+		r["attempts"] = r["attempts"].(int64) + c.Attempts
+		r["estimated_attempts"] = r["estimated_attempts"].(float64) + estimated
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// shortLen is how many characters the short form keeps from each end.
+const shortLen = 4
+
+// keyDisplay is the presentation of an address frontends would otherwise
+// compute themselves. Match is the [start, end) character range of the
+// matched pattern's text, absent for unmatched keys.
+type keyDisplay struct {
+	Short string  `json:"short"`
+	Color string  `json:"color"`
+	Match *[2]int `json:"match,omitempty"`
+}
+
+// shortForm is the first and last shortLen characters joined by an ellipsis.
+func shortForm(pub string) string {
+	if len(pub) <= 2*shortLen {
+		return pub
+	}
+	return pub[:shortLen] + "…" + pub[len(pub)-shortLen:]
+}
+
+// parseShortForm splits a short form, with "…" or "...", into its ends.
+func parseShortForm(s string) (first, last string, ok bool) {
+	first, last, ok = strings.Cut(s, "…")
+	if !ok {
+		first, last, ok = strings.Cut(s, "...")
+	}
+	return first, last, ok && len(first) == shortLen && len(last) == shortLen
+}
+
+// keyChecksum is the compact code keys are referenced by: the CRC-32 of
+// the public key in 8 hex digits. Unlike the short form it is one token,
+// but with enough keys two collide, so lookups return every match.
+func keyChecksum(pub string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(pub)))
+}
+
+// validChecksum reports whether s could be a keyChecksum, in either case.
+func validChecksum(s string) bool {
+	_, err := hex.DecodeString(s)
+	return len(s) == 8 && err == nil
+}
+
+func displayFor(pub, matchedPattern string) keyDisplay {
+	sum := sha256.Sum256([]byte(pub))
+	d := keyDisplay{Short: shortForm(pub), Color: fmt.Sprintf("#%02x%02x%02x", sum[0], sum[1], sum[2])}
+	if text, ok := parseContainsName(matchedPattern); ok {
+		if i := strings.Index(pub, text); i >= 0 {
+			d.Match = &[2]int{i, i + len(text)}
+		}
+	} else if prefix, ok := strings.CutSuffix(matchedPattern, "*"); ok && strings.HasPrefix(pub, prefix) {
+		d.Match = &[2]int{0, len(prefix)}
+	} else if matchedPattern != "" && strings.HasSuffix(pub, matchedPattern) {
+		d.Match = &[2]int{len(pub) - len(matchedPattern), len(pub)}
+	}
+	return d
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// entropyMaxChiSquare bounds the chi-square statistic of a sample's byte
+// counts. With 255 degrees of freedom it averages 255 with a standard
+// deviation of about 22.6, so a healthy source exceeds 400 with
+// probability below one in a million.
+const entropyMaxChiSquare = 400
+
+// entropyBlock is the size of the blocks a sample must not repeat: one key
+// seed.
+const entropyBlock = 32
+
+// entropyResult is the outcome of one entropy check.
+type entropyResult struct {
+	At        time.Time     `json:"at"`
+	Bytes     int           `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Seconds   float64       `json:"read_seconds"`
+	ChiSquare float64       `json:"chi_square"`
+	Problem   string        `json:"problem,omitempty"`
+}
+
+// Healthy reports whether the check found nothing wrong.
+func (r entropyResult) Healthy() bool { return r.Problem == "" }
+
+// checkEntropy reads n bytes from src and checks that the read took at most
+// maxDuration (0 = any) and that the sample is not all zero, repeats no
+// seed-sized block and has byte counts plausible for a uniform source.
+// These only catch a broken source, not a subtly predictable one.
+func checkEntropy(src io.Reader, n int, maxDuration time.Duration) entropyResult {
+	buf := make([]byte, n)
+	start := clock.Now()
+	_, err := io.ReadFull(src, buf)
+	r := entropyResult{At: start.UTC(), Bytes: n, Duration: clock.Now().Sub(start)}
+	r.Seconds = r.Duration.Seconds()
+	switch {
+	case err != nil:
+		r.Problem = fmt.Sprintf("read failed: %v", err)
+		return r
+	case maxDuration > 0 && r.Duration > maxDuration:
+		r.Problem = fmt.Sprintf("reading %d bytes took %v, more than %v", n, r.Duration.Round(time.Millisecond), maxDuration)
+		return r
+	}
+
+	var counts [256]int
+	for _, b := range buf {
+		counts[b]++
+	}
+	if counts[0] == n {
+		r.Problem = "sample is all zero bytes"
+		return r
+	}
+	expected := float64(n) / 256
+	for _, c := range counts {
+		d := float64(c) - expected
+		r.ChiSquare += d * d / expected
+	}
+	if r.ChiSquare > entropyMaxChiSquare {
+		r.Problem = fmt.Sprintf("byte distribution is not uniform (chi-square %.0f over 255 degrees of freedom)", r.ChiSquare)
+		return r
+	}
+	seen := make(map[[entropyBlock]byte]bool, n/entropyBlock)
+	for i := 0; i+entropyBlock <= n; i += entropyBlock {
+		block := [entropyBlock]byte(buf[i : i+entropyBlock])
+		if seen[block] {
+			r.Problem = fmt.Sprintf("a %d-byte block repeats within the sample", entropyBlock)
+			return r
+		}
+		seen[block] = true
+	}
+	return r
+}
+
+// entropyMonitor repeats checkEntropy on crypto/rand and keeps the last
+// result for /healthz and metrics. A nil monitor checks nothing and is
+// always healthy.
+type entropyMonitor struct {
+	bytes       int
+	maxDuration time.Duration
+
+	mu   sync.Mutex
+	last entropyResult
+}
+
+func newEntropyMonitor(first entropyResult, bytes int, maxDuration time.Duration) *entropyMonitor {
+	m := &entropyMonitor{bytes: bytes, maxDuration: maxDuration}
+	m.record(first)
+	return m
+}
+
+func (m *entropyMonitor) record(r entropyResult) {
+	m.mu.Lock()
+	m.last = r
+	m.mu.Unlock()
+	entropyReadSeconds.Set(r.Seconds)
+	entropyChiSquare.Set(r.ChiSquare)
+	if r.Healthy() {
+		entropyHealthy.Set(1)
+	} else {
+		entropyHealthy.Set(0)
+		entropyChecksFailedTotal.Inc()
+	}
+}
+
+// Last is the most recent check.
+func (m *entropyMonitor) Last() (entropyResult, bool) {
+	if m == nil {
+		return entropyResult{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last, true
+}
+
+// Healthy reports whether the most recent check passed.
+func (m *entropyMonitor) Healthy() bool {
+	last, ok := m.Last()
+	return !ok || last.Healthy()
+}
+
+// Check is the entropy_check job: it samples crypto/rand and records the
+// result, failing if it is unhealthy.
+func (m *entropyMonitor) Check(ctx context.Context) error {
+	was := m.Healthy()
+	r := checkEntropy(rand.Reader, m.bytes, m.maxDuration)
+	m.record(r)
+	switch {
+	case !r.Healthy():
+		log.Printf("ALERT entropy check failed: %s; keys generated now may be weak, investigate the host's entropy source\n", r.Problem)
+		return errors.New(r.Problem)
+	case !was:
+		log.Println("Entropy check passing again")
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"solana-key-gen/keygen"
+)
+
+// estimate is how hard one pattern is to find.
+type estimate struct {
+	Mode       string
+	Value      string
+	Pattern    pattern
+	IgnoreCase bool
+	Attempts   float64
+}
+
+// feasibleFill is how long filling a pool may reasonably take; a target
+// that needs longer at the grinding rate is warned about.
+const feasibleFill = 7 * 24 * time.Hour
+
+// fillFeasibility reports whether grinding keys keys, each taking attempts
+// candidates on average, finishes within limit at rate candidates per
+// second, with how long it would take and how many keys limit allows. An
+// unknown rate or difficulty is taken to be feasible.
+func fillFeasibility(keys int64, attempts, rate float64, limit time.Duration) (eta time.Duration, reachable int64, ok bool) {
+	if keys <= 0 || rate <= 0 || attempts <= 0 || math.IsInf(attempts, 1) {
+		return 0, keys, true
+	}
+	secs := float64(keys) * attempts / rate
+	eta = time.Duration(math.MaxInt64)
+	if secs < eta.Seconds() {
+		eta = time.Duration(secs * float64(time.Second))
+	}
+	reachable = int64(limit.Seconds() * rate / attempts)
+	return eta, reachable, secs <= limit.Seconds()
+}
+
+// maxTarget bounds any pattern's target: beyond it the pool would take
+// storage and years of grinding for no plausible demand.
+const maxTarget = 100_000_000
+
+// recountEvery is how many keys the fill loop counts itself between
+// recounts while a pool is far below its target.
+const recountEvery = 100
+
+// warnInfeasibleTarget warns if grinding keys more keys of p would take
+// longer than feasibleFill at rate, taken from source, suggesting the
+// target reachable in that time.
+func warnInfeasibleTarget(p pattern, keys int64, attempts, rate float64, source string) {
+	eta, reachable, ok := fillFeasibility(keys, attempts, rate, feasibleFill)
+	if ok {
+		return
+	}
+	log.Printf("WARN %d more keys for %q need ~%.3g attempts each, ~%v at the %s %.3g attempts/s; a target of about %d fills in %v\n",
+		keys, p.Name(), attempts, eta.Round(time.Hour), source, rate, max(1, int64(p.Target)-keys+reachable), feasibleFill)
+}
+
+// estimateError is why a pattern cannot be estimated, as an API error.
+type estimateError struct {
+	Code, Msg string
+	Extra     map[string]any
+}
+
+// estimatePattern estimates value matched by mode: suffix (default),
+// prefix, contains or edit, the last within distance (default 1).
+// ignoreCase estimates a case-insensitive match instead, which the
+// generator does not do but which shows what case costs. Only the share of
+// candidates with the configured addrLen counts.
+func estimatePattern(mode, value, distance string, ignoreCase bool, addrLen int) (estimate, *estimateError) {
+	mode = cmp.Or(mode, "suffix")
+	lint := keygen.Lint(value)
+	if lint.HasErrors() {
+		var problems []string
+		for _, f := range lint.Findings {
+			if f.Severity == keygen.SeverityError {
+				problems = append(problems, f.Message)
+			}
+		}
+		return estimate{}, &estimateError{"invalid_value", "value can never appear in an address", map[string]any{"problems": problems}}
+	}
+
+	p := pattern{Suffix: value}
+	switch mode {
+	case "suffix":
+	case "prefix":
+		p.Suffix, p.Prefix = "", value
+	case "contains":
+		p.Contains = true
+	case "edit":
+		p.Fuzzy, p.MaxEdit = true, 1
+		if distance != "" {
+			d, err := strconv.Atoi(distance)
+			if err != nil || d < 0 || d >= len(value) {
+				return estimate{}, &estimateError{Code: "invalid_distance", Msg: "distance must be between 0 and len(value)-1"}
+			}
+			p.MaxEdit = d
+		}
+	default:
+		return estimate{}, &estimateError{Code: "invalid_mode", Msg: `mode must be "suffix", "prefix", "contains" or "edit"`}
+	}
+
+	attempts := p.attemptsAt(addrLen)
+	if math.IsInf(attempts, 1) {
+		return estimate{}, &estimateError{Code: "unmatchable", Msg: fmt.Sprintf("no %d-character address can match this", addrLen)}
+	}
+	if ignoreCase {
+		attempts /= lint.IgnoreCaseSpeedup
+	}
+	return estimate{Mode: mode, Value: value, Pattern: p, IgnoreCase: ignoreCase, Attempts: attempts}, nil
+}
+
+func writeEstimateError(w http.ResponseWriter, err *estimateError) {
+	writeError(w, http.StatusBadRequest, err.Code, err.Msg, err.Extra)
+}
+
+// handleEstimate serves GET /v1/estimate?mode=suffix&value=ponz: how hard a
+// pattern would be before configuring it, as estimatePattern with
+// ?distance= and ?ignore_case=true. The ETA uses this instance's measured
+// grinding rate and is null while it is not grinding. A restricted token
+// may only estimate patterns within its restriction.
+func (s *server) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	e, estErr := estimatePattern(q.Get("mode"), q.Get("value"), q.Get("distance"), q.Get("ignore_case") == "true", s.agents.config.AddressLength)
+	if estErr != nil {
+		writeEstimateError(w, estErr)
+		return
+	}
+	if restrict := tokenFromContext(r.Context()).Restrict; !s.allowsPattern(restrict, e.Pattern.Name()) {
+		writeRestricted(w, restrict)
+		return
+	}
+
+	resp := map[string]any{
+		"mode":              e.Mode,
+		"value":             e.Value,
+		"pattern":           e.Pattern.Name(),
+		"ignore_case":       e.IgnoreCase,
+		"expected_attempts": e.Attempts,
+		"bits":              math.Log2(e.Attempts),
+		"rate_per_second":   nil,
+		"eta_seconds":       nil,
+	}
+	if rate := measuredRate(); rate > 0 {
+		resp["rate_per_second"] = rate
+		resp["eta_seconds"] = e.Attempts / rate
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// difficultyCost is the expected effort of one estimate at a rate.
+// EtaSeconds and Cost are null without a rate or CPU_PRICE_PER_HOUR.
+type difficultyCost struct {
+	ExpectedAttempts float64  `json:"expected_attempts"`
+	Bits             float64  `json:"bits"`
+	EtaSeconds       *float64 `json:"eta_seconds"`
+	Cost             *float64 `json:"cost"`
+}
+
+// difficultyRow is one length of the GET /v1/difficulty table.
+type difficultyRow struct {
+	Length        int            `json:"length"`
+	CaseSensitive difficultyCost `json:"case_sensitive"`
+	IgnoreCase    difficultyCost `json:"ignore_case"`
+}
+
+// difficultyRate is the grinding rate difficulty estimates use: the
+// measured one while this instance grinds, else CALIBRATED_RATE, reported
+// with its source; 0 and "" when there is neither.
+func (s *server) difficultyRate() (float64, string) {
+	if rate := measuredRate(); rate > 0 {
+		return rate, "measured"
+	}
+	if s.calibratedRate > 0 {
+		return s.calibratedRate, "calibration"
+	}
+	return 0, ""
+}
+
+func (s *server) difficultyCost(attempts, rate float64) difficultyCost {
+	c := difficultyCost{ExpectedAttempts: attempts, Bits: math.Log2(attempts)}
+	if rate > 0 {
+		eta := attempts / rate
+		c.EtaSeconds = &eta
+		if s.cpuPricePerHour > 0 {
+			cost := eta / 3600 * s.cpuPricePerHour
+			c.Cost = &cost
+		}
+	}
+	return c
+}
+
+// difficultyTableText stands in for a pattern of each table length: "2"
+// has no other case and no leading-zero meaning, and ignore_case rows
+// apply the alphabet's average case speedup per character instead.
+const difficultyTableText = "2"
+
+// caseSpeedup is how many times more likely a random alphabet character is
+// to match when case is ignored, on average.
+func caseSpeedup() float64 {
+	var variants int
+	for _, c := range keygen.Alphabet {
+		variants++
+		other := unicode.ToUpper(c)
+		if other == c {
+			other = unicode.ToLower(c)
+		}
+		if other != c && strings.ContainsRune(keygen.Alphabet, other) {
+			variants++
+		}
+	}
+	return float64(variants) / float64(len(keygen.Alphabet))
+}
+
+// handleDifficulty serves GET /v1/difficulty: a table of expected attempts,
+// time at the instance's rate (see difficultyRate) and cost at
+// CPU_PRICE_PER_HOUR for 1–8 character patterns in ?mode= (as for
+// /v1/estimate), with and without case, plus the same for ?pattern= when
+// given.
+func (s *server) handleDifficulty(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode, distance, addrLen := q.Get("mode"), q.Get("distance"), s.agents.config.AddressLength
+	rate, source := s.difficultyRate()
+
+	var table []difficultyRow
+	speedup := caseSpeedup()
+	// A prefix's difficulty depends on its first character (see
+	// prefixFraction); averaged over them it is a suffix's
+	tableMode := mode
+	if mode == "prefix" {
+		tableMode = "suffix"
+	}
+	for n := 1; n <= 8; n++ {
+		e, estErr := estimatePattern(tableMode, strings.Repeat(difficultyTableText, n), distance, false, addrLen)
+		if estErr != nil {
+			if estErr.Code == "invalid_distance" {
+				// Lengths the edit distance would cover entirely
+				continue
+			}
+			writeEstimateError(w, estErr)
+			return
+		}
+		table = append(table, difficultyRow{
+			Length:        n,
+			CaseSensitive: s.difficultyCost(e.Attempts, rate),
+			IgnoreCase:    s.difficultyCost(e.Attempts/math.Pow(speedup, float64(n)), rate),
+		})
+	}
+
+	resp := map[string]any{
+		"mode":               cmp.Or(mode, "suffix"),
+		"rate_per_second":    nil,
+		"rate_source":        nil,
+		"cpu_price_per_hour": nil,
+		"table":              table,
+	}
+	if rate > 0 {
+		resp["rate_per_second"], resp["rate_source"] = rate, source
+	}
+	if s.cpuPricePerHour > 0 {
+		resp["cpu_price_per_hour"] = s.cpuPricePerHour
+	}
+	if value := q.Get("pattern"); value != "" {
+		e, estErr := estimatePattern(mode, value, distance, q.Get("ignore_case") == "true", addrLen)
+		if estErr != nil {
+			writeEstimateError(w, estErr)
+			return
+		}
+		if restrict := tokenFromContext(r.Context()).Restrict; !s.allowsPattern(restrict, e.Pattern.Name()) {
+			writeRestricted(w, restrict)
+			return
+		}
+		resp["pattern"] = map[string]any{
+			"value":       e.Value,
+			"name":        e.Pattern.Name(),
+			"ignore_case": e.IgnoreCase,
+			"estimate":    s.difficultyCost(e.Attempts, rate),
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFillFeasibility(t *testing.T) {
+	day := 24 * time.Hour
+	for _, tc := range []struct {
+		name      string
+		keys      int64
+		attempts  float64
+		rate      float64
+		wantETA   time.Duration
+		reachable int64
+		ok        bool
+	}{
+		{"within the limit", 100, 1000, 1000, 100 * time.Second, 86400, true},
+		{"exactly the limit", 86400, 1000, 1000, day, 86400, true},
+		{"past the limit", 10_000_000, 1e6, 1e6, 10_000_000 * time.Second, 86400, false},
+		{"unknown rate", 10_000_000, 1e6, 0, 0, 10_000_000, true},
+		{"unknown difficulty", 10_000_000, 0, 1e6, 0, 10_000_000, true},
+		{"impossible pattern", 10, math.Inf(1), 1e6, 0, 10, true},
+		{"nothing to grind", 0, 1e6, 1e6, 0, 0, true},
+		{"eta beyond a Duration", 100_000_000, 1e18, 1, time.Duration(math.MaxInt64), 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eta, reachable, ok := fillFeasibility(tc.keys, tc.attempts, tc.rate, day)
+			if eta != tc.wantETA || reachable != tc.reachable || ok != tc.ok {
+				t.Fatalf("fillFeasibility(%d, %g, %g) = %v, %d, %v; want %v, %d, %v",
+					tc.keys, tc.attempts, tc.rate, eta, reachable, ok, tc.wantETA, tc.reachable, tc.ok)
+			}
+		})
+	}
+}
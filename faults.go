@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Fault kinds an operator can inject with UNSAFE_FAULT_INJECTION=true.
+const (
+	faultStorageError   = "storage_error"    // statements fail with errFaultInjected
+	faultStorageLatency = "storage_latency"  // statements are delayed by Latency
+	faultSlowPick       = "slow_pick"        // POST /v1/pick waits Latency first
+	faultPauseGen       = "pause_generation" // the fill loop does not generate
+)
+
+var faultKinds = []string{faultStorageError, faultStorageLatency, faultSlowPick, faultPauseGen}
+
+// maxFaultTTL caps how long an injected fault lasts, so one cannot be
+// forgotten in place.
+const maxFaultTTL = time.Hour
+
+var errFaultInjected = errors.New("injected fault (UNSAFE_FAULT_INJECTION)")
+
+// fault is one active injection. It fires with Probability on each
+// opportunity until Until.
+type fault struct {
+	Kind        string        `json:"kind"`
+	Probability float64       `json:"probability"`
+	Latency     time.Duration `json:"latency,omitempty"`
+	Until       time.Time     `json:"until"`
+	Actor       string        `json:"actor"`
+}
+
+// faultInjector holds the active faults. A nil injector never fires, which
+// is what every instance without UNSAFE_FAULT_INJECTION gets.
+type faultInjector struct {
+	mu     sync.Mutex
+	faults map[string]fault
+}
+
+func newFaultInjector() *faultInjector {
+	log.Println("WARNING: UNSAFE_FAULT_INJECTION is enabled; admins can make this instance fail on purpose")
+	return &faultInjector{faults: map[string]fault{}}
+}
+
+// fires reports whether the fault of kind is active and fires this time,
+// and its latency.
+func (fi *faultInjector) fires(kind string) (bool, time.Duration) {
+	if fi == nil {
+		return false, 0
+	}
+	fi.mu.Lock()
+	f, ok := fi.faults[kind]
+	fi.mu.Unlock()
+	if !ok || clock.Now().After(f.Until) || rand.Float64() >= f.Probability {
+		return false, 0
+	}
+	faultsInjectedTotal.WithLabelValues(kind).Inc()
+	return true, f.Latency
+}
+
+// delay sleeps for the fault's latency if it fires, or until ctx is done.
+func (fi *faultInjector) delay(ctx context.Context, kind string) {
+	if ok, d := fi.fires(kind); ok {
+		log.Printf("FAULT INJECTED kind=%s latency=%v\n", kind, d)
+		select {
+		case <-ctx.Done():
+		case <-clock.After(d):
+		}
+	}
+}
+
+// Paused reports whether generation is paused by an injected fault.
+func (fi *faultInjector) Paused() bool {
+	ok, _ := fi.fires(faultPauseGen)
+	return ok
+}
+
+func (fi *faultInjector) set(f fault) {
+	fi.mu.Lock()
+	fi.faults[f.Kind] = f
+	fi.mu.Unlock()
+	faultActive.WithLabelValues(f.Kind).Set(1)
+	log.Printf("FAULT INJECTION ON kind=%s probability=%.2f latency=%v until=%s by %s\n",
+		f.Kind, f.Probability, f.Latency, f.Until.Format(time.RFC3339), f.Actor)
+}
+
+// clear removes the fault of kind, or every fault if kind is empty.
+func (fi *faultInjector) clear(kind, actor string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for k := range fi.faults {
+		if kind == "" || k == kind {
+			delete(fi.faults, k)
+			faultActive.WithLabelValues(k).Set(0)
+			log.Printf("FAULT INJECTION OFF kind=%s by %s\n", k, actor)
+		}
+	}
+}
+
+func (fi *faultInjector) list() []fault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	out := make([]fault, 0, len(fi.faults))
+	for _, f := range fi.faults {
+		out = append(out, f)
+	}
+	return out
+}
+
+// Run expires faults whose TTL has passed until ctx is done.
+func (fi *faultInjector) Run(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			var expired []string
+			fi.mu.Lock()
+			for k, f := range fi.faults {
+				if now.After(f.Until) {
+					expired = append(expired, k)
+				}
+			}
+			fi.mu.Unlock()
+			for _, k := range expired {
+				fi.clear(k, "ttl")
+			}
+		}
+	}
+}
+
+// instrument registers GORM callbacks so every statement on db can be
+// delayed or failed by the storage faults.
+func (fi *faultInjector) instrument(db *gorm.DB) error {
+	hook := func(tx *gorm.DB) {
+		fi.delay(tx.Statement.Context, faultStorageLatency)
+		if ok, _ := fi.fires(faultStorageError); ok {
+			log.Printf("FAULT INJECTED kind=%s table=%s\n", faultStorageError, tx.Statement.Table)
+			tx.AddError(errFaultInjected)
+		}
+	}
+	cb := db.Callback()
+	for name, err := range map[string]error{
+		"create": cb.Create().Before("gorm:create").Register("fault:create", hook),
+		"query":  cb.Query().Before("gorm:query").Register("fault:query", hook),
+		"update": cb.Update().Before("gorm:update").Register("fault:update", hook),
+		"delete": cb.Delete().Before("gorm:delete").Register("fault:delete", hook),
+		"row":    cb.Row().Before("gorm:row").Register("fault:row", hook),
+		"raw":    cb.Raw().Before("gorm:raw").Register("fault:raw", hook),
+	} {
+		if err != nil {
+			return fmt.Errorf("register %s fault callback: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *server) handleFaultList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"faults": s.faults.list(), "kinds": faultKinds})
+}
+
+// handleFaultSet injects a fault. ttl is required and at most maxFaultTTL.
+func (s *server) handleFaultSet(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Kind        string  `json:"kind"`
+		Probability float64 `json:"probability"`
+		Latency     string  `json:"latency"`
+		TTL         string  `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "request body must be JSON", nil)
+		return
+	}
+	known := false
+	for _, k := range faultKinds {
+		known = known || k == req.Kind
+	}
+	if !known {
+		writeError(w, http.StatusBadRequest, "invalid_kind", "unknown fault kind", map[string]any{"kinds": faultKinds})
+		return
+	}
+	if req.Probability <= 0 || req.Probability > 1 {
+		writeError(w, http.StatusBadRequest, "invalid_probability", "probability must be in (0, 1]", nil)
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 || ttl > maxFaultTTL {
+		writeError(w, http.StatusBadRequest, "invalid_ttl", "ttl must be a duration up to "+maxFaultTTL.String(), nil)
+		return
+	}
+	var latency time.Duration
+	if req.Kind == faultStorageLatency || req.Kind == faultSlowPick {
+		if latency, err = time.ParseDuration(req.Latency); err != nil || latency <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid_latency", "latency must be a positive duration for "+req.Kind, nil)
+			return
+		}
+	}
+
+	f := fault{Kind: req.Kind, Probability: req.Probability, Latency: latency,
+		Until: clock.Now().Add(ttl), Actor: tokenFromContext(r.Context()).Name}
+	s.faults.set(f)
+	audit(r.Context(), "fault_inject", fmt.Sprintf("kind=%s probability=%.2f latency=%v ttl=%v", f.Kind, f.Probability, f.Latency, ttl))
+	writeJSON(w, http.StatusOK, f)
+}
+
+// handleFaultClear removes the fault named by ?kind=, or all of them.
+func (s *server) handleFaultClear(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	s.faults.clear(kind, tokenFromContext(r.Context()).Name)
+	audit(r.Context(), "fault_clear", "kind="+kind)
+	writeJSON(w, http.StatusOK, map[string]any{"faults": s.faults.list()})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// freezeFlagName is the app_flag row that stops all key issuance when set.
+const freezeFlagName = "freeze"
+
+// freezePollInterval is how quickly replicas notice a freeze set elsewhere.
+const freezePollInterval = 5 * time.Second
+
+// AppFlag is a switch shared by every replica through the database.
+type AppFlag struct {
+	Name      string    `gorm:"primaryKey;column:name"`
+	Enabled   bool      `gorm:"column:enabled"`
+	Actor     string    `gorm:"column:actor"`
+	Reason    string    `gorm:"column:reason"`
+	UpdatedAt time.Time `gorm:"column:updated_at;autoUpdateTime"`
+}
+
+func (AppFlag) TableName() string { return "app_flag" }
+
+// Flag returns the named flag, or a disabled one if it was never set.
+func (s *gormStore) Flag(ctx context.Context, name string) (AppFlag, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var flags []AppFlag
+	err := db.Where("name = ?", name).Limit(1).Find(&flags).Error
+	if err != nil || len(flags) == 0 {
+		return AppFlag{Name: name}, ctxError(ctx, "read flag", err)
+	}
+	return flags[0], nil
+}
+
+func (s *gormStore) SetFlag(ctx context.Context, f AppFlag) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&f).Error
+	return ctxError(ctx, "set flag", err)
+}
+
+// freezeSwitch caches the shared freeze flag so issuance paths can check it
+// without a query each time.
+type freezeSwitch struct {
+	store  *gormStore
+	frozen atomic.Bool
+}
+
+func newFreezeSwitch(ctx context.Context, store *gormStore) (*freezeSwitch, error) {
+	f := &freezeSwitch{store: store}
+	return f, f.refresh(ctx)
+}
+
+func (f *freezeSwitch) Frozen() bool { return f.frozen.Load() }
+
+func (f *freezeSwitch) refresh(ctx context.Context) error {
+	flag, err := f.store.Flag(ctx, freezeFlagName)
+	if err != nil {
+		return err
+	}
+	if was := f.frozen.Swap(flag.Enabled); was != flag.Enabled {
+		log.Printf("Key issuance frozen=%v by %s (reason %q)\n", flag.Enabled, flag.Actor, flag.Reason)
+	}
+	return nil
+}
+
+// Run polls the flag until ctx is cancelled. On errors the last known state
+// is kept.
+func (f *freezeSwitch) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(freezePollInterval):
+		}
+		if err := f.refresh(ctx); err != nil {
+			log.Println("Error reading freeze flag:", err)
+		}
+	}
+}
+
+func (f *freezeSwitch) set(ctx context.Context, frozen bool, actor, reason string) error {
+	err := f.store.SetFlag(ctx, AppFlag{Name: freezeFlagName, Enabled: frozen, Actor: actor, Reason: reason})
+	if err != nil {
+		return err
+	}
+	f.frozen.Store(frozen)
+	return nil
+}
+
+// unfrozen rejects the request with 423 Locked while issuance is frozen.
+func (s *server) unfrozen(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.freeze.Frozen() {
+			writeError(w, http.StatusLocked, "frozen", "key issuance is frozen by an administrator", nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) handleFreezeStatus(w http.ResponseWriter, r *http.Request) {
+	flag, err := s.store.Flag(r.Context(), freezeFlagName)
+	if err != nil {
+		log.Println("Error reading freeze flag:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read freeze flag", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"frozen":     flag.Enabled,
+		"actor":      flag.Actor,
+		"reason":     flag.Reason,
+		"updated_at": flag.UpdatedAt,
+	})
+}
+
+// handleFreeze returns a handler that sets the freeze flag to frozen.
+func (s *server) handleFreeze(frozen bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_body", "request body must be JSON", nil)
+				return
+			}
+		}
+
+		actor := tokenFromContext(r.Context()).Name
+		if err := s.freeze.set(r.Context(), frozen, actor, req.Reason); err != nil {
+			log.Println("Error setting freeze flag:", err)
+			writeError(w, http.StatusInternalServerError, "internal", "failed to set freeze flag", nil)
+			return
+		}
+		action := "unfreeze"
+		if frozen {
+			action = "freeze"
+		}
+		audit(r.Context(), action, "reason="+strconv.Quote(req.Reason))
+		writeJSON(w, http.StatusOK, map[string]any{"frozen": frozen})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readFreshness gives admins read-your-writes over the read replica. For
+// window after an admin mutation every read goes to the primary, so the
+// stats and listings an admin checks straight after quarantining keys or
+// finishing an import show the change instead of a replica still replaying
+// it. It also judges whether what the replica serves is stale.
+type readFreshness struct {
+	// window (READ_YOUR_WRITES_WINDOW) is how long reads stay on the
+	// primary after a mutation.
+	window time.Duration
+	// tolerance (READ_STALE_AFTER) is how far the replica may trail before
+	// what it serves is reported stale.
+	tolerance time.Duration
+
+	mu    sync.Mutex
+	wrote time.Time
+}
+
+// Wrote records an admin mutation that has just committed.
+func (f *readFreshness) Wrote() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.wrote = clock.Now()
+	f.mu.Unlock()
+}
+
+// primary reports whether reads should skip the replica now.
+func (f *readFreshness) primary() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.wrote.IsZero() && clock.Now().Before(f.wrote.Add(f.window))
+}
+
+// stale reports whether replica data current as of asOf may miss the last
+// admin mutation or trails by more than the tolerance.
+func (f *readFreshness) stale(asOf time.Time) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return asOf.Before(f.wrote) || clock.Now().Sub(asOf) > f.tolerance
+}
+
+type readsCtxKey struct{}
+
+// pinReads fixes where reads under the returned context go, so a response
+// built from several queries reads them all from one place even if the
+// read-your-writes window ends part way.
+func (s *gormStore) pinReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readsCtxKey{}, s.readsPrimary(ctx))
+}
+
+// readsPrimary reports whether readSession uses the primary under ctx.
+func (s *gormStore) readsPrimary(ctx context.Context) bool {
+	if pinned, ok := ctx.Value(readsCtxKey{}).(bool); ok {
+		return pinned
+	}
+	return s.read == nil || s.fresh.primary()
+}
+
+// replicaAsOf is when the data on a replica was current: now if it has
+// replayed everything it received, else its last replayed commit. A
+// replica that is not in recovery is as current as a primary. It cannot see
+// WAL not yet received, so it underestimates lag on a slow link.
+const replicaAsOf = `SELECT COALESCE(CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn()
+	THEN now() ELSE pg_last_xact_replay_timestamp() END, now())`
+
+// DataAsOf reports when the data reads under ctx see was current, and
+// whether it is stale. Reads on the primary are current.
+func (s *gormStore) DataAsOf(ctx context.Context) (time.Time, bool, error) {
+	if s.readsPrimary(ctx) {
+		return clock.Now(), false, nil
+	}
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Count)
+	defer cancel()
+
+	var asOf time.Time
+	if err := db.Raw(replicaAsOf).Row().Scan(&asOf); err != nil {
+		return time.Time{}, false, ctxError(ctx, "replica freshness", err)
+	}
+	return asOf, s.fresh.stale(asOf), nil
+}
+
+// mutates marks an admin mutation once next has handled it, so reads in
+// the following window go to the primary.
+func (s *server) mutates(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r)
+		s.store.fresh.Wrote()
+	}
+}
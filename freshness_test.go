@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// replicaStore is a gormStore with a replica whose reads can be told apart
+// from the primary's. Neither connects.
+func replicaStore(t *testing.T, window, tolerance time.Duration) *gormStore {
+	t.Helper()
+	s := newGormStore(dryRunDB(t), dbTimeouts{}, nil)
+	s.read = dryRunDB(t)
+	s.fresh = &readFreshness{window: window, tolerance: tolerance}
+	return s
+}
+
+// readsFrom names the database readSession uses under ctx.
+func readsFrom(s *gormStore, ctx context.Context) string {
+	db, _, cancel := s.readSession(ctx, 0)
+	defer cancel()
+	if db.Statement.ConnPool == s.db.Statement.ConnPool {
+		return "primary"
+	}
+	return "replica"
+}
+
+func TestReadYourWrites(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := replicaStore(t, 30*time.Second, 10*time.Second)
+	ctx := context.Background()
+
+	if got := readsFrom(s, ctx); got != "replica" {
+		t.Fatalf("reads before any mutation go to the %s", got)
+	}
+	s.fresh.Wrote()
+	if got := readsFrom(s, ctx); got != "primary" {
+		t.Fatalf("reads straight after a mutation go to the %s", got)
+	}
+	asOf, stale, err := s.DataAsOf(ctx)
+	if err != nil || stale || !asOf.Equal(c.Now()) {
+		t.Fatalf("DataAsOf on the primary = %v, %v, %v; want now, fresh", asOf, stale, err)
+	}
+
+	// A response started in the window keeps reading the primary past it
+	pinned := s.pinReads(ctx)
+	c.Advance(31 * time.Second)
+	if got := readsFrom(s, ctx); got != "replica" {
+		t.Fatalf("reads after the window go to the %s", got)
+	}
+	if got := readsFrom(s, pinned); got != "primary" {
+		t.Fatalf("pinned reads moved to the %s when the window ended", got)
+	}
+	if got := readsFrom(s, s.pinReads(ctx)); got != "replica" {
+		t.Fatalf("reads pinned after the window go to the %s", got)
+	}
+
+	s.read = nil
+	s.fresh.Wrote()
+	c.Advance(time.Hour)
+	if got := readsFrom(s, ctx); got != "primary" {
+		t.Fatalf("without a replica reads go to the %s", got)
+	}
+}
+
+// TestReplicaStaleness simulates a replica trailing the primary by lag and
+// checks when what it serves is reported stale.
+func TestReplicaStaleness(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	f := &readFreshness{window: 5 * time.Second, tolerance: 10 * time.Second}
+	replayed := func(lag time.Duration) time.Time { return c.Now().Add(-lag) }
+
+	if f.stale(replayed(2 * time.Second)) {
+		t.Error("a replica within the tolerance is stale before any mutation")
+	}
+	if !f.stale(replayed(11 * time.Second)) {
+		t.Error("a replica past the tolerance is not stale")
+	}
+
+	f.Wrote()
+	c.Advance(6 * time.Second)
+	// The window is over, but a replica 8s behind has not replayed the
+	// mutation made 6s ago
+	if !f.stale(replayed(8 * time.Second)) {
+		t.Error("a replica missing the last mutation is not stale")
+	}
+	if f.stale(replayed(4 * time.Second)) {
+		t.Error("a replica that has replayed the last mutation is stale")
+	}
+	if f.stale(replayed(0)) {
+		t.Error("a caught-up replica is stale")
+	}
+
+	var off *readFreshness
+	off.Wrote()
+	if off.primary() || off.stale(time.Time{}) {
+		t.Error("a nil readFreshness should route nothing to the primary and judge nothing stale")
+	}
+}
+
+// TestReadWriteRouting runs store statements against a primary and a
+// replica and checks counts, stats and listings read from the replica
+// while writes, and reads straight after a mutation, use the primary.
+func TestReadWriteRouting(t *testing.T) {
+	useFakeClock(t, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := replicaStore(t, 30*time.Second, 10*time.Second)
+	var ran []string
+	for name, db := range map[string]*gorm.DB{"primary": s.db, "replica": s.read} {
+		record := func(*gorm.DB) { ran = append(ran, name) }
+		cb := db.Callback()
+		cb.Create().Before("gorm:create").Register("test:route", record)
+		cb.Query().Before("gorm:query").Register("test:route", record)
+		cb.Update().Before("gorm:update").Register("test:route", record)
+		cb.Row().Before("gorm:row").Register("test:route", record)
+		cb.Raw().Before("gorm:raw").Register("test:route", record)
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name string
+		run  func() error
+		want string
+	}{
+		{"count", func() error { _, err := s.CountUnpicked(ctx, "ab"); return err }, "replica"},
+		{"list", func() error { _, _, err := s.List(ctx, listQuery{Limit: 10}); return err }, "replica"},
+		{"similar keys", func() error { _, err := s.SimilarKeys(ctx, testPub("k1")); return err }, "replica"},
+		{"campaign counts", func() error { _, err := s.CampaignCounts(ctx); return err }, "replica"},
+		{"discard counts", func() error { _, err := s.DiscardCounts(ctx, time.Time{}); return err }, "replica"},
+		{"scanner states", func() error { _, err := s.ScanStates(ctx); return err }, "replica"},
+		{"quarantine", func() error { _, err := s.Quarantine(ctx, testPub("k1")); return err }, "primary"},
+		{"count after a mutation", func() error { s.fresh.Wrote(); _, err := s.CountUnpicked(ctx, "ab"); return err }, "primary"},
+	} {
+		ran = nil
+		// Statements read back with Scan cannot dry run, but have been routed
+		if err := tc.run(); err != nil && !errors.Is(err, gorm.ErrDryRunModeUnsupported) {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(ran) == 0 {
+			t.Fatalf("%s ran no statement", tc.name)
+		}
+		for _, db := range ran {
+			if db != tc.want {
+				t.Errorf("%s ran statements on %v, want only the %s", tc.name, ran, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMutatesMarksAfterHandling(t *testing.T) {
+	useFakeClock(t, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := &server{store: replicaStore(t, 30*time.Second, 10*time.Second)}
+	var during string
+	h := s.mutates(func(w http.ResponseWriter, r *http.Request) {
+		during = readsFrom(s.store, r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/keys/quarantine", nil))
+	if during != "replica" {
+		t.Errorf("the mutation itself read from the %s", during)
+	}
+	if got := readsFrom(s.store, context.Background()); got != "primary" {
+		t.Errorf("reads after the mutation go to the %s", got)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fill loop states reported by GET /v1/stats.
+const (
+	loopCounting = "counting"
+	loopGrinding = "grinding"
+	loopWaiting  = "waiting_for_workers"
+	loopSleeping = "sleeping"
+	loopPaused   = "paused"
+)
+
+// fillGovernor shares the WORKERS budget between fill loops. With
+// FILL_LOOPS=per_pattern each pattern has its own loop, and a loop about to
+// grind takes an equal share of the budget among the loops grinding. A loop
+// left waiting preempts any loop holding more than its share, which then
+// regrinds with fewer workers; grinding is memoryless, so nothing is lost.
+// An expensive pattern thus cannot starve an easy one, and the loops
+// together never run more than budget workers. Likewise, when a loop goes
+// to sleep, loops grinding below their new share are restarted with more.
+// Loops sized with WORKERS_PER_PATTERN have a dedicated pool of that many
+// workers instead, outside the budget. GEN_DUTY_CYCLE applies to every
+// worker, so the CPU limit holds across loops too; every loop inserts
+// through the same store and shared writePacer.
+type fillGovernor struct {
+	budget int
+
+	mu    sync.Mutex
+	inUse int
+	wake  chan struct{}
+	loops []*fillLoop
+}
+
+func newFillGovernor(budget int) *fillGovernor {
+	return &fillGovernor{budget: max(1, budget), wake: make(chan struct{})}
+}
+
+// sharedLoopName is the fill loop serving every pattern without a loop
+// of its own.
+const sharedLoopName = "all"
+
+// fillLoop is one fill loop's handle on the governor. A nil loop is
+// ungoverned and reports nothing.
+type fillLoop struct {
+	gov   *fillGovernor
+	name  string
+	fixed int // dedicated pool size, 0 = share the budget
+
+	// guarded by gov.mu
+	state   string
+	since   time.Time
+	want    int
+	workers int
+	preempt context.CancelFunc
+}
+
+// Loop registers a fill loop named name, with a dedicated pool of fixed
+// workers or, if fixed is 0, a share of the budget.
+func (g *fillGovernor) Loop(name string, fixed int) *fillLoop {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l := &fillLoop{gov: g, name: name, fixed: fixed, state: loopCounting, since: clock.Now()}
+	g.loops = append(g.loops, l)
+	return l
+}
+
+// Set records the loop's state.
+func (l *fillLoop) Set(state string) {
+	if l == nil {
+		return
+	}
+	l.gov.mu.Lock()
+	defer l.gov.mu.Unlock()
+	if state != l.state {
+		l.set(state)
+		l.gov.rebalance()
+	}
+}
+
+// set must be called with gov.mu held. The time spent in the state left
+// is added to keygen_fill_loop_seconds_total.
+func (l *fillLoop) set(state string) {
+	if l.state != state {
+		now := clock.Now()
+		fillLoopSecondsTotal.WithLabelValues(l.name, l.state).Add(now.Sub(l.since).Seconds())
+		l.state, l.since = state, now
+	}
+}
+
+// share is each contending loop's share of the budget: loops not sleeping
+// or paused are about to grind or grinding. It must be called with g.mu
+// held.
+func (g *fillGovernor) share() int {
+	n := 0
+	for _, l := range g.loops {
+		if l.fixed == 0 && l.state != loopSleeping && l.state != loopPaused {
+			n++
+		}
+	}
+	return max(1, g.budget/max(1, n))
+}
+
+// rebalance preempts grinding loops holding more than their share while
+// another waits, and ones holding less than they could get now. It must be
+// called with g.mu held.
+func (g *fillGovernor) rebalance() {
+	share := g.share()
+	waiting := false
+	for _, l := range g.loops {
+		waiting = waiting || l.state == loopWaiting
+	}
+	for _, l := range g.loops {
+		if l.fixed > 0 || l.state != loopGrinding {
+			continue
+		}
+		better := min(l.want, share, g.budget-g.inUse+l.workers)
+		if (waiting && l.workers > share) || (!waiting && l.workers < better) {
+			l.preempt()
+		}
+	}
+}
+
+// Acquire blocks until the loop may grind, returning how many of want
+// workers it may run and a context to grind under, cancelled if the loop is
+// preempted. Every Acquire must be followed by a Release.
+func (l *fillLoop) Acquire(ctx context.Context, want int) (int, context.Context, error) {
+	if l == nil {
+		return want, ctx, nil
+	}
+	g := l.gov
+	g.mu.Lock()
+	if l.fixed > 0 {
+		l.workers = l.fixed
+		l.set(loopGrinding)
+		grindCtx, cancel := context.WithCancel(ctx)
+		l.preempt = cancel
+		g.mu.Unlock()
+		return l.fixed, grindCtx, nil
+	}
+	l.set(loopWaiting)
+	l.want = want
+	for {
+		if n := min(want, g.share(), g.budget-g.inUse); n >= 1 {
+			g.inUse += n
+			l.workers = n
+			l.set(loopGrinding)
+			grindCtx, cancel := context.WithCancel(ctx)
+			l.preempt = cancel
+			g.mu.Unlock()
+			return n, grindCtx, nil
+		}
+		g.rebalance()
+		wake := g.wake
+		g.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			l.Set(loopCounting)
+			return 0, nil, ctx.Err()
+		case <-wake:
+		}
+		g.mu.Lock()
+	}
+}
+
+// Release returns the loop's workers to the budget; the loop goes back to
+// counting.
+func (l *fillLoop) Release() {
+	if l == nil {
+		return
+	}
+	g := l.gov
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l.preempt()
+	if l.fixed == 0 {
+		g.inUse -= l.workers
+	}
+	l.workers = 0
+	l.set(loopCounting)
+	g.rebalance()
+	close(g.wake)
+	g.wake = make(chan struct{})
+}
+
+// parseWorkersPerPattern parses WORKERS_PER_PATTERN entries of the form
+// "pattern=workers".
+func parseWorkersPerPattern(spec string, patterns []pattern) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("want pattern=workers in %q", entry)
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("workers in %q must be a positive integer", entry)
+		}
+		found := false
+		for _, p := range patterns {
+			found = found || p.Name() == name
+		}
+		if !found {
+			return nil, fmt.Errorf("workers for unknown pattern %q", name)
+		}
+		out[name] = n
+	}
+	return out, nil
+}
+
+// fillLoopStatus is one loop's entry in GET /v1/stats.
+type fillLoopStatus struct {
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	Since   time.Time `json:"since"`
+	Workers int       `json:"workers"`
+	// Dedicated is the WORKERS_PER_PATTERN pool size, 0 when sharing WORKERS.
+	Dedicated int `json:"dedicated_workers"`
+}
+
+// Status lists the loops' states. A nil governor has none.
+func (g *fillGovernor) Status() []fillLoopStatus {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]fillLoopStatus, len(g.loops))
+	for i, l := range g.loops {
+		out[i] = fillLoopStatus{Name: l.name, State: l.state, Since: l.since.UTC(), Workers: l.workers, Dedicated: l.fixed}
+	}
+	return out
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestFillLoopStateSeconds moves a fill loop through its states on a fake
+// clock and checks each state's time is counted when it ends.
+func TestFillLoopStateSeconds(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	l := newFillGovernor(2).Loop("state-seconds", 0)
+	seconds := func(state string) float64 {
+		return testutil.ToFloat64(fillLoopSecondsTotal.WithLabelValues("state-seconds", state))
+	}
+	before := map[string]float64{}
+	for _, s := range []string{loopCounting, loopGrinding, loopSleeping} {
+		before[s] = seconds(s)
+	}
+
+	for _, step := range []struct {
+		wait time.Duration
+		next string
+	}{
+		{2 * time.Second, loopGrinding},
+		{40 * time.Second, loopCounting},
+		{time.Second, loopSleeping},
+		{5 * time.Minute, loopCounting},
+		// Setting the current state again ends nothing
+		{time.Second, loopCounting},
+	} {
+		c.Advance(step.wait)
+		l.Set(step.next)
+	}
+	for state, want := range map[string]float64{loopCounting: 3, loopGrinding: 40, loopSleeping: 300} {
+		if got := seconds(state) - before[state]; got != want {
+			t.Errorf("counted %vs %s, want %vs", got, state, want)
+		}
+	}
+}
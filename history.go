@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PoolHistory is one pool-depth sample: the unpicked count of a pattern at
+// SampledAt and how many of its keys were picked since the previous sample.
+// Resolution "raw" rows are written by the fill loop; "hour" rows are
+// rollups of them made by the history retention job.
+type PoolHistory struct {
+	ID          uint      `gorm:"primaryKey" json:"-"`
+	SampledAt   time.Time `gorm:"column:sampled_at;not null;uniqueIndex:idx_pool_history_sample" json:"sampled_at"`
+	Pattern     string    `gorm:"column:pattern;not null;uniqueIndex:idx_pool_history_sample" json:"pattern"`
+	Resolution  string    `gorm:"column:resolution;not null;default:raw;uniqueIndex:idx_pool_history_sample" json:"resolution"`
+	Unpicked    int64     `gorm:"column:unpicked;not null" json:"unpicked"`
+	PickedDelta int64     `gorm:"column:picked_delta;not null" json:"picked_delta"`
+}
+
+func (PoolHistory) TableName() string { return "pool_history" }
+
+// historyRecorder writes a raw PoolHistory sample per pattern each fill
+// cycle. Picked deltas are against the picked counts it saw last, so the
+// first sample after a restart reports a delta of 0.
+type historyRecorder struct {
+	store *gormStore
+
+	mu         sync.Mutex
+	lastPicked map[string]int64
+}
+
+func newHistoryRecorder(store *gormStore) *historyRecorder {
+	return &historyRecorder{store: store}
+}
+
+// Record samples the unpicked counts the fill loop just took. A nil
+// recorder records nothing.
+func (h *historyRecorder) Record(ctx context.Context, unpicked map[string]int64) {
+	if h == nil {
+		return
+	}
+	picked, err := h.store.PickedCounts(ctx)
+	if err != nil {
+		log.Println("Error sampling pool history:", err)
+		return
+	}
+
+	h.mu.Lock()
+	now := clock.Now().UTC()
+	rows := make([]PoolHistory, 0, len(unpicked))
+	for pattern, n := range unpicked {
+		var delta int64
+		if prev, ok := h.lastPicked[pattern]; ok {
+			delta = max(0, picked[pattern]-prev)
+		}
+		rows = append(rows, PoolHistory{SampledAt: now, Pattern: pattern, Resolution: "raw", Unpicked: n, PickedDelta: delta})
+	}
+	// Per-pattern fill loops each sample only their own pattern
+	if h.lastPicked == nil {
+		h.lastPicked = map[string]int64{}
+	}
+	for pattern := range unpicked {
+		h.lastPicked[pattern] = picked[pattern]
+	}
+	h.mu.Unlock()
+
+	if err := h.store.AddHistory(ctx, rows); err != nil {
+		log.Println("Error writing pool history:", err)
+	}
+}
+
+// PickedCounts returns the number of picked keys per matched pattern,
+// leaving out quarantined keys and those migrated to another instance.
+func (s *gormStore) PickedCounts(ctx context.Context) (map[string]int64, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Count)
+	defer cancel()
+
+	var rows []struct {
+		MatchedPattern string
+		Count          int64
+	}
+	err := db.Model(&TokenKey{}).Select("matched_pattern, count(*) AS count").
+		Where("is_picked = true AND quarantined = false AND migrated_to IS NULL").
+		Group("matched_pattern").Scan(&rows).Error
+	if err != nil {
+		return nil, ctxError(ctx, "picked counts", err)
+	}
+	out := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		out[r.MatchedPattern] = r.Count
+	}
+	return out, nil
+}
+
+func (s *gormStore) AddHistory(ctx context.Context, rows []PoolHistory) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+	return ctxError(ctx, "add pool history", db.Create(&rows).Error)
+}
+
+// RollupHistory writes an hourly rollup for every completed hour of raw
+// samples that has none yet (average unpicked, summed picked deltas), then
+// deletes raw samples older than rawRetention and rollups older than
+// retention. Returns the number of rollups written and rows deleted.
+func (s *gormStore) RollupHistory(ctx context.Context, rawRetention, retention time.Duration) (rolled, deleted int64, err error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`INSERT INTO pool_history (sampled_at, pattern, resolution, unpicked, picked_delta)
+			SELECT date_trunc('hour', sampled_at), pattern, 'hour', round(avg(unpicked)), sum(picked_delta)
+			FROM pool_history
+			WHERE resolution = 'raw' AND sampled_at < date_trunc('hour', now())
+			GROUP BY 1, 2
+			ON CONFLICT DO NOTHING`)
+		if res.Error != nil {
+			return res.Error
+		}
+		rolled = res.RowsAffected
+
+		now := clock.Now().UTC()
+		res = tx.Where("(resolution = 'raw' AND sampled_at < ?) OR (resolution = 'hour' AND sampled_at < ?)",
+			now.Add(-rawRetention), now.Add(-retention)).Delete(&PoolHistory{})
+		deleted = res.RowsAffected
+		return res.Error
+	})
+	return rolled, deleted, ctxError(ctx, "roll up pool history", err)
+}
+
+// History returns one page of the samples of one resolution within the
+// page's range, for every pattern if it names none, and the cursor for the
+// next page, if any.
+func (s *gormStore) History(ctx context.Context, resolution string, page pageParams) ([]PoolHistory, string, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	tx := pageRange(db.Where("resolution = ?", resolution), "sampled_at", page.From, page.To)
+	if page.Pattern != "" {
+		tx = tx.Where("pattern = ?", page.Pattern)
+	}
+	if page.Patterns != nil {
+		// An empty list is IN (NULL), matching nothing
+		tx = tx.Where("pattern IN ?", page.Patterns)
+	}
+	tx, err := keysetPage(tx, "sampled_at", "id", page.Cursor, page.Desc, page.Limit, intID)
+	if err != nil {
+		return nil, "", err
+	}
+	var rows []PoolHistory
+	if err := tx.Find(&rows).Error; err != nil {
+		return nil, "", ctxError(ctx, "pool history", err)
+	}
+	next := ""
+	if len(rows) == page.Limit {
+		last := rows[len(rows)-1]
+		next = pageCursor{Key: last.SampledAt, ID: strconv.FormatUint(uint64(last.ID), 10), Desc: page.Desc}.String()
+	}
+	return rows, next, nil
+}
+
+// historyRetentionJob is the history_rollup job: it rolls up and prunes
+// pool history.
+func historyRetentionJob(store *gormStore, rawRetention, retention time.Duration) func(context.Context) error {
+	return func(ctx context.Context) error {
+		rolled, deleted, err := store.RollupHistory(ctx, rawRetention, retention)
+		if err == nil && (rolled > 0 || deleted > 0) {
+			log.Printf("Pool history: %d hourly rollups written, %d expired samples deleted\n", rolled, deleted)
+		}
+		return err
+	}
+}
+
+// handleHistory serves GET /v1/history, paged and filtered by the shared
+// list parameters. from defaults to a day ago and to to now; resolution
+// defaults to raw while from is within the raw retention and hour beyond
+// it. format=csv returns CSV instead of JSON, with the next page's cursor
+// in X-Next-Cursor. A restricted token sees only the patterns within its
+// restriction.
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	page, perr := parsePageParams(qs, pageLimits{Default: 10000, Max: 100000}, "pattern", "from", "to")
+	if perr != nil {
+		writeError(w, http.StatusBadRequest, perr.Code, perr.Message, nil)
+		return
+	}
+	now := clock.Now().UTC()
+	if page.From == nil {
+		from := now.Add(-24 * time.Hour)
+		page.From = &from
+	}
+	if page.To == nil {
+		page.To = &now
+	}
+	from := *page.From
+	if !page.To.After(from) {
+		writeError(w, http.StatusBadRequest, "invalid_range", "to must be after from", nil)
+		return
+	}
+	restrict := tokenFromContext(r.Context()).Restrict
+	if page.Pattern != "" && !s.allowsPattern(restrict, page.Pattern) {
+		writeRestricted(w, restrict)
+		return
+	}
+	page.Patterns = s.visiblePatterns(restrict)
+
+	resolution := qs.Get("resolution")
+	switch resolution {
+	case "":
+		resolution = "raw"
+		if from.Before(clock.Now().Add(-s.historyRawRetention)) {
+			resolution = "hour"
+		}
+	case "raw", "hour":
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_resolution", `resolution must be "raw" or "hour"`, nil)
+		return
+	}
+
+	rows, next, err := s.store.History(r.Context(), resolution, page)
+	if errors.Is(err, errInvalidCursor) {
+		writeError(w, http.StatusBadRequest, "invalid_cursor", err.Error(), nil)
+		return
+	}
+	if err != nil {
+		log.Println("Error reading pool history:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read pool history", nil)
+		return
+	}
+
+	if qs.Get("format") != "csv" {
+		writeJSON(w, http.StatusOK, map[string]any{"resolution": resolution, "samples": rows, "next_cursor": next})
+		return
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="pool_history.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"sampled_at", "pattern", "resolution", "unpicked", "picked_delta"})
+	for _, h := range rows {
+		cw.Write([]string{h.SampledAt.UTC().Format(time.RFC3339), h.Pattern, h.Resolution,
+			strconv.FormatInt(h.Unpicked, 10), strconv.FormatInt(h.PickedDelta, 10)})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook is a side effect run after a key has been stored in the pool.
+// Hooks only ever see public data; private keys are never passed on.
+type Hook interface {
+	Run(ctx context.Context, key TokenKey) error
+}
+
+type httpHook struct {
+	url    string
+	client *http.Client
+}
+
+func (h httpHook) Run(ctx context.Context, key TokenKey) error {
+	body, err := json.Marshal(map[string]any{
+		"id":         key.ID,
+		"public_key": key.PublicKey,
+		"created_at": key.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// execHook runs a command whose argv may reference {pubkey}.
+type execHook struct {
+	argv []string
+}
+
+func (h execHook) Run(ctx context.Context, key TokenKey) error {
+	args := make([]string, len(h.argv))
+	for i, a := range h.argv {
+		args[i] = strings.ReplaceAll(a, "{pubkey}", key.PublicKey)
+	}
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+type namedHook struct {
+	name    string
+	hook    Hook
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+	// patterns limits the hook to keys of these patterns; empty runs it
+	// for every key.
+	patterns []string
+}
+
+// runsFor reports whether h runs for keys of pattern.
+func (h *namedHook) runsFor(pattern string) bool {
+	return len(h.patterns) == 0 || slices.Contains(h.patterns, pattern)
+}
+
+// HookRun is one hook waiting to run for a stored key. Seq is the hook's
+// place in HOOKS, so each key's hooks run in order. Finished runs, and
+// runs given up on, are deleted.
+type HookRun struct {
+	ID            uint64    `gorm:"primaryKey"`
+	Hook          string    `gorm:"column:hook;not null"`
+	Seq           int       `gorm:"column:seq;not null"`
+	KeyID         string    `gorm:"column:key_id;type:uuid;not null;index"`
+	PublicKey     string    `gorm:"column:public_key;not null"`
+	Pattern       string    `gorm:"column:pattern"`
+	KeyCreatedAt  time.Time `gorm:"column:key_created_at;not null"`
+	Attempts      int       `gorm:"column:attempts;not null;default:0"`
+	NextAttemptAt time.Time `gorm:"column:next_attempt_at;not null;index"`
+	LastError     string    `gorm:"column:last_error"`
+}
+
+func (HookRun) TableName() string { return "hook_run" }
+
+// hookBatch is how many runs the runner claims at a time, and hookWorkers
+// how many of them run at once.
+const (
+	hookBatch   = 100
+	hookWorkers = 8
+)
+
+// hookRunner executes the configured hooks in order for every stored key,
+// off the generation path. Runs are queued in the hook_run table, so a
+// backlog waits there, and survives a restart, rather than being dropped;
+// a run is only given up on after its hook's retries. Several instances
+// may run hooks: each run is leased to one at a time.
+type hookRunner struct {
+	store *gormStore
+	hooks []*namedHook
+}
+
+// loadHooks builds the hook list from HOOKS (ordered, comma-separated names)
+// and the per-hook HOOK_<NAME>_* variables. Returns nil if no hooks are set.
+func loadHooks(store *gormStore, patterns []pattern) (*hookRunner, error) {
+	names := strings.Split(getenv("HOOKS"), ",")
+	r := &hookRunner{store: store}
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "HOOK_" + strings.ToUpper(name) + "_"
+		target := strings.TrimSpace(getenv(prefix + "TARGET"))
+		if target == "" {
+			return nil, fmt.Errorf("hook %q: %sTARGET is not set", name, prefix)
+		}
+
+		nh := &namedHook{name: name, retries: 3, backoff: 2 * time.Second, timeout: 30 * time.Second}
+		switch typ := getenv(prefix + "TYPE"); typ {
+		case "http":
+			nh.hook = httpHook{url: target, client: &http.Client{}}
+		case "exec":
+			nh.hook = execHook{argv: strings.Fields(target)}
+		default:
+			return nil, fmt.Errorf("hook %q: unknown type %q (want http or exec)", name, typ)
+		}
+
+		if val := getenv(prefix + "RETRIES"); val != "" {
+			v, err := strconv.Atoi(val)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("hook %q: invalid %sRETRIES %q", name, prefix, val)
+			}
+			nh.retries = v
+		}
+		if val := getenv(prefix + "BACKOFF"); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("hook %q: invalid %sBACKOFF %q", name, prefix, val)
+			}
+			nh.backoff = d
+		}
+		if val := getenv(prefix + "TIMEOUT"); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("hook %q: invalid %sTIMEOUT %q", name, prefix, val)
+			}
+			nh.timeout = d
+		}
+		for _, p := range strings.Split(getenv(prefix+"PATTERNS"), ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			if !slices.ContainsFunc(patterns, func(c pattern) bool { return c.Name() == p }) {
+				return nil, fmt.Errorf("hook %q: %sPATTERNS names %q, which is not a configured pattern", name, prefix, p)
+			}
+			nh.patterns = append(nh.patterns, p)
+		}
+
+		r.hooks = append(r.hooks, nh)
+	}
+
+	if len(r.hooks) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// hook is the configured hook named name, nil if there is none.
+func (r *hookRunner) hook(name string) *namedHook {
+	for _, h := range r.hooks {
+		if h.name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// Enqueue queues the hooks for key. It only writes the queue, so the
+// caller is never held up by a hook; a run is lost only if that write
+// fails.
+func (r *hookRunner) Enqueue(ctx context.Context, key TokenKey) {
+	if r == nil {
+		return
+	}
+	var runs []HookRun
+	now := clock.Now().UTC()
+	for i, h := range r.hooks {
+		if h.runsFor(key.MatchedPattern) {
+			runs = append(runs, HookRun{Hook: h.name, Seq: i, KeyID: key.ID, PublicKey: key.PublicKey,
+				Pattern: key.MatchedPattern, KeyCreatedAt: key.CreatedAt, NextAttemptAt: now})
+		}
+	}
+	if len(runs) == 0 {
+		return
+	}
+	if err := r.store.queueHookRuns(ctx, runs); err != nil {
+		log.Printf("ALERT failed to queue hooks for %s, dropping them: %v\n", key.PublicKey, err)
+		for _, run := range runs {
+			hookRunsTotal.WithLabelValues(run.Hook, "dropped").Inc()
+		}
+	}
+}
+
+// Run works through the queue until ctx is done.
+func (r *hookRunner) Run(ctx context.Context) {
+	var lease time.Duration
+	for _, h := range r.hooks {
+		lease = max(lease, h.timeout)
+	}
+	lease += 30 * time.Second
+	for ctx.Err() == nil {
+		runs, err := r.store.claimHookRuns(ctx, hookBatch, lease)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Error reading hook queue:", err)
+		}
+		sem := make(chan struct{}, hookWorkers)
+		var wg sync.WaitGroup
+		for _, run := range runs {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				r.runHook(ctx, run)
+			}()
+		}
+		wg.Wait()
+		if len(runs) == 0 {
+			sleepCtx(ctx, time.Second)
+		}
+	}
+}
+
+// runHook makes one attempt at run, then removes it from the queue or
+// schedules its next attempt after the hook's backoff, doubling each time.
+func (r *hookRunner) runHook(ctx context.Context, run HookRun) {
+	h := r.hook(run.Hook)
+	if h == nil {
+		// Taken out of HOOKS since it was queued
+		log.Printf("Hook %s is no longer configured, dropping its run for %s\n", run.Hook, run.PublicKey)
+		hookRunsTotal.WithLabelValues(run.Hook, "dropped").Inc()
+		if err := r.store.hookRunDone(ctx, run.ID); err != nil {
+			log.Println("Error removing hook run:", err)
+		}
+		return
+	}
+
+	hctx, cancel := context.WithTimeout(ctx, h.timeout)
+	err := h.hook.Run(hctx, TokenKey{ID: run.KeyID, PublicKey: run.PublicKey, MatchedPattern: run.Pattern, CreatedAt: run.KeyCreatedAt})
+	cancel()
+	if ctx.Err() != nil {
+		// Leased until it expires, then retried
+		return
+	}
+	if err == nil {
+		hookRunsTotal.WithLabelValues(h.name, "succeeded").Inc()
+		if err := r.store.hookRunDone(ctx, run.ID); err != nil {
+			log.Println("Error removing hook run:", err)
+		}
+		return
+	}
+
+	drop := run.Attempts >= h.retries
+	next := clock.Now().Add(h.backoff * time.Duration(1<<min(run.Attempts, 20)))
+	if drop {
+		hookRunsTotal.WithLabelValues(h.name, "dropped").Inc()
+		log.Printf("Hook %s gave up on %s after %d attempts: %v\n", h.name, run.PublicKey, run.Attempts+1, err)
+	} else {
+		hookRunsTotal.WithLabelValues(h.name, "failed").Inc()
+		log.Printf("Hook %s failed for %s (attempt %d/%d): %v\n", h.name, run.PublicKey, run.Attempts+1, h.retries+1, err)
+	}
+	if err := r.store.hookRunFailed(ctx, run, err.Error(), next, drop); err != nil {
+		log.Println("Error recording failed hook run:", err)
+	}
+}
+
+// queueHookRuns adds runs to the hook queue. It runs even if ctx was
+// cancelled, as the key it is for has already been stored.
+func (s *gormStore) queueHookRuns(ctx context.Context, runs []HookRun) error {
+	db, ctx, cancel := s.session(context.WithoutCancel(ctx), s.timeouts.Insert)
+	defer cancel()
+	return ctxError(ctx, "queue hook runs", db.Create(&runs).Error)
+}
+
+// claimHookRuns leases up to n due runs for lease, oldest first, skipping
+// any key with an earlier hook still queued.
+func (s *gormStore) claimHookRuns(ctx context.Context, n int, lease time.Duration) ([]HookRun, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var runs []HookRun
+	err := db.Raw(`UPDATE hook_run SET next_attempt_at = now() + ? * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM hook_run r WHERE next_attempt_at <= now()
+			AND NOT EXISTS (SELECT 1 FROM hook_run p WHERE p.key_id = r.key_id AND p.seq < r.seq)
+			ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED
+		) RETURNING *`, lease.Seconds(), n).Scan(&runs).Error
+	return runs, ctxError(ctx, "claim hook runs", err)
+}
+
+// hookRunDone removes a finished run from the queue.
+func (s *gormStore) hookRunDone(ctx context.Context, id uint64) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	return ctxError(ctx, "delete hook run", db.Delete(&HookRun{}, id).Error)
+}
+
+// hookRunFailed schedules run's next attempt at next or, with drop set,
+// removes it, letting the key's later hooks run.
+func (s *gormStore) hookRunFailed(ctx context.Context, run HookRun, problem string, next time.Time, drop bool) error {
+	if drop {
+		return s.hookRunDone(ctx, run.ID)
+	}
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	err := db.Model(&HookRun{}).Where("id = ?", run.ID).
+		Updates(map[string]any{"attempts": run.Attempts + 1, "last_error": problem, "next_attempt_at": next}).Error
+	return ctxError(ctx, "reschedule hook run", err)
+}
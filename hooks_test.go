@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLoadHooksPatterns(t *testing.T) {
+	patterns := []pattern{{Suffix: "ponz"}, {Suffix: "pump"}}
+	setSettings(map[string]string{
+		"HOOKS":              "notify,all",
+		"HOOK_NOTIFY_TYPE":   "http",
+		"HOOK_NOTIFY_TARGET": "http://localhost/keys",
+		// Spaces around names are allowed
+		"HOOK_NOTIFY_PATTERNS": "ponz, pump ",
+		"HOOK_ALL_TYPE":        "exec",
+		"HOOK_ALL_TARGET":      "true {pubkey}",
+	})
+	t.Cleanup(func() { setSettings(nil) })
+	r, err := loadHooks(nil, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify, all := r.hook("notify"), r.hook("all")
+	if !notify.runsFor("ponz") || !notify.runsFor("pump") || notify.runsFor("moon") {
+		t.Errorf("notify runs for %v, want ponz and pump", notify.patterns)
+	}
+	if !all.runsFor("moon") {
+		t.Error("a hook without HOOK_<NAME>_PATTERNS should run for every pattern")
+	}
+
+	setSettings(map[string]string{"HOOKS": "notify", "HOOK_NOTIFY_TYPE": "http",
+		"HOOK_NOTIFY_TARGET": "http://localhost/keys", "HOOK_NOTIFY_PATTERNS": "moon"})
+	if _, err := loadHooks(nil, patterns); err == nil || !strings.Contains(err.Error(), "not a configured pattern") {
+		t.Fatalf("loadHooks with an unknown pattern = %v", err)
+	}
+}
+
+// slowHook takes a while, counting how many runs overlap.
+type slowHook struct {
+	mu            sync.Mutex
+	running, peak int
+	done          atomic.Int64
+}
+
+func (h *slowHook) Run(ctx context.Context, key TokenKey) error {
+	h.mu.Lock()
+	h.running++
+	h.peak = max(h.peak, h.running)
+	h.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	h.mu.Lock()
+	h.running--
+	h.mu.Unlock()
+	h.done.Add(1)
+	return nil
+}
+
+// TestHookQueue checks a burst far beyond the old in-memory queue is run
+// in full, concurrently, with each key's hooks in order and a failing
+// hook retried until it succeeds.
+func TestHookQueue(t *testing.T) {
+	s := testDatabase(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	order := map[string][]string{}
+	failures := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.URL.Query().Get("k")
+		// Every key's first delivery fails once
+		if failures[key] == 0 {
+			failures[key]++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		order[key] = append(order[key], "http")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	slow := &slowHook{}
+	r := &hookRunner{store: s, hooks: []*namedHook{
+		{name: "first", hook: hookFunc(func(_ context.Context, key TokenKey) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order[key.PublicKey] = append(order[key.PublicKey], "first")
+			return nil
+		}), timeout: time.Second},
+		{name: "http", hook: urlPerKey{srv.URL}, retries: 2, backoff: time.Millisecond, timeout: time.Second},
+		{name: "slow", hook: slow, timeout: time.Second, patterns: []string{"ab"}},
+	}}
+	const keys = 40
+	for i := range keys {
+		pattern := "ab"
+		if i%2 == 1 {
+			pattern = "cd"
+		}
+		r.Enqueue(ctx, TokenKey{ID: uuid.NewString(), PublicKey: fmt.Sprintf("k%d", i), MatchedPattern: pattern, CreatedAt: time.Now()})
+	}
+	go r.Run(ctx)
+
+	finished := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		n := 0
+		for _, got := range order {
+			if len(got) == 2 {
+				n++
+			}
+		}
+		return n == keys && slow.done.Load() == keys/2
+	}
+	for deadline := time.Now().Add(30 * time.Second); !finished() && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := slow.done.Load(); got != keys/2 {
+		t.Fatalf("slow hook ran %d times, want %d (only for pattern ab)", got, keys/2)
+	}
+	slow.mu.Lock()
+	if slow.peak < 2 {
+		t.Errorf("hook runs never overlapped (peak %d)", slow.peak)
+	}
+	slow.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	for key, got := range order {
+		if len(got) != 2 || got[0] != "first" || got[1] != "http" {
+			t.Errorf("hooks for %s ran as %v, want first then http", key, got)
+		}
+	}
+	if len(order) != keys {
+		t.Errorf("hooks ran for %d keys, want %d", len(order), keys)
+	}
+}
+
+type hookFunc func(context.Context, TokenKey) error
+
+func (f hookFunc) Run(ctx context.Context, key TokenKey) error { return f(ctx, key) }
+
+// urlPerKey is an httpHook that names the key in the URL.
+type urlPerKey struct{ base string }
+
+func (h urlPerKey) Run(ctx context.Context, key TokenKey) error {
+	return httpHook{url: h.base + "?k=" + key.PublicKey, client: http.DefaultClient}.Run(ctx, key)
+}
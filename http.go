@@ -0,0 +1,687 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+type server struct {
+	store    *gormStore
+	breaker  *circuitBreaker
+	patterns []pattern
+	tokens   *tokenSet
+	agents   *agentRegistry
+	config   *effectiveConfig
+	freeze   *freezeSwitch
+
+	// maintenance disables write endpoints while set.
+	maintenance *maintenanceSwitch
+	// jobs runs the maintenance jobs, reported and paused through
+	// /v1/admin/jobs.
+	jobs *jobScheduler
+
+	// stream feeds GET /v1/keys/stream.
+	stream *keyStream
+
+	// lowPool is the fraction of a pattern's target below which picks
+	// report low_pool.
+	lowPool float64
+
+	// pickRetention is how long GET /v1/pick/result can recover a pick.
+	pickRetention time.Duration
+	// pickTimeout bounds a whole POST /v1/pick (0 = only DB_PICK_TIMEOUT),
+	// or each claim of one waiting for a key.
+	pickTimeout time.Duration
+	// pickWaitMax caps a pick's wait for a key; waiters queues them.
+	pickWaitMax time.Duration
+	waiters     *pickWaiters
+	// pickReserveFloor refuses picks once a pool has this many unpicked
+	// keys or fewer (0 = off).
+	pickReserveFloor int64
+	// cluster is CLUSTER; with it set picks must declare the same cluster.
+	cluster string
+	// calibratedRate is CALIBRATED_RATE, the attempts per second
+	// GET /v1/difficulty assumes while this instance is not grinding.
+	calibratedRate float64
+	// cpuPricePerHour is CPU_PRICE_PER_HOUR, what an hour of this
+	// instance's grinding costs (0 = no cost estimates).
+	cpuPricePerHour float64
+	// faults is nil unless UNSAFE_FAULT_INJECTION is set.
+	faults *faultInjector
+	// httpLimits bounds every connection and request body.
+	httpLimits httpLimits
+	// paperBackup mounts GET /v1/keys/{publicKey}/paper.
+	paperBackup bool
+	// dbSchema is the database's schema version found at startup, for
+	// GET /v1/version.
+	dbSchema int
+	// schemaTooNew, if set, is why SCHEMA_MISMATCH=read-only holds the
+	// instance in maintenance mode, which then cannot be lifted.
+	schemaTooNew error
+	// transferKey is TRANSFER_KEY, which seals keys handed to peers; the
+	// /v1/transfers endpoints are mounted only with it set.
+	transferKey []byte
+	// auditLog receives every pick.
+	auditLog AuditLogger
+	// auditLogPath is AUDIT_LOG_FILE, served by GET /v1/audit when set.
+	auditLogPath string
+	// governor reports the fill loops' states.
+	governor *fillGovernor
+	// watch, if set, screens agent finds against WATCHLIST.
+	watch *watchlist
+	// blocks, if set, screens agent finds as it does generated ones.
+	blocks *blocklist
+	// quotas caps agent finds at each pattern's lifetime quota.
+	quotas *quotaBook
+	// rng is nil unless RNG_MONITOR is on.
+	rng *rngMonitor
+	// entropy holds the last crypto/rand health check.
+	entropy *entropyMonitor
+	// stall is nil unless STALL_THRESHOLD is set.
+	stall *stallMonitor
+	// runMode is RUN_MODE; "generator" nodes do not mount the /v1 API.
+	runMode string
+	// historyRawRetention is how far back GET /v1/history serves raw samples
+	// by default before switching to hourly rollups.
+	historyRawRetention time.Duration
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes {"error": {"code": ..., "message": ...}} plus any extra
+// fields, so clients can branch on code rather than parsing messages.
+func writeError(w http.ResponseWriter, status int, code, msg string, extra map[string]any) {
+	body := map[string]any{"code": code, "message": msg}
+	for k, v := range extra {
+		body[k] = v
+	}
+	writeJSON(w, status, map[string]any{"error": body})
+}
+
+func writePubkeyError(w http.ResponseWriter, err *pubkeyError) {
+	extra := map[string]any{"input": err.Input, "problem": err.Problem}
+	if err.Suggestion != "" {
+		extra["suggestion"] = err.Suggestion
+	}
+	writeError(w, http.StatusBadRequest, "invalid_public_key", err.Error(), extra)
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	state := s.breaker.State()
+	status, code := "ok", http.StatusOK
+	if state == breakerOpen {
+		status, code = "degraded", http.StatusServiceUnavailable
+	}
+	if s.maintenance.Active() {
+		status = "maintenance"
+	}
+	stallReason, stalled := s.stall.Stalled()
+	if stalled {
+		status, code = "stalled", http.StatusServiceUnavailable
+	}
+	if !s.entropy.Healthy() {
+		status, code = "entropy_failed", http.StatusServiceUnavailable
+	}
+	// A suspect RNG outranks everything: its keys may be predictable
+	if s.rng.Suspect() {
+		status, code = "rng_suspect", http.StatusServiceUnavailable
+	}
+	body := map[string]any{
+		"status":      status,
+		"db_breaker":  state.String(),
+		"frozen":      s.freeze.Frozen(),
+		"maintenance": s.maintenance.Active(),
+		"run_mode":    s.runMode,
+		"rng_suspect": s.rng.Suspect(),
+	}
+	if last, ok := s.entropy.Last(); ok {
+		body["entropy"] = last
+	}
+	if s.stall != nil {
+		body["last_found_at"] = nil
+		if t, ok := s.stall.LastFound(); ok {
+			body["last_found_at"] = t.UTC()
+		}
+	}
+	if stalled {
+		body["stall_reason"] = stallReason
+	}
+	// Injected faults are shown so they are never mistaken for real failures
+	if s.faults != nil {
+		body["injected_faults"] = s.faults.list()
+	}
+	writeJSON(w, code, body)
+}
+
+type pickRequest struct {
+	PublicKey string `json:"public_key"`
+	// Label picks the key named by KEY_LABEL_TEMPLATE.
+	Label         string `json:"label"`
+	Pattern       string `json:"pattern"`
+	Campaign      string `json:"campaign"`
+	AddressLength int    `json:"address_length"`
+	// Cluster is the cluster the key is for, unless given in the
+	// X-Solana-Cluster header; required with CLUSTER set.
+	Cluster string `json:"cluster"`
+	// Order is "oldest" (the default) or "quality" for the rarest match.
+	Order string `json:"order"`
+	// Metadata is JSON attached to the key as it is claimed.
+	Metadata json.RawMessage `json:"metadata"`
+	// Explain, for admin tokens, claims nothing and instead returns the
+	// keys the pick would consider and those it would pass over and why.
+	Explain bool `json:"explain"`
+	// Wait, e.g. "10s", waits up to this long (at most PICK_WAIT_MAX) for
+	// a key when the pool is empty instead of failing at once.
+	Wait string `json:"wait"`
+}
+
+type keyResponse struct {
+	ID             string          `json:"id"`
+	PublicKey      string          `json:"public_key"`
+	Label          string          `json:"label,omitempty"`
+	PrivateKey     string          `json:"private_key"`
+	MatchedPattern string          `json:"matched_pattern"`
+	AddressLength  int             `json:"address_length"`
+	Checksum       string          `json:"checksum"`
+	QualityScore   float64         `json:"quality_score"`
+	Campaign       string          `json:"campaign,omitempty"`
+	ValidUntil     *time.Time      `json:"valid_until,omitempty"`
+	Metadata       json.RawMessage `json:"metadata,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Display        keyDisplay      `json:"display"`
+}
+
+// newKeyResponse presents k, private key included.
+func newKeyResponse(k TokenKey) keyResponse {
+	return keyResponse{
+		ID:             k.ID,
+		PublicKey:      k.PublicKey,
+		Label:          k.label(),
+		PrivateKey:     k.PrivateKey,
+		MatchedPattern: k.MatchedPattern,
+		AddressLength:  len(k.PublicKey),
+		Checksum:       keyChecksum(k.PublicKey),
+		QualityScore:   k.QualityScore,
+		Campaign:       k.Campaign,
+		ValidUntil:     k.ValidUntil,
+		Metadata:       k.metadata(),
+		CreatedAt:      k.CreatedAt,
+		Display:        displayFor(k.PublicKey, k.MatchedPattern),
+	}
+}
+
+// pickResponse adds the picked pattern's remaining depth to the key, so
+// clients can back off before the pool runs dry. RemainingUnpicked is null
+// if it could not be counted.
+type pickResponse struct {
+	keyResponse
+	RemainingUnpicked *int64 `json:"remaining_unpicked"`
+	LowPool           bool   `json:"low_pool"`
+}
+
+// patternFor returns the configured pattern named name.
+func (s *server) patternFor(name string) (pattern, bool) {
+	for _, p := range s.patterns {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return pattern{}, false
+}
+
+// unpickedFor counts the unpicked keys a pick for pattern could take: the
+// pattern's own, or every configured pattern's if it is empty.
+func (s *server) unpickedFor(ctx context.Context, pattern string) (int64, error) {
+	var total int64
+	for _, p := range s.patterns {
+		if pattern != "" && p.Name() != pattern {
+			continue
+		}
+		n, err := s.store.CountUnpicked(ctx, p.Name())
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// retryAfter estimates how long until the pool for name, or the easiest
+// pool if name is empty, has a key again at the current grinding rate.
+func (s *server) retryAfter(name string) time.Duration {
+	d := math.Inf(1)
+	for _, p := range s.patterns {
+		if name == "" || p.Name() == name {
+			// Only a share of candidates has the configured length
+			d = math.Min(d, p.attemptsAt(s.agents.config.AddressLength))
+		}
+	}
+	rate := measuredRate()
+	if rate <= 0 || math.IsInf(d, 1) {
+		return time.Minute
+	}
+	wait := time.Duration(d / rate * float64(time.Second))
+	return max(time.Second, min(time.Hour, wait))
+}
+
+func (s *server) handlePick(w http.ResponseWriter, r *http.Request) {
+	var req pickRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_body", "request body must be JSON", nil)
+			return
+		}
+	}
+
+	if req.PublicKey != "" {
+		if err := validatePublicKey(req.PublicKey, true); err != nil {
+			var pe *pubkeyError
+			errors.As(err, &pe)
+			writePubkeyError(w, pe)
+			return
+		}
+	}
+
+	if req.Order != "" && req.Order != "oldest" && req.Order != "quality" {
+		writeError(w, http.StatusBadRequest, "invalid_order", `order must be "oldest" or "quality"`, nil)
+		return
+	}
+
+	var wait time.Duration
+	if req.Wait != "" {
+		d, err := time.ParseDuration(req.Wait)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_wait", `wait must be a duration such as "10s"`, nil)
+			return
+		}
+		wait = min(d, s.pickWaitMax)
+	}
+
+	meta, err := parseMetadata(req.Metadata)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error(), nil)
+		return
+	}
+
+	cluster, ok := s.declaredCluster(w, r, req.Cluster)
+	if !ok {
+		return
+	}
+
+	restrict := tokenFromContext(r.Context()).Restrict
+	if restrict.Excludes(req.Pattern, req.Campaign) {
+		writeRestricted(w, restrict)
+		return
+	}
+
+	f := pickFilter{PublicKey: req.PublicKey, Label: req.Label, Pattern: req.Pattern, Campaign: req.Campaign,
+		AddressLength: req.AddressLength, Cluster: cluster, ByQuality: req.Order == "quality", Restrict: restrict, Metadata: meta}
+	if req.Explain {
+		s.explainPick(w, r, f)
+		return
+	}
+
+	// The deadline reaches the pick statement itself, so a pick stuck on
+	// locks is cancelled in the database rather than just abandoned
+	ctx := r.Context()
+	if s.pickTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.pickTimeout)
+		defer cancel()
+	}
+	s.faults.delay(ctx, faultSlowPick)
+
+	if req.PublicKey == "" && s.pickReserveFloor > 0 {
+		n, err := s.unpickedFor(ctx, req.Pattern)
+		if err != nil {
+			log.Println("Error counting unpicked keys for the reserve floor:", err)
+			writeError(w, http.StatusInternalServerError, "internal", "failed to count keys", nil)
+			return
+		}
+		if n <= s.pickReserveFloor {
+			wait := s.retryAfter(req.Pattern)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+			writeError(w, http.StatusServiceUnavailable, "reserve_floor", "the pool is at its reserve floor, back off and retry",
+				map[string]any{"unpicked": n, "reserve_floor": s.pickReserveFloor})
+			return
+		}
+	}
+
+	pick := func(ctx context.Context) (TokenKey, error) {
+		idemKey := r.Header.Get("Idempotency-Key")
+		if idemKey == "" {
+			return s.store.Pick(ctx, f)
+		}
+		key, replay, err := s.store.PickOnce(ctx, f, idemKey, tokenFromContext(ctx).Name)
+		if replay && err == nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		return key, err
+	}
+	key, err := pick(ctx)
+	// A waiting pick gives each claim its own PICK_TIMEOUT
+	if errors.Is(err, ErrPoolEmpty) && wait > 0 && s.waiters != nil {
+		key, err = s.waiters.waitForKey(r.Context(), f, wait, func(ctx context.Context) (TokenKey, error) {
+			if s.pickTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, s.pickTimeout)
+				defer cancel()
+			}
+			return pick(ctx)
+		})
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, "pick_timeout", "the pick did not complete in time and was cancelled, retry", nil)
+		return
+	case errors.Is(err, ErrResultExpired):
+		writeError(w, http.StatusGone, "result_expired", "this idempotency key was used and its result has expired", nil)
+		return
+	case errors.Is(err, ErrResultNotFound):
+		// The pick result was recorded and then went, e.g. deleted mid-pick
+		writeError(w, http.StatusConflict, "result_not_found", "this idempotency key's pick result could not be read, retry", nil)
+		return
+	case errors.Is(err, ErrKeyNotFound):
+		// The key may exist, labelled with another cluster
+		if cluster != "" {
+			if other, found, err := s.store.ClusterOf(r.Context(), f); err == nil && found && other != cluster {
+				writeClusterError(w, &clusterError{Declared: cluster, Cluster: other, Key: cmp.Or(req.PublicKey, req.Label)})
+				return
+			}
+		}
+		extra := map[string]any{}
+		// Suggestions could name keys outside a restricted token's reach
+		if similar, err := s.store.SimilarKeys(r.Context(), req.PublicKey); err == nil && restrict == nil {
+			if m := closestKey(req.PublicKey, similar, 2); m != "" && m != req.PublicKey {
+				extra["suggestion"] = m
+			}
+		}
+		writeError(w, http.StatusNotFound, "key_not_found", err.Error(), extra)
+		return
+	case errors.Is(err, ErrPoolEmpty):
+		wait := s.retryAfter(req.Pattern)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		writeError(w, http.StatusServiceUnavailable, "pool_empty", err.Error(), nil)
+		return
+	case errors.Is(err, ErrCorruptKey):
+		writeError(w, http.StatusInternalServerError, "corrupt_key", "the picked key was corrupt and has been quarantined, pick again", nil)
+		return
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		// The client went away while waiting for a key
+		return
+	case err != nil:
+		log.Println("Error picking key:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to pick key", nil)
+		return
+	}
+
+	audit(r.Context(), "pick", "public_key="+key.PublicKey+labelDetail(key))
+	s.logPick(r.Context(), key)
+	resp := pickResponse{keyResponse: newKeyResponse(key)}
+	if n, err := s.store.CountUnpicked(r.Context(), key.MatchedPattern); err != nil {
+		log.Println("Error counting remaining keys:", err)
+	} else {
+		resp.RemainingUnpicked = &n
+		if p, ok := s.patternFor(key.MatchedPattern); ok {
+			resp.LowPool = float64(n) < cmp.Or(p.LowPool, s.lowPool)*float64(p.Target)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handlePickResult lets a client recover the key a previous pick with the
+// given idempotency key delivered, e.g. after losing the response.
+func (s *server) handlePickResult(w http.ResponseWriter, r *http.Request) {
+	idemKey := r.PathValue("idempotencyKey")
+	key, err := s.store.PickResult(r.Context(), idemKey, tokenFromContext(r.Context()).Name, s.pickRetention)
+	switch {
+	case errors.Is(err, ErrResultNotFound):
+		writeError(w, http.StatusNotFound, "result_not_found", err.Error(), nil)
+		return
+	case errors.Is(err, ErrResultExpired):
+		writeError(w, http.StatusGone, "result_expired", err.Error(), nil)
+		return
+	case errors.Is(err, ErrCorruptKey):
+		writeError(w, http.StatusInternalServerError, "corrupt_key", "the delivered key was corrupt and has been quarantined", nil)
+		return
+	case err != nil:
+		log.Println("Error looking up pick result:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to look up pick result", nil)
+		return
+	}
+
+	audit(r.Context(), "pick_result", "public_key="+key.PublicKey+labelDetail(key)+" idempotency_key="+idemKey)
+	writeJSON(w, http.StatusOK, newKeyResponse(key))
+}
+
+type importKey struct {
+	PrivateKey string          `json:"private_key"`
+	PublicKey  string          `json:"public_key"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+type importRequest struct {
+	Keys []importKey `json:"keys"`
+}
+
+type importResult struct {
+	PublicKey string         `json:"public_key,omitempty"`
+	Status    string         `json:"status"`
+	Error     map[string]any `json:"error,omitempty"`
+}
+
+func (s *server) handleImport(w http.ResponseWriter, r *http.Request) {
+	var req importRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "request body must be JSON", nil)
+		return
+	}
+
+	results := make([]importResult, 0, len(req.Keys))
+	for _, k := range req.Keys {
+		res := importResult{PublicKey: k.PublicKey}
+		if k.PublicKey != "" {
+			if err := validatePublicKey(k.PublicKey, true); err != nil {
+				var pe *pubkeyError
+				errors.As(err, &pe)
+				res.Status = "invalid"
+				res.Error = map[string]any{"code": "invalid_public_key", "problem": pe.Problem}
+				results = append(results, res)
+				continue
+			}
+		}
+
+		meta, err := parseMetadata(k.Metadata)
+		if err != nil {
+			res.Status = "invalid"
+			res.Error = map[string]any{"code": "invalid_metadata", "problem": err.Error()}
+			results = append(results, res)
+			continue
+		}
+
+		pub, inserted, err := s.store.Import(r.Context(), k.PrivateKey, k.PublicKey, meta, s.patterns)
+		if pub != "" {
+			res.PublicKey = pub
+		}
+		var pe *pubkeyError
+		switch {
+		case errors.As(err, &pe):
+			res.Status = "invalid"
+			res.Error = map[string]any{"code": "invalid_public_key", "problem": pe.Problem, "suggestion": pe.Suggestion}
+		case err != nil:
+			res.Status = "invalid"
+			res.Error = map[string]any{"code": "invalid_private_key", "problem": err.Error()}
+		case inserted:
+			res.Status = "imported"
+			audit(r.Context(), "import", "public_key="+res.PublicKey)
+		default:
+			res.Status = "duplicate"
+		}
+		results = append(results, res)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+// handlePurge deletes unpicked keys (scope=unpicked) or all keys
+// (scope=all). confirm must repeat the scope, to guard against accidents.
+func (s *server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	if scope != "unpicked" && scope != "all" {
+		writeError(w, http.StatusBadRequest, "invalid_scope", "scope must be unpicked or all", nil)
+		return
+	}
+	if r.URL.Query().Get("confirm") != scope {
+		writeError(w, http.StatusBadRequest, "confirmation_required", "repeat the scope as confirm="+scope+" to delete keys", nil)
+		return
+	}
+
+	n, err := s.store.Purge(r.Context(), scope == "all")
+	if err != nil {
+		log.Println("Error purging keys:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to purge keys", nil)
+		return
+	}
+	audit(r.Context(), "purge", "scope="+scope+" deleted="+strconv.FormatInt(n, 10))
+	writeJSON(w, http.StatusOK, map[string]any{"scope": scope, "deleted": n})
+}
+
+// httpLimits are the HTTP server's timeouts and size limits. Streaming
+// responses clear the write deadline themselves.
+type httpLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxBodyBytes      int64
+}
+
+// limitBody caps request bodies at n bytes. Bodies declared larger are
+// refused with 413 up front; others fail to decode once they pass n.
+func limitBody(n int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			writeError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+				fmt.Sprintf("request body must be at most %d bytes", n), nil)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// logPick records a delivered key in the audit log.
+func (s *server) logPick(ctx context.Context, key TokenKey) {
+	ev := auditEvent{Event: "pick", PublicKey: key.PublicKey, Pattern: key.MatchedPattern, Actor: tokenFromContext(ctx).Name}
+	if err := s.auditLog.Log(ev); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+// serveHTTP runs the HTTP server on addr until ctx is cancelled. The /v1 API
+// is only mounted when API tokens are configured.
+func serveHTTP(ctx context.Context, addr string, s *server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /v1/version", s.handleVersion)
+	mux.Handle("GET /metrics", metricsHandler())
+	mux.HandleFunc("GET /dashboard.json", handleDashboard)
+	switch {
+	case s.runMode == "generator":
+		log.Println("RUN_MODE=generator, /v1 API disabled")
+	case s.tokens.Enabled():
+		mux.HandleFunc("POST /v1/pick", s.require(scopePick, s.writable(s.unfrozen(s.handlePick))))
+		mux.HandleFunc("GET /v1/pick/result/{idempotencyKey}", s.require(scopePick, s.unfrozen(s.handlePickResult)))
+		mux.HandleFunc("POST /v1/swap", s.require(scopePick, s.writable(s.unfrozen(s.handleSwap))))
+		mux.HandleFunc("POST /v1/import", s.require(scopeImport, s.writable(s.unfrozen(s.mutates(s.handleImport)))))
+		mux.HandleFunc("DELETE /v1/keys", s.require(scopeAdmin, s.writable(s.mutates(s.handlePurge))))
+		mux.HandleFunc("GET /v1/keys", s.require(scopeAdmin, s.handleExport))
+		if s.paperBackup {
+			mux.HandleFunc("GET /v1/keys/{publicKey}/paper", s.require(scopeAdmin, s.handlePaperBackup))
+		}
+		mux.HandleFunc("POST /v1/keys/release", s.require(scopeAdmin, s.writable(s.mutates(s.handleKeyAction("release", s.store.Release)))))
+		mux.HandleFunc("POST /v1/keys/quarantine", s.require(scopeAdmin, s.writable(s.mutates(s.handleKeyAction("quarantine", s.store.Quarantine)))))
+		mux.HandleFunc("GET /v1/admin/config", s.require(scopeAdmin, s.handleAdminConfig))
+		mux.HandleFunc("GET /v1/admin/freeze", s.require(scopeAdmin, s.handleFreezeStatus))
+		mux.HandleFunc("POST /v1/admin/freeze", s.require(scopeAdmin, s.writable(s.mutates(s.handleFreeze(true)))))
+		mux.HandleFunc("POST /v1/admin/unfreeze", s.require(scopeAdmin, s.writable(s.mutates(s.handleFreeze(false)))))
+		mux.HandleFunc("GET /v1/admin/quotas", s.require(scopeAdmin, s.handleQuotaList))
+		mux.HandleFunc("POST /v1/admin/quotas", s.require(scopeAdmin, s.writable(s.mutates(s.handleQuotaSet))))
+		mux.HandleFunc("GET /v1/admin/prewarm", s.require(scopeAdmin, s.handlePrewarmList))
+		mux.HandleFunc("POST /v1/admin/prewarm", s.require(scopeAdmin, s.writable(s.mutates(s.handlePrewarm))))
+		mux.HandleFunc("DELETE /v1/admin/prewarm", s.require(scopeAdmin, s.writable(s.mutates(s.handlePrewarmCancel))))
+		mux.HandleFunc("GET /v1/admin/maintenance", s.require(scopeAdmin, s.handleMaintenanceStatus))
+		if s.faults != nil {
+			mux.HandleFunc("GET /v1/admin/faults", s.require(scopeAdmin, s.handleFaultList))
+			mux.HandleFunc("POST /v1/admin/faults", s.require(scopeAdmin, s.mutates(s.handleFaultSet)))
+			mux.HandleFunc("DELETE /v1/admin/faults", s.require(scopeAdmin, s.mutates(s.handleFaultClear)))
+		}
+		mux.HandleFunc("POST /v1/admin/maintenance", s.require(scopeAdmin, s.mutates(s.handleMaintenance)))
+		mux.HandleFunc("GET /v1/admin/jobs", s.require(scopeAdmin, s.handleJobs))
+		mux.HandleFunc("POST /v1/admin/jobs/{name}/pause", s.require(scopeAdmin, s.mutates(s.handleJobPause(true))))
+		mux.HandleFunc("POST /v1/admin/jobs/{name}/resume", s.require(scopeAdmin, s.mutates(s.handleJobPause(false))))
+		if s.store.outbox {
+			mux.HandleFunc("GET /v1/admin/webhook/dead-letters", s.require(scopeAdmin, s.handleDeadLetters))
+			mux.HandleFunc("POST /v1/admin/webhook/dead-letters/replay", s.require(scopeAdmin, s.writable(s.mutates(s.handleReplayDeadLetters))))
+		}
+		mux.HandleFunc("GET /v1/stats", s.require(scopeRead, s.handleStats))
+		mux.HandleFunc("GET /v1/estimate", s.require(scopeRead, s.handleEstimate))
+		mux.HandleFunc("GET /v1/difficulty", s.require(scopeRead, s.handleDifficulty))
+		mux.HandleFunc("GET /v1/history", s.require(scopeRead, s.handleHistory))
+		mux.HandleFunc("GET /v1/report", s.require(scopeRead, s.handleReport))
+		if s.auditLogPath != "" {
+			mux.HandleFunc("GET /v1/audit", s.require(scopeAdmin, s.handleAudit))
+		}
+		mux.HandleFunc("GET /v1/keys/stream", s.require(scopeRead, s.handleKeyStream))
+		mux.HandleFunc("GET /v1/agents", s.require(scopeRead, s.handleAgentList))
+		mux.HandleFunc("POST /v1/agents", s.require(scopeAgent, s.handleAgentRegister))
+		mux.HandleFunc("POST /v1/agents/{id}/heartbeat", s.require(scopeAgent, s.handleAgentHeartbeat))
+		mux.HandleFunc("POST /v1/agents/{id}/finds", s.require(scopeAgent, s.writable(s.unfrozen(s.handleAgentFinds))))
+		mux.HandleFunc("DELETE /v1/agents/{id}", s.require(scopeAgent, s.handleAgentDeregister))
+		if s.transferKey != nil {
+			mux.HandleFunc("POST /v1/transfers", s.require(scopeExport, s.writable(s.unfrozen(s.mutates(s.handleTransferExport)))))
+			mux.HandleFunc("POST /v1/transfers/{id}/commit", s.require(scopeExport, s.writable(s.mutates(s.handleTransferClose(true)))))
+			mux.HandleFunc("POST /v1/transfers/{id}/abort", s.require(scopeExport, s.writable(s.mutates(s.handleTransferClose(false)))))
+			mux.HandleFunc("GET /v1/transfers", s.require(scopeExport, s.handleTransferList))
+		}
+	default:
+		log.Println("API_TOKEN and API_TOKENS_FILE not set, /v1 API disabled")
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           otelhttp.NewHandler(limitBody(s.httpLimits.MaxBodyBytes, mux), "http"),
+		ReadHeaderTimeout: s.httpLimits.ReadHeaderTimeout,
+		ReadTimeout:       s.httpLimits.ReadTimeout,
+		WriteTimeout:      s.httpLimits.WriteTimeout,
+		IdleTimeout:       s.httpLimits.IdleTimeout,
+		MaxHeaderBytes:    s.httpLimits.MaxHeaderBytes,
+	}
+	go func() {
+		<-ctx.Done()
+		s.stream.Close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("HTTP server listening on %s\n", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("HTTP server error:", err)
+	}
+}
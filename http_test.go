@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// servePick sends body to POST /v1/pick as token, with an Idempotency-Key
+// header if idemKey is set, and decodes the response.
+func servePick(t *testing.T, s *server, token, idemKey, body string) (int, keyResponse, bool) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/v1/pick", strings.NewReader(body))
+	if idemKey != "" {
+		r.Header.Set("Idempotency-Key", idemKey)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, apiToken{Name: token, Scopes: []string{scopePick}}))
+	w := httptest.NewRecorder()
+	s.handlePick(w, r)
+	var k keyResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, k, w.Header().Get("Idempotent-Replayed") == "true"
+}
+
+func TestPickResultKeyedByActor(t *testing.T) {
+	stmt := dryRunDB(t).Model(&PickResult{}).Statement
+	if err := stmt.Parse(&PickResult{}); err != nil {
+		t.Fatal(err)
+	}
+	var cols []string
+	for _, f := range stmt.Schema.PrimaryFields {
+		cols = append(cols, f.DBName)
+	}
+	if strings.Join(cols, ",") != "idempotency_key,actor" {
+		t.Fatalf("pick_result primary key = %v, want the idempotency key and actor", cols)
+	}
+}
+
+// TestIdempotencyKeySharedByTokens has two tokens pick with the same
+// idempotency key: each gets its own key, and each replay returns its own.
+func TestIdempotencyKeySharedByTokens(t *testing.T) {
+	store := testDatabase(t)
+	ctx := context.Background()
+	for range 2 {
+		priv, pub := agentKey(t)
+		if _, err := store.Insert(ctx, &TokenKey{ID: uuid.NewString(), PrivateKey: priv, PublicKey: pub, MatchedPattern: "ab"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{store: store}
+	idemKey := uuid.NewString()
+
+	tests := []struct {
+		token      string
+		wantReplay bool
+	}{
+		{"app-a", false},
+		{"app-b", false},
+		{"app-a", true},
+		{"app-b", true},
+	}
+	delivered := map[string]string{}
+	for _, tt := range tests {
+		code, k, replay := servePick(t, s, tt.token, idemKey, `{"pattern":"ab"}`)
+		if code != http.StatusOK || replay != tt.wantReplay {
+			t.Fatalf("%s pick = %d, replayed %v; want 200, replayed %v", tt.token, code, replay, tt.wantReplay)
+		}
+		if first, ok := delivered[tt.token]; ok && first != k.PublicKey {
+			t.Fatalf("%s replay = %s, want its first key %s", tt.token, k.PublicKey, first)
+		}
+		delivered[tt.token] = k.PublicKey
+	}
+	if delivered["app-a"] == delivered["app-b"] {
+		t.Fatalf("both tokens were given %s", delivered["app-a"])
+	}
+}
+
+// TestDashboardMetricsRegistered checks every metric a panel of GET
+// /dashboard.json queries is one the registry exposes.
+func TestDashboardMetricsRegistered(t *testing.T) {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := map[string]bool{}
+	for _, mf := range families {
+		registered[mf.GetName()] = true
+		if mf.GetType() == dto.MetricType_HISTOGRAM {
+			registered[mf.GetName()+"_bucket"] = true
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleDashboard(w, httptest.NewRequest(http.MethodGet, "/dashboard.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	var d struct {
+		Panels []struct {
+			Title   string
+			Targets []struct{ Expr string }
+		}
+	}
+	if err := json.NewDecoder(w.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Panels) == 0 {
+		t.Fatal("the dashboard has no panels")
+	}
+
+	// Grouping labels and range selectors are not metrics; functions are
+	// the names followed by a "("
+	strip := regexp.MustCompile(`by \([^)]*\)|\[[^\]]*\]`)
+	ident := regexp.MustCompile(`([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(\(?)`)
+	for _, p := range d.Panels {
+		for _, target := range p.Targets {
+			var found bool
+			for _, m := range ident.FindAllStringSubmatch(strip.ReplaceAllString(target.Expr, ""), -1) {
+				if m[2] != "" {
+					continue
+				}
+				found = true
+				if !registered[m[1]] {
+					t.Errorf("panel %s queries %s, which is not registered", p.Title, m[1])
+				}
+			}
+			if !found {
+				t.Errorf("panel %s query %q names no metric", p.Title, target.Expr)
+			}
+		}
+	}
+}
+
+// TestKeyStream subscribes to GET /v1/keys/stream and checks the first
+// event a token is sent for two newly stored keys.
+func TestKeyStream(t *testing.T) {
+	keys := []TokenKey{
+		{ID: "00000000-0000-0000-0000-000000000001", PublicKey: testPub("k1"), PrivateKey: testPriv("k1"), MatchedPattern: "cd"},
+		{ID: "00000000-0000-0000-0000-000000000002", PublicKey: testPub("k2"), PrivateKey: testPriv("k2"), MatchedPattern: "ab"},
+	}
+	for _, tc := range []struct {
+		name        string
+		query       string
+		tok         apiToken
+		wantStatus  int
+		wantKey     TokenKey
+		wantPrivate bool
+	}{
+		{"public keys only", "", apiToken{Name: "app", Scopes: []string{scopeRead}}, http.StatusOK, keys[0], false},
+		{"private keys for admin", "?include_private_key=true", apiToken{Name: "ops", Scopes: []string{scopeRead, scopeAdmin}}, http.StatusOK, keys[0], true},
+		{"private keys need admin", "?include_private_key=true", apiToken{Name: "app", Scopes: []string{scopeRead}}, http.StatusForbidden, TokenKey{}, false},
+		{"restricted token", "", apiToken{Name: "app", Scopes: []string{scopeRead}, Restrict: &keyRestriction{Patterns: []string{"ab"}}}, http.StatusOK, keys[1], false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &server{stream: newKeyStream()}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				s.handleKeyStream(w, r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, tc.tok)))
+			}))
+			defer ts.Close()
+			defer s.stream.Close()
+
+			resp, err := http.Get(ts.URL + "/v1/keys/stream" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+			}
+
+			// The handler subscribes after sending the headers
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				s.stream.mu.Lock()
+				n := len(s.stream.subs)
+				s.stream.mu.Unlock()
+				if n > 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("the handler never subscribed")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			for _, k := range keys {
+				s.stream.Publish(k)
+			}
+
+			lines := bufio.NewScanner(resp.Body)
+			var ev streamEvent
+			for lines.Scan() {
+				if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+					if err := json.Unmarshal([]byte(data), &ev); err != nil {
+						t.Fatal(err)
+					}
+					break
+				}
+			}
+			if ev.PublicKey != tc.wantKey.PublicKey || ev.MatchedPattern != tc.wantKey.MatchedPattern || ev.ID != tc.wantKey.ID {
+				t.Fatalf("first event = %+v, want key %s of %s", ev, tc.wantKey.PublicKey, tc.wantKey.MatchedPattern)
+			}
+			if got := ev.PrivateKey != ""; got != tc.wantPrivate || got && ev.PrivateKey != tc.wantKey.PrivateKey {
+				t.Fatalf("event private key %q, want it sent: %v", ev.PrivateKey, tc.wantPrivate)
+			}
+		})
+	}
+}
+
+// TestKeyStreamSlowSubscriber checks publishing never waits for a
+// subscriber that stopped reading: keys past its buffer are dropped.
+func TestKeyStreamSlowSubscriber(t *testing.T) {
+	st := newKeyStream()
+	keys, unsubscribe := st.Subscribe()
+	defer unsubscribe()
+	before := testutil.ToFloat64(streamDroppedTotal)
+	for range streamBuffer + 3 {
+		st.Publish(TokenKey{PublicKey: testPub("k1")})
+	}
+	if dropped := testutil.ToFloat64(streamDroppedTotal) - before; dropped != 3 {
+		t.Fatalf("dropped %v keys, want the 3 past the buffer", dropped)
+	}
+	if len(keys) != streamBuffer {
+		t.Fatalf("subscriber holds %d keys, want %d", len(keys), streamBuffer)
+	}
+	st.Close()
+	for range keys {
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrResultExpired  = errors.New("pick result has expired")
+	ErrResultNotFound = errors.New("no pick recorded for this idempotency key")
+)
+
+// PickResult remembers which key a pick with a given idempotency key was
+// given, so a retried or lost request can recover it. Once the retention
+// window passes the key reference is cleared but the row is kept as a
+// tombstone so lookups can answer "expired" rather than "unknown". Each
+// token has its own idempotency keys, so two tokens using the same one get
+// a pick each.
+type PickResult struct {
+	IdempotencyKey string    `gorm:"primaryKey;column:idempotency_key"`
+	Actor          string    `gorm:"primaryKey;column:actor"`
+	TokenKeyID     *string   `gorm:"type:uuid;column:token_key_id"`
+	Purged         bool      `gorm:"column:purged;default:false"`
+	CreatedAt      time.Time `gorm:"column:created_at;autoCreateTime;index"`
+}
+
+func (PickResult) TableName() string { return "pick_result" }
+
+// PickOnce picks a key for idemKey exactly once. A repeat call with the
+// same idempotency key returns the key delivered the first time, with
+// replay set. Concurrent repeats serialise on the pick_result primary key,
+// the idempotency key and actor.
+func (s *gormStore) PickOnce(ctx context.Context, f pickFilter, idemKey, actor string) (key TokenKey, replay bool, err error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Pick)
+	defer cancel()
+
+	start := clock.Now()
+	defer func() { observePick(clock.Now().Sub(start)) }()
+	err = withRetry(ctx, "pick_once", func() error {
+		replay = false
+		return db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&PickResult{IdempotencyKey: idemKey, Actor: actor})
+			if res.Error != nil {
+				return res.Error
+			}
+
+			if res.RowsAffected == 0 {
+				replay = true
+				key, err = lookupPickResult(tx, idemKey, actor, 0)
+				return err
+			}
+
+			key, err = pickTx(tx, f)
+			if err != nil {
+				return err
+			}
+			if err := s.recordEvent(tx, eventPicked, key.MatchedPattern, key.PublicKey); err != nil {
+				return err
+			}
+			return tx.Model(&PickResult{}).Where("idempotency_key = ? AND actor = ?", idemKey, actor).
+				Update("token_key_id", key.ID).Error
+		})
+	})
+	if err != nil && !errors.Is(err, ErrPoolEmpty) && !errors.Is(err, ErrKeyNotFound) &&
+		!errors.Is(err, ErrResultExpired) && !errors.Is(err, ErrResultNotFound) {
+		err = ctxError(ctx, "pick key", err)
+	}
+	if err == nil {
+		err = s.open(ctx, &key)
+	}
+	return key, replay, err
+}
+
+// PickResult returns the key previously delivered for idemKey to actor.
+func (s *gormStore) PickResult(ctx context.Context, idemKey, actor string, retention time.Duration) (TokenKey, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	key, err := lookupPickResult(db, idemKey, actor, retention)
+	if err != nil && !errors.Is(err, ErrResultExpired) && !errors.Is(err, ErrResultNotFound) {
+		err = ctxError(ctx, "pick result", err)
+	}
+	if err == nil {
+		err = s.open(ctx, &key)
+	}
+	return key, err
+}
+
+// lookupPickResult resolves idemKey for actor. A retention of zero skips
+// the age check. Results belonging to other actors read as not found.
+func lookupPickResult(db *gorm.DB, idemKey, actor string, retention time.Duration) (TokenKey, error) {
+	var pr PickResult
+	err := db.Where("idempotency_key = ? AND actor = ?", idemKey, actor).Take(&pr).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return TokenKey{}, ErrResultNotFound
+	}
+	if err != nil {
+		return TokenKey{}, err
+	}
+	if pr.Purged || pr.TokenKeyID == nil || (retention > 0 && clock.Now().Sub(pr.CreatedAt) > retention) {
+		return TokenKey{}, ErrResultExpired
+	}
+
+	var key TokenKey
+	if err := db.Where("id = ?", *pr.TokenKeyID).Take(&key).Error; err != nil {
+		return TokenKey{}, err
+	}
+	return key, nil
+}
+
+// PurgePickResults clears key references older than retention, leaving
+// tombstones behind. Returns the number of results purged.
+func (s *gormStore) PurgePickResults(ctx context.Context, retention time.Duration) (int64, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	res := db.Model(&PickResult{}).
+		Where("purged = false AND created_at < ?", clock.Now().Add(-retention)).
+		Updates(map[string]any{"token_key_id": nil, "purged": true})
+	return res.RowsAffected, ctxError(ctx, "purge pick results", res.Error)
+}
@@ -0,0 +1,267 @@
+//go:build integration
+
+package main
+
+// The integration harness runs the database tests against a throwaway
+// Postgres started with testcontainers, so they need Docker rather than a
+// database kept for tests:
+//
+//	go test -tags integration ./...
+//
+// Without the tag they skip unless TEST_DATABASE_URL is set. With it, a
+// TEST_DATABASE_URL already set is used instead of a container. The
+// conformance suite, TestGormStoreConformance, is what a storage backend is
+// checked with; a backend on another database adds its container here.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/testcontainers/testcontainers-go"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"solana-key-gen/keygen"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runWithDatabase(m))
+}
+
+// runWithDatabase runs the tests with TEST_DATABASE_URL pointing at a
+// fresh Postgres container, removed afterwards.
+func runWithDatabase(m *testing.M) int {
+	if os.Getenv("TEST_DATABASE_URL") != "" {
+		return m.Run()
+	}
+	ctx := context.Background()
+	ctr, err := tcpostgres.Run(ctx, "docker.io/postgres:16-alpine",
+		tcpostgres.WithDatabase("keygen"), tcpostgres.WithUsername("keygen"), tcpostgres.WithPassword("keygen"),
+		// Postgres restarts once after initdb; the second ready line is the real one
+		testcontainers.WithWaitStrategy(wait.ForLog("database system is ready to accept connections").
+			WithOccurrence(2).WithStartupTimeout(time.Minute)))
+	defer func() {
+		if err := testcontainers.TerminateContainer(ctr); err != nil {
+			fmt.Fprintln(os.Stderr, "Error removing the Postgres container:", err)
+		}
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting the Postgres container:", err)
+		return 1
+	}
+	dsn, err := ctr.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the Postgres container's address:", err)
+		return 1
+	}
+	os.Setenv("TEST_DATABASE_URL", dsn)
+	return m.Run()
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// apiClient calls a running instance's API with the admin token.
+type apiClient struct {
+	base, token string
+}
+
+// do sends body as JSON and decodes the JSON response.
+func (c apiClient) do(method, path string, body any) (int, map[string]any, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return 0, nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.base+path, &buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("%s %s: decode response: %w", method, path, err)
+	}
+	return resp.StatusCode, out, nil
+}
+
+// call is do, failing the test on a transport error.
+func (c apiClient) call(t *testing.T, method, path string, body any) (int, map[string]any) {
+	t.Helper()
+	status, out, err := c.do(method, path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, out
+}
+
+// eventually polls cond every 50ms until it holds or d passes.
+func eventually(t *testing.T, d time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting for %s", d, what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestIntegrationFillPickRelease runs the whole service against Postgres:
+// the fill loop grinds a one-character pattern from a seeded entropy
+// source, concurrent picks each get a different key, a released key can be
+// picked again and a purge deletes the pool.
+func TestIntegrationFillPickRelease(t *testing.T) {
+	store := testDatabase(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	seed := [32]byte{'i', 'n', 't', 'e', 'g', 'r', 'a', 't', 'i', 'o', 'n'}
+
+	// The first key from the seed is the one a lone worker finds first
+	first, err := keygen.NewGenerator(keygen.WithPattern(keygen.Suffix("z")), keygen.WithEntropy(rand.NewChaCha8(seed))).Find(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := freeAddr(t)
+	api := apiClient{base: "http://" + addr, token: "integration-token"}
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, Config{Entropy: rand.NewChaCha8(seed), Env: map[string]string{
+			"DATABASE_URL": os.Getenv("TEST_DATABASE_URL"),
+			"SUFFIXES":     "z:5",
+			"WORKERS":      "1",
+			"API_TOKEN":    api.token,
+			"HTTP_ADDR":    addr,
+		}})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run = %v after cancel, want nil", err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Error("Run did not stop after its context was cancelled")
+		}
+	})
+
+	eventually(t, time.Minute, "the pool to fill", func() bool {
+		n, err := store.CountUnpicked(ctx, "z")
+		return err == nil && n >= 5
+	})
+	var stored TokenKey
+	if err := store.db.Where("public_key = ?", first.Address).First(&stored).Error; err != nil {
+		t.Fatalf("the seed's first key %s is not in the pool: %v", first.Address, err)
+	}
+	eventually(t, 10*time.Second, "the API", func() bool {
+		resp, err := http.Get(api.base + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil && resp.StatusCode == http.StatusOK
+	})
+
+	// Concurrent picks never share a key
+	var mu sync.Mutex
+	picked := map[string]int{}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body, err := api.do(http.MethodPost, "/v1/pick", map[string]any{"pattern": "z"})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				t.Error(err)
+			case status == http.StatusOK:
+				picked[body["public_key"].(string)]++
+			case status != http.StatusServiceUnavailable:
+				t.Errorf("pick = %d %v, want 200 or pool_empty", status, body)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(picked) < 5 {
+		t.Fatalf("%d picks succeeded from a pool of at least 5", len(picked))
+	}
+	var pub string
+	for k, n := range picked {
+		if n > 1 {
+			t.Errorf("%s was picked %d times", k, n)
+		}
+		pub = k
+	}
+
+	// Release returns a key to the pool, and it can be picked again
+	if status, body := api.call(t, http.MethodPost, "/v1/keys/release", map[string]any{"public_key": pub}); status != http.StatusOK {
+		t.Fatalf("release = %d %v", status, body)
+	}
+	if err := store.db.Where("public_key = ?", pub).First(&stored).Error; err != nil || stored.IsPicked {
+		t.Fatalf("after release the key is picked=%v (%v), want unpicked", stored.IsPicked, err)
+	}
+	if status, body := api.call(t, http.MethodPost, "/v1/pick", map[string]any{"public_key": pub}); status != http.StatusOK || body["public_key"] != pub {
+		t.Fatalf("picking the released key = %d %v", status, body)
+	}
+
+	// A purge of everything takes the picked keys with it
+	status, body := api.call(t, http.MethodDelete, "/v1/keys?scope=all&confirm=all", nil)
+	if status != http.StatusOK {
+		t.Fatalf("purge = %d %v", status, body)
+	}
+	if deleted, _ := body["deleted"].(float64); int(deleted) < len(picked) {
+		t.Fatalf("purge deleted %v keys, fewer than the %d picked", body["deleted"], len(picked))
+	}
+	var left int64
+	keys := make([]string, 0, len(picked))
+	for k := range picked {
+		keys = append(keys, k)
+	}
+	if err := store.db.Model(&TokenKey{}).Where("public_key IN ?", keys).Count(&left).Error; err != nil || left != 0 {
+		t.Fatalf("%d picked keys left after the purge (%v)", left, err)
+	}
+}
+
+// TestIntegrationReadYourWrites runs checkReadYourWrites against Postgres
+// through GORM and through DB_ENGINE=pgx, which picks, inserts and counts
+// on its own pool.
+func TestIntegrationReadYourWrites(t *testing.T) {
+	store := testDatabase(t)
+	key := func(name string) *TokenKey {
+		return &TokenKey{ID: uuid.NewString(), PublicKey: testPub(name), PrivateKey: testPriv(name), MatchedPattern: "ab"}
+	}
+	checkReadYourWrites(t, store, key("k1"))
+
+	pool, err := newPgxPool(context.Background(), os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	store.pgx = pool
+	checkReadYourWrites(t, store, key("k2"))
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recurring maintenance (purges, rollups, vacuums, checkpoints, sweeps)
+// runs as jobs of one jobScheduler rather than each in its own loop, so
+// every job is scheduled, paused, reported and stopped the same way. Loops
+// that are part of serving or filling rather than maintenance, such as the
+// freeze poll and the webhook outbox, keep their own.
+
+// overlapPolicy says what happens to a run that falls due while the last
+// one is still going.
+type overlapPolicy string
+
+const (
+	// overlapSkip drops the run; the next is at the following due time.
+	overlapSkip overlapPolicy = "skip"
+	// overlapQueue starts it as soon as the last run ends. Runs missed
+	// while waiting coalesce into that one.
+	overlapQueue overlapPolicy = "queue"
+)
+
+// jobSpec is a job as registered.
+type jobSpec struct {
+	Name string
+	// Every runs the job at this interval; Cron, a five-field cron
+	// expression in UTC, instead at the times it names. JOB_SCHEDULES can
+	// override either.
+	Every time.Duration
+	Cron  string
+	// Jitter delays each run by up to this much, so instances sharing a
+	// database do not all run at once.
+	Jitter  time.Duration
+	Overlap overlapPolicy
+	// Immediately runs the job at startup rather than one interval in.
+	Immediately bool
+	// InMaintenance runs the job in maintenance mode too; other jobs skip
+	// runs falling due then.
+	InMaintenance bool
+	// AtShutdown runs the job once more as the scheduler stops, unless it
+	// is paused.
+	AtShutdown bool
+	// Interruptible jobs have their run's context cancelled at shutdown;
+	// only for jobs safe to stop at any statement. Other runs finish first,
+	// so no job is stopped mid-transaction.
+	Interruptible bool
+	Run           func(ctx context.Context) error
+}
+
+// jobSchedule gives a job's due times.
+type jobSchedule interface {
+	// next is the first due time after t, zero if there is none.
+	next(t time.Time) time.Time
+	String() string
+}
+
+// everySchedule is due at a fixed interval.
+type everySchedule time.Duration
+
+func (e everySchedule) next(t time.Time) time.Time { return t.Add(time.Duration(e)) }
+func (e everySchedule) String() string             { return "@every " + time.Duration(e).String() }
+
+// cronSchedule is due at the minutes a cron expression matches, in UTC.
+type cronSchedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for "*": a job with both fields
+	// restricted runs on days matching either, as in cron.
+	domAny, dowAny bool
+}
+
+// cronMacros are the shorthand cron expressions accepted.
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseJobSchedule parses "@every <duration>", a cron macro such as
+// "@daily", or a five-field cron expression: minute, hour, day of month,
+// month and day of week, each "*", a number, a range "a-b" or a list of
+// them, optionally stepped as in "*/15".
+func parseJobSchedule(spec string) (jobSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("invalid interval in %q", spec)
+		}
+		return everySchedule(every), nil
+	}
+	expr := spec
+	if m, ok := cronMacros[spec]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, has %d", spec, len(fields))
+	}
+	c := &cronSchedule{spec: spec, domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, f := range []struct {
+		set      *uint64
+		min, max int
+		name     string
+	}{{&c.minute, 0, 59, "minute"}, {&c.hour, 0, 23, "hour"}, {&c.dom, 1, 31, "day of month"},
+		{&c.month, 1, 12, "month"}, {&c.dow, 0, 7, "day of week"}} {
+		set, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in %q: %w", f.name, spec, err)
+		}
+		*f.set = set
+	}
+	// Sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	if c.next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", spec)
+	}
+	return c, nil
+}
+
+// parseCronField parses one cron field into a set of values in [lo, hi].
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step, stepped := strings.Cut(part, "/")
+		by := 1
+		if stepped {
+			n, err := strconv.Atoi(step)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", step)
+			}
+			by = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", a)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", b)
+				}
+			} else if stepped {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += by {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) String() string { return c.spec }
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// next skips whole months, days and hours that cannot match, so it is
+// cheap even for rare expressions. It looks at most five years ahead,
+// which covers every date that exists.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			// Straight to the next matching minute of this hour, if any
+			if later := c.minute >> (t.Minute() + 1); later != 0 {
+				t = t.Add(time.Duration(bits.TrailingZeros64(later)+1) * time.Minute)
+			} else {
+				t = t.Truncate(time.Hour).Add(time.Hour)
+			}
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// job is a registered job and what it has done.
+type job struct {
+	spec     jobSpec
+	schedule jobSchedule
+
+	mu           sync.Mutex
+	paused       bool
+	running      bool
+	nextRun      time.Time
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    string
+	lastSuccess  time.Time
+	runs         int64
+	failures     int64
+	skipped      int64
+}
+
+// jobStatus is a job's state, for /v1/stats and /v1/admin/jobs.
+type jobStatus struct {
+	Name                string     `json:"name"`
+	Schedule            string     `json:"schedule"`
+	Overlap             string     `json:"overlap"`
+	Paused              bool       `json:"paused"`
+	Running             bool       `json:"running"`
+	NextRun             *time.Time `json:"next_run"`
+	LastRun             *time.Time `json:"last_run"`
+	LastDurationSeconds float64    `json:"last_duration_seconds"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastSuccess         *time.Time `json:"last_success"`
+	Runs                int64      `json:"runs"`
+	Failures            int64      `json:"failures"`
+	Skipped             int64      `json:"skipped"`
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	at := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		t = t.UTC()
+		return &t
+	}
+	return jobStatus{Name: j.spec.Name, Schedule: j.schedule.String(), Overlap: string(j.spec.Overlap),
+		Paused: j.paused, Running: j.running, NextRun: at(j.nextRun), LastRun: at(j.lastRun),
+		LastDurationSeconds: j.lastDuration.Seconds(), LastError: j.lastError, LastSuccess: at(j.lastSuccess),
+		Runs: j.runs, Failures: j.failures, Skipped: j.skipped}
+}
+
+func (j *job) isPaused() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.paused
+}
+
+func (j *job) isRunning() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.running
+}
+
+func (j *job) setNext(t time.Time) {
+	j.mu.Lock()
+	j.nextRun = t
+	j.mu.Unlock()
+}
+
+// skip records a due run not made, for reason.
+func (j *job) skip(reason string) {
+	j.mu.Lock()
+	j.skipped++
+	j.mu.Unlock()
+	jobSkippedTotal.WithLabelValues(j.spec.Name, reason).Inc()
+}
+
+// run runs the job once and records the outcome.
+func (j *job) run(ctx context.Context) {
+	start := clock.Now()
+	j.mu.Lock()
+	j.running = true
+	j.mu.Unlock()
+	j.finish(start, j.spec.Run(ctx))
+}
+
+// finish records the outcome of the run begun at start.
+func (j *job) finish(start time.Time, err error) {
+	d := clock.Now().Sub(start)
+	j.mu.Lock()
+	j.running, j.lastRun, j.lastDuration = false, start, d
+	j.runs++
+	if err != nil {
+		j.failures++
+		j.lastError = err.Error()
+	} else {
+		j.lastError, j.lastSuccess = "", start
+	}
+	j.mu.Unlock()
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+		log.Printf("Error running job %s: %v\n", j.spec.Name, err)
+	} else {
+		jobLastSuccess.WithLabelValues(j.spec.Name).Set(float64(start.Unix()))
+	}
+	jobRunsTotal.WithLabelValues(j.spec.Name, result).Inc()
+	jobLastRun.WithLabelValues(j.spec.Name).Set(float64(start.Unix()))
+	jobLastDuration.WithLabelValues(j.spec.Name).Set(d.Seconds())
+}
+
+// jobScheduler runs registered jobs until its context is done.
+type jobScheduler struct {
+	ctx   context.Context
+	maint *maintenanceSwitch
+	// overrides (JOB_SCHEDULES) replace registered schedules by job name.
+	overrides map[string]jobSchedule
+	// jitter picks a delay in [0, d).
+	jitter func(d time.Duration) time.Duration
+
+	mu   sync.Mutex
+	jobs []*job
+	wg   sync.WaitGroup
+}
+
+// ErrJobNotFound is returned for a job name nothing registered.
+var ErrJobNotFound = errors.New("no such job")
+
+func newJobScheduler(ctx context.Context, maint *maintenanceSwitch) *jobScheduler {
+	return &jobScheduler{ctx: ctx, maint: maint, overrides: map[string]jobSchedule{},
+		jitter: func(d time.Duration) time.Duration { return rand.N(d) }}
+}
+
+// parseJobSchedules parses JOB_SCHEDULES, "name=schedule" entries
+// separated by ";" since cron expressions contain commas.
+func parseJobSchedules(spec string) (map[string]jobSchedule, error) {
+	out := map[string]jobSchedule{}
+	for _, entry := range strings.Split(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, sched, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("want name=schedule in %q", entry)
+		}
+		s, err := parseJobSchedule(sched)
+		if err != nil {
+			return nil, err
+		}
+		out[strings.TrimSpace(name)] = s
+	}
+	return out, nil
+}
+
+// Register adds the job and starts scheduling it.
+func (s *jobScheduler) Register(spec jobSpec) error {
+	var sched jobSchedule
+	switch {
+	case spec.Name == "" || spec.Run == nil:
+		return errors.New("a job needs a name and a Run function")
+	case s.overrides[spec.Name] != nil:
+		sched = s.overrides[spec.Name]
+	case spec.Cron != "" && spec.Every != 0:
+		return fmt.Errorf("job %s has both an interval and a cron expression", spec.Name)
+	case spec.Cron != "":
+		var err error
+		if sched, err = parseJobSchedule(spec.Cron); err != nil {
+			return fmt.Errorf("job %s: %w", spec.Name, err)
+		}
+	case spec.Every > 0:
+		sched = everySchedule(spec.Every)
+	default:
+		return fmt.Errorf("job %s has no schedule", spec.Name)
+	}
+	if spec.Overlap == "" {
+		spec.Overlap = overlapSkip
+	}
+	if spec.Overlap != overlapSkip && spec.Overlap != overlapQueue {
+		return fmt.Errorf("job %s has unknown overlap policy %q", spec.Name, spec.Overlap)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.spec.Name == spec.Name {
+			return fmt.Errorf("job %s is already registered", spec.Name)
+		}
+	}
+	j := &job{spec: spec, schedule: sched}
+	s.jobs = append(s.jobs, j)
+	jobPaused.WithLabelValues(spec.Name).Set(0)
+	for _, result := range []string{"ok", "error"} {
+		jobRunsTotal.WithLabelValues(spec.Name, result)
+	}
+	for _, reason := range []string{"paused", "maintenance", "overlap"} {
+		jobSkippedTotal.WithLabelValues(spec.Name, reason)
+	}
+	s.wg.Add(1)
+	go s.loop(j)
+	return nil
+}
+
+// Unregistered names the JOB_SCHEDULES entries no registered job matches.
+func (s *jobScheduler) Unregistered() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.overrides {
+		if s.find(name) == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// find returns the job named name, nil if none; s.mu must be held.
+func (s *jobScheduler) find(name string) *job {
+	for _, j := range s.jobs {
+		if j.spec.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// loop runs one job at its due times until the scheduler stops, then waits
+// for the run in progress and makes any shutdown run.
+func (s *jobScheduler) loop(j *job) {
+	defer s.wg.Done()
+	var running chan struct{}
+	due := clock.Now()
+	if !j.spec.Immediately {
+		due = j.schedule.next(due)
+	}
+	for !due.IsZero() {
+		j.setNext(due)
+		wait := due.Sub(clock.Now())
+		if j.spec.Jitter > 0 {
+			wait += s.jitter(j.spec.Jitter)
+		}
+		select {
+		case <-s.ctx.Done():
+			s.stop(j, running)
+			return
+		case <-clock.After(wait):
+		}
+
+		// A schedule that fell behind resumes from now rather than
+		// making up what it missed
+		if due = j.schedule.next(due); !due.IsZero() && due.Before(clock.Now()) {
+			due = j.schedule.next(clock.Now())
+		}
+		switch {
+		case j.isPaused():
+			j.skip("paused")
+		case !j.spec.InMaintenance && s.maint != nil && s.maint.Active():
+			j.skip("maintenance")
+		case j.isRunning() && j.spec.Overlap == overlapSkip:
+			j.skip("overlap")
+		default:
+			if running != nil {
+				select {
+				case <-running:
+				case <-s.ctx.Done():
+					continue
+				}
+			}
+			running = s.start(j)
+		}
+	}
+	j.setNext(time.Time{})
+	<-s.ctx.Done()
+	s.stop(j, running)
+}
+
+// start runs j in the background, returning a channel closed when it ends.
+// j is marked running before start returns, so a run falling due next
+// sees it.
+func (s *jobScheduler) start(j *job) chan struct{} {
+	ctx := context.WithoutCancel(s.ctx)
+	if j.spec.Interruptible {
+		ctx = s.ctx
+	}
+	start := clock.Now()
+	j.mu.Lock()
+	j.running = true
+	j.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j.finish(start, j.spec.Run(ctx))
+	}()
+	return done
+}
+
+// stop waits for j's run in progress, if any, then makes its shutdown run.
+func (s *jobScheduler) stop(j *job, running chan struct{}) {
+	if running != nil {
+		<-running
+	}
+	j.setNext(time.Time{})
+	if j.spec.AtShutdown && !j.isPaused() {
+		j.run(context.WithoutCancel(s.ctx))
+	}
+}
+
+// Wait blocks until the scheduler's context is done and every job has
+// stopped.
+func (s *jobScheduler) Wait() {
+	s.wg.Wait()
+}
+
+// SetPaused pauses or resumes the job named name. A paused job skips the
+// runs falling due; one in progress carries on.
+func (s *jobScheduler) SetPaused(name string, paused bool) (jobStatus, error) {
+	if s == nil {
+		return jobStatus{}, ErrJobNotFound
+	}
+	s.mu.Lock()
+	j := s.find(name)
+	s.mu.Unlock()
+	if j == nil {
+		return jobStatus{}, ErrJobNotFound
+	}
+	j.mu.Lock()
+	j.paused = paused
+	j.mu.Unlock()
+	v := 0.0
+	if paused {
+		v = 1
+	}
+	jobPaused.WithLabelValues(name).Set(v)
+	return j.status(), nil
+}
+
+// Status reports every job, in registration order. A nil scheduler has
+// none.
+func (s *jobScheduler) Status() []jobStatus {
+	out := []jobStatus{}
+	if s == nil {
+		return out
+	}
+	s.mu.Lock()
+	jobs := append([]*job(nil), s.jobs...)
+	s.mu.Unlock()
+	for _, j := range jobs {
+		out = append(out, j.status())
+	}
+	return out
+}
+
+// handleJobs serves GET /v1/admin/jobs.
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": s.jobs.Status()})
+}
+
+// handleJobPause serves POST /v1/admin/jobs/{name}/pause and /resume.
+func (s *server) handleJobPause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		st, err := s.jobs.SetPaused(name, paused)
+		if errors.Is(err, ErrJobNotFound) {
+			writeError(w, http.StatusNotFound, "job_not_found", "no job named "+strconv.Quote(name), nil)
+			return
+		}
+		action := "job_resume"
+		if paused {
+			action = "job_pause"
+		}
+		audit(r.Context(), action, "job="+name)
+		writeJSON(w, http.StatusOK, st)
+	}
+}
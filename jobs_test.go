@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startJobs runs a scheduler on a fake clock until the test ends.
+func startJobs(t *testing.T, maint *maintenanceSwitch) (*jobScheduler, *fakeClock, context.CancelFunc) {
+	t.Helper()
+	c := useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newJobScheduler(ctx, maint)
+	t.Cleanup(func() {
+		cancel()
+		s.Wait()
+	})
+	return s, c, cancel
+}
+
+// received waits, up to a second of real time, for a value on ch.
+func received[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatalf("no %s", what)
+	}
+	var zero T
+	return zero
+}
+
+// jobSettled waits, up to a second of real time, for the only job of s to
+// have finished n runs and not be running.
+func jobSettled(t *testing.T, s *jobScheduler, n int64) jobStatus {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		st := s.Status()[0]
+		if st.Runs >= n && !st.Running {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s has %d runs, running %v; want %d finished", st.Name, st.Runs, st.Running, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJobRunsEveryInterval(t *testing.T) {
+	s, c, _ := startJobs(t, nil)
+	start := c.Now()
+	before := testutil.ToFloat64(jobRunsTotal.WithLabelValues("every_test", "ok"))
+	ran := make(chan time.Time, 10)
+	if err := s.Register(jobSpec{Name: "every_test", Every: time.Minute,
+		Run: func(context.Context) error { ran <- clock.Now(); return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		c.BlockUntil(t, 1)
+		if next := s.Status()[0].NextRun; next == nil || !next.Equal(start.Add(time.Duration(i)*time.Minute)) {
+			t.Fatalf("run %d is next at %v, want %v", i, next, start.Add(time.Duration(i)*time.Minute))
+		}
+		c.Advance(time.Minute)
+		if at := received(t, ran, "run"); !at.Equal(start.Add(time.Duration(i) * time.Minute)) {
+			t.Fatalf("run %d at %v, want %v", i, at, start.Add(time.Duration(i)*time.Minute))
+		}
+	}
+	st := jobSettled(t, s, 3)
+	if st.Runs != 3 || st.Failures != 0 || st.LastRun == nil || !st.LastRun.Equal(start.Add(3*time.Minute)) {
+		t.Fatalf("status = %+v, want three runs, the last at %v", st, start.Add(3*time.Minute))
+	}
+	if n := testutil.ToFloat64(jobRunsTotal.WithLabelValues("every_test", "ok")) - before; n != 3 {
+		t.Fatalf("counted %v ok runs, want 3", n)
+	}
+}
+
+func TestJobImmediately(t *testing.T) {
+	s, _, _ := startJobs(t, nil)
+	ran := make(chan struct{}, 1)
+	if err := s.Register(jobSpec{Name: "immediate_test", Every: time.Hour, Immediately: true,
+		Run: func(context.Context) error { ran <- struct{}{}; return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	received(t, ran, "run at startup")
+}
+
+func TestJobJitter(t *testing.T) {
+	s, c, _ := startJobs(t, nil)
+	s.jitter = func(d time.Duration) time.Duration { return d / 2 }
+	ran := make(chan struct{}, 1)
+	if err := s.Register(jobSpec{Name: "jitter_test", Every: time.Minute, Jitter: 20 * time.Second,
+		Run: func(context.Context) error { ran <- struct{}{}; return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	c.BlockUntil(t, 1)
+	c.Advance(time.Minute)
+	select {
+	case <-ran:
+		t.Fatal("ran before its jitter passed")
+	default:
+	}
+	c.Advance(10 * time.Second)
+	received(t, ran, "run after the jitter")
+
+	jitter := newJobScheduler(context.Background(), nil).jitter
+	for range 1000 {
+		if d := jitter(time.Second); d < 0 || d >= time.Second {
+			t.Fatalf("jitter of up to 1s = %v", d)
+		}
+	}
+}
+
+func TestJobOverlap(t *testing.T) {
+	for _, policy := range []overlapPolicy{overlapSkip, overlapQueue} {
+		t.Run(string(policy), func(t *testing.T) {
+			s, c, _ := startJobs(t, nil)
+			name := "overlap_" + string(policy) + "_test"
+			started, release := make(chan struct{}, 10), make(chan struct{})
+			if err := s.Register(jobSpec{Name: name, Every: time.Minute, Overlap: policy,
+				Run: func(context.Context) error { started <- struct{}{}; <-release; return nil }}); err != nil {
+				t.Fatal(err)
+			}
+			c.BlockUntil(t, 1)
+			c.Advance(time.Minute)
+			received(t, started, "first run")
+
+			// Due again while the first run is going
+			skippedBefore := testutil.ToFloat64(jobSkippedTotal.WithLabelValues(name, "overlap"))
+			c.BlockUntil(t, 1)
+			c.Advance(time.Minute)
+			// Only a skipping job waits for its next due time meanwhile
+			if policy == overlapSkip {
+				c.BlockUntil(t, 1)
+			}
+			skipped := testutil.ToFloat64(jobSkippedTotal.WithLabelValues(name, "overlap")) - skippedBefore
+			release <- struct{}{}
+
+			switch policy {
+			case overlapSkip:
+				if skipped != 1 || s.Status()[0].Skipped != 1 {
+					t.Fatalf("skipped %v runs, want 1", skipped)
+				}
+				jobSettled(t, s, 1)
+				c.Advance(time.Minute)
+			case overlapQueue:
+				if skipped != 0 {
+					t.Fatalf("skipped %v runs, want the run queued", skipped)
+				}
+			}
+			received(t, started, "second run")
+			release <- struct{}{}
+			jobSettled(t, s, 2)
+		})
+	}
+}
+
+func TestJobPause(t *testing.T) {
+	s, c, _ := startJobs(t, nil)
+	ran := make(chan struct{}, 10)
+	if err := s.Register(jobSpec{Name: "pause_test", Every: time.Minute,
+		Run: func(context.Context) error { ran <- struct{}{}; return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.SetPaused("pause_test", true)
+	if err != nil || !st.Paused {
+		t.Fatalf("pausing = %+v, %v", st, err)
+	}
+	if v := testutil.ToFloat64(jobPaused.WithLabelValues("pause_test")); v != 1 {
+		t.Fatalf("keygen_job_paused = %v, want 1", v)
+	}
+	c.BlockUntil(t, 1)
+	c.Advance(time.Minute)
+	c.BlockUntil(t, 1)
+	if st := s.Status()[0]; st.Runs != 0 || st.Skipped != 1 {
+		t.Fatalf("a paused job ran or was not skipped: %+v", st)
+	}
+
+	if _, err := s.SetPaused("pause_test", false); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Minute)
+	received(t, ran, "run once resumed")
+	if _, err := s.SetPaused("nope", true); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("pausing an unknown job = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestJobMaintenance(t *testing.T) {
+	maint := newMaintenanceSwitch(true, "")
+	s, c, _ := startJobs(t, maint)
+	before := testutil.ToFloat64(jobSkippedTotal.WithLabelValues("maint_skip_test", "maintenance"))
+	ran := make(chan string, 10)
+	for _, spec := range []jobSpec{{Name: "maint_skip_test"}, {Name: "maint_run_test", InMaintenance: true}} {
+		spec.Every = time.Minute
+		spec.Run = func(context.Context) error { ran <- spec.Name; return nil }
+		if err := s.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.BlockUntil(t, 2)
+	c.Advance(time.Minute)
+	if got := received(t, ran, "run in maintenance"); got != "maint_run_test" {
+		t.Fatalf("%s ran in maintenance mode", got)
+	}
+	c.BlockUntil(t, 2)
+	if n := testutil.ToFloat64(jobSkippedTotal.WithLabelValues("maint_skip_test", "maintenance")) - before; n != 1 {
+		t.Fatalf("counted %v maintenance skips, want 1", n)
+	}
+	select {
+	case got := <-ran:
+		t.Fatalf("%s ran twice", got)
+	default:
+	}
+}
+
+// TestJobShutdown cancels the scheduler mid-run: the run finishes with its
+// context intact, then the shutdown run is made, and only then does Wait
+// return.
+func TestJobShutdown(t *testing.T) {
+	s, c, cancel := startJobs(t, nil)
+	started, release := make(chan context.Context, 10), make(chan struct{})
+	if err := s.Register(jobSpec{Name: "shutdown_test", Every: time.Minute, AtShutdown: true,
+		Run: func(ctx context.Context) error { started <- ctx; <-release; return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	c.BlockUntil(t, 1)
+	c.Advance(time.Minute)
+	runCtx := received(t, started, "run")
+
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned with a run in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if runCtx.Err() != nil {
+		t.Fatal("shutdown cancelled a run that is not interruptible")
+	}
+	release <- struct{}{}
+	if ctx := received(t, started, "shutdown run"); ctx.Err() != nil {
+		t.Fatal("the shutdown run's context is cancelled")
+	}
+	release <- struct{}{}
+	received(t, waited, "Wait to return")
+	if st := s.Status()[0]; st.Runs != 2 || st.NextRun != nil {
+		t.Fatalf("status after shutdown = %+v, want two runs and none next", st)
+	}
+}
+
+func TestJobInterruptible(t *testing.T) {
+	s, c, cancel := startJobs(t, nil)
+	started := make(chan struct{}, 1)
+	if err := s.Register(jobSpec{Name: "interruptible_test", Every: time.Minute, Interruptible: true,
+		Run: func(ctx context.Context) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}}); err != nil {
+		t.Fatal(err)
+	}
+	c.BlockUntil(t, 1)
+	c.Advance(time.Minute)
+	received(t, started, "run")
+	cancel()
+	s.Wait()
+	if st := s.Status()[0]; st.Failures != 1 || st.LastError != context.Canceled.Error() {
+		t.Fatalf("status = %+v, want the run cancelled", st)
+	}
+}
+
+func TestJobFailure(t *testing.T) {
+	s, c, _ := startJobs(t, nil)
+	before := testutil.ToFloat64(jobRunsTotal.WithLabelValues("failure_test", "error"))
+	fail := true
+	if err := s.Register(jobSpec{Name: "failure_test", Every: time.Minute, Run: func(context.Context) error {
+		c.Advance(3 * time.Second)
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	c.BlockUntil(t, 1)
+	c.Advance(time.Minute)
+	st := jobSettled(t, s, 1)
+	if st.Failures != 1 || st.LastError != "boom" || st.LastSuccess != nil || st.LastDurationSeconds != 3 {
+		t.Fatalf("status after a failure = %+v", st)
+	}
+	if n := testutil.ToFloat64(jobRunsTotal.WithLabelValues("failure_test", "error")) - before; n != 1 {
+		t.Fatalf("counted %v failed runs, want 1", n)
+	}
+	if d := testutil.ToFloat64(jobLastDuration.WithLabelValues("failure_test")); d != 3 {
+		t.Fatalf("keygen_job_last_duration_seconds = %v, want 3", d)
+	}
+
+	fail = false
+	c.BlockUntil(t, 1)
+	c.Advance(time.Minute)
+	st = jobSettled(t, s, 2)
+	if st.LastError != "" || st.LastSuccess == nil || !st.LastSuccess.Equal(*st.LastRun) {
+		t.Fatalf("status after a success = %+v, want the error cleared", st)
+	}
+	if at := testutil.ToFloat64(jobLastSuccess.WithLabelValues("failure_test")); at != float64(st.LastRun.Unix()) {
+		t.Fatalf("keygen_job_last_success_timestamp_seconds = %v, want %d", at, st.LastRun.Unix())
+	}
+}
+
+func TestJobRegister(t *testing.T) {
+	run := func(context.Context) error { return nil }
+	tests := []struct {
+		spec    jobSpec
+		wantErr string
+	}{
+		{jobSpec{Name: "a", Every: time.Hour, Run: run}, ""},
+		{jobSpec{Name: "a", Every: time.Hour, Run: run}, "already registered"},
+		{jobSpec{Name: "b", Cron: "*/5 * * * *", Run: run}, ""},
+		{jobSpec{Name: "c", Every: time.Hour}, "needs a name and a Run"},
+		{jobSpec{Every: time.Hour, Run: run}, "needs a name and a Run"},
+		{jobSpec{Name: "d", Run: run}, "no schedule"},
+		{jobSpec{Name: "e", Every: time.Hour, Cron: "@daily", Run: run}, "both"},
+		{jobSpec{Name: "f", Cron: "61 * * * *", Run: run}, "invalid minute"},
+		{jobSpec{Name: "g", Every: time.Hour, Overlap: "wait", Run: run}, "overlap policy"},
+		// Overridden by JOB_SCHEDULES, so its own schedule does not matter
+		{jobSpec{Name: "overridden", Run: run}, ""},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newJobScheduler(ctx, nil)
+	s.overrides = map[string]jobSchedule{"overridden": everySchedule(time.Minute), "unknown": everySchedule(time.Minute)}
+	defer func() {
+		cancel()
+		s.Wait()
+	}()
+	for _, tt := range tests {
+		err := s.Register(tt.spec)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("Register(%s) = %v", tt.spec.Name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("Register(%s) = %v, want an error with %q", tt.spec.Name, err, tt.wantErr)
+		}
+	}
+	var names, schedules []string
+	for _, st := range s.Status() {
+		names, schedules = append(names, st.Name), append(schedules, st.Schedule)
+	}
+	if strings.Join(names, ",") != "a,b,overridden" || strings.Join(schedules, ",") != "@every 1h0m0s,*/5 * * * *,@every 1m0s" {
+		t.Fatalf("registered %v with schedules %v", names, schedules)
+	}
+	if got := s.Unregistered(); len(got) != 1 || got[0] != "unknown" {
+		t.Fatalf("unregistered overrides = %v, want unknown", got)
+	}
+}
+
+func TestParseJobSchedule(t *testing.T) {
+	for _, spec := range []string{"", "@every", "@every -1m", "@every soon", "@yearly", "* * * *", "* * * * * *",
+		"60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *",
+		"a * * * *", "0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		if _, err := parseJobSchedule(spec); err == nil {
+			t.Errorf("parseJobSchedule(%q) accepted it", spec)
+		}
+	}
+}
+
+func TestJobScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec, after, want string
+	}{
+		{"@every 90m", "2026-01-01 00:00", "2026-01-01 01:30"},
+		{"* * * * *", "2026-01-01 00:00", "2026-01-01 00:01"},
+		{"*/15 * * * *", "2026-01-01 00:07", "2026-01-01 00:15"},
+		{"*/15 * * * *", "2026-01-01 00:45", "2026-01-01 01:00"},
+		{"10,40 * * * *", "2026-01-01 00:10", "2026-01-01 00:40"},
+		{"5-7 9 * * *", "2026-01-01 09:07", "2026-01-02 09:05"},
+		{"@hourly", "2026-01-01 23:30", "2026-01-02 00:00"},
+		{"@daily", "2026-12-31 12:00", "2027-01-01 00:00"},
+		// 2026-01-01 is a Thursday
+		{"@weekly", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"0 0 * * 7", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"0 3 * * 1-5", "2026-01-02 04:00", "2026-01-05 03:00"},
+		{"@monthly", "2026-01-15 00:00", "2026-02-01 00:00"},
+		{"0 0 31 * *", "2026-02-01 00:00", "2026-03-31 00:00"},
+		{"0 0 29 2 *", "2026-01-01 00:00", "2028-02-29 00:00"},
+		// Day of month and day of week both restricted: either matches
+		{"0 0 13 * 5", "2026-01-01 00:00", "2026-01-02 00:00"},
+		{"0 0 13 * 5", "2026-01-10 00:00", "2026-01-13 00:00"},
+		{"30 2 1 1,7 *", "2026-01-01 02:30", "2026-07-01 02:30"},
+	}
+	for _, tt := range tests {
+		sched, err := parseJobSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("parseJobSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := sched.next(at(tt.after)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s = %s, want %s", tt.spec, tt.after, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+func TestParseJobSchedules(t *testing.T) {
+	got, err := parseJobSchedules("vacuum=0 3 * * 0; pick_result_purge = @every 30m;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["vacuum"].String() != "0 3 * * 0" || got["pick_result_purge"].String() != "@every 30m0s" {
+		t.Fatalf("parsed %v", got)
+	}
+	for _, bad := range []string{"vacuum", "vacuum=@every never", "vacuum=0 3 * *"} {
+		if _, err := parseJobSchedules(bad); err == nil {
+			t.Errorf("parseJobSchedules(%q) accepted it", bad)
+		}
+	}
+}
+
+func TestJobAdminEndpoints(t *testing.T) {
+	jobs, c, _ := startJobs(t, nil)
+	if err := jobs.Register(jobSpec{Name: "admin_test", Cron: "@daily", Run: func(context.Context) error { return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	c.BlockUntil(t, 1)
+	s := &server{jobs: jobs}
+	post := func(name, action string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/admin/jobs/"+name+"/"+action, nil)
+		r.SetPathValue("name", name)
+		w := httptest.NewRecorder()
+		s.handleJobPause(action == "pause")(w, r)
+		return w
+	}
+
+	w := post("admin_test", "pause")
+	var st jobStatus
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil || w.Code != http.StatusOK || !st.Paused {
+		t.Fatalf("pause = %d %+v (%v)", w.Code, st, err)
+	}
+	w = httptest.NewRecorder()
+	s.handleJobs(w, httptest.NewRequest(http.MethodGet, "/v1/admin/jobs", nil))
+	var list struct {
+		Jobs []jobStatus `json:"jobs"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || len(list.Jobs) != 1 || !list.Jobs[0].Paused ||
+		list.Jobs[0].Schedule != "@daily" || list.Jobs[0].NextRun == nil {
+		t.Fatalf("jobs = %+v (%v), want admin_test paused and next due", list.Jobs, err)
+	}
+	if w := post("admin_test", "resume"); w.Code != http.StatusOK || jobs.Status()[0].Paused {
+		t.Fatalf("resume = %d %s", w.Code, w.Body)
+	}
+	if w := post("nope", "pause"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "job_not_found") {
+		t.Fatalf("pausing an unknown job = %d %s, want job_not_found", w.Code, w.Body)
+	}
+	if got := (&server{}).jobs.Status(); got == nil || len(got) != 0 {
+		t.Fatalf("a server without jobs reports %v", got)
+	}
+}
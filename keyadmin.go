@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Release returns a picked key to the pool. Quarantined keys stay out.
+func (s *gormStore) Release(ctx context.Context, pub string) (bool, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var rows []struct{ MatchedPattern string }
+	err := db.Raw(`UPDATE token_key SET is_picked = false
+		WHERE public_key = ? AND is_picked = true AND quarantined = false RETURNING matched_pattern`, pub).
+		Scan(&rows).Error
+	if err != nil {
+		return false, ctxError(ctx, "release key", err)
+	}
+	for _, r := range rows {
+		s.logEvent(ctx, eventReleased, r.MatchedPattern, pub)
+	}
+	return len(rows) > 0, nil
+}
+
+// Quarantine takes the key with public key pub out of the pool for good.
+func (s *gormStore) Quarantine(ctx context.Context, pub string) (bool, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	// Only the first quarantine of a key goes in the discard ledger
+	var rows []struct {
+		MatchedPattern string
+		Was            bool
+	}
+	err := db.Raw(`UPDATE token_key t SET quarantined = true, is_picked = true
+		FROM (SELECT id, quarantined FROM token_key WHERE public_key = ? FOR UPDATE) old
+		WHERE t.id = old.id RETURNING t.matched_pattern, old.quarantined AS was`, pub).
+		Scan(&rows).Error
+	if err != nil {
+		return false, ctxError(ctx, "quarantine key", err)
+	}
+	for _, r := range rows {
+		if !r.Was {
+			s.discards.Record(discardQuarantine, r.MatchedPattern, pub, 0)
+			s.logEvent(ctx, eventQuarantined, r.MatchedPattern, pub)
+		}
+	}
+	return len(rows) > 0, nil
+}
+
+// handleKeyAction returns a handler applying action to the key named by
+// the body's public_key, or its label, for release and quarantine.
+func (s *server) handleKeyAction(name string, action func(context.Context, string) (bool, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			PublicKey string `json:"public_key"`
+			Label     string `json:"label"`
+			Reason    string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.PublicKey == "") == (req.Label == "") {
+			writeError(w, http.StatusBadRequest, "invalid_body", `request body must be JSON with a "public_key" or a "label"`, nil)
+			return
+		}
+		detail := "public_key=" + req.PublicKey
+		if req.Label != "" {
+			pub, err := s.store.PublicKeyByLabel(r.Context(), req.Label)
+			if errors.Is(err, ErrLabelNotFound) {
+				writeError(w, http.StatusNotFound, "key_not_found", "no key with this label", nil)
+				return
+			}
+			if err != nil {
+				log.Printf("Error in %s: %v\n", name, err)
+				writeError(w, http.StatusInternalServerError, "internal", "failed to "+name+" key", nil)
+				return
+			}
+			req.PublicKey = pub
+			detail = "public_key=" + pub + " label=" + req.Label
+		}
+
+		ok, err := action(r.Context(), req.PublicKey)
+		if err != nil {
+			log.Printf("Error in %s: %v\n", name, err)
+			writeError(w, http.StatusInternalServerError, "internal", "failed to "+name+" key", nil)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "key_not_found", "no key to "+name+" with this public key", nil)
+			return
+		}
+		audit(r.Context(), name, detail+" reason="+strconv.Quote(req.Reason))
+		writeJSON(w, http.StatusOK, map[string]any{"public_key": req.PublicKey, "status": name + "d"})
+	}
+}
+
+// handleExport returns one page of keys, paged and filtered by the shared
+// list parameters (status is unpicked, picked or quarantined; from and to
+// bound the creation time), and also by short form, e.g.
+// short=Abcd...ponz, by checksum=1a2b3c4d, which returns every key sharing
+// it, or by label. Private keys are only included with
+// include_private_key=true.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	page, perr := parsePageParams(qs, pageLimits{Default: 100, Max: 10000}, "pattern", "status", "from", "to")
+	if perr != nil {
+		writeError(w, http.StatusBadRequest, perr.Code, perr.Message, nil)
+		return
+	}
+	if page.Status != "" && !slices.Contains(keyStatuses, page.Status) {
+		writeError(w, http.StatusBadRequest, "invalid_status", "status must be one of "+strings.Join(keyStatuses, ", "), nil)
+		return
+	}
+	q := listQuery{Pattern: page.Pattern, Status: page.Status, From: page.From, To: page.To, Label: qs.Get("label"),
+		Limit: page.Limit, Cursor: page.Cursor, Desc: page.Desc}
+	if val := qs.Get("short"); val != "" {
+		first, last, ok := parseShortForm(val)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_short", "short must be the first 4 and last 4 characters joined by … or ...", nil)
+			return
+		}
+		q.ShortFirst, q.ShortLast = first, last
+	}
+	if val := qs.Get("checksum"); val != "" {
+		if !validChecksum(val) {
+			writeError(w, http.StatusBadRequest, "invalid_checksum", "checksum must be 8 hex digits", nil)
+			return
+		}
+		q.Checksum = strings.ToLower(val)
+	}
+	// picked and created_after predate status and from
+	if val := qs.Get("picked"); val != "" {
+		v, err := strconv.ParseBool(val)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_picked", "picked must be true or false", nil)
+			return
+		}
+		q.Picked = &v
+	}
+	if val := qs.Get("created_after"); val != "" {
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_created_after", "created_after must be an RFC 3339 time", nil)
+			return
+		}
+		q.CreatedAfter = t
+	}
+	withPrivate := qs.Get("include_private_key") == "true"
+
+	keys, next, err := s.store.List(r.Context(), q)
+	if errors.Is(err, errInvalidCursor) {
+		writeError(w, http.StatusBadRequest, "invalid_cursor", err.Error(), nil)
+		return
+	}
+	if err != nil {
+		log.Println("Error exporting keys:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to export keys", nil)
+		return
+	}
+
+	out := make([]keyResponse, 0, len(keys))
+	for _, k := range keys {
+		kr := newKeyResponse(k)
+		if !withPrivate {
+			kr.PrivateKey = ""
+		}
+		out = append(out, kr)
+	}
+	audit(r.Context(), "export", "count="+strconv.Itoa(len(out))+" include_private_key="+strconv.FormatBool(withPrivate))
+	writeJSON(w, http.StatusOK, map[string]any{"keys": out, "next_cursor": next})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mr-tron/base58/base58"
+)
+
+// writeKeyFile writes kp into dir as <pubkey>.json using the solana-keygen
+// byte-array format, replacing any previous file, and syncs the directory
+// so the file survives a crash.
+func writeKeyFile(dir string, kp Keypair) error {
+	if err := saveKeyFile(dir, kp, true); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// errKeyFileExists is a key file saveKeyFile was not allowed to replace.
+var errKeyFileExists = errors.New("key file already exists")
+
+// saveKeyFile writes kp into dir as <pubkey>.json using the solana-keygen
+// byte-array format. The file is written to a temp file first and moved
+// into place so a crash never leaves a partial keypair behind; without
+// overwrite an existing file is left alone and errKeyFileExists returned.
+// The caller syncs dir.
+func saveKeyFile(dir string, kp Keypair, overwrite bool) error {
+	priv, err := base58.Decode(kp.Priv)
+	if err != nil {
+		return fmt.Errorf("decode private key: %w", err)
+	}
+
+	ints := make([]int, len(priv))
+	for i, b := range priv {
+		ints[i] = int(b)
+	}
+	data, err := json.Marshal(ints)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+kp.Pub+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, kp.Pub+".json")
+	if overwrite {
+		return os.Rename(tmp.Name(), path)
+	}
+	// Linking fails rather than replace, and the temp name is removed after
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%s: %w", path, errKeyFileExists)
+		}
+		return err
+	}
+	return nil
+}
+
+// cmdExportKeygenDir implements the "export-keygen-dir" subcommand: every
+// key matching the filters written into a directory as <pubkey>.json files
+// solana-keygen reads, decrypted if the pool is encrypted. Keys are read a
+// page at a time, so the pool never has to fit in memory. Existing files
+// stop the export unless -force is given.
+func cmdExportKeygenDir(ctx context.Context, store *gormStore, args []string) error {
+	fset := flag.NewFlagSet("export-keygen-dir", flag.ContinueOnError)
+	picked := fset.String("picked", "", "filter by is_picked (true or false)")
+	pattern := fset.String("pattern", "", "filter by matched pattern")
+	after := fset.String("created-after", "", "only keys created after this RFC3339 time")
+	force := fset.Bool("force", false, "overwrite existing key files")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		return errors.New("usage: export-keygen-dir [-picked true|false] [-pattern P] [-created-after T] [-force] <dir>")
+	}
+	dir := fset.Arg(0)
+
+	q := listQuery{Pattern: *pattern, Limit: 500}
+	if *picked != "" {
+		v, err := strconv.ParseBool(*picked)
+		if err != nil {
+			return fmt.Errorf("invalid -picked %q", *picked)
+		}
+		q.Picked = &v
+	}
+	if *after != "" {
+		t, err := time.Parse(time.RFC3339, *after)
+		if err != nil {
+			return fmt.Errorf("invalid -created-after %q", *after)
+		}
+		q.CreatedAfter = t
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	if n, err := cleanKeyDir(dir); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("Removed %d partial key files left in %s by an interrupted export\n", n, dir)
+	}
+
+	written := 0
+	for {
+		keys, next, err := store.List(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := saveKeyFile(dir, Keypair{Priv: k.PrivateKey, Pub: k.PublicKey}, *force); err != nil {
+				return fmt.Errorf("after %d keys: %w", written, err)
+			}
+			written++
+		}
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	log.Printf("Exported %d keys to %s\n", written, dir)
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// cleanKeyDir removes temp files a crash mid-write left in dir and returns
+// how many there were. Finished key files are never touched; a missing dir
+// is not an error.
+func cleanKeyDir(dir string) (int, error) {
+	leftovers, err := filepath.Glob(filepath.Join(dir, ".*.tmp"))
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range leftovers {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, err
+		}
+	}
+	return len(leftovers), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mr-tron/base58/base58"
+)
+
+// readKeyFile reads a solana-keygen byte-array file back into a key.
+func readKeyFile(t *testing.T, path string) ed25519.PrivateKey {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ints []int
+	if err := json.Unmarshal(data, &ints); err != nil {
+		t.Fatalf("%s is not a byte array: %v", path, err)
+	}
+	key := make(ed25519.PrivateKey, len(ints))
+	for i, v := range ints {
+		key[i] = byte(v)
+	}
+	return key
+}
+
+func TestWriteKeyFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	kp := Keypair{Priv: testPriv("k1"), Pub: testPub("k1")}
+	if err := writeKeyFile(dir, kp); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, kp.Pub+".json")
+	key := readKeyFile(t, path)
+	if base58.Encode(key) != kp.Priv {
+		t.Fatal("the key file does not hold the private key")
+	}
+	if pub := base58.Encode(key.Public().(ed25519.PublicKey)); pub != kp.Pub {
+		t.Fatalf("the key file is for %s, want %s", pub, kp.Pub)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("key file mode = %v, want 0600", mode)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("dir holds %d files, want only the key file", len(entries))
+	}
+
+	// A rewrite replaces the file in place
+	if err := writeKeyFile(dir, kp); err != nil {
+		t.Fatalf("rewriting the key file: %v", err)
+	}
+	if base58.Encode(readKeyFile(t, path)) != kp.Priv {
+		t.Fatal("the rewritten key file does not hold the private key")
+	}
+}
+
+func TestSaveKeyFileKeepsExisting(t *testing.T) {
+	dir := t.TempDir()
+	kp := Keypair{Priv: testPriv("k1"), Pub: testPub("k1")}
+	path := filepath.Join(dir, kp.Pub+".json")
+	if err := os.WriteFile(path, []byte("[]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveKeyFile(dir, kp, false); !errors.Is(err, errKeyFileExists) {
+		t.Fatalf("saveKeyFile over an existing file = %v, want errKeyFileExists", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "[]" {
+		t.Fatalf("existing file was replaced with %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("dir holds %d files, want the temp file removed", len(entries))
+	}
+}
+
+func TestCleanKeyDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{".k1.123.tmp", ".k2.456.tmp", "k3.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := cleanKeyDir(dir); err != nil || n != 2 {
+		t.Fatalf("cleanKeyDir = %d, %v; want 2", n, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != "k3.json" {
+		t.Fatalf("left %v, want only the finished key file", entries)
+	}
+	if n, err := cleanKeyDir(filepath.Join(dir, "missing")); err != nil || n != 0 {
+		t.Fatalf("cleanKeyDir of a missing dir = %d, %v", n, err)
+	}
+}
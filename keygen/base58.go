@@ -0,0 +1,39 @@
+package keygen
+
+// encodedLen is the longest base58 encoding of a 32-byte public key.
+const encodedLen = 44
+
+// encodeBase58 writes the base58 encoding of src, at most 32 bytes, into
+// buf and returns it, so the hot loop encodes every candidate without
+// allocating. It matches base58.Encode.
+func encodeBase58(buf *[encodedLen]byte, src []byte) []byte {
+	zeros := 0
+	for zeros < len(src) && src[zeros] == 0 {
+		zeros++
+	}
+	// Base-58 digits of the rest, least significant first
+	var digits [encodedLen]byte
+	n := 0
+	for _, c := range src[zeros:] {
+		carry := uint32(c)
+		for i := 0; i < n; i++ {
+			carry += uint32(digits[i]) << 8
+			digits[i] = byte(carry % 58)
+			carry /= 58
+		}
+		for carry > 0 {
+			digits[n] = byte(carry % 58)
+			carry /= 58
+			n++
+		}
+	}
+
+	out := buf[:0]
+	for range zeros {
+		out = append(out, '1')
+	}
+	for i := n - 1; i >= 0; i-- {
+		out = append(out, Alphabet[digits[i]])
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package keygen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Equivalence makes characters of the same class interchangeable when
+// matching, e.g. "z2,sS" accepts "2" wherever a pattern has "z" and the
+// other way round. Unlike Edit it keeps lengths and positions fixed. The
+// zero Equivalence treats every character as itself.
+type Equivalence struct {
+	canon [256]byte
+	spec  string
+}
+
+// ParseEquivalence parses comma-separated classes of base58 characters.
+// A character may be in one class only.
+func ParseEquivalence(spec string) (Equivalence, error) {
+	var e Equivalence
+	var classes []string
+	for _, class := range strings.Split(spec, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		if len(class) < 2 {
+			return Equivalence{}, fmt.Errorf("class %q needs at least two characters", class)
+		}
+		for i := 0; i < len(class); i++ {
+			c := class[i]
+			if strings.IndexByte(Alphabet, c) < 0 {
+				return Equivalence{}, fmt.Errorf("%q in class %q is not in the base58 alphabet", c, class)
+			}
+			if e.canon[c] != 0 {
+				return Equivalence{}, fmt.Errorf("%q is in more than one class", c)
+			}
+			// The first character of the class stands for all of them
+			e.canon[c] = class[0]
+		}
+		classes = append(classes, class)
+	}
+	e.spec = strings.Join(classes, ",")
+	return e, nil
+}
+
+// String is the normalized spec, "" for the zero Equivalence.
+func (e Equivalence) String() string { return e.spec }
+
+// Active reports whether any characters are interchangeable.
+func (e Equivalence) Active() bool { return e.spec != "" }
+
+func (e *Equivalence) of(c byte) byte {
+	if k := e.canon[c]; k != 0 {
+		return k
+	}
+	return c
+}
+
+// Canonical replaces every character by its class's first character.
+func (e Equivalence) Canonical(s string) string {
+	if !e.Active() {
+		return s
+	}
+	b := []byte(s)
+	for i, c := range b {
+		b[i] = e.of(c)
+	}
+	return string(b)
+}
+
+// equal reports whether a and b, of the same length, are equivalent.
+func (e *Equivalence) equal(a, b string) bool {
+	for i := 0; i < len(a); i++ {
+		if e.of(a[i]) != e.of(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasSuffix, HasPrefix and Contains are the strings functions up to e.
+func (e Equivalence) HasSuffix(s, suffix string) bool {
+	return len(s) >= len(suffix) && e.equal(s[len(s)-len(suffix):], suffix)
+}
+
+func (e Equivalence) HasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && e.equal(s[:len(prefix)], prefix)
+}
+
+func (e Equivalence) Contains(s, substr string) bool {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if e.equal(s[i:i+len(substr)], substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply rebuilds a Suffix, Prefix or Contains pattern to match up to e,
+// keeping its name. Other patterns, and every pattern under the zero
+// Equivalence, are returned unchanged.
+func (e Equivalence) apply(p Pattern) Pattern {
+	if !e.Active() {
+		return p
+	}
+	text := p.text
+	switch p.kind {
+	case "suffix":
+		p.Match = func(addr string) bool { return e.HasSuffix(addr, text) }
+	case "prefix":
+		p.Match = func(addr string) bool { return e.HasPrefix(addr, text) }
+	case "contains":
+		p.Match = func(addr string) bool { return e.Contains(addr, text) }
+	}
+	return p
+}
+
+// WithEquivalence makes the Suffix, Prefix and Contains patterns match up
+// to e. Edit patterns stay exact.
+func WithEquivalence(e Equivalence) Option {
+	return func(g *Generator) { g.equiv = e }
+}
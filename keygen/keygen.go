@@ -0,0 +1,432 @@
+// Package keygen grinds ed25519 keypairs whose base58 Solana address
+// satisfies one of a set of patterns.
+package keygen
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"filippo.io/edwards25519"
+	"github.com/mr-tron/base58/base58"
+)
+
+// Pattern is one rule a generated address may satisfy. Name is reported on
+// keys found by it. Match sees a view of a reused buffer and must not keep
+// addr.
+type Pattern struct {
+	Name  string
+	Match func(addr string) bool
+
+	// kind and text let WithEquivalence rebuild Match; empty for patterns
+	// it does not apply to.
+	kind, text string
+}
+
+// Suffix returns a Pattern matching addresses ending in s. It anchors at
+// the last character whatever the address length, so s starts one index
+// earlier in a 43-character address than in a 44-character one, and never
+// matches an address shorter than itself.
+func Suffix(s string) Pattern {
+	return Pattern{Name: s, Match: func(addr string) bool { return strings.HasSuffix(addr, s) }, kind: "suffix", text: s}
+}
+
+// Prefix returns a Pattern matching addresses starting with s. A
+// 44-character address only starts with 1 to J, so a prefix starting with
+// a later character matches 43-character addresses only.
+func Prefix(s string) Pattern {
+	return Pattern{Name: s + "*", Match: func(addr string) bool { return strings.HasPrefix(addr, s) }, kind: "prefix", text: s}
+}
+
+// Any returns a Pattern matching every address, for plain keypairs. It is
+// named "*".
+func Any() Pattern {
+	return Pattern{Name: "*", Match: func(string) bool { return true }}
+}
+
+// Contains returns a Pattern matching addresses with s anywhere in them. It
+// is named "*s*".
+func Contains(s string) Pattern {
+	return Pattern{Name: "*" + s + "*", Match: func(addr string) bool { return strings.Contains(addr, s) }, kind: "contains", text: s}
+}
+
+// Edit returns a Pattern matching addresses whose last len(word)
+// characters are within Levenshtein distance d of word, anchored at the
+// end like Suffix. It is named "~word/d".
+func Edit(word string, d int) Pattern {
+	return Pattern{
+		Name: "~" + word + "/" + strconv.Itoa(d),
+		Match: func(addr string) bool {
+			return len(addr) >= len(word) && Levenshtein(addr[len(addr)-len(word):], word) <= d
+		},
+	}
+}
+
+// Levenshtein returns the edit distance between a and b, counting byte
+// insertions, deletions and substitutions.
+func Levenshtein(a, b string) int {
+	// One row of the DP table; words are short, so avoid allocating for them
+	var buf [32]int
+	row := buf[:0]
+	if len(b)+1 > len(buf) {
+		row = make([]int, 0, len(b)+1)
+	}
+	for j := 0; j <= len(b); j++ {
+		row = append(row, j)
+	}
+	for i := 1; i <= len(a); i++ {
+		diag := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := min(row[j]+1, row[j-1]+1, diag+cost)
+			diag, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
+
+// Key is a found keypair.
+type Key struct {
+	PrivateKey ed25519.PrivateKey
+	Address    string
+	Pattern    string
+	// Attempts is the number of candidates tried since the previous find.
+	// It is exact for Find and approximate for keys streamed by Run.
+	Attempts int64
+}
+
+// Option configures a Generator.
+type Option func(*Generator)
+
+// WithWorkers sets the number of grinding goroutines. Default 1.
+func WithWorkers(n int) Option {
+	return func(g *Generator) { g.workers = max(1, n) }
+}
+
+// WithPattern adds a pattern. Patterns are tried in the order given and a
+// key is attributed to the first one it matches.
+func WithPattern(p Pattern) Option {
+	return func(g *Generator) { g.patterns = append(g.patterns, p) }
+}
+
+// WithEntropy replaces crypto/rand as the source of key seeds. Reads are
+// serialised, so src need not be safe for concurrent use.
+func WithEntropy(src io.Reader) Option {
+	return func(g *Generator) { g.entropy = &lockedReader{r: src} }
+}
+
+// WithRateReporter calls fn about once a second while grinding with the
+// total attempts so far and the attempt rate over the last interval.
+func WithRateReporter(fn func(attempts int64, perSecond float64)) Option {
+	return func(g *Generator) { g.report = fn }
+}
+
+// WithDutyCycle makes each worker grind for only duty (0, 1] of every
+// 100ms window, resting for the remainder.
+func WithDutyCycle(duty float64) Option {
+	return func(g *Generator) {
+		if duty > 0 && duty <= 1 {
+			g.duty = duty
+		}
+	}
+}
+
+// WithRamp staggers worker starts evenly over d instead of starting them
+// all at once. Zero starts every worker immediately.
+func WithRamp(d time.Duration) Option {
+	return func(g *Generator) { g.ramp = max(0, d) }
+}
+
+// WithFilter adds a predicate every key must also satisfy. Filters only run
+// on candidates that already matched a pattern, so they may be costlier.
+func WithFilter(f func(addr string) bool) Option {
+	return func(g *Generator) { g.filters = append(g.filters, f) }
+}
+
+// WithCheck adds a predicate like WithFilter that can also fail. The first
+// error stops every worker and is returned by Find or Run.
+func WithCheck(f func(addr string) (bool, error)) Option {
+	return func(g *Generator) { g.checks = append(g.checks, f) }
+}
+
+// WithSampler calls fn with about every nth candidate address across all
+// workers and whether it was accepted, for debugging the matcher. fn never
+// sees private keys and may be called concurrently.
+func WithSampler(n int64, fn func(addr string, matched bool)) Option {
+	return func(g *Generator) {
+		if n > 0 {
+			g.sampleEvery, g.sample = n, fn
+		}
+	}
+}
+
+// WithAddressLength skips candidates whose address is not exactly n
+// characters before pattern matching. Zero allows any length.
+func WithAddressLength(n int) Option {
+	return func(g *Generator) { g.addrLen = max(0, n) }
+}
+
+// TrailingDigits returns a filter requiring at least need digits among the
+// last window characters of the address.
+func TrailingDigits(window, need int) func(string) bool {
+	return func(addr string) bool {
+		start := max(0, len(addr)-window)
+		n := 0
+		for i := start; i < len(addr); i++ {
+			if c := addr[i]; c >= '0' && c <= '9' {
+				n++
+				if n >= need {
+					return true
+				}
+			}
+		}
+		return n >= need
+	}
+}
+
+const dutyInterval = 100 * time.Millisecond
+
+// flushEvery is how many attempts a worker batches before publishing them
+// to the shared counter, keeping the hot loop free of atomic contention.
+const flushEvery = 256
+
+// Generator grinds keys for a set of patterns.
+type Generator struct {
+	workers  int
+	patterns []Pattern
+	filters  []func(string) bool
+	checks   []func(string) (bool, error)
+	entropy  io.Reader
+	report   func(int64, float64)
+	duty     float64
+	addrLen  int
+	ramp     time.Duration
+
+	sampleEvery int64
+	sample      func(string, bool)
+	equiv       Equivalence
+
+	attempts atomic.Int64
+}
+
+// NewGenerator returns a Generator configured by opts.
+func NewGenerator(opts ...Option) *Generator {
+	g := &Generator{workers: 1, entropy: rand.Reader, duty: 1}
+	for _, o := range opts {
+		o(g)
+	}
+	for i, p := range g.patterns {
+		g.patterns[i] = g.equiv.apply(p)
+	}
+	return g
+}
+
+// Attempts returns the total number of candidates tried so far.
+func (g *Generator) Attempts() int64 { return g.attempts.Load() }
+
+var errStop = errors.New("stop")
+
+// Find grinds until one key matches and returns it.
+func (g *Generator) Find(ctx context.Context) (Key, error) {
+	var key Key
+	start := g.Attempts()
+	err := g.Run(ctx, func(k Key) error {
+		key = k
+		return errStop
+	})
+	if errors.Is(err, errStop) {
+		// Run has waited for the workers, so every attempt is flushed.
+		key.Attempts = g.Attempts() - start
+		return key, nil
+	}
+	return Key{}, err
+}
+
+// Run grinds until ctx is done or fn returns an error, calling fn for each
+// matching key. fn is never called concurrently. Run returns fn's error,
+// the first entropy read error, or ctx.Err().
+func (g *Generator) Run(ctx context.Context, fn func(Key) error) error {
+	if len(g.patterns) == 0 {
+		return errors.New("keygen: no patterns configured")
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	found := make(chan Key)
+	var wg sync.WaitGroup
+	wg.Add(g.workers)
+	for i := 0; i < g.workers; i++ {
+		delay := g.ramp * time.Duration(i) / time.Duration(g.workers)
+		go func() {
+			defer wg.Done()
+			if delay > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+			}
+			if err := g.work(ctx, found); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	var ticker <-chan time.Time
+	if g.report != nil {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		ticker = t.C
+	}
+	lastReport, lastAttempts := time.Now(), g.Attempts()
+	lastFind := g.Attempts()
+
+	for {
+		select {
+		case <-ticker:
+			now, total := time.Now(), g.Attempts()
+			g.report(total, float64(total-lastAttempts)/now.Sub(lastReport).Seconds())
+			lastReport, lastAttempts = now, total
+		case k, ok := <-found:
+			if !ok {
+				return context.Cause(ctx)
+			}
+			total := g.Attempts()
+			k.Attempts, lastFind = total-lastFind, total
+			if err := fn(k); err != nil {
+				cancel(err)
+				for range found {
+				}
+				wg.Wait()
+				return err
+			}
+		}
+	}
+}
+
+// work grinds candidates until ctx is done. The loop reuses its seed,
+// hash, scalar, point and address buffers and matches patterns against a
+// string view of the address buffer, so a candidate allocates nothing until
+// it matches.
+func (g *Generator) work(ctx context.Context, found chan<- Key) error {
+	var n int64
+	defer func() { g.attempts.Add(n % flushEvery) }()
+
+	var (
+		seed  [ed25519.SeedSize]byte
+		s     edwards25519.Scalar
+		point edwards25519.Point
+		enc   [encodedLen]byte
+	)
+	busy := time.Duration(g.duty * float64(dutyInterval))
+	// each worker samples its own share so the total rate is about 1 in sampleEvery
+	sampleEvery := g.sampleEvery * int64(g.workers)
+	windowStart := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		n++
+		if n%flushEvery == 0 {
+			g.attempts.Add(flushEvery)
+			if g.duty < 1 && time.Since(windowStart) >= busy {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(dutyInterval - busy):
+				}
+				windowStart = time.Now()
+			}
+		}
+
+		if _, err := io.ReadFull(g.entropy, seed[:]); err != nil {
+			return err
+		}
+		// The public key derivation of ed25519.NewKeyFromSeed, into reused values
+		h := sha512.Sum512(seed[:])
+		if _, err := s.SetBytesWithClamping(h[:32]); err != nil {
+			return err
+		}
+		b := encodeBase58(&enc, point.ScalarBaseMult(&s).Bytes())
+		// Only valid until the next candidate; copied before it escapes
+		view := unsafe.String(&b[0], len(b))
+
+		matched, addr := "", ""
+		if g.addrLen == 0 || len(view) == g.addrLen {
+			for _, p := range g.patterns {
+				if p.Match(view) {
+					addr = strings.Clone(view)
+					ok, err := g.accept(addr)
+					if err != nil {
+						return err
+					}
+					if ok {
+						matched = p.Name
+					}
+					break
+				}
+			}
+		}
+		if sampleEvery > 0 && n%sampleEvery == 0 {
+			g.sample(cmp.Or(addr, strings.Clone(view)), matched != "")
+		}
+		if matched != "" {
+			priv := ed25519.NewKeyFromSeed(seed[:])
+			if base58.Encode(priv[ed25519.SeedSize:]) != addr {
+				return errors.New("keygen: derived address does not match the key")
+			}
+			select {
+			case found <- Key{PrivateKey: priv, Address: addr, Pattern: matched}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func (g *Generator) accept(addr string) (bool, error) {
+	for _, f := range g.filters {
+		if !f(addr) {
+			return false, nil
+		}
+	}
+	for _, f := range g.checks {
+		if ok, err := f(addr); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
@@ -0,0 +1,102 @@
+package keygen
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// never is a pattern no address matches, so a run only counts attempts.
+var never = Pattern{Name: "never", Match: func(string) bool { return false }}
+
+// grind runs a single worker at duty for d and returns its attempts.
+func grind(t *testing.T, duty float64, d time.Duration) int64 {
+	t.Helper()
+	g := NewGenerator(WithPattern(never), WithDutyCycle(duty))
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if err := g.Run(ctx, func(Key) error { return nil }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run = %v, want the deadline", err)
+	}
+	return g.Attempts()
+}
+
+func TestDutyCycleLowersAttemptRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("grinds for real time")
+	}
+	const d = 500 * time.Millisecond
+	full := grind(t, 1, d)
+	if full == 0 {
+		t.Fatal("no attempts at full duty")
+	}
+	// The duty check runs once per flushEvery attempts, so it cannot rest
+	// inside a window that one batch outlasts, as under the race detector
+	if batch := d * flushEvery / time.Duration(full); batch > dutyInterval/2 {
+		t.Skipf("a batch of %d attempts takes %v, too slow for the %v duty window", flushEvery, batch, dutyInterval)
+	}
+	low := grind(t, 0.1, d)
+	// A tenth of each window, with slack for the batched duty check
+	// overrunning the busy part on a slow or instrumented build
+	if low*2 > full {
+		t.Fatalf("duty 0.1 made %d attempts against %d at full duty", low, full)
+	}
+}
+
+func TestDutyCycleIgnoresOutOfRange(t *testing.T) {
+	for _, duty := range []float64{0, -0.5, 1.5} {
+		if g := NewGenerator(WithDutyCycle(duty)); g.duty != 1 {
+			t.Errorf("WithDutyCycle(%v) set duty %v, want the default 1", duty, g.duty)
+		}
+	}
+	if g := NewGenerator(WithDutyCycle(0.5)); g.duty != 0.5 {
+		t.Errorf("WithDutyCycle(0.5) set duty %v", g.duty)
+	}
+}
+
+func TestTrailingDigits(t *testing.T) {
+	for _, tc := range []struct {
+		addr         string
+		window, need int
+		want         bool
+	}{
+		{"abcdef12", 4, 2, true},
+		{"abcdef1x", 4, 2, false},
+		{"12abcdef", 4, 2, false},
+		// digits just outside the window do not count
+		{"ab1cdef2", 5, 2, false},
+		{"ab1cdef2", 6, 2, true},
+		{"a1b2c3d4", 8, 4, true},
+		{"a1b2c3d4", 8, 5, false},
+		// a window wider than the address covers all of it
+		{"9z9", 10, 2, true},
+		{"", 4, 1, false},
+		{"abc", 4, 0, true},
+		// base58 letters that look like digits are not digits
+		{"xxxxlIoO", 4, 1, false},
+	} {
+		if got := TrailingDigits(tc.window, tc.need)(tc.addr); got != tc.want {
+			t.Errorf("TrailingDigits(%d, %d)(%q) = %v, want %v", tc.window, tc.need, tc.addr, got, tc.want)
+		}
+	}
+}
+
+// TestTrailingDigitsWithSuffix checks the filter composes with a suffix
+// pattern: every key found ends in the suffix and has the digits.
+func TestTrailingDigitsWithSuffix(t *testing.T) {
+	// The suffix is itself a digit, so the filter asks for one more
+	digits := TrailingDigits(4, 2)
+	g := NewGenerator(WithPattern(Suffix("1")), WithFilter(digits), WithWorkers(2))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		k, err := g.Find(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Suffix("1").Match(k.Address) || !digits(k.Address) {
+			t.Fatalf("found %s, which fails the suffix or the digit filter", k.Address)
+		}
+	}
+}
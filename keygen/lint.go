@@ -0,0 +1,144 @@
+package keygen
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Alphabet is the base58 alphabet Solana addresses are written in. It
+// leaves out 0, O, I and l.
+const Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// maxAddressLen is the longest base58 encoding of a 32-byte public key.
+const maxAddressLen = 44
+
+// Severity ranks a LintFinding. Only SeverityError makes a pattern
+// unusable.
+type Severity string
+
+const (
+	SeverityError Severity = "error"
+	SeverityWarn  Severity = "warn"
+)
+
+// LintFinding is one problem with one character of a pattern. Pos is the
+// rune index of Char, and Substitutes the base58 characters a user most
+// likely meant, if any.
+type LintFinding struct {
+	Severity    Severity
+	Pos         int
+	Char        rune
+	Message     string
+	Substitutes string
+}
+
+// LintReport is what Lint found in a pattern. Difficulty is the expected
+// attempts to match it at a fixed position, and IgnoreCaseSpeedup how many
+// times fewer a case-insensitive match would need: the generator only
+// matches case exactly.
+type LintReport struct {
+	Text              string
+	Findings          []LintFinding
+	Difficulty        float64
+	IgnoreCaseSpeedup float64
+}
+
+// HasErrors reports whether any finding makes the pattern unusable.
+func (r LintReport) HasErrors() bool {
+	for _, f := range r.Findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidSubstitutes maps characters outside the alphabet to the base58
+// characters usually meant by them.
+var invalidSubstitutes = map[rune]string{
+	'0': "o",
+	'O': "o",
+	'I': "1i",
+	'l': "1Li",
+}
+
+// lookalikes maps valid characters to the characters they are easily read
+// as, so a pattern containing them is easy to misread or mistype.
+var lookalikes = map[rune]string{
+	'o': "0O",
+	'1': "lI",
+	'i': "jl",
+	'j': "i",
+	'L': "1",
+	'2': "Z",
+	'Z': "2",
+	'5': "S",
+	'S': "5",
+	'8': "B",
+	'B': "8",
+	'6': "G",
+	'G': "6",
+	'9': "q",
+	'q': "9",
+	'u': "v",
+	'v': "u",
+}
+
+// Lint checks a pattern's text for characters that cannot appear in an
+// address, characters easily confused with others, and how much its case
+// sensitivity costs. It has no side effects, so tooling outside this
+// program can run it on candidate patterns.
+func Lint(text string) LintReport {
+	r := LintReport{Text: text, IgnoreCaseSpeedup: 1}
+	n := 0
+	for i, c := range []rune(text) {
+		n++
+		if !strings.ContainsRune(Alphabet, c) {
+			f := LintFinding{Severity: SeverityError, Pos: i, Char: c, Substitutes: invalidSubstitutes[c]}
+			f.Message = fmt.Sprintf("%q is not in the base58 alphabet and never appears in an address", c)
+			if f.Substitutes != "" {
+				f.Message += fmt.Sprintf("; did you mean %s?", orList(f.Substitutes))
+			}
+			r.Findings = append(r.Findings, f)
+			continue
+		}
+		if like, ok := lookalikes[c]; ok {
+			r.Findings = append(r.Findings, LintFinding{Severity: SeverityWarn, Pos: i, Char: c,
+				Message: fmt.Sprintf("%q is easily confused with %s", c, orList(like))})
+		}
+		// Both cases of a letter would match if case were ignored
+		if other := swapCase(c); other != c && strings.ContainsRune(Alphabet, other) {
+			r.IgnoreCaseSpeedup *= 2
+		}
+	}
+	if n == 0 {
+		r.Findings = append(r.Findings, LintFinding{Severity: SeverityError, Pos: -1, Message: "pattern is empty"})
+	}
+	if n > maxAddressLen {
+		r.Findings = append(r.Findings, LintFinding{Severity: SeverityError, Pos: -1,
+			Message: fmt.Sprintf("pattern is %d characters but addresses are at most %d", n, maxAddressLen)})
+	}
+	r.Difficulty = math.Pow(float64(len(Alphabet)), float64(n))
+	return r
+}
+
+func swapCase(c rune) rune {
+	if unicode.IsUpper(c) {
+		return unicode.ToLower(c)
+	}
+	return unicode.ToUpper(c)
+}
+
+// orList renders chars as "'a', 'b' or 'c'".
+func orList(chars string) string {
+	var parts []string
+	for _, c := range chars {
+		parts = append(parts, fmt.Sprintf("%q", c))
+	}
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return strings.Join(parts[:len(parts)-1], ", ") + " or " + parts[len(parts)-1]
+}
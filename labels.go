@@ -0,0 +1,177 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrLabelNotFound = errors.New("no key with this label")
+
+// labelAttempts is how many labels an insert tries before giving up on a
+// run of taken ones.
+const labelAttempts = 5
+
+// keyLabeler names keys from KEY_LABEL_TEMPLATE, e.g. "{pattern}-{seq:4}"
+// gives "ponz-0042": {pattern} is the matched pattern's text and {seq} a
+// number, zero-padded to the width after the colon. Numbers come from a
+// Postgres sequence per pattern text, shared by patterns with the same
+// text (say "ponz" and "ponz*"), so neither concurrent inserts nor such
+// patterns ever share a label; a rolled-back or conflicting insert leaves
+// a gap instead.
+type keyLabeler struct {
+	tmpl string
+	// seq is the {seq} or {seq:N} placeholder in tmpl, width its N.
+	seq   string
+	width int
+	// segments maps each pattern name to the text standing in for it.
+	segments map[string]string
+}
+
+// parseLabelTemplate parses tmpl for patterns. It must contain {seq} once
+// and may contain {pattern}.
+func parseLabelTemplate(tmpl string, patterns []pattern) (*keyLabeler, error) {
+	_, rest, ok := strings.Cut(tmpl, "{seq")
+	end := strings.IndexByte(rest, '}')
+	if !ok || end < 0 || strings.Contains(rest, "{seq") {
+		return nil, fmt.Errorf("label template %q must contain {seq} exactly once", tmpl)
+	}
+	l := &keyLabeler{tmpl: tmpl, seq: "{seq" + rest[:end+1], segments: make(map[string]string, len(patterns))}
+	if w, ok := strings.CutPrefix(rest[:end], ":"); ok {
+		n, err := strconv.Atoi(w)
+		if err != nil || n < 1 || n > 20 {
+			return nil, fmt.Errorf("label template %q: {seq:N} needs a width between 1 and 20", tmpl)
+		}
+		l.width = n
+	} else if end > 0 {
+		return nil, fmt.Errorf("label template %q: unknown placeholder %s", tmpl, l.seq)
+	}
+	for _, p := range patterns {
+		l.segments[p.Name()] = labelSegment(p)
+	}
+	return l, nil
+}
+
+// labelSegment is the text standing in for p's {pattern}.
+func labelSegment(p pattern) string {
+	return cmp.Or(p.Predicate, p.text())
+}
+
+// format is the label for the seq'th key of pattern.
+func (l *keyLabeler) format(pattern string, seq int64) string {
+	label := strings.Replace(l.tmpl, l.seq, fmt.Sprintf("%0*d", l.width, seq), 1)
+	return strings.ReplaceAll(label, "{pattern}", l.segments[pattern])
+}
+
+// labelSequence is the Postgres sequence numbering the keys of patterns
+// whose text is segment. Segments are not identifiers, so it is named after
+// a hash of the segment.
+func labelSequence(segment string) string {
+	sum := sha256.Sum256([]byte(segment))
+	return "key_label_seq_" + hex.EncodeToString(sum[:8])
+}
+
+// migrateLabelSequences creates the sequence of every configured pattern.
+func migrateLabelSequences(db *gorm.DB, patterns []pattern) error {
+	for _, p := range patterns {
+		if err := db.Exec("CREATE SEQUENCE IF NOT EXISTS " + labelSequence(labelSegment(p))).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateLabel numbers the next key of pattern through db. Keys of no
+// configured pattern, and every key without KEY_LABEL_TEMPLATE, get none.
+func (s *gormStore) allocateLabel(db *gorm.DB, pattern string) (*string, error) {
+	if s.labels == nil {
+		return nil, nil
+	}
+	segment, ok := s.labels.segments[pattern]
+	if !ok {
+		return nil, nil
+	}
+	var seq int64
+	if err := db.Raw("SELECT nextval(?::regclass)", labelSequence(segment)).Scan(&seq).Error; err != nil {
+		return nil, fmt.Errorf("allocate label: %w", err)
+	}
+	label := s.labels.format(pattern, seq)
+	return &label, nil
+}
+
+// syncLabelSequences moves each sequence past the highest label already
+// stored for its patterns, as after restoring a snapshot into a fresh
+// database, so new labels cannot collide with old ones.
+func (s *gormStore) syncLabelSequences(ctx context.Context) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	names := make(map[string][]string)
+	for name, segment := range s.labels.segments {
+		names[segment] = append(names[segment], name)
+	}
+	for segment, patterns := range names {
+		lead, trail, _ := strings.Cut(s.labels.tmpl, s.labels.seq)
+		lead = strings.ReplaceAll(lead, "{pattern}", segment)
+		trail = strings.ReplaceAll(trail, "{pattern}", segment)
+		// Numbers are zero-padded to a fixed width, so the longest label,
+		// then the greatest, holds the highest one
+		var labels []string
+		err := db.Model(&TokenKey{}).Where("matched_pattern IN ? AND label IS NOT NULL", patterns).
+			Order("length(label) DESC, label DESC").Limit(1).Pluck("label", &labels).Error
+		if err != nil {
+			return ctxError(ctx, "read labels", err)
+		}
+		if len(labels) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(labels[0], lead), trail), 10, 64)
+		if err != nil {
+			// Written with another template; nothing to collide with
+			continue
+		}
+		seq := labelSequence(segment)
+		err = db.Exec("SELECT setval(?::regclass, ?) WHERE ? > (SELECT last_value FROM "+seq+")", seq, n, n).Error
+		if err != nil {
+			return ctxError(ctx, "advance label sequence", err)
+		}
+	}
+	return nil
+}
+
+// PublicKeyByLabel resolves a key label.
+func (s *gormStore) PublicKeyByLabel(ctx context.Context, label string) (string, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var pubs []string
+	err := db.Model(&TokenKey{}).Where("label = ?", label).Limit(1).Pluck("public_key", &pubs).Error
+	if err != nil {
+		return "", ctxError(ctx, "look up label", err)
+	}
+	if len(pubs) == 0 {
+		return "", ErrLabelNotFound
+	}
+	return pubs[0], nil
+}
+
+// label is k's label, "" if it has none.
+func (k TokenKey) label() string {
+	if k.Label == nil {
+		return ""
+	}
+	return *k.Label
+}
+
+// labelDetail is k's label for an audit detail, "" if it has none.
+func labelDetail(k TokenKey) string {
+	if k.Label == nil {
+		return ""
+	}
+	return " label=" + *k.Label
+}
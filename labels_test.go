@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TestLabelSequenceShared checks patterns with the same text number their
+// keys from one sequence, so their labels cannot collide.
+func TestLabelSequenceShared(t *testing.T) {
+	suffix, prefix, other := pattern{Suffix: "ponz"}, pattern{Prefix: "ponz"}, pattern{Suffix: "pump"}
+	l, err := parseLabelTemplate("{pattern}-{seq:4}", []pattern{suffix, prefix, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := l.segments[suffix.Name()], l.segments[prefix.Name()]; a != b {
+		t.Fatalf("segments %q and %q differ", a, b)
+	}
+	if labelSequence(labelSegment(suffix)) != labelSequence(labelSegment(prefix)) {
+		t.Error("patterns with the same text use different sequences")
+	}
+	if labelSequence(labelSegment(suffix)) == labelSequence(labelSegment(other)) {
+		t.Error("patterns with different text share a sequence")
+	}
+	if got := l.format(prefix.Name(), 42); got != "ponz-0042" {
+		t.Errorf("format = %q, want ponz-0042", got)
+	}
+}
+
+func TestUniqueViolationConstraint(t *testing.T) {
+	for _, c := range []struct {
+		constraint    string
+		unique, label bool
+	}{
+		{"uni_token_key_public_key", true, false},
+		{"token_key_private_key_key", true, false},
+		{"idx_token_key_label", false, true},
+	} {
+		err := fmt.Errorf("insert: %w", &pgconn.PgError{Code: "23505", ConstraintName: c.constraint})
+		if got := uniqueViolation(err); got != c.unique {
+			t.Errorf("uniqueViolation(%s) = %v, want %v", c.constraint, got, c.unique)
+		}
+		if got := labelViolation(err); got != c.label {
+			t.Errorf("labelViolation(%s) = %v, want %v", c.constraint, got, c.label)
+		}
+	}
+	if uniqueViolation(&pgconn.PgError{Code: "40001", ConstraintName: "uni_token_key_public_key"}) {
+		t.Error("a serialization failure counted as a duplicate key")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"time"
+)
+
+// fillLeaseName is the lease an instance holds while it fills the pool, so
+// overlapping instances (e.g. during a rolling deploy) do not both fill.
+const fillLeaseName = "fill"
+
+// GenerationLease is a short-lived claim on generation, renewed by its
+// holder while it works and free for the taking once it expires.
+type GenerationLease struct {
+	Name      string    `gorm:"primaryKey;column:name"`
+	Holder    string    `gorm:"column:holder"`
+	ExpiresAt time.Time `gorm:"column:expires_at"`
+}
+
+func (GenerationLease) TableName() string { return "generation_lease" }
+
+// AcquireLease takes or renews the named lease for holder for ttl. It
+// reports false if another holder's lease has not expired yet.
+func (s *gormStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	res := db.Exec(`INSERT INTO generation_lease (name, holder, expires_at)
+		VALUES (?, ?, now() + ? * interval '1 millisecond')
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE generation_lease.holder = EXCLUDED.holder OR generation_lease.expires_at < now()`,
+		name, holder, ttl.Milliseconds())
+	return res.RowsAffected > 0, ctxError(ctx, "acquire lease", res.Error)
+}
+
+// StealLease takes the named lease for holder for ttl whoever holds it,
+// returning the previous holder if there was one.
+func (s *gormStore) StealLease(ctx context.Context, name, holder string, ttl time.Duration) (string, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var prev []string
+	err := db.Model(&GenerationLease{}).Where("name = ?", name).Pluck("holder", &prev).Error
+	if err == nil {
+		err = db.Exec(`INSERT INTO generation_lease (name, holder, expires_at)
+			VALUES (?, ?, now() + ? * interval '1 millisecond')
+			ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at`,
+			name, holder, ttl.Milliseconds()).Error
+	}
+	if err != nil || len(prev) == 0 {
+		return "", ctxError(ctx, "steal lease", err)
+	}
+	return prev[0], nil
+}
+
+// ReleaseLease gives up holder's lease early so others need not wait.
+func (s *gormStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	err := db.Where("name = ? AND holder = ?", name, holder).Delete(&GenerationLease{}).Error
+	return ctxError(ctx, "release lease", err)
+}
+
+// Leases live on the primary, the store counts come from.
+func (m *multiStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	return m.stores[0].AcquireLease(ctx, name, holder, ttl)
+}
+
+func (m *multiStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	return m.stores[0].ReleaseLease(ctx, name, holder)
+}
+
+// fillLease is how the fill loop identifies itself and how long its lease
+// lasts between renewals. A zero TTL disables leasing. Name is the lease
+// taken, fillLeaseName if empty; per-pattern fill loops each hold their own.
+type fillLease struct {
+	Name   string
+	Holder string
+	TTL    time.Duration
+}
+
+func (l fillLease) name() string { return cmp.Or(l.Name, fillLeaseName) }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Lifecycle events delivered to WEBHOOK_URL.
+const (
+	eventGenerated   = "generated"   // stored by the fill loop or an agent
+	eventImported    = "imported"    // stored by POST /v1/import
+	eventPicked      = "picked"      // handed out by a pick or swap
+	eventReleased    = "released"    // returned to the pool by an admin or a swap
+	eventExpired     = "expired"     // deleted unpicked by MAX_KEY_AGE or its campaign window
+	eventQuarantined = "quarantined" // taken out for good, by an admin, a swap or as corrupt
+)
+
+// KeyEvent is one lifecycle event in the outbox, waiting for the webhook
+// sink. Seq counts each key's events from 1, so a receiver can order them
+// and notice one parked as a dead letter. Delivered events are deleted.
+type KeyEvent struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	PublicKey     string    `gorm:"column:public_key;not null;index" json:"public_key"`
+	Seq           int64     `gorm:"column:seq;not null" json:"seq"`
+	Event         string    `gorm:"column:event;not null" json:"event"`
+	Pattern       string    `gorm:"column:pattern" json:"pattern"`
+	OccurredAt    time.Time `gorm:"column:occurred_at;not null" json:"occurred_at"`
+	Attempts      int       `gorm:"column:attempts;not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time `gorm:"column:next_attempt_at;not null;index" json:"next_attempt_at"`
+	LastError     string    `gorm:"column:last_error" json:"last_error,omitempty"`
+}
+
+func (KeyEvent) TableName() string { return "key_event" }
+
+// KeyEventSeq is the last sequence number handed to a key's events.
+type KeyEventSeq struct {
+	PublicKey string `gorm:"primaryKey;column:public_key"`
+	Seq       int64  `gorm:"column:seq;not null"`
+}
+
+func (KeyEventSeq) TableName() string { return "key_event_seq" }
+
+// KeyEventDeadLetter is an event the webhook sink gave up on after
+// WEBHOOK_MAX_ATTEMPTS, kept until replayed.
+type KeyEventDeadLetter struct {
+	KeyEvent
+	FailedAt time.Time `gorm:"column:failed_at;not null;index" json:"failed_at"`
+}
+
+func (KeyEventDeadLetter) TableName() string { return "key_event_dead_letter" }
+
+// recordEvent adds event for key to the outbox through db, which may be
+// the transaction that made the transition. It does nothing unless the
+// store has an outbox (WEBHOOK_URL).
+func (s *gormStore) recordEvent(db *gorm.DB, event, pattern, pub string) error {
+	if !s.outbox {
+		return nil
+	}
+	return db.Exec(`WITH s AS (
+			INSERT INTO key_event_seq (public_key, seq) VALUES (?, 1)
+			ON CONFLICT (public_key) DO UPDATE SET seq = key_event_seq.seq + 1 RETURNING seq
+		) INSERT INTO key_event (public_key, seq, event, pattern, occurred_at, next_attempt_at, attempts)
+		SELECT ?, s.seq, ?, ?, now(), now(), 0 FROM s`, pub, pub, event, pattern).Error
+}
+
+// logEvent records an event for a transition that has already committed.
+// A failure is logged, leaving a gap in the key's sequence numbers.
+func (s *gormStore) logEvent(ctx context.Context, event, pattern, pub string) {
+	if !s.outbox {
+		return
+	}
+	db, ctx, cancel := s.session(context.WithoutCancel(ctx), s.timeouts.Insert)
+	defer cancel()
+	if err := s.recordEvent(db, event, pattern, pub); err != nil {
+		log.Printf("Error recording %s event for %s: %v\n", event, pub, ctxError(ctx, "record event", err))
+	}
+}
+
+// claimEvents leases up to n due events for lease, oldest first, skipping
+// any key with an earlier event still in the outbox so each key's events
+// are delivered in order.
+func (s *gormStore) claimEvents(ctx context.Context, n int, lease time.Duration) ([]KeyEvent, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var events []KeyEvent
+	err := db.Raw(`UPDATE key_event SET next_attempt_at = now() + ? * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM key_event e WHERE next_attempt_at <= now()
+			AND NOT EXISTS (SELECT 1 FROM key_event p WHERE p.public_key = e.public_key AND p.seq < e.seq)
+			ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED
+		) RETURNING *`, lease.Seconds(), n).Scan(&events).Error
+	return events, ctxError(ctx, "claim events", err)
+}
+
+// eventDelivered removes a delivered event from the outbox.
+func (s *gormStore) eventDelivered(ctx context.Context, id uint64) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	return ctxError(ctx, "delete event", db.Delete(&KeyEvent{}, id).Error)
+}
+
+// eventFailed schedules ev's next attempt at next or, with dead set, moves
+// it to the dead letter table.
+func (s *gormStore) eventFailed(ctx context.Context, ev KeyEvent, problem string, next time.Time, dead bool) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	ev.Attempts++
+	ev.LastError = problem
+	if !dead {
+		err := db.Model(&KeyEvent{}).Where("id = ?", ev.ID).
+			Updates(map[string]any{"attempts": ev.Attempts, "last_error": problem, "next_attempt_at": next}).Error
+		return ctxError(ctx, "reschedule event", err)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&KeyEventDeadLetter{KeyEvent: ev, FailedAt: clock.Now().UTC()}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&KeyEvent{}, ev.ID).Error
+	})
+	return ctxError(ctx, "park event", err)
+}
+
+// DeadLetters lists up to limit parked events, oldest first.
+func (s *gormStore) DeadLetters(ctx context.Context, limit int) ([]KeyEventDeadLetter, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var out []KeyEventDeadLetter
+	err := db.Order("id").Limit(limit).Find(&out).Error
+	return out, ctxError(ctx, "list dead letters", err)
+}
+
+// ReplayDeadLetters moves the parked events ids, or all of them with ids
+// empty, back into the outbox with fresh attempts, returning how many.
+// They keep their sequence numbers, so a receiver may see them after a
+// later event of the same key.
+func (s *gormStore) ReplayDeadLetters(ctx context.Context, ids []uint64) (int64, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	where, args := "true", []any{}
+	if len(ids) > 0 {
+		where, args = "id IN ?", []any{ids}
+	}
+	var n int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`INSERT INTO key_event (id, public_key, seq, event, pattern, occurred_at, next_attempt_at, attempts, last_error)
+			SELECT id, public_key, seq, event, pattern, occurred_at, now(), 0, last_error
+			FROM key_event_dead_letter WHERE `+where, args...)
+		if res.Error != nil {
+			return res.Error
+		}
+		n = res.RowsAffected
+		return tx.Where(where, args...).Delete(&KeyEventDeadLetter{}).Error
+	})
+	return n, ctxError(ctx, "replay dead letters", err)
+}
+
+// webhookSink POSTs every outbox event to WEBHOOK_URL as JSON, signed
+// with HMAC-SHA256 over the body in the X-Keygen-Signature header. A
+// failed delivery is retried after backoff, doubling up to an hour, and
+// parked as a dead letter after maxAttempts; a key's later events wait
+// for its earlier ones until then. Several instances may run the sink:
+// each event is leased to one at a time.
+type webhookSink struct {
+	store       *gormStore
+	url         string
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func newWebhookSink(store *gormStore, url string, secret []byte) *webhookSink {
+	return &webhookSink{store: store, url: url, secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second}, maxAttempts: 10, backoff: time.Second}
+}
+
+// webhookSignature is the X-Keygen-Signature value for body.
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhookSignature is how a receiver checks a delivery: recompute
+// the HMAC over the raw request body with the shared WEBHOOK_SECRET and
+// compare it in constant time with the X-Keygen-Signature header, before
+// parsing the body.
+//
+//	body, _ := io.ReadAll(r.Body)
+//	if !verifyWebhookSignature(secret, body, r.Header.Get("X-Keygen-Signature")) {
+//		http.Error(w, "bad signature", http.StatusUnauthorized)
+//		return
+//	}
+func verifyWebhookSignature(secret, body []byte, header string) bool {
+	return hmac.Equal([]byte(webhookSignature(secret, body)), []byte(header))
+}
+
+// Run delivers events until ctx is done.
+func (w *webhookSink) Run(ctx context.Context, maint *maintenanceSwitch) {
+	lease := w.client.Timeout + 30*time.Second
+	for ctx.Err() == nil {
+		var events []KeyEvent
+		if !maint.Active() {
+			var err error
+			if events, err = w.store.claimEvents(ctx, 100, lease); err != nil && ctx.Err() == nil {
+				log.Println("Error reading webhook outbox:", err)
+			}
+		}
+		for _, ev := range events {
+			w.deliver(ctx, ev)
+		}
+		if len(events) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-clock.After(time.Second):
+			}
+		}
+	}
+}
+
+func (w *webhookSink) deliver(ctx context.Context, ev KeyEvent) {
+	body, err := json.Marshal(map[string]any{
+		"id":          ev.ID,
+		"event":       ev.Event,
+		"public_key":  ev.PublicKey,
+		"pattern":     ev.Pattern,
+		"seq":         ev.Seq,
+		"occurred_at": ev.OccurredAt.UTC(),
+	})
+	if err == nil {
+		err = w.post(ctx, ev, body)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		webhookDeliveriesTotal.WithLabelValues("delivered").Inc()
+		if err := w.store.eventDelivered(ctx, ev.ID); err != nil {
+			log.Println("Error removing delivered event:", err)
+		}
+		return
+	}
+
+	dead := ev.Attempts+1 >= w.maxAttempts
+	next := clock.Now().Add(min(time.Hour, w.backoff*time.Duration(1<<min(ev.Attempts, 20))))
+	if dead {
+		webhookDeliveriesTotal.WithLabelValues("dead_letter").Inc()
+		log.Printf("ALERT webhook gave up on %s event %d for %s after %d attempts, parked as a dead letter: %v\n",
+			ev.Event, ev.ID, ev.PublicKey, ev.Attempts+1, err)
+	} else {
+		webhookDeliveriesTotal.WithLabelValues("failed").Inc()
+		log.Printf("Webhook delivery of event %d failed (attempt %d/%d), retrying at %s: %v\n",
+			ev.ID, ev.Attempts+1, w.maxAttempts, next.Format(time.RFC3339), err)
+	}
+	if err := w.store.eventFailed(ctx, ev, err.Error(), next, dead); err != nil {
+		log.Println("Error recording failed delivery:", err)
+	}
+}
+
+func (w *webhookSink) post(ctx context.Context, ev KeyEvent, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Keygen-Event", ev.Event)
+	req.Header.Set("X-Keygen-Delivery", strconv.FormatUint(ev.ID, 10))
+	req.Header.Set("X-Keygen-Signature", webhookSignature(w.secret, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// handleDeadLetters serves GET /v1/admin/webhook/dead-letters?limit=100.
+func (s *server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if val := r.URL.Query().Get("limit"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 || n > 10000 {
+			writeError(w, http.StatusBadRequest, "invalid_limit", "limit must be between 1 and 10000", nil)
+			return
+		}
+		limit = n
+	}
+	out, err := s.store.DeadLetters(r.Context(), limit)
+	if err != nil {
+		log.Println("Error listing dead letters:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "could not list dead letters", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"dead_letters": out})
+}
+
+// handleReplayDeadLetters serves POST /v1/admin/webhook/dead-letters/replay
+// with {"ids": [...]}, or {"all": true} to replay every parked event.
+func (s *server) handleReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []uint64 `json:"ids"`
+		All bool     `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (len(req.IDs) == 0) == !req.All {
+		writeError(w, http.StatusBadRequest, "invalid_body", `request body must be JSON with "ids" or "all": true`, nil)
+		return
+	}
+	n, err := s.store.ReplayDeadLetters(r.Context(), req.IDs)
+	if err != nil {
+		log.Println("Error replaying dead letters:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "could not replay dead letters", nil)
+		return
+	}
+	detail := "all"
+	if !req.All {
+		ids := make([]string, len(req.IDs))
+		for i, id := range req.IDs {
+			ids[i] = strconv.FormatUint(id, 10)
+		}
+		detail = strings.Join(ids, ",")
+	}
+	audit(r.Context(), "webhook_replay", fmt.Sprintf("ids=%s replayed=%d", detail, n))
+	writeJSON(w, http.StatusOK, map[string]any{"replayed": n})
+}
+
+var errWebhookSecretMissing = errors.New("WEBHOOK_SECRET must be set with WEBHOOK_URL")
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"solana-key-gen/keygen"
+)
+
+// lintNote marks informational lint lines about a pattern; the header line
+// naming it has no severity.
+const lintNote keygen.Severity = "note"
+
+// lintLine is one line of a pattern lint report.
+type lintLine struct {
+	Severity keygen.Severity
+	Text     string
+}
+
+// lintPatterns lints the fixed text of each pattern, returning a report and
+// whether any pattern has a hard error. Difficulty comes from the pattern
+// kind, so contains and fuzzy patterns get their own estimates.
+func lintPatterns(patterns []pattern) ([]lintLine, bool) {
+	var out []lintLine
+	failed := false
+	for _, p := range patterns {
+		if p.Predicate != "" {
+			out = append(out, lintLine{Text: fmt.Sprintf("%s (%s): ~%.3g attempts per key, as declared by the predicate", p.Name(), p.Source, p.expectedAttempts())})
+			continue
+		}
+		if p.Any {
+			out = append(out, lintLine{Text: fmt.Sprintf("%s (%s): matches every key, 1 attempt per key", p.Name(), p.Source)})
+			continue
+		}
+		r := keygen.Lint(p.text())
+		failed = failed || r.HasErrors()
+		d := p.attemptsAt(0)
+		out = append(out, lintLine{Text: fmt.Sprintf("%s (%s): ~%.3g attempts per key", p.Name(), p.Source, d)})
+		if p.Prefix != "" && !r.HasErrors() && prefixFraction(p.Prefix, maxAddressLen) == 0 {
+			out = append(out, lintLine{Severity: keygen.SeverityWarn, Text: fmt.Sprintf("%s: only 43-character addresses can start with %q; 44-character ones start with 1 to J",
+				p.Name(), p.Prefix)})
+		}
+		for _, f := range r.Findings {
+			where := "pattern"
+			if f.Pos >= 0 {
+				where = fmt.Sprintf("position %d", f.Pos)
+			}
+			out = append(out, lintLine{Severity: f.Severity, Text: fmt.Sprintf("%s %s: %s", p.Name(), where, f.Message)})
+		}
+		if r.IgnoreCaseSpeedup > 1 && !r.HasErrors() {
+			out = append(out, lintLine{Severity: lintNote, Text: fmt.Sprintf("%s: matching regardless of case would be %.0fx cheaper (~%.3g attempts); keys are matched case-sensitively",
+				p.Name(), r.IgnoreCaseSpeedup, d/r.IgnoreCaseSpeedup)})
+		}
+	}
+	return out, failed
+}
+
+// cmdLintPatterns implements the "lint-patterns" subcommand: lint the
+// patterns given as arguments, or the configured ones without any, and
+// print the report. It fails if any pattern has a hard error.
+func cmdLintPatterns(args []string, patterns []pattern) error {
+	if len(args) > 0 {
+		patterns = nil
+		for _, a := range args {
+			patterns = append(patterns, pattern{Suffix: a, Source: "args"})
+		}
+	}
+	lines, failed := lintPatterns(patterns)
+	for _, l := range lines {
+		if l.Severity != "" {
+			fmt.Printf("  %s: %s\n", strings.ToUpper(string(l.Severity)), l.Text)
+			continue
+		}
+		fmt.Println(l.Text)
+	}
+	if failed {
+		return errors.New("pattern lint found errors")
+	}
+	return nil
+}
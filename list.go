@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// listQuery selects a page of keys. Cursor, when set, continues after the
+// last row of a previous page and takes precedence over Offset.
+type listQuery struct {
+	Picked *bool
+	// Status is one of keyStatuses.
+	Status       string
+	Pattern      string
+	CreatedAfter time.Time
+	// From and To bound created_at to [From, To).
+	From, To *time.Time
+	// ShortFirst and ShortLast match the ends of the short display form.
+	ShortFirst, ShortLast string
+	// Checksum matches keyChecksum; several keys may share one.
+	Checksum string
+	// Label matches one KEY_LABEL_TEMPLATE label.
+	Label  string
+	Limit  int
+	Offset int
+	Cursor string
+	// Desc lists the newest keys first.
+	Desc bool
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// keyStatuses are the values of a key listing's status filter.
+var keyStatuses = []string{"unpicked", "picked", "quarantined"}
+
+// apply adds the query's filters, ordering and paging to db.
+func (q listQuery) apply(db *gorm.DB) (*gorm.DB, error) {
+	tx := db.Model(&TokenKey{})
+	if q.Picked != nil {
+		tx = tx.Where("is_picked = ?", *q.Picked)
+	}
+	if q.Pattern != "" {
+		tx = tx.Where("matched_pattern = ?", q.Pattern)
+	}
+	switch q.Status {
+	case "unpicked":
+		tx = tx.Where("is_picked = false")
+	case "picked":
+		tx = tx.Where("is_picked = true AND quarantined = false")
+	case "quarantined":
+		tx = tx.Where("quarantined = true")
+	}
+	if !q.CreatedAfter.IsZero() {
+		tx = tx.Where("created_at > ?", q.CreatedAfter)
+	}
+	tx = pageRange(tx, "created_at", q.From, q.To)
+	if q.ShortFirst != "" || q.ShortLast != "" {
+		// Served by idx_token_key_short
+		tx = tx.Where("left(public_key, 4) = ? AND right(public_key, 4) = ?", q.ShortFirst, q.ShortLast)
+	}
+	if q.Checksum != "" {
+		tx = tx.Where("checksum = ?", q.Checksum)
+	}
+	if q.Label != "" {
+		tx = tx.Where("label = ?", q.Label)
+	}
+	if q.Cursor == "" && q.Offset > 0 {
+		tx = tx.Offset(q.Offset)
+	}
+	return keysetPage(tx, "created_at", "id", q.Cursor, q.Desc, q.Limit, stringID)
+}
+
+// List returns one page of keys and the cursor for the next page, if any.
+func (s *gormStore) List(ctx context.Context, q listQuery) ([]TokenKey, string, error) {
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Query)
+	defer cancel()
+
+	tx, err := q.apply(db)
+	if err != nil {
+		return nil, "", err
+	}
+	var keys []TokenKey
+	if err := tx.Find(&keys).Error; err != nil {
+		return nil, "", ctxError(ctx, "list keys", err)
+	}
+	next := ""
+	if len(keys) == q.Limit {
+		last := keys[len(keys)-1]
+		next = pageCursor{Key: last.CreatedAt, ID: last.ID, Desc: q.Desc}.String()
+	}
+	// Corrupt keys are quarantined by open and left out of the page
+	out := keys[:0]
+	for _, k := range keys {
+		err := s.open(ctx, &k)
+		if errors.Is(err, ErrCorruptKey) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		out = append(out, k)
+	}
+	return out, next, nil
+}
+
+// cmdList implements the "list" subcommand.
+func cmdList(ctx context.Context, store *gormStore, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	picked := fs.String("picked", "", "filter by is_picked (true or false)")
+	pattern := fs.String("pattern", "", "filter by matched pattern")
+	after := fs.String("created-after", "", "only keys created after this RFC3339 time")
+	limit := fs.Int("limit", 50, "page size")
+	offset := fs.Int("offset", 0, "rows to skip")
+	cursor := fs.String("cursor", "", "continue after a previous page's cursor")
+	checksum := fs.String("checksum", "", "only keys with this checksum")
+	label := fs.String("label", "", "only the key with this label")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	secrets := fs.Bool("include-secrets", false, "include private keys in the output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	q := listQuery{Pattern: *pattern, Checksum: strings.ToLower(*checksum), Label: *label, Limit: *limit, Offset: *offset, Cursor: *cursor}
+	if q.Limit < 1 || q.Limit > 10000 {
+		return errors.New("limit must be between 1 and 10000")
+	}
+	if *picked != "" {
+		v, err := strconv.ParseBool(*picked)
+		if err != nil {
+			return fmt.Errorf("invalid -picked %q", *picked)
+		}
+		q.Picked = &v
+	}
+	if *after != "" {
+		t, err := time.Parse(time.RFC3339, *after)
+		if err != nil {
+			return fmt.Errorf("invalid -created-after %q", *after)
+		}
+		q.CreatedAfter = t
+	}
+
+	keys, next, err := store.List(ctx, q)
+	if err != nil {
+		return err
+	}
+	if *secrets {
+		log.Println("WARNING: printing private keys; make sure this output is not logged or shared")
+	} else {
+		for i := range keys {
+			keys[i].PrivateKey = ""
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"keys": keys, "next_cursor": next})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := "PUBLIC KEY\tPATTERN\tPICKED\tCREATED"
+	if *secrets {
+		header += "\tPRIVATE KEY"
+	}
+	fmt.Fprintln(tw, header)
+	for _, k := range keys {
+		line := fmt.Sprintf("%s\t%s\t%v\t%s", k.PublicKey, k.MatchedPattern, k.IsPicked, k.CreatedAt.Format(time.RFC3339))
+		if *secrets {
+			line += "\t" + k.PrivateKey
+		}
+		fmt.Fprintln(tw, line)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if next != "" {
+		fmt.Fprintf(os.Stderr, "next page: -cursor %s\n", next)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// dryRunDB renders Postgres SQL without connecting.
+func dryRunDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// listSQL returns the statement q renders and its bound variables.
+func listSQL(t *testing.T, q listQuery) (string, []any) {
+	t.Helper()
+	tx, err := q.apply(dryRunDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := tx.Find(&[]TokenKey{}).Statement
+	return stmt.SQL.String(), stmt.Vars
+}
+
+func TestListQueryFilters(t *testing.T) {
+	picked := false
+	after := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sql, vars := listSQL(t, listQuery{Picked: &picked, Pattern: "pump", CreatedAfter: after, Checksum: "ab12", Label: "pump-7", Limit: 20})
+	for _, want := range []string{
+		"is_picked = $1", "matched_pattern = $2", "created_at > $3", "checksum = $4", "label = $5",
+		"ORDER BY created_at, id LIMIT $6",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("SQL lacks %q:\n%s", want, sql)
+		}
+	}
+	if strings.Contains(sql, "OFFSET") {
+		t.Errorf("no offset was asked for:\n%s", sql)
+	}
+	want := []any{false, "pump", after, "ab12", "pump-7", 20}
+	if len(vars) != len(want) {
+		t.Fatalf("vars = %v, want %v", vars, want)
+	}
+	for i := range want {
+		if vars[i] != want[i] {
+			t.Errorf("var %d = %v, want %v", i, vars[i], want[i])
+		}
+	}
+}
+
+func TestListQueryUnfiltered(t *testing.T) {
+	sql, _ := listSQL(t, listQuery{Limit: 50})
+	if strings.Contains(sql, "WHERE") {
+		t.Errorf("unfiltered listing has a WHERE clause:\n%s", sql)
+	}
+}
+
+func TestListQueryStatus(t *testing.T) {
+	for status, want := range map[string]string{
+		"unpicked":    "is_picked = false",
+		"picked":      "is_picked = true AND quarantined = false",
+		"quarantined": "quarantined = true",
+	} {
+		if sql, _ := listSQL(t, listQuery{Status: status, Limit: 10}); !strings.Contains(sql, want) {
+			t.Errorf("status %s lacks %q:\n%s", status, want, sql)
+		}
+	}
+}
+
+func TestListQueryPaging(t *testing.T) {
+	sql, vars := listSQL(t, listQuery{Limit: 10, Offset: 30})
+	if !strings.Contains(sql, "LIMIT $1 OFFSET $2") || len(vars) != 2 || vars[0] != 10 || vars[1] != 30 {
+		t.Errorf("offset page = %s %v", sql, vars)
+	}
+
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	cursor := pageCursor{Key: at, ID: "k-9"}.String()
+	sql, vars = listSQL(t, listQuery{Limit: 10, Offset: 30, Cursor: cursor})
+	if !strings.Contains(sql, "(created_at, id) > ($1, $2)") || !strings.Contains(sql, "ORDER BY created_at, id LIMIT $3") {
+		t.Errorf("cursor page = %s", sql)
+	}
+	if strings.Contains(sql, "OFFSET") {
+		t.Errorf("a cursor should take precedence over the offset:\n%s", sql)
+	}
+	if len(vars) != 3 || !vars[0].(time.Time).Equal(at) || vars[1] != "k-9" {
+		t.Errorf("cursor vars = %v", vars)
+	}
+
+	desc := pageCursor{Key: at, ID: "k-9", Desc: true}.String()
+	sql, _ = listSQL(t, listQuery{Limit: 10, Cursor: desc, Desc: true})
+	if !strings.Contains(sql, "(created_at, id) < ($1, $2)") || !strings.Contains(sql, "ORDER BY created_at DESC, id DESC") {
+		t.Errorf("descending cursor page = %s", sql)
+	}
+}
+
+func TestListQueryBadCursor(t *testing.T) {
+	asc := pageCursor{Key: time.Now(), ID: "k-1"}.String()
+	for name, q := range map[string]listQuery{
+		"garbage":        {Limit: 10, Cursor: "not a cursor"},
+		"wrong ordering": {Limit: 10, Cursor: asc, Desc: true},
+	} {
+		if _, err := q.apply(dryRunDB(t)); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("%s: apply = %v, want errInvalidCursor", name, err)
+		}
+	}
+}
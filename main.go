@@ -1,188 +1,2183 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/blocto/solana-go-sdk/types"
 	"github.com/google/uuid"
-	"github.com/joho/godotenv"
 	"github.com/mr-tron/base58/base58"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
+
+	"solana-key-gen/keygen"
 )
 
 type TokenKey struct {
-	ID         string    `gorm:"type:uuid;primaryKey"`
-	PrivateKey string    `gorm:"unique;column:private_key"`
-	PublicKey  string    `gorm:"unique;column:public_key"`
-	IsPicked   bool      `gorm:"column:is_picked;default:false"`
-	CreatedAt  time.Time `gorm:"column:created_at;autoCreateTime"`
+	ID             string  `gorm:"type:uuid;primaryKey"`
+	PrivateKey     string  `gorm:"unique;column:private_key"`
+	PublicKey      string  `gorm:"unique;column:public_key"`
+	IsPicked       bool    `gorm:"column:is_picked;default:false;index"`
+	MatchedPattern string  `gorm:"column:matched_pattern;index"`
+	AddressLength  int     `gorm:"column:address_length;index"`
+	Checksum       string  `gorm:"column:checksum;index"`
+	QualityScore   float64 `gorm:"column:quality_score;index"`
+	Quarantined    bool    `gorm:"column:quarantined;default:false"`
+	// PrivateKeyDigest is privateKeyDigest of the private key, unique where
+	// the sealed private key is not. Rows stored before it are backfilled.
+	PrivateKeyDigest *string `gorm:"column:private_key_digest;uniqueIndex"`
+	// Label is the KEY_LABEL_TEMPLATE name, e.g. "ponz-0042", if any.
+	Label *string `gorm:"column:label;uniqueIndex"`
+	// MigratedTo is the transfer that moved the key to another instance's
+	// pool; such keys are picked here and never served.
+	MigratedTo *string `gorm:"column:migrated_to;type:uuid;index"`
+	Campaign   string  `gorm:"column:campaign;index"`
+	// Cluster is the CLUSTER the key was generated or imported for, e.g.
+	// "devnet"; empty if the instance had none.
+	Cluster    string     `gorm:"column:cluster;index"`
+	ValidFrom  *time.Time `gorm:"column:valid_from"`
+	ValidUntil *time.Time `gorm:"column:valid_until"`
+	// Metadata is consumer JSON attached at import or pick, if any.
+	Metadata  *string   `gorm:"column:metadata;type:jsonb"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime;index"`
 }
 
 func (TokenKey) TableName() string { return "token_key" }
 
-func connectDB(dsn string) *gorm.DB {
+// connectDB opens the database configured by the variable name, failing
+// with the kind of failure and a remediation hint if it is unreachable.
+func connectDB(name, dsn string) (*gorm.DB, error) {
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		kind := classifyConnError(err)
+		log.Printf("Failed to connect to database %s (%s): %v\n", name, redactDSN(dsn), err)
+		return nil, fmt.Errorf("database connection failure: %s: %s", kind, connHints[kind])
 	}
-	return db
+	return db, nil
 }
 
 type Keypair struct {
-	Priv string
-	Pub  string
+	Priv     string
+	Pub      string
+	Pattern  string
+	Attempts int64
 }
 
-func generateVanityKeypair(ctx context.Context, suffix string, workers int) (Keypair, error) {
-	suffix = strings.TrimSpace(suffix)
-	found := make(chan Keypair, 1)
-
-	worker := func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				acc := types.NewAccount()
-				pub := base58.Encode(acc.PublicKey[:])
-				if strings.HasSuffix(pub, suffix) {
-					found <- Keypair{
-						Priv: base58.Encode(acc.PrivateKey[:]),
-						Pub:  pub,
-					}
-					return
-				}
+// generateVanityKeypair grinds until a key matches one of the named
+// patterns (see pattern.Name). When several match, the key is attributed to
+// the longest one. Extra options (duty cycle, filters) are passed through
+// to the generator.
+func generateVanityKeypair(ctx context.Context, names []string, workers int, extra ...keygen.Option) (Keypair, error) {
+	ctx, span := tracer.Start(ctx, "generate", trace.WithAttributes(
+		attribute.StringSlice("patterns", names),
+		attribute.Int("workers", workers),
+	))
+	defer span.End()
+
+	names = slices.Clone(names)
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	textLen := func(name string) int { return len(strings.TrimSuffix(name, "*")) }
+	slices.SortFunc(names, func(a, b string) int { return textLen(b) - textLen(a) })
+
+	opts := append([]keygen.Option{keygen.WithWorkers(workers)}, extra...)
+	for _, n := range names {
+		opts = append(opts, keygen.WithPattern(keygenPattern(n)))
+	}
+	gen := keygen.NewGenerator(opts...)
+
+	key, err := gen.Find(ctx)
+	span.SetAttributes(attribute.Int64("attempts", gen.Attempts()))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return Keypair{}, err
+	}
+	span.SetAttributes(attribute.String("pattern", key.Pattern))
+	return Keypair{
+		Priv:     base58.Encode(key.PrivateKey),
+		Pub:      key.Address,
+		Pattern:  key.Pattern,
+		Attempts: key.Attempts,
+	}, nil
+}
+
+// deficient returns the names of patterns whose count is below target.
+// Weighted patterns (PATTERN_WEIGHTS) share one pool: once their total is
+// below the sum of their targets, all of them are returned, and which one
+// each key is ground for is left to the weights. Scheduled patterns outside
+// their windows are never deficient.
+func deficient(patterns []pattern, counts map[string]int64) []string {
+	var out []string
+	if newWeightedSampler(patterns) != nil {
+		var have, want int64
+		for _, p := range patterns {
+			have, want = have+counts[p.Name()], want+int64(p.Target)
+		}
+		if have < want {
+			for _, p := range patterns {
+				out = append(out, p.Name())
 			}
 		}
+		return out
 	}
-
-	for i := 0; i < workers; i++ {
-		go worker()
+	now := clock.Now()
+	for _, p := range patterns {
+		if counts[p.Name()] < int64(p.Target) && p.activeAt(now) {
+			out = append(out, p.Name())
+		}
 	}
+	return out
+}
 
-	select {
-	case <-ctx.Done():
-		return Keypair{}, ctx.Err()
-	case kp := <-found:
-		return kp, nil
+// startupRamp ramps workers up over d for the first generator built with
+// it only. Every find builds a fresh generator, and ramping each of them
+// would slow short finds for no benefit once the process is warm.
+func startupRamp(d time.Duration) keygen.Option {
+	var once sync.Once
+	return func(g *keygen.Generator) {
+		once.Do(func() { keygen.WithRamp(d)(g) })
 	}
 }
 
-func countUnpicked(db *gorm.DB) (int64, error) {
-	var c int64
-	err := db.Model(&TokenKey{}).Where("is_picked = false").Count(&c).Error
-	return c, err
+// fillConfig is what fill loops run with. Every loop of an instance shares
+// it, but for Lease, which a loop per pattern names after its pattern.
+type fillConfig struct {
+	Store     KeyStore
+	Sleep     time.Duration
+	Workers   int
+	GenOpts   []keygen.Option
+	KeyDir    string
+	Hooks     *hookRunner
+	Stream    *keyStream
+	Breaker   *circuitBreaker
+	Pacer     *writePacer
+	Limits    capacityLimits
+	Freeze    *freezeSwitch
+	Maint     *maintenanceSwitch
+	Lease     fillLease
+	MaxKeyAge time.Duration
+	History   *historyRecorder
+	Faults    *faultInjector
+	Discards  *discardLedger
+	RNG       *rngMonitor
+	Stall     *stallMonitor
+	Quotas    *quotaBook
+	Prewarms  *prewarmBook
+	AuditLog  AuditLogger
+	Pipeline  pipelineConfig
+	Watch     *watchlist
+	Sleeps    *sleepTuner
 }
 
-func maintainUnpickedKeys(db *gorm.DB, target int, suffix string, sleepDur time.Duration, workers int) {
-	for {
-		c, err := countUnpicked(db)
+// maintainUnpickedKeys keeps each of patterns at its target of unpicked
+// keys until ctx ends, grinding on loop's share of the workers.
+func maintainUnpickedKeys(ctx context.Context, fc fillConfig, patterns []pattern, loop *fillLoop) {
+	targets := make(map[string]int, len(patterns))
+	byName := make(map[string]pattern, len(patterns))
+	for _, p := range patterns {
+		targets[p.Name()] = p.Target
+		byName[p.Name()] = p
+	}
+	// patterns carries the prewarmed targets, base the configured ones
+	base := patterns
+	applyPrewarms := func() {
+		patterns = fc.Prewarms.Apply(base)
+		for _, p := range patterns {
+			targets[p.Name()] = p.Target
+		}
+	}
+	weights := newWeightedSampler(patterns)
+	priority := newPipelinePriority(patterns, fc.Pipeline.Urgent)
+	m := &matcher{loop: loop, workers: fc.Workers, weights: weights, quotas: fc.Quotas, genOpts: fc.GenOpts}
+	stallName := sharedLoopName
+	if len(patterns) == 1 {
+		stallName = patterns[0].Name()
+	}
+
+	warned := map[string]bool{}
+	sinceRecount := map[string]int64{}
+	defer fc.Stall.Stop(stallName)
+	for ctx.Err() == nil {
+		if fc.Freeze.Frozen() {
+			log.Println("Key issuance is frozen, not generating")
+			loop.Set(loopPaused)
+			fc.Stall.Stop(stallName)
+			sleepCtx(ctx, 10*time.Second)
+			continue
+		}
+		if fc.Faults.Paused() {
+			log.Println("FAULT INJECTED: generation paused")
+			loop.Set(loopPaused)
+			sleepCtx(ctx, 10*time.Second)
+			continue
+		}
+		// Leaving maintenance wakes the sleep, so the pool is recounted and
+		// refilled immediately
+		if fc.Maint.Active() {
+			log.Println("In maintenance mode, not generating")
+			loop.Set(loopPaused)
+			fc.Stall.Stop(stallName)
+			fc.Maint.Sleep(ctx, fc.Sleep)
+			continue
+		}
+
+		// Drop stale and out-of-window unpicked keys first so the counts
+		// below include their replacements
+		loop.Set(loopCounting)
+		var cutoff time.Time
+		if fc.MaxKeyAge > 0 {
+			cutoff = clock.Now().Add(-fc.MaxKeyAge)
+		}
+		var expired map[string]int64
+		err := fc.Breaker.Do(func() (err error) {
+			expired, err = fc.Store.ExpireUnpicked(ctx, cutoff)
+			return err
+		})
+		if err != nil && !errors.Is(err, errBreakerOpen) {
+			log.Println("Error expiring old keys:", err)
+		}
+		for p, n := range expired {
+			keysExpiredTotal.WithLabelValues(p).Add(float64(n))
+			log.Printf("Expired %d unpicked keys for %q\n", n, p)
+		}
+
+		counts := make(map[string]int64, len(patterns))
+		for _, p := range patterns {
+			var c int64
+			err = fc.Breaker.Do(func() (err error) {
+				c, err = fc.Store.CountUnpicked(ctx, p.Name())
+				return err
+			})
+			if err != nil {
+				break
+			}
+			counts[p.Name()] = c
+		}
 		if err != nil {
-			log.Println("Error counting unpicked keys:", err)
-			time.Sleep(10 * time.Second)
+			if !errors.Is(err, errBreakerOpen) {
+				log.Println("Error counting unpicked keys:", err)
+			}
+			sleepCtx(ctx, 10*time.Second)
 			continue
 		}
 
-		if c >= int64(target) {
-			log.Printf("Enough unpicked keys (%d >= %d). Sleeping for %v...\n", c, target, sleepDur)
-			time.Sleep(sleepDur)
+		fc.History.Record(ctx, counts)
+
+		// A prewarm raises its pattern's target until built, expired or cancelled
+		if err := fc.Prewarms.Refresh(ctx, counts); err != nil {
+			log.Println("Error reading prewarms:", err)
+		}
+		applyPrewarms()
+
+		// Patterns at their lifetime quota are not generated for, whatever their deficit
+		if err := fc.Quotas.Refresh(ctx); err != nil {
+			log.Println("Error reading pattern quotas:", err)
+		}
+		need := deficient(patterns, counts)
+		if len(need) > 0 {
+			if need = fc.Quotas.Allowed(ctx, need); len(need) == 0 {
+				log.Printf("Every pattern below target has reached its quota. Sleeping for %v...\n", fc.Sleep)
+				loop.Set(loopSleeping)
+				fc.Stall.Stop(stallName)
+				fc.Maint.Sleep(ctx, fc.Sleep)
+				continue
+			}
+		}
+		if len(need) == 0 {
+			now := clock.Now()
+			for _, p := range patterns {
+				if !p.activeAt(now) {
+					log.Printf("%q is outside its schedule, not generating\n", p.Name())
+					continue
+				}
+				log.Printf("Enough unpicked keys for %q (%d >= %d)\n", p.Name(), counts[p.Name()], p.Target)
+			}
+			// Wake for the next window to open or close
+			d := fc.Sleeps.Next(ctx, stallName, counts, fc.Sleep)
+			if next := nextScheduleChange(patterns, now); !next.IsZero() {
+				d = min(d, next.Sub(now))
+			}
+			log.Printf("Sleeping for %v...\n", d)
+			loop.Set(loopSleeping)
+			fc.Stall.Stop(stallName)
+			fc.Maint.Sleep(ctx, d)
 			continue
 		}
 
-		log.Printf("Unpicked keys below target: %d / %d. Generating...\n", c, target)
-		for c < int64(target) {
-			ctx, cancel := context.WithCancel(context.Background())
-			kp, err := generateVanityKeypair(ctx, suffix, workers)
-			cancel()
+		if fc.Limits.enabled() {
+			var planned int64
+			for _, s := range need {
+				planned += int64(targets[s]) - counts[s]
+			}
+			var u storeUsage
+			err := fc.Breaker.Do(func() (err error) {
+				u, err = fc.Store.Usage(ctx)
+				return err
+			})
+			if err != nil {
+				if !errors.Is(err, errBreakerOpen) {
+					log.Println("Error checking pool capacity:", err)
+				}
+				sleepCtx(ctx, 10*time.Second)
+				continue
+			}
+			if problem := fc.Limits.exceeds(u, planned); problem != "" {
+				if fc.Limits.Refuse {
+					log.Printf("Capacity check failed, not generating: %s. Sleeping for %v...\n", problem, fc.Sleep)
+					loop.Set(loopSleeping)
+					fc.Maint.Sleep(ctx, fc.Sleep)
+					continue
+				}
+				log.Printf("WARN capacity: %s\n", problem)
+			}
+		}
+
+		// Only one instance fills at a time; the other rechecks once the lease frees up
+		var renewed time.Time
+		if fc.Lease.TTL > 0 {
+			var ok bool
+			err := fc.Breaker.Do(func() (err error) {
+				ok, err = fc.Store.AcquireLease(ctx, fc.Lease.name(), fc.Lease.Holder, fc.Lease.TTL)
+				return err
+			})
+			if err != nil || !ok {
+				if err != nil && !errors.Is(err, errBreakerOpen) {
+					log.Println("Error acquiring generation lease:", err)
+				} else if err == nil {
+					log.Println("Another instance holds the generation lease, waiting")
+				}
+				loop.Set(loopPaused)
+				fc.Stall.Stop(stallName)
+				sleepCtx(ctx, fc.Lease.TTL/2)
+				continue
+			}
+			renewed = clock.Now()
+		}
+
+		for _, s := range need {
+			log.Printf("Unpicked keys for %q below target: %d / %d. Generating...\n", s, counts[s], targets[s])
+			// Once per pattern, when a rate has been measured
+			if rate := measuredRate(); rate > 0 && !warned[s] {
+				warned[s] = true
+				warnInfeasibleTarget(byName[s], int64(targets[s])-counts[s], byName[s].attemptsAt(0), rate, "measured")
+			}
+		}
+		fc.Stall.Start(stallName)
+		cycleCtx, cycle := tracer.Start(ctx, "fill_cycle", trace.WithAttributes(attribute.StringSlice("pools", need)))
+		var backoff time.Duration
+		var pipe *matchPipeline
+		// Why keys left in the pipeline when the cycle ends were discarded;
+		// unset, they go unrecorded
+		var dropped string
+		if fc.Pipeline.Depth > 0 {
+			pipe = startMatchPipeline(cycleCtx, m, fc.Pipeline, priority, need, fc.Maint)
+		}
+		for len(need) > 0 {
+			var f found
+			var ok bool
+			if pipe != nil {
+				f, ok = pipe.Next()
+			} else {
+				f, ok = m.next(cycleCtx, func() []string { return need })
+			}
+			if !ok {
+				break
+			}
+			kp, err := f.kp, f.err
+			// A key found as shutdown began is not stored: the fill stops here
+			// rather than inserting against a cancelled context
+			if ctx.Err() != nil {
+				if err == nil {
+					fc.Discards.Record(discardShutdown, kp.Pattern, kp.Pub, kp.Attempts)
+				}
+				dropped = discardShutdown
+				break
+			}
+			if errors.Is(err, errDerivationHalted) {
+				log.Printf("ALERT %v; check DERIVED_CONSTRAINTS\n", err)
+				break
+			}
 			if err != nil {
-				log.Println("Error generating vanity key:", err)
-				time.Sleep(1 * time.Second)
+				// Entropy or derivation failures: back off, doubling up to 30s.
+				// The pipeline's matcher backs off by itself.
+				backoff = generationBackoff(backoff)
+				log.Printf("Error generating vanity key, retrying in %v: %v\n", backoff, err)
+				if pipe == nil {
+					fc.Maint.Sleep(cycleCtx, backoff)
+				}
 				continue
 			}
+			backoff = 0
+			fc.Stall.Found()
 
+			p := byName[kp.Pattern]
 			newKey := TokenKey{
-				ID:         uuid.NewString(), // Generate UUID in code
-				PrivateKey: kp.Priv,
-				PublicKey:  kp.Pub,
-				IsPicked:   false,
+				ID:             uuid.NewString(), // Generate UUID in code
+				PrivateKey:     kp.Priv,
+				PublicKey:      kp.Pub,
+				IsPicked:       false,
+				MatchedPattern: kp.Pattern,
+				QualityScore:   qualityScore(kp.Pattern),
+				Campaign:       p.Campaign,
+				ValidFrom:      p.ValidFrom,
+				ValidUntil:     p.ValidUntil,
+			}
+
+			if err := fc.Pacer.Wait(cycleCtx); err != nil {
+				break
+			}
+			if fc.Freeze.Frozen() {
+				log.Println("Key issuance frozen mid-fill, dropping the key just found")
+				fc.Discards.Record(discardFrozen, kp.Pattern, kp.Pub, kp.Attempts)
+				dropped = discardFrozen
+				break
+			}
+			// Keys carry the pattern active when they were found
+			if !byName[kp.Pattern].activeAt(clock.Now()) {
+				log.Printf("Schedule window of %q closed mid-fill, dropping the key just found\n", kp.Pattern)
+				fc.Discards.Record(discardUnscheduled, kp.Pattern, kp.Pub, kp.Attempts)
+				need = fc.Quotas.Allowed(cycleCtx, deficient(patterns, counts))
+				pipe.Retarget(need)
+				continue
+			}
+			if fc.Maint.Active() {
+				log.Println("Maintenance mode entered mid-fill, dropping the key just found")
+				fc.Discards.Record(discardMaintenance, kp.Pattern, kp.Pub, kp.Attempts)
+				dropped = discardMaintenance
+				break
+			}
+			if fc.Lease.TTL > 0 && clock.Now().Sub(renewed) > fc.Lease.TTL/3 {
+				var ok bool
+				err := fc.Breaker.Do(func() (err error) {
+					ok, err = fc.Store.AcquireLease(cycleCtx, fc.Lease.name(), fc.Lease.Holder, fc.Lease.TTL)
+					return err
+				})
+				if err != nil || !ok {
+					log.Println("Lost the generation lease, stopping this fill")
+					fc.Discards.Record(discardLeaseLost, kp.Pattern, kp.Pub, kp.Attempts)
+					dropped = discardLeaseLost
+					break
+				}
+				renewed = clock.Now()
+			}
+
+			// Another instance may have filled the pool since this burst began.
+			// Weighted patterns have no per-pattern target to check against,
+			// and a pool far below its target is only checked on recounts.
+			if weights == nil && (int64(targets[kp.Pattern])-counts[kp.Pattern] <= recountEvery || sinceRecount[kp.Pattern]+1 >= recountEvery) {
+				var fresh int64
+				err = fc.Breaker.Do(func() (err error) {
+					fresh, err = fc.Store.CountUnpicked(cycleCtx, kp.Pattern)
+					return err
+				})
+				if err == nil && fresh >= int64(targets[kp.Pattern]) {
+					log.Printf("Pool %q already at target (%d), abandoning surplus key\n", kp.Pattern, fresh)
+					fc.Discards.Record(discardSurplus, kp.Pattern, kp.Pub, kp.Attempts)
+					counts[kp.Pattern] = fresh
+					need = fc.Quotas.Allowed(cycleCtx, deficient(patterns, counts))
+					pipe.Retarget(need)
+					continue
+				}
+			}
+
+			// A key on a WATCHLIST is kept, quarantined, for the investigation
+			if src, ok := fc.Watch.Listed(cycleCtx, kp.Pub); ok {
+				fc.Watch.Hit(cycleCtx, kp.Pub, src, "generated")
+				newKey.IsPicked, newKey.Quarantined = true, true
+				if _, err := fc.Store.Insert(cycleCtx, &newKey); err != nil {
+					log.Println("Error storing watchlisted key:", err)
+				}
+				fc.Discards.Record(discardQuarantine, kp.Pattern, kp.Pub, kp.Attempts)
+				continue
 			}
 
-			err = db.Clauses(clause.OnConflict{
-				Columns:   []clause.Column{{Name: "public_key"}},
-				DoNothing: true,
-			}).Create(&newKey).Error
+			var inserted bool
+			var dupErr error
+			insertCtx, insertSpan := tracer.Start(cycleCtx, "db.insert", trace.WithAttributes(attribute.String("pool", kp.Pattern)))
+			err = fc.Breaker.Do(func() (err error) {
+				inserted, err = fc.Store.Insert(insertCtx, &newKey)
+				// A STRICT_INSERT conflict says nothing about the database's health
+				if errors.Is(err, ErrDuplicateKey) {
+					dupErr, err = err, nil
+				}
+				return err
+			})
+			if err = cmp.Or(err, dupErr); err != nil {
+				insertSpan.SetStatus(codes.Error, err.Error())
+			}
+			insertSpan.End()
+			if errors.Is(err, errBreakerOpen) || ctx.Err() != nil {
+				break
+			}
+			if dupErr != nil {
+				insertConflictsTotal.WithLabelValues(kp.Pattern).Inc()
+				fc.Discards.Record(discardDuplicate, kp.Pattern, kp.Pub, kp.Attempts)
+				log.Printf("ALERT duplicate key with STRICT_INSERT, stopping this fill; check the RNG and generator: %v\n", dupErr)
+				break
+			}
 			if err != nil {
 				log.Println("Error inserting key:", err)
 				continue
 			}
 
-			c, err = countUnpicked(db)
-			if err != nil {
-				log.Println("Error recounting unpicked keys:", err)
-				break
+			attemptsTotal.WithLabelValues(kp.Pattern).Add(float64(kp.Attempts))
+			fc.RNG.Observe(!inserted)
+
+			// A conflict means the key was already stored: it is not
+			// progress, so keep generating without recounting.
+			if !inserted {
+				insertConflictsTotal.WithLabelValues(kp.Pattern).Inc()
+				log.Printf("Skipped duplicate key: %s\n", newKey.PublicKey)
+				fc.Discards.Record(discardDuplicate, kp.Pattern, kp.Pub, kp.Attempts)
+				continue
+			}
+
+			if fc.KeyDir != "" {
+				if err := writeKeyFile(fc.KeyDir, kp); err != nil {
+					log.Println("Error writing key file:", err)
+				}
+			}
+			keysFoundTotal.WithLabelValues(kp.Pattern).Inc()
+			fc.Quotas.Counted(kp.Pattern)
+			if err := fc.AuditLog.Log(auditEvent{Event: "generate", PublicKey: newKey.PublicKey, Pattern: kp.Pattern, Actor: fc.Lease.Holder}); err != nil {
+				log.Println("Error writing audit log:", err)
+			}
+			fc.Hooks.Enqueue(ctx, newKey)
+			fc.Stream.Publish(newKey)
+
+			// Far below a large target, recounting after every insert is
+			// wasted work: count the key and recount every recountEvery
+			// keys, and for the last ones
+			c := counts[kp.Pattern] + 1
+			sinceRecount[kp.Pattern]++
+			if weights != nil || int64(targets[kp.Pattern])-c <= recountEvery || sinceRecount[kp.Pattern] >= recountEvery {
+				sinceRecount[kp.Pattern] = 0
+				err = fc.Breaker.Do(func() (err error) {
+					c, err = fc.Store.CountUnpicked(cycleCtx, kp.Pattern)
+					return err
+				})
+				if err != nil {
+					if !errors.Is(err, errBreakerOpen) {
+						log.Println("Error recounting unpicked keys:", err)
+					}
+					break
+				}
+			}
+			counts[kp.Pattern] = c
+			log.Printf("Added key: %s | Current unpicked for %q: %d / %d\n", newKey.PublicKey, kp.Pattern, c, targets[kp.Pattern])
+			if fc.Prewarms.Poll(cycleCtx, counts) {
+				applyPrewarms()
+			}
+			need = fc.Quotas.Allowed(cycleCtx, deficient(patterns, counts))
+			pipe.Retarget(need)
+		}
+		if len(need) == 0 {
+			dropped = discardSurplus
+		}
+		pipe.Stop(fc.Discards, dropped)
+		cycle.End()
+		// Released on shutdown too, so a replacement need not wait out the TTL
+		if fc.Lease.TTL > 0 {
+			if err := fc.Store.ReleaseLease(context.WithoutCancel(ctx), fc.Lease.name(), fc.Lease.Holder); err != nil {
+				log.Println("Error releasing generation lease:", err)
 			}
-			log.Printf("Added key: %s | Current unpicked: %d\n", newKey.PublicKey, c)
+		}
+		if ctx.Err() != nil {
+			return
 		}
 
-		log.Printf("Target %d unpicked reached. Sleeping for %v...\n", target, sleepDur)
-		time.Sleep(sleepDur)
+		d := fc.Sleeps.Next(ctx, stallName, counts, fc.Sleep)
+		if next := nextScheduleChange(patterns, clock.Now()); !next.IsZero() {
+			d = min(d, next.Sub(clock.Now()))
+		}
+		log.Printf("Targets reached. Sleeping for %v...\n", d)
+		loop.Set(loopSleeping)
+		fc.Maint.Sleep(ctx, d)
 	}
 }
 
 func main() {
-	err := godotenv.Load()
+	yesReplace := flag.Bool("yes-replace", false, "restore-snapshot: replace the whole pool instead of merging")
+	repair := flag.Bool("repair", false, "check-consistency: fix safely repairable drift")
+	stuckAfter := flag.Duration("stuck-after", 15*time.Minute, "check-consistency: outbox events undelivered this long are stuck")
+	demo := flag.Bool("demo", false, "run a self-contained demo with an in-memory pool, ignoring .env")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	conf := Config{Args: flag.Args(), EnvFile: ".env", YesReplace: *yesReplace, Repair: *repair, StuckAfter: *stuckAfter, Demo: *demo}
+	if err := Run(ctx, conf); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Config is what Run runs: the command line, and settings on top of the
+// environment. Settings are read by their environment variable names, as
+// documented in .env.
+type Config struct {
+	// Args are the subcommand and its arguments, e.g. ["ctl", "stats"];
+	// none runs MODE and RUN_MODE.
+	Args []string
+	// Env sets variables over the process environment, .env and
+	// CONFIG_FILE, none of which it modifies.
+	Env map[string]string
+	// EnvFile is the .env file filling in variables set nowhere else, if
+	// any.
+	EnvFile string
+
+	// YesReplace, Repair, StuckAfter and Demo are the -yes-replace,
+	// -repair, -stuck-after and -demo flags.
+	YesReplace, Repair, Demo bool
+	StuckAfter               time.Duration
+	// Entropy, if set, replaces crypto/rand as the source of the fill
+	// loop's key seeds, so a run with one worker finds the same keys every
+	// time. It is for tests; the startup entropy check still reads
+	// crypto/rand.
+	Entropy io.Reader
+}
+
+// arg is the ith of Args, or "" past their end, like flag.Arg.
+func (c Config) arg(i int) string {
+	if i < len(c.Args) {
+		return c.Args[i]
+	}
+	return ""
+}
+
+// Run is the whole program but flag parsing: it loads the configuration,
+// runs the subcommand, MODE or RUN_MODE it selects and returns once that
+// finishes or ctx is cancelled. Every startup failure is returned rather
+// than exiting, so os.Exit stays in main. Settings, metrics and the clock
+// belong to the process, so only one Run may be in progress at a time.
+func Run(ctx context.Context, conf Config) error {
+	setSettings(conf.Env)
+	defer setSettings(nil)
+	if conf.StuckAfter == 0 {
+		conf.StuckAfter = 15 * time.Minute
+	}
+	if conf.Demo {
+		if err := runDemo(ctx); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// The operator CLI only talks to a running instance's API
+	if conf.arg(0) == "ctl" {
+		if err := cmdCtl(ctx, conf.Args[1:]); err != nil {
+			return err
+		}
+		return nil
+	}
+	if conf.arg(0) == "version" {
+		fmt.Println(currentBuild())
+		return nil
+	}
+	if conf.arg(0) == "verify-audit-log" {
+		if err := cmdVerifyAuditLog(conf.Args[1:]); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	cfg, err := loadEnvFile(conf.EnvFile)
 	if err != nil {
 		log.Println("Error loading .env file:", err)
 	}
+	// CONFIG_FILE fills in whatever the environment and .env leave unset,
+	// its PROFILE section overriding the rest of it
+	if path := getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadConfigFile(path); err != nil {
+			return fmt.Errorf("invalid CONFIG_FILE: %w", err)
+		}
+		cfg.add("CONFIG_FILE", path)
+	} else if profile := getenv("PROFILE"); profile != "" {
+		return fmt.Errorf("PROFILE %q needs a CONFIG_FILE defining it", profile)
+	}
+	cfg.add("PROFILE", getenv("PROFILE"))
 
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		log.Fatal("DATABASE_URL environment variable is not set")
+	// Signed exports of AUDIT_LOG_FILE need its configuration but no database
+	switch conf.arg(0) {
+	case "export-audit-log":
+		return cmdExportAuditLog(conf.Args[1:])
+	case "verify-audit-export":
+		return cmdVerifyAuditExport(conf.Args[1:])
 	}
-	db := connectDB(dsn)
 
 	targetUnpicked := 100
-	if val := os.Getenv("TARGET_UNPICKED"); val != "" {
+	if val := getenv("TARGET_UNPICKED"); val != "" {
 		if v, err := strconv.Atoi(val); err == nil {
 			targetUnpicked = v
 		}
 	}
 
 	suffix := "ponz"
-	if val := os.Getenv("SUFFIX"); val != "" {
+	if val := getenv("SUFFIX"); val != "" {
 		suffix = val
 	}
 
-	sleepMinutes := 1
-	if val := os.Getenv("SLEEP_MINUTES"); val != "" {
+	// SUFFIXES ("ponz,moon:20") takes precedence over the single SUFFIX. With
+	// only PREFIXES set there is no default suffix.
+	spec, source := suffix, "env:SUFFIX"
+	if val := getenv("SUFFIXES"); val != "" {
+		spec, source = val, "env:SUFFIXES"
+	} else if getenv("SUFFIX") == "" && getenv("PREFIXES") != "" {
+		spec, source = "", "env:PREFIXES"
+	}
+	// Decorative characters trimmed from pasted patterns, e.g. quotes and trailing punctuation
+	patternTrim := defaultPatternTrim
+	if val, ok := lookupEnv("PATTERN_TRIM_CHARS"); ok {
+		patternTrim = val
+	}
+	patterns, err := parsePatterns(spec, source, false, patternTrim)
+	if err != nil {
+		return fmt.Errorf("invalid SUFFIXES: %w", err)
+	}
+	prefixes, err := parsePatterns(getenv("PREFIXES"), "env:PREFIXES", true, patternTrim)
+	if err != nil {
+		return fmt.Errorf("invalid PREFIXES: %w", err)
+	}
+	patterns = append(patterns, prefixes...)
+
+	// MATCH_MODE is a comma-separated list of registered match modes (see
+	// registerMatchMode) a key may satisfy, any one being enough; each key
+	// is tagged with the pattern it matched. exact keeps the
+	// SUFFIXES/PREFIXES patterns, suffix and prefix one kind of them, edit
+	// adds near-misses of TARGET_WORD, contains adds CONTAINS texts found
+	// anywhere in the address
+	matchMode := cmp.Or(getenv("MATCH_MODE"), "exact")
+	// predicate adds PREDICATES, matched by compiled-in predicates or the
+	// PREDICATE_WASM modules, each call limited to PREDICATE_TIMEOUT
+	predicateTimeout := time.Millisecond
+	if val := getenv("PREDICATE_TIMEOUT"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			predicateTimeout = d
+		}
+	}
+	if err := loadWASMPredicates(ctx, getenv("PREDICATE_WASM"), predicateTimeout); err != nil {
+		return fmt.Errorf("invalid PREDICATE_WASM: %w", err)
+	}
+	cfg.add("PREDICATE_WASM", getenv("PREDICATE_WASM"))
+	cfg.add("PREDICATE_TIMEOUT", predicateTimeout)
+	patterns, err = resolveMatchModes(matchMode, matchModeEnv{patterns: patterns, trim: patternTrim, cfg: cfg})
+	if err != nil {
+		return fmt.Errorf("invalid MATCH_MODE configuration: %w", err)
+	}
+	cfg.add("MATCH_MODE", matchMode)
+	if len(patterns) == 0 {
+		return errors.New("no patterns configured")
+	}
+	// CHAR_EQUIV classes of characters match each other, e.g. "z2,sS" (off by default)
+	equiv, err := keygen.ParseEquivalence(getenv("CHAR_EQUIV"))
+	if err != nil {
+		return fmt.Errorf("invalid CHAR_EQUIV: %w", err)
+	}
+	for i := range patterns {
+		patterns[i].equiv = equiv
+	}
+	cfg.add("CHAR_EQUIV", equiv)
+
+	// Patterns may be written against how addresses are shown, e.g. solana:{address}
+	matchTemplate := getenv("MATCH_TEMPLATE")
+	if err := applyTemplate(patterns, matchTemplate); err != nil {
+		return fmt.Errorf("invalid MATCH_TEMPLATE: %w", err)
+	}
+	// The lint-patterns subcommand only needs the patterns, not a database
+	if conf.arg(0) == "lint-patterns" {
+		if err := cmdLintPatterns(conf.Args[1:], patterns); err != nil {
+			return err
+		}
+		return nil
+	}
+	lint, lintFailed := lintPatterns(patterns)
+	for _, l := range lint {
+		switch l.Severity {
+		case keygen.SeverityError:
+			log.Printf("Pattern lint error: %s\n", l.Text)
+		case keygen.SeverityWarn:
+			log.Printf("WARN pattern lint: %s\n", l.Text)
+		default:
+			log.Printf("Pattern lint: %s\n", l.Text)
+		}
+	}
+	if lintFailed {
+		return errors.New("invalid pattern configuration: pattern lint found errors; run lint-patterns for the report")
+	}
+	overlaps, err := validatePatterns(patterns)
+	if err != nil {
+		return fmt.Errorf("invalid pattern configuration: %w", err)
+	}
+	if len(patterns) > 1 {
+		log.Printf("Any of %d patterns matches; combined difficulty ~%.3g attempts per key\n", len(patterns), combinedDifficulty(patterns))
+	}
+	for _, o := range overlaps {
+		log.Printf("WARN pattern_overlap sub=%q sub_source=%s super=%q super_source=%s msg=%q\n",
+			o.Sub.Name(), o.Sub.Source, o.Super.Name(), o.Super.Source,
+			"every key matching sub also matches super; keys are attributed to the longer pattern")
+	}
+
+	targetMin, targetMax := 1, targetUnpicked
+	if val := getenv("TARGET_MIN"); val != "" {
 		if v, err := strconv.Atoi(val); err == nil {
-			sleepMinutes = v
+			targetMin = v
+		}
+	}
+	if val := getenv("TARGET_MAX"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil {
+			targetMax = v
+		}
+	}
+	// Named pool policy profiles (PATTERN_PROFILES) patterns reference by
+	// PATTERN_PROFILE; a pattern's own target, WORKERS_PER_PATTERN and
+	// PATTERN_QUOTAS entries win over its profile's
+	profiles, err := parsePoolProfiles(getenv("PATTERN_PROFILES"))
+	if err != nil {
+		return fmt.Errorf("invalid PATTERN_PROFILES: %w", err)
+	}
+	if err := applyPoolProfiles(getenv("PATTERN_PROFILE"), profiles, patterns); err != nil {
+		return fmt.Errorf("invalid PATTERN_PROFILE: %w", err)
+	}
+	applyDefaultTargets(patterns, targetUnpicked, getenv("TARGET_AUTO_SCALE") == "true", targetMin, targetMax)
+	for _, p := range patterns {
+		if p.Target > maxTarget {
+			return fmt.Errorf("target %d for %q is above the %d maximum; grinding towards it would never finish", p.Target, p.Name(), maxTarget)
 		}
 	}
+	// Per-pattern campaign label and validity window stamped on new keys
+	if err := parseCampaigns(getenv("CAMPAIGNS"), patterns); err != nil {
+		return fmt.Errorf("invalid CAMPAIGNS: %w", err)
+	}
+	// Scheduled patterns are only ground for inside their windows
+	if err := parseSchedule(getenv("PATTERN_SCHEDULE"), patterns); err != nil {
+		return fmt.Errorf("invalid PATTERN_SCHEDULE: %w", err)
+	}
+	// Weighted mode: keep the sum of the targets and grind each key for a
+	// pattern drawn by weight, instead of refilling each pattern to its own target
+	if err := parsePatternWeights(getenv("PATTERN_WEIGHTS"), patterns); err != nil {
+		return fmt.Errorf("invalid PATTERN_WEIGHTS: %w", err)
+	}
+	if getenv("PATTERN_WEIGHTS") != "" && getenv("PATTERN_SCHEDULE") != "" {
+		return errors.New("weighted patterns share one pool and cannot be combined with PATTERN_SCHEDULE")
+	}
+	initPatternMetrics(patterns)
+
+	// The dashboard only depends on the registered metrics, not the database
+	if conf.arg(0) == "dashboard" {
+		if err := cmdDashboard(); err != nil {
+			return err
+		}
+		return nil
+	}
+	if conf.arg(0) == "compare-generators" {
+		constraints, err := parseDerivedConstraints(getenv("DERIVED_CONSTRAINTS"))
+		if err != nil {
+			return fmt.Errorf("invalid DERIVED_CONSTRAINTS: %w", err)
+		}
+		if err := cmdCompareGenerators(conf.Args[1:], constraints); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// SLEEP ("30s", "2m") takes precedence over SLEEP_MINUTES; either is
+	// clamped to at least MIN_SLEEP so a full pool is not polled in a busy loop
+	minSleep := time.Second
+	if val := getenv("MIN_SLEEP"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			minSleep = d
+		}
+	}
+	sleepDur, err := parseSleep(getenv("SLEEP"), getenv("SLEEP_MINUTES"), minSleep)
+	if err != nil {
+		return fmt.Errorf("invalid sleep: %w", err)
+	}
 
 	workers := 100
-	if val := os.Getenv("WORKERS"); val != "" {
+	if val := getenv("WORKERS"); val != "" {
 		if v, err := strconv.Atoi(val); err == nil {
 			workers = v
 		}
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	// Keys found ahead of the inserter, so grinding goes on during inserts (0 = in turn)
+	pipelineDepth := 0
+	if val := getenv("PIPELINE_DEPTH"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			pipelineDepth = v
+		}
+	}
+	// Pipelined finds costing at least this many attempts never wait for room (empty or "auto" = 58 times
+	// the cheapest pattern's, 0 = none)
+	pipelineUrgent, urgentSetting := -1.0, "auto"
+	if val := getenv("PIPELINE_URGENT_ATTEMPTS"); val != "" && val != "auto" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 {
+			pipelineUrgent, urgentSetting = v, val
+		}
+	}
+	// At most this many found keys wait to be stored, urgent or not; reaching it pauses generation until
+	// PIPELINE_RESUME_BUFFERED remain (0 = no cap; default resume = half)
+	pipelineMax := 1000
+	if val := getenv("PIPELINE_MAX_BUFFERED"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			pipelineMax = v
+		}
+	}
+	pipelineResume := pipelineMax / 2
+	if val := getenv("PIPELINE_RESUME_BUFFERED"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 && v < pipelineMax {
+			pipelineResume = v
+		}
+	}
+
+	// Fraction of time workers spend grinding; only applies while generating
+	duty := 1.0
+	if val := getenv("GEN_DUTY_CYCLE"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v > 0 && v <= 1 {
+			duty = v
+		}
+	}
+	genOpts := []keygen.Option{keygen.WithDutyCycle(duty), keygen.WithRateReporter(recordRate)}
+	if conf.Entropy != nil {
+		genOpts = append(genOpts, keygen.WithEntropy(conf.Entropy))
+	}
+	if equiv.Active() {
+		genOpts = append(genOpts, keygen.WithEquivalence(equiv))
+	}
+
+	// Start workers gradually over WORKER_RAMP on the first fill, not all at once (0 = off)
+	var workerRamp time.Duration
+	if val := getenv("WORKER_RAMP"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			workerRamp = d
+			genOpts = append(genOpts, startupRamp(workerRamp))
+		}
+	}
+
+	// Require MIN_TRAILING_DIGITS digits within the last TRAILING_WINDOW characters
+	var minDigits, window int
+	if val := getenv("MIN_TRAILING_DIGITS"); val != "" {
+		minDigits, err = strconv.Atoi(val)
+		if err != nil || minDigits < 1 {
+			return fmt.Errorf("invalid MIN_TRAILING_DIGITS %q", val)
+		}
+		window = minDigits
+		if val := getenv("TRAILING_WINDOW"); val != "" {
+			if v, err := strconv.Atoi(val); err == nil {
+				window = v
+			}
+		}
+		if window < minDigits {
+			return fmt.Errorf("TRAILING_WINDOW (%d) must be at least MIN_TRAILING_DIGITS (%d)", window, minDigits)
+		}
+		genOpts = append(genOpts, keygen.WithFilter(keygen.TrailingDigits(window, minDigits)))
+	}
+
+	// Secondary constraints on addresses derived from each candidate, e.g. its metadata PDA
+	constraints, err := parseDerivedConstraints(getenv("DERIVED_CONSTRAINTS"))
+	if err != nil {
+		return fmt.Errorf("invalid DERIVED_CONSTRAINTS: %w", err)
+	}
+	if len(constraints) > 0 {
+		if err := checkDerivations(constraints); err != nil {
+			return fmt.Errorf("invalid DERIVED_CONSTRAINTS: %w", err)
+		}
+		// After DERIVED_MAX_FAILURES failed derivations in a row the burst is
+		// halted; the next fill cycle probes again
+		maxFailures := 10
+		if val := getenv("DERIVED_MAX_FAILURES"); val != "" {
+			if v, err := strconv.Atoi(val); err == nil && v > 0 {
+				maxFailures = v
+			}
+		}
+		derivationBreaker := newCircuitBreaker("derivation", maxFailures, time.Minute)
+		genOpts = append(genOpts, keygen.WithCheck(derivedCheck(constraints, derivationBreaker)))
+		cfg.add("DERIVED_MAX_FAILURES", maxFailures)
+	}
+	cfg.add("DERIVED_CONSTRAINTS", getenv("DERIVED_CONSTRAINTS"))
+
+	// Candidates containing a BLOCKLIST_FILE term anywhere are dropped; reloaded on SIGHUP
+	var blocks *blocklist
+	if path := getenv("BLOCKLIST_FILE"); path != "" {
+		warnRate := 0.2
+		if val := getenv("BLOCKLIST_WARN_RATE"); val != "" {
+			if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 && v <= 1 {
+				warnRate = v
+			}
+		}
+		if blocks, err = newBlocklist(path, patterns, warnRate); err != nil {
+			return fmt.Errorf("failed to load BLOCKLIST_FILE: %w", err)
+		}
+		genOpts = append(genOpts, keygen.WithFilter(blocks.allows))
+		cfg.add("BLOCKLIST_WARN_RATE", warnRate)
+	}
+	cfg.add("BLOCKLIST_FILE", getenv("BLOCKLIST_FILE"))
+
+	var specs []string
+	for _, p := range patterns {
+		specs = append(specs, fmt.Sprintf("%s:%d", p.Name(), p.Target))
+	}
+	yesReplaceOrigin := "default"
+	if conf.YesReplace {
+		yesReplaceOrigin = "flag"
+	}
+	cfg.addAs("-yes-replace", strconv.FormatBool(conf.YesReplace), yesReplaceOrigin)
+	cfg.add("MODE", cmp.Or(getenv("MODE"), "generate"))
+	cfg.add("TARGET_UNPICKED", targetUnpicked)
+	cfg.add("SUFFIX", suffix)
+	cfg.add("SUFFIXES", getenv("SUFFIXES"))
+	cfg.add("PATTERN_WEIGHTS", getenv("PATTERN_WEIGHTS"))
+	cfg.add("PATTERN_PROFILES", getenv("PATTERN_PROFILES"))
+	cfg.add("PATTERN_PROFILE", getenv("PATTERN_PROFILE"))
+	cfg.add("PREFIXES", getenv("PREFIXES"))
+	cfg.add("PATTERN_TRIM_CHARS", patternTrim)
+	cfg.add("CAMPAIGNS", getenv("CAMPAIGNS"))
+	cfg.add("PATTERN_SCHEDULE", getenv("PATTERN_SCHEDULE"))
+	cfg.add("MATCH_TEMPLATE", cmp.Or(matchTemplate, "{address}"))
+	cfg.addAs("patterns", strings.Join(specs, ","), cfg.origin(strings.TrimPrefix(source, "env:")))
+	cfg.add("TARGET_AUTO_SCALE", getenv("TARGET_AUTO_SCALE") == "true")
+	cfg.add("TARGET_MIN", targetMin)
+	cfg.add("TARGET_MAX", targetMax)
+	cfg.add("SLEEP_MINUTES", getenv("SLEEP_MINUTES"))
+	cfg.add("SLEEP", sleepDur)
+	cfg.add("MIN_SLEEP", minSleep)
+	cfg.add("WORKERS", workers)
+	cfg.add("PIPELINE_DEPTH", pipelineDepth)
+	cfg.add("PIPELINE_URGENT_ATTEMPTS", urgentSetting)
+	cfg.add("PIPELINE_MAX_BUFFERED", pipelineMax)
+	cfg.add("PIPELINE_RESUME_BUFFERED", pipelineResume)
+	cfg.add("GEN_DUTY_CYCLE", duty)
+	cfg.add("WORKER_RAMP", workerRamp)
+	cfg.add("MIN_TRAILING_DIGITS", minDigits)
+	cfg.add("TRAILING_WINDOW", window)
+
+	// Only keep addresses of exactly ADDRESS_LENGTH characters (43 or 44, empty or "any" = both)
+	var addrLen int
+	switch val := getenv("ADDRESS_LENGTH"); val {
+	case "", "any":
+	case "43", "44":
+		addrLen, _ = strconv.Atoi(val)
+		genOpts = append(genOpts, keygen.WithAddressLength(addrLen))
+	default:
+		return fmt.Errorf("invalid ADDRESS_LENGTH %q, want 43, 44 or any", val)
+	}
+	if err := checkAddressLengths(patterns, addrLen); err != nil {
+		return fmt.Errorf("invalid ADDRESS_LENGTH: %w", err)
+	}
+	if addrLen > 0 {
+		cfg.add("ADDRESS_LENGTH", addrLen)
+	} else {
+		cfg.add("ADDRESS_LENGTH", "any")
+	}
+
+	// Log about every Nth candidate address for debugging the matcher
+	if val := getenv("DEBUG_SAMPLE_EVERY_N"); val != "" {
+		if n, err := strconv.ParseInt(val, 10, 64); err == nil && n > 0 {
+			genOpts = append(genOpts, keygen.WithSampler(n, func(addr string, matched bool) {
+				log.Printf("DEBUG sample address=%s matched=%v\n", addr, matched)
+			}))
+			cfg.add("DEBUG_SAMPLE_EVERY_N", n)
+		}
+	}
+
+	// Agents need no database: they grind whatever the coordinator hands out
+	if getenv("MODE") == "agent" {
+		coordinator := getenv("AGENT_COORDINATOR_URL")
+		if coordinator == "" {
+			return errors.New("AGENT_COORDINATOR_URL environment variable is not set")
+		}
+		name := getenv("AGENT_NAME")
+		if name == "" {
+			name, _ = os.Hostname()
+		}
+
+		cfg.add("AGENT_COORDINATOR_URL", coordinator)
+		cfg.add("AGENT_NAME", name)
+		cfg.addSecret("AGENT_TOKEN", getenv("AGENT_TOKEN"))
+		log.Printf("%s\nEffective configuration:\n%s", currentBuild(), cfg)
+
+		newAgent(newAgentClient(coordinator, getenv("AGENT_TOKEN")), name, workers, duty).Run(ctx)
+		return nil
+	}
+
+	dsn := getenv("DATABASE_URL")
+	if dsn == "" {
+		return errors.New("DATABASE_URL environment variable is not set")
+	}
+	db, err := connectDB("DATABASE_URL", dsn)
+	if err != nil {
+		return err
+	}
+
+	timeouts := dbTimeouts{Count: 10 * time.Second, Insert: 10 * time.Second, Pick: 10 * time.Second, Query: 30 * time.Second}
+	for env, d := range map[string]*time.Duration{
+		"DB_COUNT_TIMEOUT":  &timeouts.Count,
+		"DB_INSERT_TIMEOUT": &timeouts.Insert,
+		"DB_PICK_TIMEOUT":   &timeouts.Pick,
+		"DB_QUERY_TIMEOUT":  &timeouts.Query,
+	} {
+		if val := getenv(env); val != "" {
+			if v, err := time.ParseDuration(val); err == nil {
+				*d = v
+			}
+		}
+	}
 
-	// Keep at least targetUnpicked unpicked keys, sleep sleepMinutes when enough
-	go maintainUnpickedKeys(db, targetUnpicked, suffix, time.Duration(sleepMinutes)*time.Minute, workers)
+	// With ENCRYPTION_KEY set, private keys are stored encrypted
+	var encKey []byte
+	if val := getenv("ENCRYPTION_KEY"); val != "" {
+		if encKey, err = parseEncryptionKey(val); err != nil {
+			return fmt.Errorf("invalid ENCRYPTION_KEY: %w", err)
+		}
+	}
+	store := newGormStore(db, timeouts, encKey)
+	// READ_DATABASE_URL, a replica of DATABASE_URL, takes unpicked counts,
+	// stats and listings off the primary
+	readDSN := getenv("READ_DATABASE_URL")
+	if readDSN != "" {
+		if store.read, err = connectDB("READ_DATABASE_URL", readDSN); err != nil {
+			return err
+		}
+	}
+	// Reads skip the replica for READ_YOUR_WRITES_WINDOW after an admin
+	// mutation; replica data trailing by over READ_STALE_AFTER is stale
+	store.fresh = &readFreshness{window: 30 * time.Second, tolerance: 10 * time.Second}
+	if val := getenv("READ_YOUR_WRITES_WINDOW"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			store.fresh.window = d
+		}
+	}
+	if val := getenv("READ_STALE_AFTER"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			store.fresh.tolerance = d
+		}
+	}
+
+	// TRANSFER_KEY, shared with peers, seals keys moved between instances by
+	// the seed subcommand and POST /v1/transfers
+	var transferKey []byte
+	if val := getenv("TRANSFER_KEY"); val != "" {
+		if transferKey, err = parseEncryptionKey(val); err != nil {
+			return fmt.Errorf("invalid TRANSFER_KEY: %w", err)
+		}
+	}
+	cfg.addSecret("TRANSFER_KEY", getenv("TRANSFER_KEY"))
+
+	// A database migrated by a newer binary is refused, or with
+	// SCHEMA_MISMATCH=read-only served unmigrated in maintenance mode
+	schemaMismatch := cmp.Or(getenv("SCHEMA_MISMATCH"), "refuse")
+	if schemaMismatch != "refuse" && schemaMismatch != "read-only" {
+		return fmt.Errorf("unknown SCHEMA_MISMATCH %q, want refuse or read-only", schemaMismatch)
+	}
+	cfg.add("SCHEMA_MISMATCH", schemaMismatch)
+	var schemaTooNew error
+	dbSchema, err := checkSchema(ctx, db, "DATABASE_URL")
+	switch {
+	case errors.Is(err, errSchemaTooNew) && schemaMismatch == "read-only":
+		log.Printf("WARN %v; running read-only\n", err)
+		schemaTooNew = err
+	case err != nil:
+		return err
+	default:
+		if err := migrate(ctx, db, patterns); err != nil {
+			return fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+	if err := refuseWrites(schemaTooNew, conf.arg(0), getenv("MODE"), conf.Repair); err != nil {
+		return err
+	}
+	if err := store.CheckEncryption(ctx, getenv("ENCRYPTION_REQUIRED") == "true"); err != nil {
+		return fmt.Errorf("encryption check failed: %w", err)
+	}
+	if schemaTooNew == nil {
+		if n, err := store.BackfillDigests(ctx); err != nil {
+			return fmt.Errorf("private key digest backfill failed: %w", err)
+		} else if n > 0 {
+			log.Printf("Set the private key digest of %d stored keys\n", n)
+		}
+	}
+	// CLUSTER labels stored keys and must be declared by picks; RPC_URL,
+	// if set, must serve it
+	store.cluster = getenv("CLUSTER")
+	if store.cluster != "" {
+		if err := checkClusterName(store.cluster); err != nil {
+			return fmt.Errorf("invalid CLUSTER: %w", err)
+		}
+	}
+	rpcURL := getenv("RPC_URL")
+	switch {
+	case rpcURL != "" && store.cluster == "":
+		return errors.New("RPC_URL is set without CLUSTER; set CLUSTER to the cluster it serves")
+	case rpcURL != "":
+		if err := verifyCluster(ctx, rpcURL, store.cluster); err != nil {
+			return err
+		}
+		log.Printf("RPC_URL serves CLUSTER %s\n", store.cluster)
+	case store.cluster != "":
+		log.Printf("WARN CLUSTER %s is not checked without RPC_URL\n", store.cluster)
+	}
+	if store.cluster != "" && schemaTooNew == nil {
+		if n, err := store.LabelUnclustered(ctx); err != nil {
+			return err
+		} else if n > 0 {
+			log.Printf("Labelled %d keys stored without a cluster as %s\n", n, store.cluster)
+		}
+	}
+	cfg.add("CLUSTER", store.cluster)
+	cfg.addSecret("RPC_URL", rpcURL)
+	// DB_ENGINE=pgx moves picks, inserts and counts off GORM onto a pgx pool
+	switch engine := cmp.Or(getenv("DB_ENGINE"), "gorm"); engine {
+	case "gorm":
+		cfg.add("DB_ENGINE", engine)
+	case "pgx":
+		if store.pgx, err = newPgxPool(ctx, dsn); err != nil {
+			return fmt.Errorf("failed to connect pgx pool: %w", err)
+		}
+		defer store.pgx.Close()
+		cfg.add("DB_ENGINE", engine)
+	default:
+		return fmt.Errorf("unknown DB_ENGINE %q, want gorm or pgx", engine)
+	}
+	// STRICT_INSERT=true makes a public key conflict an error instead of a skip
+	store.strictInsert = getenv("STRICT_INSERT") == "true"
+	cfg.add("STRICT_INSERT", store.strictInsert)
+
+	switch cmd := conf.arg(0); cmd {
+	case "":
+	case "list":
+		if err := cmdList(ctx, store, conf.Args[1:]); err != nil {
+			return err
+		}
+		return nil
+	case "stage":
+		if err := cmdStage(ctx, store, conf.Args[1:], patterns, workers, genOpts); err != nil {
+			return err
+		}
+		return nil
+	case "promote":
+		if err := cmdPromote(ctx, store, conf.Args[1:]); err != nil {
+			return err
+		}
+		return nil
+	case "seed":
+		if err := cmdSeed(ctx, store, conf.Args[1:], transferKey); err != nil {
+			return err
+		}
+		return nil
+	case "reconcile-transfers":
+		if err := cmdReconcileTransfers(ctx, store, conf.Args[1:], transferKey); err != nil {
+			return err
+		}
+		return nil
+	case "export-keygen-dir":
+		if err := cmdExportKeygenDir(ctx, store, conf.Args[1:]); err != nil {
+			return err
+		}
+		return nil
+	case "reconcile-expected":
+		if err := cmdReconcileExpected(ctx, store, conf.Args[1:]); err != nil {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+
+	mode := getenv("MODE")
+	switch mode {
+	case "", "generate", "standby", "check-consistency":
+	case "snapshot", "restore-snapshot":
+		key := encKey
+		if key == nil {
+			return errors.New("ENCRYPTION_KEY environment variable is not set")
+		}
+		path := getenv("SNAPSHOT_FILE")
+		if path == "" {
+			return errors.New("SNAPSHOT_FILE environment variable is not set")
+		}
+
+		if mode == "snapshot" {
+			compress, err := compression()
+			if err != nil {
+				return err
+			}
+			n, err := writeSnapshot(ctx, db, key, path, compress)
+			if err != nil {
+				return fmt.Errorf("snapshot failed: %w", err)
+			}
+			log.Printf("Snapshot of %d keys written to %s\n", n, path)
+			return nil
+		}
+
+		n, err := restoreSnapshot(ctx, db, key, path, conf.YesReplace, store.cluster)
+		if err != nil {
+			return fmt.Errorf("restore failed: %w", err)
+		}
+		log.Printf("Restored %d keys from %s (replace=%v)\n", n, path, conf.YesReplace)
+		return nil
+	default:
+		return fmt.Errorf("unknown MODE %q", mode)
+	}
+
+	// Secondary pools (DATABASE_URL_2, DATABASE_URL_3, ...) get a copy of every
+	// generated key; WRITE_QUORUM of all pools must accept it
+	poolNames, pools := []string{"DATABASE_URL"}, []KeyStore{store}
+	var mirrors []*gormStore
+	statPools := []dbStatsPool{{role: "primary", pool: "DATABASE_URL", db: db}}
+	if store.read != nil {
+		statPools = append(statPools, dbStatsPool{role: "replica", pool: "READ_DATABASE_URL", db: store.read})
+	}
+	for i := 2; ; i++ {
+		name := fmt.Sprintf("DATABASE_URL_%d", i)
+		dsn := getenv(name)
+		if dsn == "" {
+			break
+		}
+		sdb, err := connectDB(name, dsn)
+		if err != nil {
+			return err
+		}
+		switch _, err := checkSchema(ctx, sdb, name); {
+		case errors.Is(err, errSchemaTooNew) && schemaMismatch == "read-only":
+			log.Printf("WARN %v; running read-only\n", err)
+			schemaTooNew = cmp.Or(schemaTooNew, err)
+		case err != nil:
+			return err
+		default:
+			if err := migrate(ctx, sdb, patterns); err != nil {
+				return fmt.Errorf("failed to migrate %s: %w", name, err)
+			}
+		}
+		secondary := newGormStore(sdb, timeouts, encKey)
+		secondary.strictInsert = store.strictInsert
+		secondary.cluster = store.cluster
+		if err := secondary.CheckEncryption(ctx, false); err != nil {
+			return fmt.Errorf("encryption check failed for %s: %w", name, err)
+		}
+		if schemaTooNew == nil {
+			if _, err := secondary.BackfillDigests(ctx); err != nil {
+				return fmt.Errorf("private key digest backfill failed for %s: %w", name, err)
+			}
+		}
+		if secondary.cluster != "" && schemaTooNew == nil {
+			if _, err := secondary.LabelUnclustered(ctx); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		poolNames, pools = append(poolNames, name), append(pools, secondary)
+		mirrors = append(mirrors, secondary)
+		statPools = append(statPools, dbStatsPool{role: "secondary", pool: name, db: sdb})
+		cfg.addAs(name, redactDSN(dsn), cfg.origin(name))
+	}
+	// MODE=check-consistency reports how the secondary pools and the outbox
+	// have drifted from token_key, exiting non-zero on drift
+	if mode == "check-consistency" {
+		if err := refuseWrites(schemaTooNew, "", mode, conf.Repair); err != nil {
+			return err
+		}
+		if err := checkConsistency(ctx, store, poolNames[1:], mirrors, conf.StuckAfter, conf.Repair); err != nil {
+			return err
+		}
+		return nil
+	}
+	registerRuntimeMetrics(statPools)
+	quorum := len(pools)
+	if val := getenv("WRITE_QUORUM"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil {
+			quorum = v
+		}
+	}
+	freeze, err := newFreezeSwitch(ctx, store)
+	if err != nil {
+		return fmt.Errorf("failed to read freeze flag: %w", err)
+	}
+	// Admin-controlled storage, pick and generation faults for testing consumers
+	var faults *faultInjector
+	if getenv("UNSAFE_FAULT_INJECTION") == "true" {
+		faults = newFaultInjector()
+		if err := faults.instrument(db); err != nil {
+			return fmt.Errorf("failed to set up fault injection: %w", err)
+		}
+	}
+	cfg.add("UNSAFE_FAULT_INJECTION", faults != nil)
+	// Maintenance mode disables all database writes until lifted via the admin API
+	maint := newMaintenanceSwitch(getenv("MAINTENANCE_MODE") == "true", getenv("MAINTENANCE_MESSAGE"))
+	if schemaTooNew != nil {
+		maint.set(true, "schema", schemaTooNew.Error()+"; writes are disabled")
+	}
+	cfg.add("MAINTENANCE_MODE", maint.Active())
+
+	var pool KeyStore = store
+	if len(pools) > 1 {
+		if pool, err = newMultiStore(poolNames, pools, quorum); err != nil {
+			return fmt.Errorf("invalid WRITE_QUORUM: %w", err)
+		}
+		cfg.add("WRITE_QUORUM", quorum)
+	}
+
+	// Generation lease so overlapping instances do not both fill (0 = off)
+	leaseTTL := 30 * time.Second
+	if val := getenv("GENERATION_LEASE_TTL"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			leaseTTL = d
+		}
+	}
+	host, _ := os.Hostname()
+	leaseHolder := fmt.Sprintf("%s/%d/%s", host, os.Getpid(), uuid.NewString()[:8])
+	cfg.add("GENERATION_LEASE_TTL", leaseTTL)
+
+	// MODE=standby: a warm spare that only fills once the primary has
+	// inserted nothing for STANDBY_STALL_AFTER while below target
+	standbyPoll, standbyStall, standbyHold := 30*time.Second, 10*time.Minute, 30*time.Minute
+	if val := getenv("STANDBY_POLL_INTERVAL"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			standbyPoll = d
+		}
+	}
+	if val := getenv("STANDBY_STALL_AFTER"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			standbyStall = d
+		}
+	}
+	// Minimum time a standby leads once it has taken over, so it does not flap
+	if val := getenv("STANDBY_MIN_HOLD"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			standbyHold = d
+		}
+	}
+	if mode == "standby" {
+		cfg.add("STANDBY_POLL_INTERVAL", standbyPoll)
+		cfg.add("STANDBY_STALL_AFTER", standbyStall)
+		cfg.add("STANDBY_MIN_HOLD", standbyHold)
+		cfg.add("STANDBY_ALERT_URL", getenv("STANDBY_ALERT_URL"))
+	}
+
+	// Unpicked keys older than MAX_KEY_AGE are deleted and regenerated (0 = never)
+	var maxKeyAge time.Duration
+	if val := getenv("MAX_KEY_AGE"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			maxKeyAge = d
+		}
+	}
+	cfg.add("MAX_KEY_AGE", maxKeyAge)
+
+	// Generation and pick events also go to a hash-chained AUDIT_LOG_FILE,
+	// checked with the verify-audit-log subcommand
+	var auditLog AuditLogger = nopAuditLogger{}
+	if path := getenv("AUDIT_LOG_FILE"); path != "" {
+		fl, err := openFileAuditLog(path)
+		if err != nil {
+			return fmt.Errorf("failed to open AUDIT_LOG_FILE: %w", err)
+		}
+		defer fl.Close()
+		auditLog = fl
+	}
+	cfg.add("AUDIT_LOG_FILE", getenv("AUDIT_LOG_FILE"))
+	cfg.add("PAPER_BACKUP_ENABLED", getenv("PAPER_BACKUP_ENABLED") == "true")
+
+	// PATTERN_QUOTAS caps how many keys a pattern may ever have generated
+	// (pattern=max_total_keys); stored caps, e.g. raised via POST
+	// /v1/admin/quotas, win over the env on restart
+	caps, err := parsePatternQuotas(getenv("PATTERN_QUOTAS"), patterns)
+	if err != nil {
+		return fmt.Errorf("invalid PATTERN_QUOTAS: %w", err)
+	}
+	addProfileQuotas(patterns, caps)
+	if schemaTooNew == nil {
+		if err := store.SeedQuotas(ctx, caps); err != nil {
+			return fmt.Errorf("failed to store pattern quotas: %w", err)
+		}
+	}
+	quotas := newQuotaBook(store, getenv("QUOTA_ALERT_URL"))
+	prewarms := newPrewarmBook(store)
+	cfg.add("PATTERN_QUOTAS", getenv("PATTERN_QUOTAS"))
+	cfg.add("QUOTA_ALERT_URL", getenv("QUOTA_ALERT_URL"))
+
+	// A generated key repeating means a broken RNG; above this insert conflict
+	// rate /healthz fails and ALERTs are logged (RNG_MONITOR=false to disable)
+	var rng *rngMonitor
+	rngThreshold := 0.001
+	if val := getenv("RNG_CONFLICT_THRESHOLD"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 && v < 1 {
+			rngThreshold = v
+		}
+	}
+	if getenv("RNG_MONITOR") != "false" {
+		rng = newRNGMonitor(rngThreshold)
+		cfg.add("RNG_CONFLICT_THRESHOLD", rngThreshold)
+	}
+	cfg.add("RNG_MONITOR", rng != nil)
+
+	// Below target with no key found for STALL_THRESHOLD, /healthz fails
+	// (0 disables the check)
+	var stall *stallMonitor
+	if val := getenv("STALL_THRESHOLD"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			stall = newStallMonitor(d)
+		}
+	}
+	cfg.add("STALL_THRESHOLD", getenv("STALL_THRESHOLD"))
+
+	// crypto/rand is sampled at startup, aborting if it is broken or slower
+	// than ENTROPY_CHECK_MAX_DURATION, and every ENTROPY_CHECK_INTERVAL after
+	entropyBytes, entropySlow, entropyEvery := 1<<20, 2*time.Second, 10*time.Minute
+	if val := getenv("ENTROPY_CHECK_BYTES"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 4096 {
+			entropyBytes = v
+		}
+	}
+	if val := getenv("ENTROPY_CHECK_MAX_DURATION"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			entropySlow = d
+		}
+	}
+	if val := getenv("ENTROPY_CHECK_INTERVAL"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			entropyEvery = d
+		}
+	}
+	entropyCheck := checkEntropy(rand.Reader, entropyBytes, entropySlow)
+	if !entropyCheck.Healthy() {
+		return fmt.Errorf("entropy check failed, refusing to generate keys: %s", entropyCheck.Problem)
+	}
+	log.Printf("Entropy check passed: %d bytes in %v, chi-square %.0f\n", entropyBytes, entropyCheck.Duration.Round(time.Microsecond), entropyCheck.ChiSquare)
+	// Periodic checks are lighter than the startup one
+	entropy := newEntropyMonitor(entropyCheck, max(4096, entropyBytes/16), entropySlow)
+	cfg.add("ENTROPY_CHECK_BYTES", entropyBytes)
+	cfg.add("ENTROPY_CHECK_MAX_DURATION", entropySlow)
+	cfg.add("ENTROPY_CHECK_INTERVAL", entropyEvery)
+
+	// Optional directory receiving one solana-keygen JSON file per found key
+	keyDir := getenv("KEY_FILE_DIR")
+	if keyDir != "" {
+		if n, err := cleanKeyDir(keyDir); err != nil {
+			log.Println("Error cleaning KEY_FILE_DIR:", err)
+		} else if n > 0 {
+			log.Printf("Removed %d partial key files left in %s by an interrupted write\n", n, keyDir)
+		}
+	}
+
+	breakerThreshold := 5
+	if val := getenv("DB_BREAKER_THRESHOLD"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil {
+			breakerThreshold = v
+		}
+	}
+
+	breakerCooldown := 30 * time.Second
+	if val := getenv("DB_BREAKER_COOLDOWN"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil {
+			breakerCooldown = d
+		}
+	}
+	breaker := newCircuitBreaker("db", breakerThreshold, breakerCooldown)
+
+	// Write pacing to keep generation from crowding out pickers
+	var maxInserts float64
+	if val := getenv("MAX_INSERTS_PER_SECOND"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v > 0 {
+			maxInserts = v
+		}
+	}
+	var maxPickLatency time.Duration
+	if val := getenv("PAUSE_GENERATION_ON_PICK_LATENCY"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			maxPickLatency = d
+		}
+	}
+	pacer := newWritePacer(maxInserts, maxPickLatency)
+
+	// Capacity limits checked before each fill; CAPACITY_POLICY=refuse skips fills that would exceed them
+	var limits capacityLimits
+	if val := getenv("MAX_TOTAL_KEYS"); val != "" {
+		if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+			limits.MaxRows = v
+		}
+	}
+	if val := getenv("MAX_DB_SIZE_MB"); val != "" {
+		if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+			limits.MaxBytes = v << 20
+		}
+	}
+	switch policy := cmp.Or(getenv("CAPACITY_POLICY"), "warn"); policy {
+	case "warn":
+	case "refuse":
+		limits.Refuse = true
+	default:
+		return fmt.Errorf("unknown CAPACITY_POLICY %q", policy)
+	}
+
+	hooks, err := loadHooks(store, patterns)
+	if err != nil {
+		return fmt.Errorf("invalid hook configuration: %w", err)
+	}
+
+	shutdownTracing, err := setupTracing(ctx, getenv("OTLP_ENDPOINT"))
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer shutdownTracing(context.WithoutCancel(ctx))
+
+	if hooks != nil {
+		go hooks.Run(ctx)
+	}
+	go freeze.Run(ctx)
+
+	// Recurring maintenance runs on one scheduler; JOB_SCHEDULES replaces a
+	// job's schedule by name, e.g. "vacuum=0 3 * * 0;pick_result_purge=@every 30m"
+	jobs := newJobScheduler(ctx, maint)
+	if val := getenv("JOB_SCHEDULES"); val != "" {
+		overrides, err := parseJobSchedules(val)
+		if err != nil {
+			return fmt.Errorf("invalid JOB_SCHEDULES: %w", err)
+		}
+		jobs.overrides = overrides
+	}
+	cfg.add("JOB_SCHEDULES", getenv("JOB_SCHEDULES"))
+	if entropyEvery > 0 {
+		if err := jobs.Register(jobSpec{Name: "entropy_check", Every: entropyEvery, InMaintenance: true,
+			Run: entropy.Check}); err != nil {
+			return err
+		}
+	}
+	if faults != nil {
+		go faults.Run(ctx)
+	}
+
+	tokens, err := newTokenSet(getenv("API_TOKENS_FILE"), getenv("API_TOKEN"))
+	if err != nil {
+		return fmt.Errorf("failed to load API tokens: %w", err)
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := tokens.Reload(); err != nil {
+				log.Println("Error reloading API tokens, keeping previous set:", err)
+			} else {
+				log.Println("Reloaded API tokens")
+			}
+			if blocks != nil {
+				if err := blocks.Reload(); err != nil {
+					log.Println("Error reloading blocklist, keeping previous terms:", err)
+				}
+			}
+		}
+	}()
+
+	pickRetention := 24 * time.Hour
+	if val := getenv("PICK_RESULT_RETENTION"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			pickRetention = d
+		}
+	}
+	// Deadline for a whole pick request; a timed-out pick answers 504 (0 = off)
+	var pickTimeout time.Duration
+	if val := getenv("PICK_TIMEOUT"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			pickTimeout = d
+		}
+	}
+	// The longest a pick may wait for a key on an empty pool (0 = never waits)
+	pickWaitMax := 30 * time.Second
+	if val := getenv("PICK_WAIT_MAX"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			pickWaitMax = d
+		}
+	}
+	if err := jobs.Register(jobSpec{Name: "pick_result_purge", Every: time.Hour, Jitter: time.Minute, Immediately: true,
+		Run: func(ctx context.Context) error {
+			n, err := store.PurgePickResults(ctx, pickRetention)
+			if err == nil && n > 0 {
+				log.Printf("Purged %d expired pick results\n", n)
+			}
+			return err
+		}}); err != nil {
+		return err
+	}
+
+	// Periodic VACUUM (ANALYZE) of the pool table, off unless MAINTENANCE_ENABLED
+	if getenv("MAINTENANCE_ENABLED") == "true" {
+		vacuumInterval := 24 * time.Hour
+		if val := getenv("VACUUM_INTERVAL"); val != "" {
+			if d, err := time.ParseDuration(val); err == nil && d > 0 {
+				vacuumInterval = d
+			}
+		}
+		if name := db.Dialector.Name(); name == "postgres" {
+			// VACUUM is safe to cancel, and can take a while on a bloated table
+			if err := jobs.Register(jobSpec{Name: "vacuum", Every: vacuumInterval, Jitter: time.Minute, Interruptible: true,
+				Run: vacuumJob(store)}); err != nil {
+				return err
+			}
+			cfg.add("VACUUM_INTERVAL", vacuumInterval)
+		} else {
+			log.Printf("MAINTENANCE_ENABLED is set but the database is %s, not vacuuming\n", name)
+		}
+	}
+	cfg.add("MAINTENANCE_ENABLED", getenv("MAINTENANCE_ENABLED") == "true")
+
+	// The attempt and found counters are saved to counter_checkpoints every
+	// CHECKPOINT_INTERVAL (0 = off) under CHECKPOINT_INSTANCE and resumed
+	// from there at startup
+	var checkpointInterval time.Duration
+	if val := getenv("CHECKPOINT_INTERVAL"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			checkpointInterval = d
+		}
+	}
+	cfg.add("CHECKPOINT_INTERVAL", checkpointInterval)
+	if checkpointInterval > 0 {
+		instance := cmp.Or(getenv("CHECKPOINT_INSTANCE"), host)
+		cfg.add("CHECKPOINT_INSTANCE", instance)
+		if err := store.ResumeCheckpoint(ctx, instance, patterns); err != nil {
+			log.Println("Error resuming counters from checkpoint, starting from zero:", err)
+		}
+		// Saved once more at shutdown, and in maintenance mode as before,
+		// but not to a read-only schema
+		if err := jobs.Register(jobSpec{Name: "checkpoint", Every: checkpointInterval, InMaintenance: schemaTooNew == nil, AtShutdown: schemaTooNew == nil,
+			Run: func(ctx context.Context) error { return store.SaveCheckpoint(ctx, instance, patterns) }}); err != nil {
+			return err
+		}
+	}
+
+	// Pool depth sampled each fill cycle into pool_history: raw samples for
+	// POOL_HISTORY_RAW_RETENTION, hourly rollups for POOL_HISTORY_RETENTION
+	var history *historyRecorder
+	historyRaw, historyKeep := 30*24*time.Hour, 365*24*time.Hour
+	if val := getenv("POOL_HISTORY_RAW_RETENTION"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			historyRaw = d
+		}
+	}
+	if val := getenv("POOL_HISTORY_RETENTION"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			historyKeep = d
+		}
+	}
+	if getenv("POOL_HISTORY") != "false" {
+		history = newHistoryRecorder(store)
+		if err := jobs.Register(jobSpec{Name: "history_rollup", Every: time.Hour, Jitter: time.Minute, Immediately: true,
+			Run: historyRetentionJob(store, historyRaw, historyKeep)}); err != nil {
+			return err
+		}
+		cfg.add("POOL_HISTORY_RAW_RETENTION", historyRaw)
+		cfg.add("POOL_HISTORY_RETENTION", historyKeep)
+	}
+	cfg.add("POOL_HISTORY", history != nil)
+
+	// With SLEEP_MAX the sleep between full-pool cycles adapts to pick
+	// velocity: down to SLEEP_MIN while the pool runs dry within the hour,
+	// up to SLEEP_MAX once nothing has been picked for hours
+	var sleeps *sleepTuner
+	if val := getenv("SLEEP_MAX"); val != "" {
+		sleepMax, err := time.ParseDuration(val)
+		if err != nil || sleepMax <= 0 {
+			return fmt.Errorf("invalid SLEEP_MAX %q", val)
+		}
+		sleepMin := minSleep
+		if v := getenv("SLEEP_MIN"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d > 0 {
+				sleepMin = max(minSleep, d)
+			}
+		}
+		if sleepMax < sleepMin {
+			return fmt.Errorf("SLEEP_MAX %v is below SLEEP_MIN %v", sleepMax, sleepMin)
+		}
+		sleeps = newSleepTuner(store, sleepMin, sleepMax)
+		cfg.add("SLEEP_MIN", sleepMin)
+	}
+	cfg.add("SLEEP_MAX", getenv("SLEEP_MAX"))
+
+	// Keys found but never used (surplus, duplicates, blocklisted, expired,
+	// quarantined, ...) go in the discarded_key ledger for DISCARD_LEDGER_RETENTION
+	var discards *discardLedger
+	discardKeep := 90 * 24 * time.Hour
+	if val := getenv("DISCARD_LEDGER_RETENTION"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			discardKeep = d
+		}
+	}
+	if getenv("DISCARD_LEDGER") != "false" {
+		discards = newDiscardLedger(store, discardKeep)
+		store.discards = discards
+		if blocks != nil {
+			blocks.discards = discards
+		}
+		go discards.Run(ctx, maint)
+		if err := jobs.Register(jobSpec{Name: "discard_prune", Every: time.Hour, Jitter: time.Minute,
+			Run: discards.Prune}); err != nil {
+			return err
+		}
+		cfg.add("DISCARD_LEDGER_RETENTION", discardKeep)
+	}
+	cfg.add("DISCARD_LEDGER", discards != nil)
+
+	// Addresses we generated must never appear on WATCHLIST sources; new keys
+	// are screened before insert and the table every WATCHLIST_REFRESH
+	var watch *watchlist
+	if val := getenv("WATCHLIST"); val != "" {
+		refresh := time.Hour
+		if v := getenv("WATCHLIST_REFRESH"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d > 0 {
+				refresh = d
+			}
+		}
+		watch = newWatchlist(ctx, strings.Split(val, ","), getenv("WATCHLIST_ALERT_URL"))
+		// A sweep resumes from its cursor, so shutdown may stop one midway
+		if err := jobs.Register(jobSpec{Name: "watchlist", Every: refresh, Immediately: true, Interruptible: true,
+			Run: watch.Job(store)}); err != nil {
+			return err
+		}
+		cfg.add("WATCHLIST_REFRESH", refresh)
+	}
+	cfg.add("WATCHLIST", getenv("WATCHLIST"))
+	cfg.add("WATCHLIST_ALERT_URL", getenv("WATCHLIST_ALERT_URL"))
+
+	// Keys are named by KEY_LABEL_TEMPLATE, numbered per pattern, on insert
+	if tmpl := getenv("KEY_LABEL_TEMPLATE"); tmpl != "" {
+		labels, err := parseLabelTemplate(tmpl, patterns)
+		if err != nil {
+			return err
+		}
+		store.labels = labels
+		if schemaTooNew == nil {
+			if err := store.syncLabelSequences(ctx); err != nil {
+				return fmt.Errorf("failed to sync key label sequences: %w", err)
+			}
+		}
+	}
+	cfg.add("KEY_LABEL_TEMPLATE", getenv("KEY_LABEL_TEMPLATE"))
+
+	// Each key's lifecycle events go in an outbox and are POSTed, signed
+	// with WEBHOOK_SECRET, to WEBHOOK_URL
+	if webhookURL := getenv("WEBHOOK_URL"); webhookURL != "" {
+		secret := getenv("WEBHOOK_SECRET")
+		if secret == "" {
+			return errWebhookSecretMissing
+		}
+		sink := newWebhookSink(store, webhookURL, []byte(secret))
+		if val := getenv("WEBHOOK_MAX_ATTEMPTS"); val != "" {
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				sink.maxAttempts = n
+			}
+		}
+		if val := getenv("WEBHOOK_BACKOFF"); val != "" {
+			if d, err := time.ParseDuration(val); err == nil && d > 0 {
+				sink.backoff = d
+			}
+		}
+		if val := getenv("WEBHOOK_TIMEOUT"); val != "" {
+			if d, err := time.ParseDuration(val); err == nil && d > 0 {
+				sink.client.Timeout = d
+			}
+		}
+		store.outbox = true
+		go sink.Run(ctx, maint)
+		cfg.add("WEBHOOK_MAX_ATTEMPTS", sink.maxAttempts)
+		cfg.add("WEBHOOK_BACKOFF", sink.backoff)
+		cfg.add("WEBHOOK_TIMEOUT", sink.client.Timeout)
+	}
+	cfg.add("WEBHOOK_URL", getenv("WEBHOOK_URL"))
+	cfg.addSecret("WEBHOOK_SECRET", getenv("WEBHOOK_SECRET"))
+
+	heartbeat := 15 * time.Second
+	if val := getenv("AGENT_HEARTBEAT_INTERVAL"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			heartbeat = d
+		}
+	}
+	// Newly generated keys are fanned out to GET /v1/keys/stream subscribers
+	stream := newKeyStream()
+	agents := newAgentRegistry(newAgentConfig(patterns, minDigits, window, addrLen, constraints, equiv), heartbeat)
+
+	addr := getenv("HTTP_ADDR")
+
+	// RUN_MODE splits one deployment into generator-only and API-only nodes
+	// sharing the database: generator nodes serve only /healthz, /metrics and
+	// /dashboard.json, API nodes never fill the pool
+	runMode := cmp.Or(getenv("RUN_MODE"), "all")
+	switch runMode {
+	case "all", "generator":
+	case "api":
+		if addr == "" {
+			return errors.New("RUN_MODE=api needs HTTP_ADDR")
+		}
+		if mode == "standby" {
+			return errors.New("MODE=standby generates on takeover and cannot be combined with RUN_MODE=api")
+		}
+	default:
+		return fmt.Errorf("unknown RUN_MODE %q, want all, generator or api", runMode)
+	}
+	cfg.add("RUN_MODE", runMode)
+
+	// FILL_LOOPS=per_pattern runs one fill loop per pattern, sharing WORKERS
+	// through the governor, so an expensive pattern does not hold up an easy
+	// one. WORKERS_PER_PATTERN gives patterns dedicated pools instead, and
+	// implies per_pattern
+	poolSizes, err := parseWorkersPerPattern(getenv("WORKERS_PER_PATTERN"), patterns)
+	if err != nil {
+		return fmt.Errorf("invalid WORKERS_PER_PATTERN: %w", err)
+	}
+	addProfileWorkers(patterns, poolSizes)
+	fillLoops := cmp.Or(getenv("FILL_LOOPS"), "shared")
+	if len(poolSizes) > 0 && getenv("FILL_LOOPS") == "" {
+		fillLoops = "per_pattern"
+	}
+	if len(poolSizes) > 0 && fillLoops != "per_pattern" {
+		return errors.New("WORKERS_PER_PATTERN needs FILL_LOOPS=per_pattern")
+	}
+	switch fillLoops {
+	case "shared":
+	case "per_pattern":
+		if mode == "standby" {
+			return errors.New("FILL_LOOPS=per_pattern takes a lease per pattern and cannot be combined with MODE=standby")
+		}
+		if getenv("PATTERN_WEIGHTS") != "" {
+			return errors.New("weighted patterns share one pool and cannot be combined with FILL_LOOPS=per_pattern")
+		}
+	default:
+		return fmt.Errorf("unknown FILL_LOOPS %q, want shared or per_pattern", fillLoops)
+	}
+	cfg.add("FILL_LOOPS", fillLoops)
+	cfg.add("WORKERS_PER_PATTERN", getenv("WORKERS_PER_PATTERN"))
+	governor := newFillGovernor(workers)
+
+	// Server timeouts and size limits, against slow clients and oversized requests
+	hl := httpLimits{ReadHeaderTimeout: 5 * time.Second, ReadTimeout: 15 * time.Second, WriteTimeout: 60 * time.Second,
+		IdleTimeout: 2 * time.Minute, MaxHeaderBytes: 64 << 10, MaxBodyBytes: 1 << 20}
+	for name, d := range map[string]*time.Duration{
+		"HTTP_READ_HEADER_TIMEOUT": &hl.ReadHeaderTimeout,
+		"HTTP_READ_TIMEOUT":        &hl.ReadTimeout,
+		"HTTP_WRITE_TIMEOUT":       &hl.WriteTimeout,
+		"HTTP_IDLE_TIMEOUT":        &hl.IdleTimeout,
+	} {
+		if val := getenv(name); val != "" {
+			if v, err := time.ParseDuration(val); err == nil && v > 0 {
+				*d = v
+			}
+		}
+	}
+	if val := getenv("HTTP_MAX_HEADER_BYTES"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			hl.MaxHeaderBytes = v
+		}
+	}
+	if val := getenv("HTTP_MAX_BODY_BYTES"); val != "" {
+		if v, err := strconv.ParseInt(val, 10, 64); err == nil && v > 0 {
+			hl.MaxBodyBytes = v
+		}
+	}
+	if pickTimeout >= hl.WriteTimeout {
+		log.Printf("WARN PICK_TIMEOUT (%v) is not below HTTP_WRITE_TIMEOUT (%v); timed-out picks may not get their 504\n", pickTimeout, hl.WriteTimeout)
+	}
+	if pickWaitMax+pickTimeout >= hl.WriteTimeout {
+		log.Printf("WARN PICK_WAIT_MAX (%v) plus PICK_TIMEOUT is not below HTTP_WRITE_TIMEOUT (%v); the longest waits may be cut off\n", pickWaitMax, hl.WriteTimeout)
+	}
+
+	// Picks report low_pool once a pattern's unpicked count is below this fraction of its target
+	lowPool := 0.2
+	if val := getenv("LOW_POOL_FRACTION"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 && v <= 1 {
+			lowPool = v
+		}
+	}
+	cfg.add("LOW_POOL_FRACTION", lowPool)
+
+	// Picks are refused with a 503 once a pool is down to PICK_RESERVE_FLOOR unpicked keys (0 = off)
+	var reserveFloor int64
+	if val := getenv("PICK_RESERVE_FLOOR"); val != "" {
+		if v, err := strconv.ParseInt(val, 10, 64); err == nil && v >= 0 {
+			reserveFloor = v
+		}
+	}
+	cfg.add("PICK_RESERVE_FLOOR", reserveFloor)
+
+	// GET /v1/difficulty prices grinding at CPU_PRICE_PER_HOUR and assumes
+	// CALIBRATED_RATE attempts/s while this instance is not grinding
+	var calibratedRate, cpuPrice float64
+	if val := getenv("CALIBRATED_RATE"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 {
+			calibratedRate = v
+		}
+	}
+	cfg.add("CALIBRATED_RATE", calibratedRate)
+	for _, p := range patterns {
+		warnInfeasibleTarget(p, int64(p.Target), p.attemptsAt(addrLen), calibratedRate, "CALIBRATED_RATE")
+	}
+	if val := getenv("CPU_PRICE_PER_HOUR"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 {
+			cpuPrice = v
+		}
+	}
+	cfg.add("CPU_PRICE_PER_HOUR", cpuPrice)
+
+	cfg.addAs("DATABASE_URL", redactDSN(dsn), cfg.origin("DATABASE_URL"))
+	if readDSN != "" {
+		cfg.addAs("READ_DATABASE_URL", redactDSN(readDSN), cfg.origin("READ_DATABASE_URL"))
+		cfg.add("READ_YOUR_WRITES_WINDOW", store.fresh.window)
+		cfg.add("READ_STALE_AFTER", store.fresh.tolerance)
+	}
+	cfg.add("DB_COUNT_TIMEOUT", timeouts.Count)
+	cfg.add("DB_INSERT_TIMEOUT", timeouts.Insert)
+	cfg.add("DB_PICK_TIMEOUT", timeouts.Pick)
+	cfg.add("DB_QUERY_TIMEOUT", timeouts.Query)
+	cfg.add("DB_BREAKER_THRESHOLD", breakerThreshold)
+	cfg.add("DB_BREAKER_COOLDOWN", breakerCooldown)
+	cfg.addSecret("ENCRYPTION_KEY", getenv("ENCRYPTION_KEY"))
+	cfg.add("ENCRYPTION_REQUIRED", getenv("ENCRYPTION_REQUIRED") == "true")
+	cfg.add("MAX_INSERTS_PER_SECOND", maxInserts)
+	cfg.add("PAUSE_GENERATION_ON_PICK_LATENCY", maxPickLatency)
+	cfg.add("MAX_TOTAL_KEYS", limits.MaxRows)
+	cfg.add("MAX_DB_SIZE_MB", limits.MaxBytes>>20)
+	cfg.add("CAPACITY_POLICY", cmp.Or(getenv("CAPACITY_POLICY"), "warn"))
+	cfg.add("KEY_FILE_DIR", keyDir)
+	cfg.add("HOOKS", getenv("HOOKS"))
+	cfg.add("OTLP_ENDPOINT", getenv("OTLP_ENDPOINT"))
+	cfg.add("HTTP_ADDR", addr)
+	cfg.add("HTTP_READ_HEADER_TIMEOUT", hl.ReadHeaderTimeout)
+	cfg.add("HTTP_READ_TIMEOUT", hl.ReadTimeout)
+	cfg.add("HTTP_WRITE_TIMEOUT", hl.WriteTimeout)
+	cfg.add("HTTP_IDLE_TIMEOUT", hl.IdleTimeout)
+	cfg.add("HTTP_MAX_HEADER_BYTES", hl.MaxHeaderBytes)
+	cfg.add("HTTP_MAX_BODY_BYTES", hl.MaxBodyBytes)
+	cfg.addSecret("API_TOKEN", getenv("API_TOKEN"))
+	cfg.add("API_TOKENS_FILE", getenv("API_TOKENS_FILE"))
+	cfg.add("PICK_RESULT_RETENTION", pickRetention)
+	cfg.add("PICK_TIMEOUT", pickTimeout)
+	cfg.add("PICK_WAIT_MAX", pickWaitMax)
+	cfg.add("AGENT_HEARTBEAT_INTERVAL", heartbeat)
+	log.Printf("%s\nEffective configuration:\n%s", currentBuild(), cfg)
+
+	if addr != "" {
+		go serveHTTP(ctx, addr, &server{
+			store:            store,
+			breaker:          breaker,
+			patterns:         patterns,
+			tokens:           tokens,
+			agents:           agents,
+			config:           cfg,
+			freeze:           freeze,
+			maintenance:      maint,
+			jobs:             jobs,
+			stream:           stream,
+			lowPool:          lowPool,
+			pickRetention:    pickRetention,
+			pickTimeout:      pickTimeout,
+			pickWaitMax:      pickWaitMax,
+			waiters:          newPickWaiters(stream),
+			pickReserveFloor: reserveFloor,
+			cluster:          store.cluster,
+			calibratedRate:   calibratedRate,
+			cpuPricePerHour:  cpuPrice,
+			faults:           faults,
+			runMode:          runMode,
+			httpLimits:       hl,
+			rng:              rng,
+			entropy:          entropy,
+			stall:            stall,
+			auditLog:         auditLog,
+			auditLogPath:     getenv("AUDIT_LOG_FILE"),
+			paperBackup:      getenv("PAPER_BACKUP_ENABLED") == "true",
+			dbSchema:         dbSchema,
+			schemaTooNew:     schemaTooNew,
+			transferKey:      transferKey,
+			governor:         governor,
+			watch:            watch,
+			blocks:           blocks,
+			quotas:           quotas,
+
+			historyRawRetention: historyRaw,
+		})
+	}
+
+	// Keep at least each pattern's target unpicked keys, sleep sleepDur when enough
+	lease := fillLease{Holder: leaseHolder, TTL: leaseTTL}
+	var shared *fillLoop
+	if fillLoops == "shared" && runMode != "api" {
+		shared = governor.Loop(sharedLoopName, 0)
+	}
+	fc := fillConfig{
+		Store:     pool,
+		Sleep:     sleepDur,
+		Workers:   workers,
+		GenOpts:   genOpts,
+		KeyDir:    keyDir,
+		Hooks:     hooks,
+		Stream:    stream,
+		Breaker:   breaker,
+		Pacer:     pacer,
+		Limits:    limits,
+		Freeze:    freeze,
+		Maint:     maint,
+		Lease:     lease,
+		MaxKeyAge: maxKeyAge,
+		History:   history,
+		Faults:    faults,
+		Discards:  discards,
+		RNG:       rng,
+		Stall:     stall,
+		Quotas:    quotas,
+		Prewarms:  prewarms,
+		AuditLog:  auditLog,
+		Pipeline:  pipelineConfig{Depth: pipelineDepth, Urgent: pipelineUrgent, MaxBuffered: pipelineMax, ResumeBuffered: pipelineResume},
+		Watch:     watch,
+		Sleeps:    sleeps,
+	}
+	fill := func(ctx context.Context) {
+		if shared != nil {
+			maintainUnpickedKeys(ctx, fc, patterns, shared)
+			return
+		}
+		var wg sync.WaitGroup
+		for _, p := range patterns {
+			fc := fc
+			fc.Lease.Name = fillLeaseName + ":" + p.Name()
+			loop := governor.Loop(p.Name(), poolSizes[p.Name()])
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				maintainUnpickedKeys(ctx, fc, []pattern{p}, loop)
+			}()
+		}
+		wg.Wait()
+		log.Println("All fill loops stopped")
+	}
+	switch {
+	case runMode == "api":
+		log.Println("RUN_MODE=api, not generating")
+	case mode == "standby":
+		sb := &standby{Store: store, Patterns: patterns, Lease: lease, Fill: fill,
+			Poll: standbyPoll, StallAfter: standbyStall, MinHold: standbyHold,
+			AlertURL: getenv("STANDBY_ALERT_URL")}
+		go sb.Run(ctx)
+	default:
+		go fill(ctx)
+	}
+
+	for _, name := range jobs.Unregistered() {
+		log.Printf("WARN JOB_SCHEDULES names %s, which is not a job of this instance\n", name)
+	}
 
 	<-ctx.Done()
 	fmt.Println("Shutting down...")
+	// Running jobs finish their transactions, and the checkpoint is saved
+	jobs.Wait()
+	return nil
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaintenanceMessage is returned by write endpoints when no message
+// was given on entering maintenance.
+const defaultMaintenanceMessage = "database maintenance in progress, writes are disabled"
+
+// maintenanceSwitch disables every database write on this instance while
+// the service otherwise stays up. Unlike the freeze flag it lives in memory,
+// since the database may be unavailable while it is set.
+type maintenanceSwitch struct {
+	on      atomic.Bool
+	resumed chan struct{}
+
+	mu      sync.Mutex
+	message string
+	actor   string
+	since   time.Time
+}
+
+func newMaintenanceSwitch(on bool, message string) *maintenanceSwitch {
+	m := &maintenanceSwitch{resumed: make(chan struct{}, 1)}
+	if on {
+		m.set(true, "env", message)
+	}
+	return m
+}
+
+func (m *maintenanceSwitch) Active() bool { return m.on.Load() }
+
+// set enters or leaves maintenance. Leaving wakes anything blocked in
+// Sleep so the pool is recounted and refilled straight away.
+func (m *maintenanceSwitch) set(on bool, actor, message string) {
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	m.mu.Lock()
+	m.message, m.actor, m.since = message, actor, clock.Now()
+	m.mu.Unlock()
+
+	if was := m.on.Swap(on); was != on {
+		log.Printf("Maintenance mode=%v by %s (%q)\n", on, actor, message)
+		if !on {
+			select {
+			case m.resumed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (m *maintenanceSwitch) reason() (string, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.message, m.since
+}
+
+func (m *maintenanceSwitch) status() map[string]any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return map[string]any{
+		"maintenance": m.on.Load(),
+		"message":     m.message,
+		"actor":       m.actor,
+		"since":       m.since,
+	}
+}
+
+// Sleep waits for d, ctx to be done, or maintenance to end, whichever is
+// first.
+func (m *maintenanceSwitch) Sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-m.resumed:
+	case <-clock.After(d):
+	}
+}
+
+// writable rejects the request with a 503 while in maintenance mode.
+func (s *server) writable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.maintenance.Active() {
+			msg, since := s.maintenance.reason()
+			w.Header().Set("Retry-After", "60")
+			writeError(w, http.StatusServiceUnavailable, "maintenance", msg, map[string]any{"since": since})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) handleMaintenanceStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.maintenance.status())
+}
+
+func (s *server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool  `json:"enabled"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", `request body must be JSON with "enabled"`, nil)
+		return
+	}
+	if !*req.Enabled && s.schemaTooNew != nil {
+		writeError(w, http.StatusConflict, "schema_read_only", s.schemaTooNew.Error()+"; writes stay disabled", nil)
+		return
+	}
+
+	s.maintenance.set(*req.Enabled, tokenFromContext(r.Context()).Name, req.Message)
+	audit(r.Context(), "maintenance", "enabled="+strconv.FormatBool(*req.Enabled)+" message="+strconv.Quote(req.Message))
+	writeJSON(w, http.StatusOK, s.maintenance.status())
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// matchModeEnv is what a match mode builds its patterns from: the
+// SUFFIXES/PREFIXES patterns, PATTERN_TRIM_CHARS and the effective config,
+// to which it adds the settings it read.
+type matchModeEnv struct {
+	patterns []pattern
+	trim     string
+	cfg      *effectiveConfig
+}
+
+// matchModeBuilder returns the patterns a MATCH_MODE entry grinds for.
+type matchModeBuilder func(env matchModeEnv) ([]pattern, error)
+
+var (
+	matchModesMu sync.Mutex
+	matchModes   = map[string]matchModeBuilder{}
+)
+
+// registerMatchMode makes build selectable as MATCH_MODE=name. The modes
+// below register themselves from init, and a new mode is one more call;
+// its patterns can use any match rule a pattern or registered predicate
+// expresses.
+func registerMatchMode(name string, build matchModeBuilder) error {
+	matchModesMu.Lock()
+	defer matchModesMu.Unlock()
+	if name == "" || strings.ContainsAny(name, ", ") {
+		return fmt.Errorf("invalid match mode name %q", name)
+	}
+	if _, dup := matchModes[name]; dup {
+		return fmt.Errorf("match mode %q registered twice", name)
+	}
+	matchModes[name] = build
+	return nil
+}
+
+// matchModeNames lists the registered modes, sorted.
+func matchModeNames() []string {
+	matchModesMu.Lock()
+	defer matchModesMu.Unlock()
+	names := make([]string, 0, len(matchModes))
+	for name := range matchModes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// resolveMatchModes builds the patterns of MATCH_MODE spec, a
+// comma-separated list of modes, any one being enough for a key.
+func resolveMatchModes(spec string, env matchModeEnv) ([]pattern, error) {
+	var out []pattern
+	for _, m := range strings.Split(spec, ",") {
+		m = strings.TrimSpace(m)
+		matchModesMu.Lock()
+		build, ok := matchModes[m]
+		matchModesMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown MATCH_MODE %q, want a list of %s", m, strings.Join(matchModeNames(), ", "))
+		}
+		patterns, err := build(env)
+		if err != nil {
+			return nil, fmt.Errorf("MATCH_MODE=%s: %w", m, err)
+		}
+		out = append(out, patterns...)
+	}
+	return out, nil
+}
+
+func init() {
+	for name, build := range map[string]matchModeBuilder{
+		"exact":     matchExact,
+		"suffix":    matchSuffix,
+		"prefix":    matchPrefix,
+		"edit":      matchEdit,
+		"contains":  matchContains,
+		"predicate": matchPredicates,
+		"any":       matchAny,
+	} {
+		if err := registerMatchMode(name, build); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// matchExact keeps the SUFFIXES/PREFIXES patterns.
+func matchExact(env matchModeEnv) ([]pattern, error) {
+	return env.patterns, nil
+}
+
+// matchSuffix keeps only the SUFFIXES ones.
+func matchSuffix(env matchModeEnv) ([]pattern, error) {
+	return slices.DeleteFunc(slices.Clone(env.patterns), func(p pattern) bool { return p.Prefix != "" }), nil
+}
+
+// matchPrefix keeps only the PREFIXES ones.
+func matchPrefix(env matchModeEnv) ([]pattern, error) {
+	return slices.DeleteFunc(slices.Clone(env.patterns), func(p pattern) bool { return p.Prefix == "" }), nil
+}
+
+// matchEdit adds near-misses of TARGET_WORD: the last len(TARGET_WORD)
+// characters within MAX_EDIT_DISTANCE edits of it.
+func matchEdit(env matchModeEnv) ([]pattern, error) {
+	maxEdit := 1
+	if val := getenv("MAX_EDIT_DISTANCE"); val != "" {
+		var err error
+		if maxEdit, err = strconv.Atoi(val); err != nil {
+			return nil, fmt.Errorf("invalid MAX_EDIT_DISTANCE: %w", err)
+		}
+	}
+	fuzzy, err := fuzzyPattern(getenv("TARGET_WORD"), maxEdit, env.trim)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("WARN MATCH_MODE=edit computes an edit distance for every candidate, and %q's difficulty (~%.3g attempts) is a rough estimate\n",
+		fuzzy.Name(), fuzzy.expectedAttempts())
+	env.cfg.add("TARGET_WORD", fuzzy.Suffix)
+	env.cfg.add("MAX_EDIT_DISTANCE", maxEdit)
+	return []pattern{fuzzy}, nil
+}
+
+// matchContains adds CONTAINS texts found anywhere in the address.
+func matchContains(env matchModeEnv) ([]pattern, error) {
+	contains, err := parsePatterns(getenv("CONTAINS"), "env:CONTAINS", false, env.trim)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CONTAINS: %w", err)
+	}
+	if len(contains) == 0 {
+		return nil, errors.New("needs CONTAINS")
+	}
+	for i := range contains {
+		contains[i].Contains = true
+	}
+	env.cfg.add("CONTAINS", getenv("CONTAINS"))
+	return contains, nil
+}
+
+// matchAny adds "*", accepting every key: a pool of plain keypairs,
+// filled to its target like any other.
+func matchAny(env matchModeEnv) ([]pattern, error) {
+	return []pattern{{Any: true, Source: "env:MATCH_MODE"}}, nil
+}
+
+// matchPredicates adds PREDICATES, matched by registered predicates.
+func matchPredicates(env matchModeEnv) ([]pattern, error) {
+	preds, err := parsePredicatePatterns(getenv("PREDICATES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PREDICATES: %w", err)
+	}
+	env.cfg.add("PREDICATES", getenv("PREDICATES"))
+	return preds, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestResolveMatchModes resolves the built-in modes, alone and combined,
+// and a mode registered by a test, and checks an unknown one is refused.
+func TestResolveMatchModes(t *testing.T) {
+	t.Setenv("CONTAINS", "moon")
+	suffixes, err := parsePatterns("ponz", "env:SUFFIXES", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes, err := parsePatterns("abc", "env:PREFIXES", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registerMatchMode("test-fixed", func(matchModeEnv) ([]pattern, error) {
+		return []pattern{{Suffix: "fix"}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		matchModesMu.Lock()
+		delete(matchModes, "test-fixed")
+		matchModesMu.Unlock()
+	})
+
+	tests := []struct {
+		spec string
+		// want is the names of the patterns built, or the error expected
+		want    []string
+		wantErr string
+	}{
+		{spec: "exact", want: []string{"ponz", "abc*"}},
+		{spec: "suffix", want: []string{"ponz"}},
+		{spec: "prefix", want: []string{"abc*"}},
+		{spec: "contains", want: []string{"*moon*"}},
+		{spec: "any", want: []string{"*"}},
+		{spec: "suffix, any", want: []string{"ponz", "*"}},
+		{spec: "test-fixed", want: []string{"fix"}},
+		{spec: "exact,bogus", wantErr: `unknown MATCH_MODE "bogus"`},
+		{spec: "", wantErr: `unknown MATCH_MODE ""`},
+	}
+	for _, tt := range tests {
+		env := matchModeEnv{patterns: append(slices.Clone(suffixes), prefixes...), cfg: &effectiveConfig{}}
+		got, err := resolveMatchModes(tt.spec, env)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "test-fixed") {
+				t.Errorf("MATCH_MODE=%s: %v, want an error with %q listing the registered modes", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		var names []string
+		for _, p := range got {
+			names = append(names, p.Name())
+		}
+		if err != nil || !slices.Equal(names, tt.want) {
+			t.Errorf("MATCH_MODE=%s = %v, %v; want %v", tt.spec, names, err, tt.want)
+		}
+	}
+}
+
+func TestRegisterMatchMode(t *testing.T) {
+	build := func(matchModeEnv) ([]pattern, error) { return nil, nil }
+	for _, name := range []string{"exact", "", "a,b", "a b"} {
+		if err := registerMatchMode(name, build); err == nil {
+			t.Errorf("registering match mode %q succeeded, want it refused", name)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memStore is a KeyStore kept in memory, for running the fill loop without
+// a database. It follows gormStore's semantics, including picking, release
+// and quarantine, but keeps private keys as given and loses everything on
+// exit. Keys are held in insertion order, so the oldest is the first
+// unpicked one.
+type memStore struct {
+	strictInsert bool
+
+	mu     sync.Mutex
+	keys   []*TokenKey
+	byPub  map[string]*TokenKey
+	byPriv map[string]string
+	leases map[string]memLease
+}
+
+// memLease is a held GenerationLease.
+type memLease struct {
+	holder  string
+	expires time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{byPub: map[string]*TokenKey{}, byPriv: map[string]string{}, leases: map[string]memLease{}}
+}
+
+func (m *memStore) CountUnpicked(ctx context.Context, pattern string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var c int64
+	for _, k := range m.keys {
+		if !k.IsPicked && k.MatchedPattern == pattern {
+			c++
+		}
+	}
+	return c, nil
+}
+
+// Insert stores a copy of key, returning false if its public key already
+// exists, or ErrDuplicateKey with strictInsert. A private key stored under
+// another public key is ErrPrivateKeyConflict; there is nowhere to park it.
+func (m *memStore) Insert(ctx context.Context, key *TokenKey) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byPub[key.PublicKey]; ok {
+		if m.strictInsert {
+			return false, fmt.Errorf("%w: %s", ErrDuplicateKey, key.PublicKey)
+		}
+		return false, nil
+	}
+	if other, ok := m.byPriv[key.PrivateKey]; ok {
+		return false, fmt.Errorf("%w: %s conflicts with %s", ErrPrivateKeyConflict, key.PublicKey, other)
+	}
+	row := *key
+	if row.ID == "" {
+		row.ID = uuid.NewString()
+	}
+	row.AddressLength = len(row.PublicKey)
+	row.Checksum = keyChecksum(row.PublicKey)
+	row.CreatedAt = clock.Now().UTC()
+	m.keys = append(m.keys, &row)
+	m.byPub[row.PublicKey] = &row
+	m.byPriv[row.PrivateKey] = row.PublicKey
+	key.CreatedAt = row.CreatedAt
+	return true, nil
+}
+
+// Usage counts every key, with Bytes the size of their text fields.
+func (m *memStore) Usage(ctx context.Context) (storeUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := storeUsage{Rows: int64(len(m.keys))}
+	for _, k := range m.keys {
+		u.Bytes += int64(len(k.ID) + len(k.PrivateKey) + len(k.PublicKey) + len(k.MatchedPattern) + len(k.Checksum) + len(k.Campaign))
+	}
+	return u, nil
+}
+
+func (m *memStore) ExpireUnpicked(ctx context.Context, cutoff time.Time) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := clock.Now()
+	expired := map[string]int64{}
+	kept := m.keys[:0]
+	for _, k := range m.keys {
+		if !k.IsPicked && (k.CreatedAt.Before(cutoff) || k.ValidUntil != nil && !k.ValidUntil.After(now)) {
+			expired[k.MatchedPattern]++
+			delete(m.byPub, k.PublicKey)
+			delete(m.byPriv, k.PrivateKey)
+			continue
+		}
+		kept = append(kept, k)
+	}
+	clear(m.keys[len(kept):])
+	m.keys = kept
+	return expired, nil
+}
+
+func (m *memStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := clock.Now()
+	if l, ok := m.leases[name]; ok && l.holder != holder && !l.expires.Before(now) {
+		return false, nil
+	}
+	m.leases[name] = memLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *memStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.leases[name].holder == holder {
+		delete(m.leases, name)
+	}
+	return nil
+}
+
+// Pick marks the oldest unpicked key matching f, or the highest-scoring
+// with ByQuality, as picked and returns a copy of it.
+func (m *memStore) Pick(ctx context.Context, f pickFilter) (TokenKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := clock.Now()
+	var best *TokenKey
+	for _, k := range m.keys {
+		if k.IsPicked ||
+			k.ValidFrom != nil && k.ValidFrom.After(now) ||
+			k.ValidUntil != nil && !k.ValidUntil.After(now) ||
+			f.PublicKey != "" && k.PublicKey != f.PublicKey ||
+			f.Label != "" && k.label() != f.Label ||
+			f.Pattern != "" && k.MatchedPattern != f.Pattern ||
+			f.Campaign != "" && k.Campaign != f.Campaign ||
+			f.AddressLength > 0 && k.AddressLength != f.AddressLength ||
+			f.Cluster != "" && k.Cluster != f.Cluster ||
+			!f.Restrict.Allows(k.MatchedPattern, k.Campaign) {
+			continue
+		}
+		if best == nil || f.ByQuality && k.QualityScore > best.QualityScore {
+			best = k
+		}
+		if !f.ByQuality {
+			break
+		}
+	}
+	if best == nil {
+		return TokenKey{}, pickMiss(f)
+	}
+	best.IsPicked = true
+	if f.Metadata != nil {
+		best.Metadata = f.Metadata
+	}
+	return *best, nil
+}
+
+// Release returns a picked key to the pool. Quarantined keys stay out.
+func (m *memStore) Release(ctx context.Context, pub string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.byPub[pub]
+	if !ok || !k.IsPicked || k.Quarantined {
+		return false, nil
+	}
+	k.IsPicked = false
+	return true, nil
+}
+
+// Quarantine takes the key with public key pub out of the pool for good.
+func (m *memStore) Quarantine(ctx context.Context, pub string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.byPub[pub]
+	if !ok {
+		return false, nil
+	}
+	k.Quarantined, k.IsPicked = true, true
+	return true, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// maxMetadataBytes bounds the JSON a consumer may attach to a key.
+const maxMetadataBytes = 4 << 10
+
+var errInvalidMetadata = errors.New("metadata must be valid JSON")
+
+// parseMetadata validates raw, a consumer's metadata for a key, and returns
+// it compacted for the jsonb column; absent or null metadata is nil.
+func parseMetadata(raw json.RawMessage) (*string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if !json.Valid(raw) {
+		return nil, errInvalidMetadata
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return nil, errInvalidMetadata
+	}
+	if buf.Len() > maxMetadataBytes {
+		return nil, fmt.Errorf("metadata is %d bytes, over the %d byte limit", buf.Len(), maxMetadataBytes)
+	}
+	meta := buf.String()
+	return &meta, nil
+}
+
+// metadata is k's metadata for a response, nil if it has none.
+func (k TokenKey) metadata() json.RawMessage {
+	if k.Metadata == nil {
+		return nil
+	}
+	return json.RawMessage(*k.Metadata)
+}
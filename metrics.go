@@ -0,0 +1,281 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+	factory  = promauto.With(registry)
+
+	keysFoundTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_keys_found_total",
+		Help: "Keys generated and inserted into the pool, by matched pattern.",
+	}, []string{"pattern"})
+
+	attemptsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_attempts_total",
+		Help: "Candidate keys tried, attributed to the pattern of the key they led to.",
+	}, []string{"pattern"})
+
+	insertConflictsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_insert_conflicts_total",
+		Help: "Generated keys skipped because their public key was already stored.",
+	}, []string{"pattern"})
+
+	patternQuotaReached = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_pattern_quota_reached",
+		Help: "1 while a pattern has generated its max_total_keys and is no longer generated for.",
+	}, []string{"pattern"})
+
+	rngSuspect = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keygen_rng_suspect",
+		Help: "1 once the insert conflict rate has exceeded RNG_CONFLICT_THRESHOLD, suggesting a broken RNG.",
+	})
+
+	keysExpiredTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_keys_expired_total",
+		Help: "Unpicked keys deleted for being older than MAX_KEY_AGE, by matched pattern.",
+	}, []string{"pattern"})
+
+	attemptRate = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keygen_attempts_per_second",
+		Help: "Local grinding rate over the last second of generation.",
+	})
+
+	dbRetriesTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_db_retries_total",
+		Help: "Statements retried after a serialization failure or deadlock, by operation.",
+	}, []string{"operation"})
+
+	pickDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "keygen_pick_duration_seconds",
+		Help:    "Duration of pick transactions.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	insertThrottledTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_insert_throttled_total",
+		Help: "Inserts delayed by MAX_INSERTS_PER_SECOND.",
+	})
+
+	insertThrottleSeconds = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_insert_throttle_seconds_total",
+		Help: "Time inserts spent waiting on MAX_INSERTS_PER_SECOND.",
+	})
+
+	pipelineBuffered = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_pipeline_buffered_keys",
+		Help: "Found keys queued in a fill loop's pipeline and not yet stored.",
+	}, []string{"loop"})
+
+	pipelineFull = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_pipeline_full",
+		Help: "1 while a fill loop's generation is paused at PIPELINE_MAX_BUFFERED unstored keys.",
+	}, []string{"loop"})
+
+	pipelineFullTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_pipeline_full_total",
+		Help: "Times a fill loop's pipeline reached PIPELINE_MAX_BUFFERED and paused generation.",
+	}, []string{"loop"})
+
+	clusterMismatchesTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_cluster_mismatches_total",
+		Help: "Picks, transfers and RPC_URL checks refused because the cluster did not match CLUSTER, by check.",
+	}, []string{"check"})
+
+	jobRunsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_job_runs_total",
+		Help: "Maintenance job runs, by job and result (ok or error).",
+	}, []string{"job", "result"})
+	jobSkippedTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_job_skipped_total",
+		Help: "Maintenance job runs not made when due, by job and reason (paused, maintenance or overlap).",
+	}, []string{"job", "reason"})
+	jobLastRun = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_job_last_run_timestamp_seconds",
+		Help: "Unix time the job's last run started.",
+	}, []string{"job"})
+	jobLastSuccess = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_job_last_success_timestamp_seconds",
+		Help: "Unix time the job's last successful run started.",
+	}, []string{"job"})
+	jobLastDuration = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_job_last_duration_seconds",
+		Help: "How long the job's last run took.",
+	}, []string{"job"})
+	jobPaused = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_job_paused",
+		Help: "1 while the job is paused through /v1/admin/jobs.",
+	}, []string{"job"})
+
+	generationPaused = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keygen_generation_paused",
+		Help: "1 while generation writes are paused for slow picks.",
+	})
+
+	generationPausesTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_generation_pauses_total",
+		Help: "Times generation writes paused because p95 pick latency exceeded PAUSE_GENERATION_ON_PICK_LATENCY.",
+	})
+
+	corruptKeysTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_corrupt_keys_total",
+		Help: "Stored keys quarantined on read because the private key did not match the public key.",
+	})
+
+	streamDroppedTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_stream_dropped_total",
+		Help: "Keys not delivered to a /v1/keys/stream subscriber because it was too slow.",
+	})
+
+	standbyLeading = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keygen_standby_leading",
+		Help: "1 while a MODE=standby instance has taken over generation.",
+	})
+
+	standbyTakeoversTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_standby_takeovers_total",
+		Help: "Times a MODE=standby instance took over generation from a stalled primary.",
+	})
+
+	derivationFailuresTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_derivation_failures_total",
+		Help: "Candidates rejected because a DERIVED_CONSTRAINTS derivation failed, by derivation.",
+	}, []string{"derivation"})
+
+	faultActive = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_fault_injection_active",
+		Help: "1 while an UNSAFE_FAULT_INJECTION fault of this kind is in effect.",
+	}, []string{"kind"})
+
+	faultsInjectedTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_faults_injected_total",
+		Help: "Deliberate failures or delays caused by UNSAFE_FAULT_INJECTION, by kind.",
+	}, []string{"kind"})
+
+	blocklistCheckedTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_blocklist_checked_total",
+		Help: "Pattern-matching candidates screened against BLOCKLIST_FILE.",
+	})
+
+	blocklistRejectedTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_blocklist_rejected_total",
+		Help: "Pattern-matching candidates thrown away for containing a BLOCKLIST_FILE term.",
+	})
+
+	keysDiscardedTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_keys_discarded_total",
+		Help: "Found keys that were never used, by discard reason.",
+	}, []string{"reason"})
+
+	entropyHealthy = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keygen_entropy_healthy",
+		Help: "1 while the last crypto/rand health check passed.",
+	})
+
+	entropyReadSeconds = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keygen_entropy_read_seconds",
+		Help: "Time the last entropy health check took to read its sample.",
+	})
+
+	entropyChiSquare = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "keygen_entropy_chi_square",
+		Help: "Chi-square statistic of the last entropy sample's byte counts; around 255 when healthy.",
+	})
+
+	entropyChecksFailedTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "keygen_entropy_checks_failed_total",
+		Help: "Entropy health checks that failed.",
+	})
+
+	predicateFailuresTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_predicate_failures_total",
+		Help: "WASM predicate calls counted as no match, by predicate and reason (timeout, trap or instantiate).",
+	}, []string{"predicate", "reason"})
+
+	watchlistHitsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_watchlist_hits_total",
+		Help: "Generated addresses found on a WATCHLIST source, by how (generated or sweep). Should always be zero.",
+	}, []string{"found_by"})
+
+	watchlistEntries = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_watchlist_entries",
+		Help: "Addresses loaded from each WATCHLIST source.",
+	}, []string{"source"})
+
+	watchlistRefreshFailuresTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_watchlist_refresh_failures_total",
+		Help: "Failed loads of a WATCHLIST source; its previous entries stay in use.",
+	}, []string{"source"})
+
+	webhookDeliveriesTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_webhook_deliveries_total",
+		Help: "Lifecycle webhook delivery attempts, by result (delivered, failed or dead_letter).",
+	}, []string{"result"})
+
+	hookRunsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_hook_runs_total",
+		Help: "Post-insert hook attempts, by hook and result (succeeded, failed and to be retried, or dropped).",
+	}, []string{"hook", "result"})
+
+	fillLoopSecondsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_fill_loop_seconds_total",
+		Help: "Wall-clock time each fill loop spent in each state (counting, grinding, waiting_for_workers, sleeping, paused), added when the state ends.",
+	}, []string{"loop", "state"})
+
+	fillSleepSeconds = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keygen_fill_sleep_seconds",
+		Help: "The sleep each fill loop chose last between cycles with a full pool, adaptive with SLEEP_MAX.",
+	}, []string{"loop"})
+
+	discardedAttemptsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygen_discarded_attempts_total",
+		Help: "Candidates spent on discarded keys, by discard reason; the pattern's expected attempts where unknown.",
+	}, []string{"reason"})
+)
+
+// initPatternMetrics pre-creates labelled series so they read zero
+// rather than missing. Only configured patterns are ever used as labels.
+func initPatternMetrics(patterns []pattern) {
+	for _, p := range patterns {
+		keysFoundTotal.WithLabelValues(p.Name())
+		attemptsTotal.WithLabelValues(p.Name())
+		insertConflictsTotal.WithLabelValues(p.Name())
+		keysExpiredTotal.WithLabelValues(p.Name())
+	}
+	for _, r := range discardReasons {
+		keysDiscardedTotal.WithLabelValues(r)
+		discardedAttemptsTotal.WithLabelValues(r)
+	}
+	for _, op := range []string{"insert", "import", "pick", "pick_once", "swap"} {
+		dbRetriesTotal.WithLabelValues(op)
+	}
+	for _, check := range []string{"request", "key", "transfer", "genesis"} {
+		clusterMismatchesTotal.WithLabelValues(check)
+	}
+}
+
+// lastRate holds the float64 bits of the most recent grinding rate.
+var lastRate atomic.Uint64
+
+// recordRate is the generator's rate reporter.
+func recordRate(_ int64, perSecond float64) {
+	attemptRate.Set(perSecond)
+	lastRate.Store(math.Float64bits(perSecond))
+}
+
+// measuredRate returns the most recent local grinding rate, 0 if unknown.
+func measuredRate() float64 {
+	return math.Float64frombits(lastRate.Load())
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
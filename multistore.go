@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// KeyStore is what the fill loop needs from the pool.
+type KeyStore interface {
+	CountUnpicked(ctx context.Context, pattern string) (int64, error)
+	Insert(ctx context.Context, key *TokenKey) (bool, error)
+	Usage(ctx context.Context) (storeUsage, error)
+	ExpireUnpicked(ctx context.Context, cutoff time.Time) (map[string]int64, error)
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name, holder string) error
+}
+
+// multiStore writes every key to several stores for redundancy. An insert
+// succeeds once quorum stores accept it; counts come from the first store,
+// the primary, which is also the one the API picks from.
+type multiStore struct {
+	names  []string
+	stores []KeyStore
+	quorum int
+}
+
+func newMultiStore(names []string, stores []KeyStore, quorum int) (*multiStore, error) {
+	if quorum < 1 || quorum > len(stores) {
+		return nil, fmt.Errorf("write quorum must be between 1 and %d, got %d", len(stores), quorum)
+	}
+	return &multiStore{names: names, stores: stores, quorum: quorum}, nil
+}
+
+func (m *multiStore) CountUnpicked(ctx context.Context, pattern string) (int64, error) {
+	return m.stores[0].CountUnpicked(ctx, pattern)
+}
+
+// Insert writes key to every store concurrently. It reports whether the
+// first store that accepted the key had not seen it before.
+func (m *multiStore) Insert(ctx context.Context, key *TokenKey) (bool, error) {
+	type result struct {
+		inserted bool
+		err      error
+	}
+	results := make([]result, len(m.stores))
+	// Each store gets its own copy, taken before any store writes back
+	keys := make([]TokenKey, len(m.stores))
+	var wg sync.WaitGroup
+	for i, s := range m.stores {
+		keys[i] = *key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].inserted, results[i].err = s.Insert(ctx, &keys[i])
+		}()
+	}
+	wg.Wait()
+	key.CreatedAt = keys[0].CreatedAt
+
+	ok, inserted, first := 0, false, true
+	var errs []error
+	for i, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.names[i], r.err))
+			continue
+		}
+		if first {
+			inserted, first = r.inserted, false
+		}
+		ok++
+	}
+	if ok < m.quorum {
+		return false, fmt.Errorf("insert reached %d of %d required stores: %w", ok, m.quorum, errors.Join(errs...))
+	}
+	if len(errs) > 0 {
+		log.Printf("Partial insert of %s: %d/%d stores succeeded: %v\n", key.PublicKey, ok, len(m.stores), errors.Join(errs...))
+	}
+	return inserted, nil
+}
+
+// ExpireUnpicked expires keys in every store, so secondaries do not keep
+// keys the primary has dropped, and reports the primary's counts.
+func (m *multiStore) ExpireUnpicked(ctx context.Context, cutoff time.Time) (map[string]int64, error) {
+	var primary map[string]int64
+	for i, s := range m.stores {
+		expired, err := s.ExpireUnpicked(ctx, cutoff)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.names[i], err)
+		}
+		if i == 0 {
+			primary = expired
+		}
+	}
+	return primary, nil
+}
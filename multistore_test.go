@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// downStore is a KeyStore whose writes fail, as a database that is down.
+type downStore struct{ *memStore }
+
+var errStoreDown = errors.New("store is down")
+
+func (downStore) Insert(context.Context, *TokenKey) (bool, error) { return false, errStoreDown }
+
+func (downStore) ExpireUnpicked(context.Context, time.Time) (map[string]int64, error) {
+	return nil, errStoreDown
+}
+
+func TestMultiStoreQuorum(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		down      int // index of the failing store
+		quorum    int
+		wantErr   bool
+		primaryOK bool
+	}{
+		{"secondary down within quorum", 1, 1, false, true},
+		{"primary down within quorum", 0, 1, false, false},
+		{"secondary down below quorum", 1, 2, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			stores := []KeyStore{newMemStore(), newMemStore()}
+			stores[tc.down] = downStore{newMemStore()}
+			m, err := newMultiStore([]string{"DATABASE_URL", "DATABASE_URL_2"}, stores, tc.quorum)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := &TokenKey{PublicKey: testPub("k1"), PrivateKey: testPriv("k1"), MatchedPattern: "A"}
+			inserted, err := m.Insert(ctx, key)
+			if tc.wantErr {
+				if !errors.Is(err, errStoreDown) || inserted {
+					t.Fatalf("Insert = %v, %v; want the down store's error", inserted, err)
+				}
+			} else if err != nil || !inserted {
+				t.Fatalf("Insert = %v, %v; want the key inserted", inserted, err)
+			}
+			up := stores[1-tc.down].(*memStore)
+			if n, _ := up.CountUnpicked(ctx, "A"); n != 1 {
+				t.Errorf("the working store holds %d keys, want 1", n)
+			}
+			if !tc.primaryOK {
+				return
+			}
+			if key.CreatedAt.IsZero() {
+				t.Error("the key's CreatedAt was not taken from the primary")
+			}
+			if n, err := m.CountUnpicked(ctx, "A"); err != nil || n != 1 {
+				t.Errorf("CountUnpicked = %d, %v; want the primary's 1", n, err)
+			}
+			if _, err := m.ExpireUnpicked(ctx, time.Now()); !errors.Is(err, errStoreDown) {
+				t.Errorf("ExpireUnpicked = %v, want the down store's error", err)
+			}
+		})
+	}
+}
+
+func TestMultiStoreRejectsQuorum(t *testing.T) {
+	stores := []KeyStore{newMemStore(), newMemStore()}
+	for _, quorum := range []int{0, 3} {
+		if _, err := newMultiStore([]string{"a", "b"}, stores, quorum); err == nil {
+			t.Errorf("quorum %d of 2 stores was accepted", quorum)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindowSize samples feed the p95; older or staler samples drop out.
+	latencyWindowSize = 256
+	latencyMaxAge     = time.Minute
+
+	// maxLatencyPause caps one back-off, so a database that is slow for
+	// other reasons cannot starve the pool indefinitely.
+	maxLatencyPause = 30 * time.Second
+)
+
+// latencyWindow keeps the most recent pick durations.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []latencySample
+	next    int
+}
+
+type latencySample struct {
+	at time.Time
+	d  time.Duration
+}
+
+var pickLatency = &latencyWindow{}
+
+// observePick records how long a pick transaction took.
+func observePick(d time.Duration) {
+	pickDuration.Observe(d.Seconds())
+	pickLatency.add(d)
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := latencySample{at: clock.Now(), d: d}
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, s)
+		return
+	}
+	w.samples[w.next] = s
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// p95 returns the 95th percentile of samples newer than latencyMaxAge, and
+// false if there are none.
+func (w *latencyWindow) p95() (time.Duration, bool) {
+	w.mu.Lock()
+	cutoff := clock.Now().Add(-latencyMaxAge)
+	var ds []time.Duration
+	for _, s := range w.samples {
+		if s.at.After(cutoff) {
+			ds = append(ds, s.d)
+		}
+	}
+	w.mu.Unlock()
+	if len(ds) == 0 {
+		return 0, false
+	}
+	slices.Sort(ds)
+	// nearest-rank percentile
+	return ds[(len(ds)*95+99)/100-1], true
+}
+
+// writePacer slows generation writes so they do not crowd out pickers on a
+// small database: at most perSecond inserts, and none while the recent p95
+// pick latency is above maxPickLatency. Zero values disable either control.
+type writePacer struct {
+	interval       time.Duration
+	maxPickLatency time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newWritePacer(perSecond float64, maxPickLatency time.Duration) *writePacer {
+	p := &writePacer{maxPickLatency: maxPickLatency}
+	if perSecond > 0 {
+		p.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return p
+}
+
+// Wait blocks until the next insert may go ahead. Concurrent fill loops
+// share the rate: each caller reserves the next free slot.
+func (p *writePacer) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.maxPickLatency > 0 {
+		if err := p.waitForPicks(ctx); err != nil {
+			return err
+		}
+	}
+
+	if p.interval > 0 {
+		p.mu.Lock()
+		at := clock.Now()
+		if p.next.After(at) {
+			at = p.next
+		}
+		p.next = at.Add(p.interval)
+		p.mu.Unlock()
+		if d := at.Sub(clock.Now()); d > 0 {
+			insertThrottledTotal.Inc()
+			insertThrottleSeconds.Add(d.Seconds())
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-clock.After(d):
+			}
+		}
+	}
+	return nil
+}
+
+// waitForPicks backs off while pickers are seeing slow transactions.
+func (p *writePacer) waitForPicks(ctx context.Context) error {
+	p95, ok := pickLatency.p95()
+	if !ok || p95 <= p.maxPickLatency {
+		return nil
+	}
+
+	log.Printf("Pick p95 latency %v above %v, pausing generation writes\n", p95, p.maxPickLatency)
+	generationPaused.Set(1)
+	generationPausesTotal.Inc()
+	defer generationPaused.Set(0)
+
+	deadline := clock.Now().Add(maxLatencyPause)
+	for clock.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(time.Second):
+		}
+		if p95, ok = pickLatency.p95(); !ok || p95 <= p.maxPickLatency {
+			log.Println("Pick latency recovered, resuming generation writes")
+			return nil
+		}
+	}
+	log.Printf("Pick latency still %v after %v, resuming generation writes anyway\n", p95, maxLatencyPause)
+	return nil
+}
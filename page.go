@@ -0,0 +1,224 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// pageLimits bound an endpoint's limit parameter.
+type pageLimits struct {
+	Default, Max int
+}
+
+// pageParams are the query parameters every list endpoint shares:
+//
+//	limit=N         page size, up to the endpoint's maximum
+//	cursor=C        continue after a previous page's next_cursor
+//	order=asc|desc  by the endpoint's sort key, id breaking ties (default asc)
+//	pattern=P       only this pattern
+//	status=S        only rows in this state, e.g. picked
+//	from=T, to=T    sort key within [from, to), RFC 3339 times or dates
+//
+// Each endpoint names the filters it supports and what status means for
+// it; any other filter given is refused rather than ignored.
+type pageParams struct {
+	Limit   int
+	Cursor  string
+	Desc    bool
+	Pattern string
+	Status  string
+	Source  string
+	From    *time.Time
+	To      *time.Time
+	// Patterns, if not nil, limits rows to these patterns, as for a
+	// restricted token.
+	Patterns []string
+}
+
+// pageError is a 400 for a malformed page parameter.
+type pageError struct {
+	Code, Message string
+}
+
+// pageFilters are the filters parsePageParams knows. What source means is
+// up to each endpoint: who or what produced the row.
+var pageFilters = []string{"pattern", "status", "source", "from", "to"}
+
+// parsePageParams reads the shared parameters from qs, allowing only the
+// named filters.
+func parsePageParams(qs url.Values, limits pageLimits, filters ...string) (pageParams, *pageError) {
+	p := pageParams{Limit: limits.Default, Cursor: qs.Get("cursor"), Pattern: qs.Get("pattern"), Status: qs.Get("status"),
+		Source: qs.Get("source")}
+	for _, name := range pageFilters {
+		if qs.Has(name) && !slices.Contains(filters, name) {
+			return p, &pageError{"unsupported_filter", fmt.Sprintf("this endpoint filters by %s, not %s", strings.Join(filters, ", "), name)}
+		}
+	}
+	if val := qs.Get("limit"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 || n > limits.Max {
+			return p, &pageError{"invalid_limit", fmt.Sprintf("limit must be between 1 and %d", limits.Max)}
+		}
+		p.Limit = n
+	}
+	switch qs.Get("order") {
+	case "", "asc":
+	case "desc":
+		p.Desc = true
+	default:
+		return p, &pageError{"invalid_order", `order must be "asc" or "desc"`}
+	}
+	for name, t := range map[string]**time.Time{"from": &p.From, "to": &p.To} {
+		if val := qs.Get(name); val != "" {
+			parsed, err := parseCampaignTime(val)
+			if err != nil {
+				return p, &pageError{"invalid_" + name, name + " must be an RFC 3339 time or a date"}
+			}
+			*t = parsed
+		}
+	}
+	if p.From != nil && p.To != nil && !p.To.After(*p.From) {
+		return p, &pageError{"invalid_range", "to must be after from"}
+	}
+	if p.Cursor != "" {
+		c, err := decodePageCursor(p.Cursor)
+		if err != nil || c.Desc != p.Desc {
+			return p, &pageError{"invalid_cursor", "cursor is not one of this listing's, in this order"}
+		}
+	}
+	return p, nil
+}
+
+// pageCursor is the position after the last row of a page: its sort key
+// and id. A cursor only continues a listing in the order it came from.
+type pageCursor struct {
+	Key  time.Time
+	ID   string
+	Desc bool
+}
+
+// String encodes c opaquely. Ascending cursors keep the form GET /v1/keys
+// has always returned, so cursors handed out before stay valid.
+func (c pageCursor) String() string {
+	raw := c.Key.UTC().Format(time.RFC3339Nano) + "," + c.ID
+	if c.Desc {
+		raw += ",desc"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodePageCursor(s string) (pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	parts := strings.Split(string(raw), ",")
+	if len(parts) < 2 || len(parts) > 3 || len(parts) == 3 && parts[2] != "desc" {
+		return pageCursor{}, errInvalidCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	return pageCursor{Key: t, ID: parts[1], Desc: len(parts) == 3}, nil
+}
+
+// keysetPage orders tx by sortCol, then idCol, limits it to a page and,
+// with cursor set, starts it after the cursor's row. id converts the
+// cursor's id to idCol's type. Paging by key rather than offset means rows
+// inserted meanwhile neither shift nor repeat later pages; a row committed
+// with a sort key before the cursor is not seen until the listing is
+// restarted.
+func keysetPage(tx *gorm.DB, sortCol, idCol, cursor string, desc bool, limit int, id func(string) (any, error)) (*gorm.DB, error) {
+	dir, cmp := "", ">"
+	if desc {
+		dir, cmp = " DESC", "<"
+	}
+	if cursor != "" {
+		c, err := decodePageCursor(cursor)
+		if err != nil || c.Desc != desc {
+			return nil, errInvalidCursor
+		}
+		cid, err := id(c.ID)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		tx = tx.Where(fmt.Sprintf("(%s, %s) %s (?, ?)", sortCol, idCol, cmp), c.Key, cid)
+	}
+	return tx.Order(sortCol + dir + ", " + idCol + dir).Limit(limit), nil
+}
+
+// slicePage is keysetPage for rows already in memory: it orders rows by
+// key, then id, and returns the page after page's cursor with the cursor of
+// the next one, "" after the last.
+func slicePage[T any](rows []T, key func(T) (time.Time, uint64), page pageParams) ([]T, string, error) {
+	less := func(a, b T) int {
+		ka, ia := key(a)
+		kb, ib := key(b)
+		if c := ka.Compare(kb); c != 0 {
+			return c
+		}
+		return cmp.Compare(ia, ib)
+	}
+	if page.Desc {
+		slices.SortStableFunc(rows, func(a, b T) int { return less(b, a) })
+	} else {
+		slices.SortStableFunc(rows, less)
+	}
+	if page.Cursor != "" {
+		c, err := decodePageCursor(page.Cursor)
+		if err != nil || c.Desc != page.Desc {
+			return nil, "", errInvalidCursor
+		}
+		cid, err := strconv.ParseUint(c.ID, 10, 64)
+		if err != nil {
+			return nil, "", errInvalidCursor
+		}
+		start, _ := slices.BinarySearchFunc(rows, c, func(row T, c pageCursor) int {
+			k, id := key(row)
+			o := k.Compare(c.Key)
+			if o == 0 {
+				o = cmp.Compare(id, cid)
+			}
+			if page.Desc {
+				o = -o
+			}
+			// Rows up to and including the cursor's come first
+			if o == 0 {
+				return -1
+			}
+			return o
+		})
+		rows = rows[start:]
+	}
+	if len(rows) <= page.Limit {
+		return rows, "", nil
+	}
+	rows = rows[:page.Limit]
+	k, id := key(rows[len(rows)-1])
+	return rows, pageCursor{Key: k, ID: strconv.FormatUint(id, 10), Desc: page.Desc}.String(), nil
+}
+
+// pageRange keeps the rows of tx whose col is within [from, to).
+func pageRange(tx *gorm.DB, col string, from, to *time.Time) *gorm.DB {
+	if from != nil {
+		tx = tx.Where(col+" >= ?", *from)
+	}
+	if to != nil {
+		tx = tx.Where(col+" < ?", *to)
+	}
+	return tx
+}
+
+// stringID and intID convert cursor ids for keysetPage.
+func stringID(s string) (any, error) { return s, nil }
+
+func intID(s string) (any, error) { return strconv.ParseUint(s, 10, 64) }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"math/rand/v2"
+	"net/url"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pagedRow is a row of a listing under test: a sort key, often shared,
+// and a unique id.
+type pagedRow struct {
+	At time.Time
+	ID uint64
+}
+
+func rowKey(r pagedRow) (time.Time, uint64) { return r.At, r.ID }
+
+// checkTraversal checks a full walk of a listing: no row twice, every row
+// of before once, and rows in order.
+func checkTraversal(t *testing.T, seen []pagedRow, before []pagedRow, desc bool) {
+	t.Helper()
+	ids := map[uint64]bool{}
+	for i, r := range seen {
+		if ids[r.ID] {
+			t.Fatalf("row %d seen twice", r.ID)
+		}
+		ids[r.ID] = true
+		if i > 0 {
+			prev := seen[i-1]
+			c := prev.At.Compare(r.At)
+			if c == 0 {
+				c = cmp.Compare(prev.ID, r.ID)
+			}
+			if desc {
+				c = -c
+			}
+			if c >= 0 {
+				t.Fatalf("row %d (%v) came after row %d (%v)", r.ID, r.At, prev.ID, prev.At)
+			}
+		}
+	}
+	for _, r := range before {
+		if !ids[r.ID] {
+			t.Fatalf("row %d, there before paging began, was skipped", r.ID)
+		}
+	}
+}
+
+// TestSlicePageConcurrentInserts pages through a listing, in both orders
+// and with many tied sort keys, while rows are inserted concurrently.
+func TestSlicePageConcurrentInserts(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for seed := range uint64(50) {
+		for _, desc := range []bool{false, true} {
+			rng := rand.New(rand.NewPCG(seed, 1))
+			var mu sync.Mutex
+			var rows []pagedRow
+			nextID := uint64(1)
+			insert := func(rng *rand.Rand) {
+				mu.Lock()
+				defer mu.Unlock()
+				rows = append(rows, pagedRow{At: base.Add(time.Duration(rng.IntN(20)) * time.Second), ID: nextID})
+				nextID++
+			}
+			for range 50 + rng.IntN(100) {
+				insert(rng)
+			}
+			before := slices.Clone(rows)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ins := rand.New(rand.NewPCG(seed, 2))
+				for range 200 {
+					insert(ins)
+					runtime.Gosched()
+				}
+			}()
+
+			page := pageParams{Limit: 1 + rng.IntN(15), Desc: desc}
+			var seen []pagedRow
+			for {
+				mu.Lock()
+				snapshot := slices.Clone(rows)
+				mu.Unlock()
+				got, next, err := slicePage(snapshot, rowKey, page)
+				if err != nil {
+					t.Fatal(err)
+				}
+				seen = append(seen, got...)
+				if next == "" {
+					break
+				}
+				page.Cursor = next
+			}
+			wg.Wait()
+			checkTraversal(t, seen, before, desc)
+		}
+	}
+}
+
+func TestSlicePageCursorOrder(t *testing.T) {
+	rows := []pagedRow{{At: time.Unix(1, 0), ID: 1}, {At: time.Unix(2, 0), ID: 2}}
+	_, next, err := slicePage(slices.Clone(rows), rowKey, pageParams{Limit: 1})
+	if err != nil || next == "" {
+		t.Fatalf("first page: next %q, %v", next, err)
+	}
+	if _, _, err := slicePage(slices.Clone(rows), rowKey, pageParams{Limit: 1, Cursor: next, Desc: true}); err != errInvalidCursor {
+		t.Fatalf("an ascending cursor continued a descending listing: %v", err)
+	}
+}
+
+func TestParsePageParamsSource(t *testing.T) {
+	qs := url.Values{"source": {"surplus"}}
+	p, perr := parsePageParams(qs, pageLimits{Default: 10, Max: 100}, "pattern", "source")
+	if perr != nil || p.Source != "surplus" {
+		t.Fatalf("parsePageParams = %+v, %v", p, perr)
+	}
+	if _, perr := parsePageParams(qs, pageLimits{Default: 10, Max: 100}, "pattern"); perr == nil || perr.Code != "unsupported_filter" {
+		t.Fatalf("source on an endpoint without it = %v, want unsupported_filter", perr)
+	}
+}
+
+// TestKeysetPageConcurrentInserts is TestSlicePageConcurrentInserts for
+// the SQL pager, through GET /v1/report's query.
+func TestKeysetPageConcurrentInserts(t *testing.T) {
+	s := testDatabase(t)
+	ctx := context.Background()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, desc := range []bool{false, true} {
+		if err := s.db.Exec("TRUNCATE discarded_key").Error; err != nil {
+			t.Fatal(err)
+		}
+		rng := rand.New(rand.NewPCG(1, 1))
+		insert := func(rng *rand.Rand) error {
+			return s.db.Create(&DiscardedKey{DiscardedAt: base.Add(time.Duration(rng.IntN(20)) * time.Second),
+				Reason: discardSurplus, Pattern: "ab"}).Error
+		}
+		for range 200 {
+			if err := insert(rng); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var before []pagedRow
+		if err := s.db.Model(&DiscardedKey{}).Select("discarded_at AS at, id").Scan(&before).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ins := rand.New(rand.NewPCG(1, 2))
+			for range 200 {
+				if err := insert(ins); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		page := pageParams{Limit: 7, Desc: desc, Source: discardSurplus}
+		var seen []pagedRow
+		for {
+			rows, next, err := s.DiscardReport(ctx, page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range rows {
+				seen = append(seen, pagedRow{At: r.DiscardedAt, ID: uint64(r.ID)})
+			}
+			if next == "" {
+				break
+			}
+			page.Cursor = next
+		}
+		wg.Wait()
+		checkTraversal(t, seen, before, desc)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mr-tron/base58/base58"
+	"gorm.io/gorm"
+	"rsc.io/qr"
+)
+
+// Key returns the stored key with public key pub, private key decrypted,
+// whatever its picked state.
+func (s *gormStore) Key(ctx context.Context, pub string) (TokenKey, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var key TokenKey
+	err := db.Where("public_key = ? AND quarantined = false", pub).Take(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return TokenKey{}, ErrKeyNotFound
+	}
+	if err != nil {
+		return TokenKey{}, ctxError(ctx, "get key", err)
+	}
+	return key, s.open(ctx, &key)
+}
+
+// paperSecret renders a base58 private key as format: "base58" as stored,
+// or "json" for the byte array of a Solana CLI keypair file. The
+// fingerprint is the SHA-256 of the key bytes, to check a restored key by.
+func paperSecret(priv, format string) (secret, fingerprint string, err error) {
+	b, err := base58.Decode(priv)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(b)
+	fingerprint = hex.EncodeToString(sum[:])
+	switch format {
+	case "base58":
+		return priv, fingerprint, nil
+	case "json":
+		ints := make([]int, len(b))
+		for i, v := range b {
+			ints[i] = int(v)
+		}
+		out, err := json.Marshal(ints)
+		return string(out), fingerprint, err
+	default:
+		return "", "", errors.New(`format must be "base58" or "json"`)
+	}
+}
+
+var paperTemplate = template.Must(template.New("paper").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Paper backup {{.Short}}</title>
+<style>body{font-family:monospace;max-width:40em;margin:2em auto}img{width:20em;image-rendering:pixelated}
+.warn{border:2px solid #000;padding:.5em}</style></head>
+<body>
+<h1>Solana key backup</h1>
+<p>Address<br><strong>{{.PublicKey}}</strong></p>
+<p><img alt="private key QR code" src="data:image/png;base64,{{.QR}}"></p>
+<p>Private key ({{.Format}}) · SHA-256 fingerprint<br>{{.Fingerprint}}</p>
+<p class="warn">Anyone holding this page controls the address. Store it offline; do not photograph or scan it on a networked device.</p>
+</body></html>
+`))
+
+// handlePaperBackup serves GET /v1/keys/{publicKey}/paper: a printable
+// backup of one key with its private key as a QR code, in ?format=base58
+// (default) or json, rendered as ?render=html (default) or the bare QR
+// code as png. Registered only with PAPER_BACKUP_ENABLED=true.
+func (s *server) handlePaperBackup(w http.ResponseWriter, r *http.Request) {
+	pub := r.PathValue("publicKey")
+	if err := validatePublicKey(pub, true); err != nil {
+		var pe *pubkeyError
+		errors.As(err, &pe)
+		writePubkeyError(w, pe)
+		return
+	}
+	format := cmp.Or(r.URL.Query().Get("format"), "base58")
+	render := cmp.Or(r.URL.Query().Get("render"), "html")
+	if render != "html" && render != "png" {
+		writeError(w, http.StatusBadRequest, "invalid_render", `render must be "html" or "png"`, nil)
+		return
+	}
+
+	key, err := s.store.Key(r.Context(), pub)
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		writeError(w, http.StatusNotFound, "key_not_found", "no such key in the pool", nil)
+		return
+	case errors.Is(err, ErrCorruptKey):
+		writeError(w, http.StatusInternalServerError, "corrupt_key", "the key was corrupt and has been quarantined", nil)
+		return
+	case err != nil:
+		log.Println("Error reading key for paper backup:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read key", nil)
+		return
+	}
+	secret, fingerprint, err := paperSecret(key.PrivateKey, format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_format", err.Error(), nil)
+		return
+	}
+	code, err := qr.Encode(secret, qr.M)
+	if err != nil {
+		log.Println("Error encoding paper backup QR code:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to render QR code", nil)
+		return
+	}
+	code.Scale = 8
+
+	audit(r.Context(), "paper_backup", "public_key="+pub+" format="+format+" render="+render)
+	w.Header().Set("Cache-Control", "no-store")
+	if render == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Public-Key", pub)
+		w.Header().Set("X-Key-Fingerprint", fingerprint)
+		w.Write(code.PNG())
+		return
+	}
+
+	var page bytes.Buffer
+	err = paperTemplate.Execute(&page, map[string]string{
+		"PublicKey":   pub,
+		"Short":       shortForm(pub),
+		"QR":          base64.StdEncoding.EncodeToString(code.PNG()),
+		"Format":      format,
+		"Fingerprint": strings.ToUpper(fingerprint),
+	})
+	if err != nil {
+		log.Println("Error rendering paper backup:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to render paper backup", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Bytes())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// ErrPrivateKeyConflict is an insert whose private key is already stored
+// under another public key. A private key has exactly one public key, so
+// the stored row is corrupt, e.g. after a bad restore.
+var ErrPrivateKeyConflict = errors.New("private key already stored under another public key")
+
+// ParkedKey is a found key that could not go in token_key, kept with its
+// sealed private key so it is not lost. An operator resolves the conflict
+// and re-imports it; nothing reads the table automatically.
+type ParkedKey struct {
+	PublicKey      string    `gorm:"column:public_key;primaryKey"`
+	PrivateKey     string    `gorm:"column:private_key;not null"`
+	MatchedPattern string    `gorm:"column:matched_pattern"`
+	Reason         string    `gorm:"column:reason;not null"`
+	ConflictsWith  string    `gorm:"column:conflicts_with"`
+	ParkedAt       time.Time `gorm:"column:parked_at;not null"`
+}
+
+func (ParkedKey) TableName() string { return "parked_key" }
+
+// privateKeyViolation reports whether err is a unique violation of the
+// private_key or private_key_digest constraint rather than the public_key
+// one.
+func privateKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && strings.Contains(pgErr.ConstraintName, "private_key")
+}
+
+// parkConflict handles row, sealed, failing to insert on the private_key
+// or private_key_digest constraint: it raises an ALERT naming both rows,
+// quarantines the stored one for investigation and parks row. The stored
+// row is found by digest, as sealing the same private key twice differs.
+func (s *gormStore) parkConflict(ctx context.Context, db *gorm.DB, row TokenKey) error {
+	var stored []string
+	err := db.Model(&TokenKey{}).Where("private_key_digest = ?", row.PrivateKeyDigest).Limit(1).Pluck("public_key", &stored).Error
+	if err != nil {
+		return err
+	}
+	other := "(not found)"
+	if len(stored) > 0 {
+		other = stored[0]
+	}
+	log.Printf("ALERT CRITICAL inconsistency: new key %s has the private key of stored key %s; quarantining %s and parking %s in parked_key\n",
+		row.PublicKey, other, other, row.PublicKey)
+	if len(stored) > 0 {
+		if _, err := s.Quarantine(ctx, other); err != nil {
+			log.Printf("Error quarantining key %s: %v\n", other, err)
+		}
+	}
+	parked := ParkedKey{PublicKey: row.PublicKey, PrivateKey: row.PrivateKey, MatchedPattern: row.MatchedPattern,
+		Reason: "private_key_conflict", ConflictsWith: other, ParkedAt: clock.Now().UTC()}
+	if err := db.Create(&parked).Error; err != nil {
+		return fmt.Errorf("park key %s: %w", row.PublicKey, err)
+	}
+	return fmt.Errorf("%w: %s conflicts with %s, parked", ErrPrivateKeyConflict, row.PublicKey, other)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"solana-key-gen/keygen"
+)
+
+// pattern is an address suffix, or for PREFIXES entries a prefix, the pool
+// keeps Target unpicked keys for. Source names the config source it came
+// from and Template the rendering it was written against, for diagnostics.
+// Campaign and the validity window are stamped onto every key it finds.
+// A non-zero Weight puts the pattern in weighted mode (see deficient).
+// Fuzzy suffixes (MATCH_MODE=edit) match any address whose last
+// len(Suffix) characters are within MaxEdit edits of Suffix, and Contains
+// ones (MATCH_MODE=contains) any address with Suffix anywhere in it.
+// Profile names the PATTERN_PROFILES entry its policies came from; a
+// non-zero LowPool overrides LOW_POOL_FRACTION for it. Non-fuzzy patterns
+// match up to equiv (CHAR_EQUIV). Predicate patterns (MATCH_MODE=predicate)
+// fix no text and match whatever the named matchPredicate accepts. Any
+// patterns (MATCH_MODE=any) accept every key, making the pool one of plain
+// keypairs at a difficulty of 1. A pattern with a Schedule
+// (PATTERN_SCHEDULE) is only ground for inside its windows.
+type pattern struct {
+	Any       bool
+	Suffix    string
+	Prefix    string
+	Fuzzy     bool
+	MaxEdit   int
+	Contains  bool
+	Predicate string
+	Target    int
+	Weight    float64
+	Source    string
+	Template  string
+
+	Profile        string
+	LowPool        float64
+	profileWorkers int
+	profileQuota   int64
+	equiv          keygen.Equivalence
+
+	Campaign   string
+	ValidFrom  *time.Time
+	ValidUntil *time.Time
+	Schedule   []scheduleWindow
+}
+
+// Name identifies the pattern in matched_pattern, metrics and logs: the
+// suffix itself, the prefix followed by "*", "~suffix/distance" for a
+// fuzzy suffix, "*text*" for a contains pattern, "@name" for a predicate
+// or "*" for any key.
+func (p pattern) Name() string {
+	if p.Any {
+		return "*"
+	}
+	if p.Predicate != "" {
+		return "@" + p.Predicate
+	}
+	if p.Prefix != "" {
+		return p.Prefix + "*"
+	}
+	if p.Fuzzy {
+		return keygen.Edit(p.Suffix, p.MaxEdit).Name
+	}
+	if p.Contains {
+		return keygen.Contains(p.Suffix).Name
+	}
+	return p.Suffix
+}
+
+// text is the part of the address the pattern fixes.
+func (p pattern) text() string { return p.Prefix + p.Suffix }
+
+func (p pattern) matches(addr string) bool {
+	if p.Any {
+		return true
+	}
+	if p.Predicate != "" {
+		pred, ok := lookupPredicate(p.Predicate)
+		return ok && pred.Match(addr)
+	}
+	if p.Prefix != "" {
+		return p.equiv.HasPrefix(addr, p.Prefix)
+	}
+	if p.Fuzzy {
+		return keygen.Edit(p.Suffix, p.MaxEdit).Match(addr)
+	}
+	if p.Contains {
+		return p.equiv.Contains(addr, p.Suffix)
+	}
+	return p.equiv.HasSuffix(addr, p.Suffix)
+}
+
+// expectedAttempts is the pattern's difficulty; see nameDifficulty.
+func (p pattern) expectedAttempts() float64 { return nameDifficulty(p.Name()) }
+
+// parseFuzzyName splits a "~word/distance" pattern name.
+func parseFuzzyName(name string) (word string, d int, ok bool) {
+	rest, ok := strings.CutPrefix(name, "~")
+	if !ok {
+		return "", 0, false
+	}
+	i := strings.LastIndex(rest, "/")
+	if i < 0 {
+		return "", 0, false
+	}
+	d, err := strconv.Atoi(rest[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return rest[:i], d, true
+}
+
+// parseContainsName returns the text of a "*text*" pattern name.
+func parseContainsName(name string) (string, bool) {
+	if len(name) < 3 || !strings.HasPrefix(name, "*") || !strings.HasSuffix(name, "*") {
+		return "", false
+	}
+	return name[1 : len(name)-1], true
+}
+
+// keygenPattern turns a pattern name back into a generator pattern.
+func keygenPattern(name string) keygen.Pattern {
+	if name == "*" {
+		return keygen.Any()
+	}
+	if pred, ok := parsePredicateName(name); ok {
+		return predicatePattern(pred)
+	}
+	if word, d, ok := parseFuzzyName(name); ok {
+		return keygen.Edit(word, d)
+	}
+	if text, ok := parseContainsName(name); ok {
+		return keygen.Contains(text)
+	}
+	if prefix, ok := strings.CutSuffix(name, "*"); ok {
+		return keygen.Prefix(prefix)
+	}
+	return keygen.Suffix(name)
+}
+
+// fuzzyPattern is the single pattern MATCH_MODE=edit grinds for.
+func fuzzyPattern(word string, maxEdit int, trim string) (pattern, error) {
+	word = normalizePatternText(word, trim)
+	if word == "" {
+		return pattern{}, fmt.Errorf("TARGET_WORD is required")
+	}
+	if maxEdit < 0 || maxEdit >= len(word) {
+		return pattern{}, fmt.Errorf("MAX_EDIT_DISTANCE must be between 0 and %d for %q", len(word)-1, word)
+	}
+	return pattern{Suffix: word, Fuzzy: true, MaxEdit: maxEdit, Source: "env:TARGET_WORD"}, nil
+}
+
+// defaultPatternTrim is the decorative characters stripped from both ends
+// of pattern entries, left over from copying addresses out of documents.
+// None of them is in the base58 alphabet.
+const defaultPatternTrim = "\"'`“”‘’.;!?()[]<>"
+
+// normalizePatternText strips surrounding whitespace and any of the trim
+// characters from both ends of s.
+func normalizePatternText(s, trim string) string {
+	return strings.Trim(strings.TrimSpace(s), trim+" \t")
+}
+
+// parsePatterns parses a comma-separated list of "text" or "text:target"
+// entries, as prefixes if prefix is set and suffixes otherwise, "*" being
+// any key. Entries
+// without a target get Target 0 for the caller to fill in. Entries are
+// normalized with trim first, logging any that changed.
+func parsePatterns(spec, source string, prefix bool, trim string) ([]pattern, error) {
+	var out []pattern
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		entry := normalizePatternText(raw, trim)
+		if entry == "" {
+			continue
+		}
+		cleaned := entry != raw
+		text, target := entry, 0
+		// A non-numeric tail is part of the text, e.g. "solana:Ponz"
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			if t, err := strconv.Atoi(entry[i+1:]); err == nil {
+				if t < 1 {
+					return nil, fmt.Errorf("invalid target in %q", raw)
+				}
+				text, target = normalizePatternText(entry[:i], trim), t
+				cleaned = cleaned || text != strings.TrimSpace(entry[:i])
+			}
+		}
+		if text == "" {
+			return nil, fmt.Errorf("empty pattern in %q", raw)
+		}
+		if cleaned {
+			log.Printf("Cleaned pattern %q from %s to %q\n", raw, source, text)
+		}
+		p := pattern{Suffix: text, Target: target, Source: source}
+		if text == "*" {
+			p = pattern{Any: true, Target: target, Source: source}
+		} else if prefix {
+			p.Suffix, p.Prefix = "", text
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// applyTemplate rewrites patterns written against how addresses are shown,
+// e.g. "solana:{address}", into address patterns. A prefix must start with
+// the text before {address} and a suffix end with the text after it; that
+// fixed text is stripped so it does not count towards what is ground for.
+func applyTemplate(patterns []pattern, tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+	lead, trail, ok := strings.Cut(tmpl, "{address}")
+	if !ok || strings.Contains(trail, "{address}") {
+		return fmt.Errorf("template %q must contain {address} exactly once", tmpl)
+	}
+
+	for i := range patterns {
+		p := &patterns[i]
+		// Predicates see the address itself, and any key matches whatever it shows
+		if p.Predicate != "" || p.Any {
+			continue
+		}
+		p.Template = tmpl
+		var rest string
+		if p.Prefix != "" {
+			rest, ok = strings.CutPrefix(p.Prefix, lead)
+			if !ok {
+				return fmt.Errorf("prefix %q does not start with %q from template %q", p.Prefix, lead, tmpl)
+			}
+			p.Prefix = rest
+		} else {
+			rest, ok = strings.CutSuffix(p.Suffix, trail)
+			if !ok {
+				return fmt.Errorf("suffix %q does not end with %q from template %q", p.Suffix, trail, tmpl)
+			}
+			p.Suffix = rest
+		}
+		if rest == "" {
+			return fmt.Errorf("pattern %q is only template text; nothing is left to grind for", p.Name())
+		}
+	}
+	return nil
+}
+
+// maxAddressLen is the longest base58 encoding of a 32-byte public key.
+const maxAddressLen = 44
+
+// patternOverlap records that every key matching Sub also matches Super.
+type patternOverlap struct {
+	Sub, Super pattern
+}
+
+// validatePatterns rejects patterns configured more than once, even with
+// the same target, longer than any address, or with characters outside the
+// base58 alphabet, and
+// reports suffix-of-another-suffix and prefix-of-another-prefix overlaps.
+func validatePatterns(patterns []pattern) ([]patternOverlap, error) {
+	seen := make(map[string]pattern, len(patterns))
+	for _, p := range patterns {
+		if len(p.text()) > maxAddressLen {
+			return nil, fmt.Errorf("pattern %q (%s) is %d characters but addresses are at most %d, so it can never match",
+				p.Name(), p.Source, len(p.text()), maxAddressLen)
+		}
+		if strings.IndexFunc(p.text(), func(r rune) bool { return !isBase58(r) }) >= 0 {
+			return nil, fmt.Errorf("pattern %q (%s) has characters that never appear in an address", p.Name(), p.Source)
+		}
+		if prev, ok := seen[p.Name()]; ok {
+			return nil, fmt.Errorf("pattern %q configured twice (%s target %d, %s target %d)",
+				p.Name(), prev.Source, prev.Target, p.Source, p.Target)
+		}
+		seen[p.Name()] = p
+	}
+
+	var overlaps []patternOverlap
+	for _, a := range patterns {
+		for _, b := range patterns {
+			if a.Prefix != "" && b.Prefix != "" && len(a.Prefix) > len(b.Prefix) && strings.HasPrefix(a.Prefix, b.Prefix) {
+				overlaps = append(overlaps, patternOverlap{Sub: a, Super: b})
+			}
+			if a.Suffix != "" && b.Suffix != "" && !a.Contains && !b.Contains &&
+				len(a.Suffix) > len(b.Suffix) && strings.HasSuffix(a.Suffix, b.Suffix) {
+				overlaps = append(overlaps, patternOverlap{Sub: a, Super: b})
+			}
+			// Any fixed text containing a contains pattern's text matches it too
+			if b.Contains && !a.Fuzzy && a.Name() != b.Name() && strings.Contains(a.text(), b.Suffix) {
+				overlaps = append(overlaps, patternOverlap{Sub: a, Super: b})
+			}
+		}
+	}
+	return overlaps, nil
+}
+
+// difficulty is the expected number of attempts to find a key with text
+// fixed at either end.
+func difficulty(text string) float64 {
+	return math.Pow(58, float64(len(text)))
+}
+
+// editDifficulty estimates the expected attempts to find n trailing
+// characters within d edits of a fixed word. It counts the strings within
+// Hamming distance d only, which undercounts the edit-distance ball, so
+// the estimate errs on the hard side.
+func editDifficulty(n, d int) float64 {
+	var near float64
+	for k := 0; k <= d; k++ {
+		choose := 1.0
+		for i := 0; i < k; i++ {
+			choose = choose * float64(n-i) / float64(i+1)
+		}
+		near += choose * math.Pow(57, float64(k))
+	}
+	return math.Pow(58, float64(n)) / near
+}
+
+// containsDifficulty estimates the expected attempts to find text anywhere
+// in an address, treating each of its possible positions as independent.
+func containsDifficulty(text string) float64 {
+	return difficulty(text) / float64(max(1, maxAddressLen-len(text)+1))
+}
+
+// nameDifficulty is the expected attempts for the pattern named name.
+func nameDifficulty(name string) float64 {
+	if pred, ok := parsePredicateName(name); ok {
+		if p, ok := lookupPredicate(pred); ok {
+			return p.Attempts
+		}
+		return defaultPredicateAttempts
+	}
+	if word, d, ok := parseFuzzyName(name); ok {
+		return editDifficulty(len(word), d)
+	}
+	if text, ok := parseContainsName(name); ok {
+		return containsDifficulty(text)
+	}
+	return difficulty(strings.TrimSuffix(name, "*"))
+}
+
+// combinedDifficulty is the expected attempts to find a key matching any
+// of patterns: the match rates of the rules add up, ignoring their overlap.
+func combinedDifficulty(patterns []pattern) float64 {
+	var rate float64
+	for _, p := range patterns {
+		rate += 1 / p.expectedAttempts()
+	}
+	return 1 / rate
+}
+
+// qualityScore rates a key by how rare its matched pattern is, as bits of
+// difficulty, so longer matches score higher. Unmatched keys score 0.
+func qualityScore(name string) float64 {
+	if name == "" {
+		return 0
+	}
+	return math.Log2(nameDifficulty(name))
+}
+
+// lengthFraction is the share of addresses that are n characters long, or
+// 1 for n == 0. A uniform 32-byte key encodes to 44 base58 characters
+// unless it is below 58^43, which about 6% are.
+func lengthFraction(n int) float64 {
+	below := func(k int) float64 { return math.Pow(58, float64(k)) / math.Pow(2, 256) }
+	switch n {
+	case 0:
+		return 1
+	case maxAddressLen:
+		return 1 - below(maxAddressLen-1)
+	default:
+		return below(n) - below(n-1)
+	}
+}
+
+// scaledTarget scales base inversely to d relative to the easiest configured
+// difficulty, so the easiest pattern gets base and each harder one gets
+// proportionally fewer keys, clamped to [lo, hi].
+func scaledTarget(base int, d, easiest float64, lo, hi int) int {
+	t := int(math.Round(float64(base) * easiest / d))
+	return max(lo, min(hi, t))
+}
+
+// applyDefaultTargets fills in Target for patterns that did not set one,
+// either with base or, when autoScale is set, with a difficulty-scaled value.
+func applyDefaultTargets(patterns []pattern, base int, autoScale bool, lo, hi int) {
+	easiest := math.Inf(1)
+	for _, p := range patterns {
+		easiest = math.Min(easiest, p.expectedAttempts())
+	}
+	for i := range patterns {
+		if patterns[i].Target > 0 {
+			continue
+		}
+		if autoScale {
+			patterns[i].Target = scaledTarget(base, patterns[i].expectedAttempts(), easiest, lo, hi)
+		} else {
+			patterns[i].Target = base
+		}
+	}
+}
+
+// matchPattern returns the name of the longest configured pattern pub
+// matches, or "".
+func matchPattern(pub string, patterns []pattern) string {
+	best, bestLen := "", 0
+	for _, p := range patterns {
+		// Predicates fix no text, so they rank below any pattern that does
+		if p.matches(pub) && (len(p.text()) > bestLen || best == "") {
+			best, bestLen = p.Name(), len(p.text())
+		}
+	}
+	return best
+}
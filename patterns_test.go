@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestScaledTarget(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		base         int
+		d, easiest   float64
+		lo, hi, want int
+	}{
+		{"easiest gets base", 1000, 58, 58, 1, 10000, 1000},
+		{"58 times harder gets a 58th", 1000, 58 * 58, 58, 1, 10000, 17},
+		{"rounds to nearest", 100, 3, 2, 1, 10000, 67},
+		{"clamped to lo", 1000, 58 * 58 * 58, 58, 5, 10000, 5},
+		{"clamped to hi", 1000, 58, 58, 1, 500, 500},
+	} {
+		if got := scaledTarget(c.base, c.d, c.easiest, c.lo, c.hi); got != c.want {
+			t.Errorf("%s: scaledTarget(%d, %v, %v, %d, %d) = %d, want %d", c.name, c.base, c.d, c.easiest, c.lo, c.hi, got, c.want)
+		}
+	}
+}
+
+func TestApplyDefaultTargets(t *testing.T) {
+	patterns := []pattern{{Suffix: "ab"}, {Suffix: "abc"}, {Suffix: "abcd", Target: 7}}
+	applyDefaultTargets(patterns, 1000, true, 1, 10000)
+	if patterns[0].Target != 1000 {
+		t.Errorf("easiest pattern target = %d, want 1000", patterns[0].Target)
+	}
+	if got := patterns[1].Target; got >= patterns[0].Target || got < 1 {
+		t.Errorf("harder pattern target = %d, want fewer than the easiest", got)
+	}
+	if patterns[2].Target != 7 {
+		t.Errorf("an explicit target was overwritten: %d", patterns[2].Target)
+	}
+
+	flat := []pattern{{Suffix: "ab"}, {Suffix: "abc"}}
+	applyDefaultTargets(flat, 50, false, 1, 10000)
+	if flat[0].Target != 50 || flat[1].Target != 50 {
+		t.Errorf("without auto scaling targets = %d, %d; want 50 each", flat[0].Target, flat[1].Target)
+	}
+}
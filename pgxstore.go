@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// With DB_ENGINE=pgx the pick, insert and count paths run on a pgxpool
+// instead of GORM. pgx prepares and caches each statement on first use per
+// connection. Migrations and every other operation stay on GORM, and the
+// statements below use the columns migrate defines.
+
+// pgxKeyColumns are the token_key columns a pgx pick returns, in scan
+// order. Columns added by later migrations may be NULL on older rows.
+const pgxKeyColumns = `id, private_key, public_key, is_picked, COALESCE(matched_pattern, ''),
+	COALESCE(address_length, 0), COALESCE(quality_score, 0), COALESCE(quarantined, false),
+	COALESCE(campaign, ''), COALESCE(cluster, ''), valid_from, valid_until, created_at, label, metadata::text`
+
+func newPgxPool(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// numbered rewrites "?" placeholders as $1, $2, ... for pgx.
+func numbered(sql string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range sql {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *gormStore) pgxCountUnpicked(ctx context.Context, pattern string) (int64, error) {
+	var c int64
+	err := s.pgx.QueryRow(ctx, `SELECT count(*) FROM token_key WHERE is_picked = false AND matched_pattern = $1`, pattern).Scan(&c)
+	return c, err
+}
+
+// pgxInsert inserts row, already sealed, returning false on a public key
+// conflict unless strictInsert.
+func (s *gormStore) pgxInsert(ctx context.Context, row *TokenKey) (bool, error) {
+	if row.CreatedAt.IsZero() {
+		row.CreatedAt = clock.Now()
+	}
+	onConflict := "ON CONFLICT (public_key) DO NOTHING"
+	if s.strictInsert {
+		onConflict = ""
+	}
+	tag, err := s.pgx.Exec(ctx, `INSERT INTO token_key (id, private_key, public_key, is_picked, matched_pattern,
+			address_length, checksum, quality_score, quarantined, campaign, cluster, valid_from, valid_until, created_at, label,
+			private_key_digest)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		`+onConflict,
+		row.ID, row.PrivateKey, row.PublicKey, row.IsPicked, row.MatchedPattern, row.AddressLength, row.Checksum,
+		row.QualityScore, row.Quarantined, row.Campaign, row.Cluster, row.ValidFrom, row.ValidUntil, row.CreatedAt, row.Label,
+		row.PrivateKeyDigest)
+	return tag.RowsAffected() > 0, err
+}
+
+func (s *gormStore) pgxPick(ctx context.Context, f pickFilter) (TokenKey, error) {
+	sql, args := planPick(f).claim(pgxKeyColumns)
+	var k TokenKey
+	err := s.pgx.QueryRow(ctx, numbered(sql), args...).Scan(&k.ID, &k.PrivateKey, &k.PublicKey, &k.IsPicked,
+		&k.MatchedPattern, &k.AddressLength, &k.QualityScore, &k.Quarantined, &k.Campaign, &k.Cluster,
+		&k.ValidFrom, &k.ValidUntil, &k.CreatedAt, &k.Label, &k.Metadata)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TokenKey{}, pickMiss(f)
+	}
+	return k, err
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A pick is planned before it runs: planPick turns a pickFilter into the
+// conditions, ordering and assignment of the claim statement. The same plan
+// claims a key and, for a pick with "explain", shows an operator which keys
+// the claim would consider and which it passes over and why.
+
+// pickCond is one condition of a pick plan, with "?" placeholders.
+type pickCond struct {
+	// Filter names the request field or token restriction the condition
+	// comes from, e.g. "pattern"; empty for those every pick applies.
+	Filter string `json:"filter,omitempty"`
+	Value  any    `json:"value,omitempty"`
+	// Excludes is why a key failing the condition is passed over, for
+	// conditions on a key's state rather than on which keys were asked for.
+	Excludes string `json:"excludes,omitempty"`
+	SQL      string `json:"sql"`
+	Args     []any  `json:"-"`
+}
+
+// pickPlan is how a pick chooses and claims a key.
+type pickPlan struct {
+	Conds []pickCond
+	// Strategy is "oldest" or "quality"; Order is its ORDER BY.
+	Strategy string
+	Order    string
+	// Set is the claim's assignment, with SetArgs.
+	Set     string
+	SetArgs []any
+}
+
+// planPick plans a pick of one unpicked key matching f.
+func planPick(f pickFilter) pickPlan {
+	p := pickPlan{Strategy: "oldest", Order: "created_at", Set: "is_picked = true"}
+	if f.ByQuality {
+		p.Strategy, p.Order = "quality", "quality_score DESC, created_at"
+	}
+	if f.Metadata != nil {
+		p.Set += ", metadata = ?::jsonb"
+		p.SetArgs = []any{*f.Metadata}
+	}
+
+	// Keys outside their validity window are never served
+	p.Conds = []pickCond{
+		{Excludes: "picked", SQL: "is_picked = false"},
+		{Excludes: "not_yet_valid", SQL: "(valid_from IS NULL OR valid_from <= now())"},
+		{Excludes: "expired", SQL: "(valid_until IS NULL OR valid_until > now())"},
+	}
+	filter := func(name string, value any, sql string) {
+		p.Conds = append(p.Conds, pickCond{Filter: name, Value: value, SQL: sql, Args: []any{value}})
+	}
+	if f.PublicKey != "" {
+		filter("public_key", f.PublicKey, "public_key = ?")
+	}
+	if f.Label != "" {
+		filter("label", f.Label, "label = ?")
+	}
+	if f.Restrict != nil {
+		cond, args := f.Restrict.where()
+		p.Conds = append(p.Conds, pickCond{Filter: "restriction", Value: f.Restrict.String(), SQL: cond, Args: args})
+	}
+	if f.Pattern != "" {
+		filter("pattern", f.Pattern, "matched_pattern = ?")
+	}
+	if f.Campaign != "" {
+		filter("campaign", f.Campaign, "campaign = ?")
+	}
+	if f.AddressLength > 0 {
+		filter("address_length", f.AddressLength, "address_length = ?")
+	}
+	// The declared cluster is asked for, and a key of another is passed
+	// over for it rather than merely not selected
+	if f.Cluster != "" {
+		p.Conds = append(p.Conds, pickCond{Filter: "cluster", Value: f.Cluster, Excludes: "wrong_cluster",
+			SQL: "cluster = ?", Args: []any{f.Cluster}})
+	}
+	return p
+}
+
+// where joins the conditions keep accepts.
+func (p pickPlan) where(keep func(pickCond) bool) (string, []any) {
+	var conds []string
+	var args []any
+	for _, c := range p.Conds {
+		if keep(c) {
+			conds = append(conds, c.SQL)
+			args = append(args, c.Args...)
+		}
+	}
+	if len(conds) == 0 {
+		return "true", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func allConds(pickCond) bool        { return true }
+func selectingCond(c pickCond) bool { return c.Excludes == "" }
+func excludingCond(c pickCond) bool { return c.Excludes != "" }
+
+// claim is the statement claiming the plan's first key, returning the
+// given columns. SKIP LOCKED lets concurrent pickers claim different rows.
+func (p pickPlan) claim(returning string) (string, []any) {
+	where, whereArgs := p.where(allConds)
+	sql := `UPDATE token_key SET ` + p.Set + `
+		WHERE id = (
+			SELECT id FROM token_key WHERE ` + where + `
+			ORDER BY ` + p.Order + ` LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING ` + returning
+	return sql, append(slices.Clone(p.SetArgs), whereArgs...)
+}
+
+// candidates is the query listing the public keys of the first n keys the
+// claim would consider, in the order it considers them.
+func (p pickPlan) candidates(n int) (string, []any) {
+	where, args := p.where(allConds)
+	return `SELECT public_key FROM token_key WHERE ` + where + ` ORDER BY ` + p.Order + ` LIMIT ?`, append(args, n)
+}
+
+// passedOver is the query listing the first n keys that were asked for
+// but fail a condition on their state: their public key, whether they are
+// quarantined or transferred, then for each excluding condition whether
+// the key fails it.
+func (p pickPlan) passedOver(n int) (string, []any) {
+	var cols []string
+	var args []any
+	for _, c := range p.Conds {
+		if excludingCond(c) {
+			cols = append(cols, "NOT COALESCE("+c.SQL+", false)")
+			args = append(args, c.Args...)
+		}
+	}
+	selecting, selectArgs := p.where(selectingCond)
+	excluding, excludeArgs := p.where(excludingCond)
+	sql := `SELECT public_key, COALESCE(quarantined, false), migrated_to IS NOT NULL, ` + strings.Join(cols, ", ") + `
+		FROM token_key WHERE ` + selecting + ` AND NOT COALESCE(` + excluding + `, false)
+		ORDER BY ` + p.Order + ` LIMIT ?`
+	args = append(append(append(args, selectArgs...), excludeArgs...), n)
+	return sql, args
+}
+
+// explainLimit is how many candidates, and how many passed-over keys, an
+// explaining pick lists.
+const explainLimit = 20
+
+// pickOrder is a plan's ordering as an explaining pick shows it.
+type pickOrder struct {
+	Strategy string `json:"strategy"`
+	SQL      string `json:"sql"`
+}
+
+// passedOverKey is a key a pick was asked for but would not claim.
+type passedOverKey struct {
+	PublicKey string   `json:"public_key"`
+	Reasons   []string `json:"reasons"`
+}
+
+// pickExplanation is what a pick would have done. Candidates are in the
+// order the claim tries them; the first not locked by a concurrent pick is
+// the one it takes.
+type pickExplanation struct {
+	Filters    []pickCond      `json:"filters"`
+	Conditions []pickCond      `json:"conditions"`
+	Order      pickOrder       `json:"order"`
+	Candidates []string        `json:"candidates"`
+	Excluded   []passedOverKey `json:"excluded"`
+	Limit      int             `json:"limit"`
+}
+
+// ExplainPick reports what a pick with f would consider, without claiming
+// anything. It reads the primary, where picks run.
+func (s *gormStore) ExplainPick(ctx context.Context, f pickFilter) (pickExplanation, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	p := planPick(f)
+	e := pickExplanation{Order: pickOrder{Strategy: p.Strategy, SQL: p.Order}, Limit: explainLimit,
+		Filters: []pickCond{}, Conditions: []pickCond{}, Candidates: []string{}, Excluded: []passedOverKey{}}
+	var reasons []string
+	for _, c := range p.Conds {
+		if c.Filter != "" {
+			e.Filters = append(e.Filters, c)
+		}
+		if c.Excludes != "" {
+			e.Conditions = append(e.Conditions, c)
+			reasons = append(reasons, c.Excludes)
+		}
+	}
+
+	sql, args := p.candidates(explainLimit)
+	if err := db.Raw(sql, args...).Scan(&e.Candidates).Error; err != nil {
+		return pickExplanation{}, ctxError(ctx, "explain pick", err)
+	}
+	sql, args = p.passedOver(explainLimit)
+	rows, err := db.Raw(sql, args...).Rows()
+	if err != nil {
+		return pickExplanation{}, ctxError(ctx, "explain pick", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k passedOverKey
+		var quarantined, transferred bool
+		fails := make([]bool, len(reasons))
+		dest := []any{&k.PublicKey, &quarantined, &transferred}
+		for i := range fails {
+			dest = append(dest, &fails[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return pickExplanation{}, ctxError(ctx, "explain pick", err)
+		}
+		for i, failed := range fails {
+			if failed {
+				k.Reasons = append(k.Reasons, passedOverReason(reasons[i], quarantined, transferred))
+			}
+		}
+		e.Excluded = append(e.Excluded, k)
+	}
+	return e, ctxError(ctx, "explain pick", rows.Err())
+}
+
+// passedOverReason refines reason for a key out of the pool for good: a
+// quarantined or transferred key is also marked picked.
+func passedOverReason(reason string, quarantined, transferred bool) string {
+	switch {
+	case reason != "picked":
+		return reason
+	case quarantined:
+		return "quarantined"
+	case transferred:
+		return "transferred"
+	}
+	return reason
+}
+
+// explainPick answers an explaining pick for f. It needs the admin scope:
+// it lists keys the token could otherwise only pick.
+func (s *server) explainPick(w http.ResponseWriter, r *http.Request, f pickFilter) {
+	if !tokenFromContext(r.Context()).Has(scopeAdmin) {
+		writeError(w, http.StatusForbidden, "forbidden", "explain needs the admin scope",
+			map[string]any{"missing_scope": scopeAdmin})
+		return
+	}
+	e, err := s.store.ExplainPick(r.Context(), f)
+	if err != nil {
+		log.Println("Error explaining pick:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to explain pick", nil)
+		return
+	}
+	audit(r.Context(), "pick_explain", "candidates="+strconv.Itoa(len(e.Candidates)))
+	writeJSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPlanPickDefaults(t *testing.T) {
+	p := planPick(pickFilter{})
+	if p.Strategy != "oldest" || p.Order != "created_at" || p.Set != "is_picked = true" {
+		t.Fatalf("plan = %+v, want the oldest key marked picked", p)
+	}
+	var excludes []string
+	for _, c := range p.Conds {
+		if c.Filter != "" {
+			t.Errorf("an unfiltered pick has filter %+v", c)
+		}
+		excludes = append(excludes, c.Excludes)
+	}
+	if want := []string{"picked", "not_yet_valid", "expired"}; !slices.Equal(excludes, want) {
+		t.Fatalf("an unfiltered pick excludes %v, want %v", excludes, want)
+	}
+}
+
+func TestPlanPickFilters(t *testing.T) {
+	tests := []struct {
+		f        pickFilter
+		filter   string
+		sql      string
+		args     []any
+		excludes string
+	}{
+		{pickFilter{PublicKey: "pub"}, "public_key", "public_key = ?", []any{"pub"}, ""},
+		{pickFilter{Label: "ponz-0042"}, "label", "label = ?", []any{"ponz-0042"}, ""},
+		{pickFilter{Pattern: "ab"}, "pattern", "matched_pattern = ?", []any{"ab"}, ""},
+		{pickFilter{Campaign: "launch"}, "campaign", "campaign = ?", []any{"launch"}, ""},
+		{pickFilter{AddressLength: 44}, "address_length", "address_length = ?", []any{44}, ""},
+		{pickFilter{Cluster: "devnet"}, "cluster", "cluster = ?", []any{"devnet"}, "wrong_cluster"},
+		{pickFilter{Restrict: &keyRestriction{Patterns: []string{"ab", "cd"}}}, "restriction",
+			"matched_pattern IN (?, ?)", []any{"ab", "cd"}, ""},
+	}
+	for _, tt := range tests {
+		p := planPick(tt.f)
+		got := p.Conds[len(p.Conds)-1]
+		if got.Filter != tt.filter || got.SQL != tt.sql || !reflect.DeepEqual(got.Args, tt.args) || got.Excludes != tt.excludes {
+			t.Errorf("planPick(%+v) added %+v, want filter %s: %s %v excluding %q", tt.f, got, tt.filter, tt.sql, tt.args, tt.excludes)
+		}
+	}
+}
+
+// placeholders checks a statement has an argument for every placeholder.
+func placeholders(t *testing.T, what, sql string, args []any) {
+	t.Helper()
+	if n := strings.Count(sql, "?"); n != len(args) {
+		t.Errorf("%s has %d placeholders and %d arguments: %s %v", what, n, len(args), sql, args)
+	}
+}
+
+func TestPlanStatements(t *testing.T) {
+	meta := `{"order":7}`
+	f := pickFilter{Pattern: "ab", Campaign: "launch", Cluster: "devnet", ByQuality: true, Metadata: &meta,
+		Restrict: &keyRestriction{Campaigns: []string{"launch"}}}
+	p := planPick(f)
+
+	sql, args := p.claim("*")
+	placeholders(t, "the claim", sql, args)
+	if args[0] != meta || !strings.Contains(sql, "metadata = ?::jsonb") {
+		t.Errorf("the claim sets %v first in %s, want the metadata", args[0], sql)
+	}
+	if !strings.Contains(sql, "ORDER BY quality_score DESC, created_at LIMIT 1 FOR UPDATE SKIP LOCKED") {
+		t.Errorf("the claim does not order by quality and skip locked rows: %s", sql)
+	}
+	if !strings.Contains(sql, "RETURNING *") {
+		t.Errorf("the claim does not return the key: %s", sql)
+	}
+
+	sql, args = p.candidates(20)
+	placeholders(t, "the candidates", sql, args)
+	if strings.Contains(sql, "UPDATE") || strings.Contains(sql, "FOR UPDATE") || args[len(args)-1] != 20 {
+		t.Errorf("the candidates query claims or locks, or is not limited: %s %v", sql, args)
+	}
+
+	sql, args = p.passedOver(20)
+	placeholders(t, "the passed-over query", sql, args)
+	// One flag per excluding condition, cluster's argument first among them
+	if !strings.Contains(sql, "NOT COALESCE(is_picked = false, false), ") || args[0] != "devnet" {
+		t.Errorf("the passed-over query does not flag each exclusion: %s %v", sql, args)
+	}
+	if !strings.Contains(sql, "AND NOT COALESCE(is_picked = false AND ") {
+		t.Errorf("the passed-over query does not select only excluded keys: %s", sql)
+	}
+
+	// The statements are valid enough for GORM to build
+	db := dryRunDB(t)
+	for _, stmt := range []func() (string, []any){func() (string, []any) { return p.claim("*") },
+		func() (string, []any) { return p.candidates(20) }, func() (string, []any) { return p.passedOver(20) }} {
+		sql, args := stmt()
+		if err := db.Exec(sql, args...).Error; err != nil {
+			t.Errorf("%s: %v", sql, err)
+		}
+	}
+}
+
+func TestPassedOverReason(t *testing.T) {
+	tests := []struct {
+		reason                   string
+		quarantined, transferred bool
+		want                     string
+	}{
+		{"picked", false, false, "picked"},
+		{"picked", true, false, "quarantined"},
+		{"picked", false, true, "transferred"},
+		{"expired", true, false, "expired"},
+		{"wrong_cluster", false, false, "wrong_cluster"},
+	}
+	for _, tt := range tests {
+		if got := passedOverReason(tt.reason, tt.quarantined, tt.transferred); got != tt.want {
+			t.Errorf("passedOverReason(%s, %v, %v) = %s, want %s", tt.reason, tt.quarantined, tt.transferred, got, tt.want)
+		}
+	}
+}
+
+func TestExplainPickNeedsAdmin(t *testing.T) {
+	s := &server{}
+	r := httptest.NewRequest(http.MethodPost, "/v1/pick", strings.NewReader(`{"explain":true}`))
+	r = r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, apiToken{Name: "app", Scopes: []string{scopePick}}))
+	w := httptest.NewRecorder()
+	s.handlePick(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("explain with a pick token = %d %s, want 403", w.Code, w.Body)
+	}
+}
+
+// TestExplainPick explains a pick over keys that are each passed over for
+// a different reason, and checks it claims nothing.
+func TestExplainPick(t *testing.T) {
+	store := testDatabase(t)
+	ctx := context.Background()
+	future := time.Now().Add(time.Hour)
+	insert := func(k TokenKey) string {
+		t.Helper()
+		k.ID, k.MatchedPattern = uuid.NewString(), "ab"
+		k.PrivateKey, k.PublicKey = agentKey(t)
+		if _, err := store.Insert(ctx, &k); err != nil {
+			t.Fatal(err)
+		}
+		return k.PublicKey
+	}
+	oldest := insert(TokenKey{Cluster: "devnet", CreatedAt: time.Now().Add(-2 * time.Minute)})
+	newer := insert(TokenKey{Cluster: "devnet", CreatedAt: time.Now().Add(-time.Minute)})
+	picked := insert(TokenKey{Cluster: "devnet", IsPicked: true})
+	quarantined := insert(TokenKey{Cluster: "devnet"})
+	if _, err := store.Quarantine(ctx, quarantined); err != nil {
+		t.Fatal(err)
+	}
+	mainnet := insert(TokenKey{Cluster: "mainnet-beta"})
+	early := insert(TokenKey{Cluster: "devnet", ValidFrom: &future})
+
+	s := &server{store: store, cluster: "devnet"}
+	r := httptest.NewRequest(http.MethodPost, "/v1/pick", strings.NewReader(`{"explain":true,"pattern":"ab"}`))
+	r.Header.Set(clusterHeader, "devnet")
+	r = r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, apiToken{Name: "ops", Scopes: []string{scopeAdmin}}))
+	w := httptest.NewRecorder()
+	s.handlePick(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("explain = %d %s", w.Code, w.Body)
+	}
+	var e pickExplanation
+	if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(e.Candidates, []string{oldest, newer}) {
+		t.Errorf("candidates = %v, want the oldest then the newer key", e.Candidates)
+	}
+	if e.Order.Strategy != "oldest" {
+		t.Errorf("order = %+v, want oldest", e.Order)
+	}
+	var filters []string
+	for _, f := range e.Filters {
+		filters = append(filters, f.Filter)
+	}
+	if !slices.Equal(filters, []string{"pattern", "cluster"}) {
+		t.Errorf("filters = %v, want pattern and cluster", filters)
+	}
+	reasons := map[string][]string{}
+	for _, k := range e.Excluded {
+		reasons[k.PublicKey] = k.Reasons
+	}
+	want := map[string][]string{
+		picked:      {"picked"},
+		quarantined: {"quarantined"},
+		mainnet:     {"wrong_cluster"},
+		early:       {"not_yet_valid"},
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("excluded = %v, want %v", reasons, want)
+	}
+	if n, err := store.CountUnpicked(ctx, "ab"); err != nil || n != 4 {
+		t.Errorf("%d unpicked after explaining (%v), want 4: explain claimed a key", n, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// pickWaitPoll is how often a waiting pick retries unwoken, for keys this
+// process did not store itself: another instance's, an agent's or an
+// import's.
+const pickWaitPoll = 2 * time.Second
+
+// pickWaiter is a pick waiting for a key its filter can claim. woken holds
+// at most one wakeup.
+type pickWaiter struct {
+	pattern, campaign string
+	woken             chan struct{}
+}
+
+// pickWaiters queues picks waiting on an empty pool (POST /v1/pick with
+// "wait") and wakes them as the fill loop stores keys, oldest first: each
+// stored key wakes the longest-waiting pick it could satisfy. A woken pick
+// that loses the key to another picker keeps its place in the queue.
+type pickWaiters struct {
+	mu    sync.Mutex
+	queue []*pickWaiter
+}
+
+// newPickWaiters wakes waiters for every key published on stream until it
+// is closed.
+func newPickWaiters(stream *keyStream) *pickWaiters {
+	pw := &pickWaiters{}
+	keys, _ := stream.Subscribe()
+	go func() {
+		for k := range keys {
+			pw.Notify(k)
+		}
+	}()
+	return pw
+}
+
+func (pw *pickWaiters) add(f pickFilter) *pickWaiter {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	w := &pickWaiter{pattern: f.Pattern, campaign: f.Campaign, woken: make(chan struct{}, 1)}
+	pw.queue = append(pw.queue, w)
+	return w
+}
+
+func (pw *pickWaiters) remove(w *pickWaiter) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.queue = slices.DeleteFunc(pw.queue, func(q *pickWaiter) bool { return q == w })
+}
+
+// Notify wakes the oldest waiter not already woken that k could satisfy.
+func (pw *pickWaiters) Notify(k TokenKey) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	for _, w := range pw.queue {
+		if w.pattern != "" && w.pattern != k.MatchedPattern || w.campaign != "" && w.campaign != k.Campaign {
+			continue
+		}
+		select {
+		case w.woken <- struct{}{}:
+			return
+		default:
+		}
+	}
+}
+
+// waitForKey retries claim for f until it finds a key or wait passes,
+// then returning ErrPoolEmpty. It retries when a stored key wakes it and
+// every pickWaitPoll; no transaction is held in between.
+func (pw *pickWaiters) waitForKey(ctx context.Context, f pickFilter, wait time.Duration, claim func(context.Context) (TokenKey, error)) (TokenKey, error) {
+	w := pw.add(f)
+	defer pw.remove(w)
+	deadline := clock.After(wait)
+	for {
+		// The first claim covers keys stored before the waiter was queued
+		key, err := claim(ctx)
+		if !errors.Is(err, ErrPoolEmpty) {
+			return key, err
+		}
+		select {
+		case <-w.woken:
+		case <-clock.After(pickWaitPoll):
+		case <-deadline:
+			return TokenKey{}, ErrPoolEmpty
+		case <-ctx.Done():
+			return TokenKey{}, ctx.Err()
+		}
+	}
+}
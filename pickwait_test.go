@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// pickResult is what a waiting pick returned.
+type pickResult struct {
+	key TokenKey
+	err error
+}
+
+// startWaiting runs waitForKey for f in the background, claiming from
+// store, and returns once it is queued.
+func startWaiting(t *testing.T, ctx context.Context, pw *pickWaiters, store *memStore, f pickFilter, wait time.Duration) <-chan pickResult {
+	t.Helper()
+	pw.mu.Lock()
+	queued := len(pw.queue)
+	pw.mu.Unlock()
+	done := make(chan pickResult, 1)
+	go func() {
+		key, err := pw.waitForKey(ctx, f, wait, func(ctx context.Context) (TokenKey, error) { return store.Pick(ctx, f) })
+		done <- pickResult{key, err}
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		pw.mu.Lock()
+		n := len(pw.queue)
+		pw.mu.Unlock()
+		if n > queued {
+			return done
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the pick was never queued")
+		}
+	}
+}
+
+// storeKey inserts the key named name of pattern and announces it to pw.
+func storeKey(t *testing.T, pw *pickWaiters, store *memStore, name, pattern string) TokenKey {
+	t.Helper()
+	k := TokenKey{PublicKey: testPub(name), PrivateKey: testPriv(name), MatchedPattern: pattern}
+	if _, err := store.Insert(context.Background(), &k); err != nil {
+		t.Fatal(err)
+	}
+	pw.Notify(k)
+	return k
+}
+
+func receive(t *testing.T, done <-chan pickResult) pickResult {
+	t.Helper()
+	select {
+	case r := <-done:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting pick did not return")
+		return pickResult{}
+	}
+}
+
+func TestPickWaitersFIFO(t *testing.T) {
+	useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+	store := newMemStore()
+	pw := &pickWaiters{}
+
+	other := startWaiting(t, ctx, pw, store, pickFilter{Pattern: "cd"}, time.Minute)
+	first := startWaiting(t, ctx, pw, store, pickFilter{Pattern: "ab"}, time.Minute)
+	second := startWaiting(t, ctx, pw, store, pickFilter{Pattern: "ab"}, time.Minute)
+
+	// The oldest waiter the key can satisfy gets it, not one for another
+	// pattern queued ahead of it
+	k1 := storeKey(t, pw, store, "k1", "ab")
+	if r := receive(t, first); r.err != nil || r.key.PublicKey != k1.PublicKey {
+		t.Fatalf("first waiter got %s, %v; want %s", r.key.PublicKey, r.err, k1.PublicKey)
+	}
+	select {
+	case r := <-second:
+		t.Fatalf("second waiter returned %s, %v before a second key", r.key.PublicKey, r.err)
+	case r := <-other:
+		t.Fatalf("the waiter for another pattern returned %s, %v", r.key.PublicKey, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	k2 := storeKey(t, pw, store, "k2", "ab")
+	if r := receive(t, second); r.err != nil || r.key.PublicKey != k2.PublicKey {
+		t.Fatalf("second waiter got %s, %v; want %s", r.key.PublicKey, r.err, k2.PublicKey)
+	}
+	k3 := storeKey(t, pw, store, "k3", "cd")
+	if r := receive(t, other); r.err != nil || r.key.PublicKey != k3.PublicKey {
+		t.Fatalf("cd waiter got %s, %v; want %s", r.key.PublicKey, r.err, k3.PublicKey)
+	}
+	if len(pw.queue) != 0 {
+		t.Fatalf("%d waiters left queued", len(pw.queue))
+	}
+}
+
+func TestPickWaitersPollAndDeadline(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+	store := newMemStore()
+	pw := &pickWaiters{}
+
+	// A key stored elsewhere wakes nobody; the next poll finds it
+	done := startWaiting(t, ctx, pw, store, pickFilter{Pattern: "ab"}, time.Minute)
+	c.BlockUntil(t, 2)
+	k := TokenKey{PublicKey: testPub("k1"), PrivateKey: testPriv("k1"), MatchedPattern: "ab"}
+	if _, err := store.Insert(ctx, &k); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(pickWaitPoll)
+	if r := receive(t, done); r.err != nil || r.key.PublicKey != k.PublicKey {
+		t.Fatalf("polling waiter got %s, %v; want %s", r.key.PublicKey, r.err, k.PublicKey)
+	}
+
+	done = startWaiting(t, ctx, pw, store, pickFilter{Pattern: "ab"}, 5*time.Second)
+	// The first waiter's deadline is still pending
+	c.BlockUntil(t, 3)
+	for range 2 {
+		c.Advance(pickWaitPoll)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("waiter returned %v before its deadline", r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	if r := receive(t, done); !errors.Is(r.err, ErrPoolEmpty) {
+		t.Fatalf("waiter at its deadline got %v, want ErrPoolEmpty", r.err)
+	}
+}
+
+func TestPickWaitersCancel(t *testing.T) {
+	useFakeClock(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	store := newMemStore()
+	pw := &pickWaiters{}
+
+	done := startWaiting(t, ctx, pw, store, pickFilter{Pattern: "ab"}, time.Minute)
+	cancel()
+	if r := receive(t, done); !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("cancelled waiter got %v, want context.Canceled", r.err)
+	}
+	if len(pw.queue) != 0 {
+		t.Fatal("a cancelled waiter stayed queued")
+	}
+	// With no one waiting the key stays in the pool
+	storeKey(t, pw, store, "k1", "ab")
+	if n, _ := store.CountUnpicked(context.Background(), "ab"); n != 1 {
+		t.Fatalf("%d unpicked keys, want the key left for the next pick", n)
+	}
+}
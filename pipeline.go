@@ -0,0 +1,326 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"solana-key-gen/keygen"
+)
+
+// found is one outcome of the matcher: a key, or why there is none.
+type found struct {
+	kp  Keypair
+	err error
+}
+
+// matcher grinds keys for whichever patterns the fill cycle still needs.
+type matcher struct {
+	loop    *fillLoop
+	workers int
+	weights *weightedSampler
+	quotas  *quotaBook
+	genOpts []keygen.Option
+}
+
+// names is what the next grind looks for: need, or with weights one
+// sampled pattern, none if it is at its quota.
+func (m *matcher) names(ctx context.Context, need []string) []string {
+	if m.weights != nil {
+		return m.quotas.Allowed(ctx, []string{m.weights.sample()})
+	}
+	return need
+}
+
+// matcherIdleWait is how long the matcher waits, with every pattern it could
+// grind for at its quota, before asking again.
+const matcherIdleWait = time.Second
+
+// next grinds one key for need(), retrying when preempted by another loop.
+// It returns false once ctx is done or the loop is stopped.
+func (m *matcher) next(ctx context.Context, need func() []string) (found, bool) {
+	for ctx.Err() == nil {
+		names := m.names(ctx, need())
+		// Nothing to grind for until a quota frees up or the need changes
+		if len(names) == 0 {
+			sleepCtx(ctx, matcherIdleWait)
+			continue
+		}
+		n, grindCtx, err := m.loop.Acquire(ctx, m.workers)
+		if err != nil {
+			return found{}, false
+		}
+		kp, err := generateVanityKeypair(grindCtx, names, n, m.genOpts...)
+		m.loop.Release()
+		// Preempted so another loop gets its share of WORKERS
+		if err != nil && grindCtx.Err() != nil && ctx.Err() == nil {
+			continue
+		}
+		// Shutting down is not a generation failure: stop without reporting one
+		if err != nil && ctx.Err() != nil {
+			return found{}, false
+		}
+		return found{kp, err}, true
+	}
+	return found{}, false
+}
+
+// generationBackoff is the wait after a failed generation that followed
+// prev: doubling from a second up to 30s.
+func generationBackoff(prev time.Duration) time.Duration {
+	return min(30*time.Second, max(time.Second, 2*prev))
+}
+
+// pipelineConfig is PIPELINE_DEPTH, PIPELINE_URGENT_ATTEMPTS,
+// PIPELINE_MAX_BUFFERED and PIPELINE_RESUME_BUFFERED.
+type pipelineConfig struct {
+	Depth int
+	// Urgent is the cost from which finds skip the depth bound; negative
+	// derives it from the patterns, as newPipelinePriority does.
+	Urgent float64
+	// MaxBuffered caps every queued find, urgent or not, so an inserter
+	// stuck on the database never lets unstored keys pile up in memory.
+	// Reaching it pauses the matcher until the queue drains to
+	// ResumeBuffered. 0 = no cap.
+	MaxBuffered    int
+	ResumeBuffered int
+}
+
+// pipelinePriority is the order a pipeline hands finds to the inserter:
+// most expensive pattern first, by expected attempts per key, and in the
+// order found among equals, generation failures counting as free. A burst
+// of finds for a cheap pattern thus cannot hold up storing a rare find for
+// an expensive one. Finds costing at least urgent are not held back by a
+// full buffer either: the matcher queues them at once rather than waiting
+// for the inserter to make room.
+type pipelinePriority struct {
+	costs  map[string]float64
+	urgent float64 // 0 = no find skips the depth bound
+}
+
+// newPipelinePriority ranks patterns by the estimator. A negative urgent
+// makes finds urgent that cost at least 58 times the cheapest pattern's, a
+// character longer, so it takes a mix of patterns for any to be.
+func newPipelinePriority(patterns []pattern, urgent float64) pipelinePriority {
+	pr := pipelinePriority{costs: make(map[string]float64, len(patterns)), urgent: urgent}
+	cheapest := math.Inf(1)
+	for _, p := range patterns {
+		c := p.attemptsAt(0)
+		pr.costs[p.Name()] = c
+		cheapest = min(cheapest, c)
+	}
+	if urgent < 0 {
+		pr.urgent = 0
+		if !math.IsInf(cheapest, 1) {
+			pr.urgent = 58 * cheapest
+		}
+	}
+	return pr
+}
+
+func (pr pipelinePriority) cost(f found) float64 {
+	if f.err != nil {
+		return 0
+	}
+	return pr.costs[f.kp.Pattern]
+}
+
+func (pr pipelinePriority) isUrgent(cost float64) bool {
+	return pr.urgent > 0 && cost >= pr.urgent
+}
+
+// queuedFind is a find waiting in a pipeline, seq being the order found.
+type queuedFind struct {
+	f    found
+	cost float64
+	seq  uint64
+}
+
+// findQueue is a heap of queued finds, costliest and then earliest first.
+type findQueue []queuedFind
+
+func (q findQueue) Len() int { return len(q) }
+func (q findQueue) Less(i, j int) bool {
+	if q[i].cost != q[j].cost {
+		return q[i].cost > q[j].cost
+	}
+	return q[i].seq < q[j].seq
+}
+func (q findQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *findQueue) Push(x any)   { *q = append(*q, x.(queuedFind)) }
+func (q *findQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// matchPipeline runs the matcher in its own goroutine during a fill
+// cycle, PIPELINE_DEPTH keys ahead of the inserter, so grinding carries on
+// while a key is being stored and a burst of finds does not wait on the
+// database. The inserter takes finds in priority order. A full buffer
+// blocks the matcher until the inserter catches up, unless the find is
+// urgent; MaxBuffered queued finds block it whatever they cost. Keys still
+// buffered when the cycle ends are discarded.
+type matchPipeline struct {
+	name     string
+	need     atomic.Pointer[[]string]
+	cancel   context.CancelFunc
+	done     chan struct{}
+	cfg      pipelineConfig
+	priority pipelinePriority
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  findQueue
+	seq    uint64
+	closed bool
+	// held is how many queued finds are not urgent, the ones depth bounds
+	held int
+	// full is set from reaching MaxBuffered until draining to ResumeBuffered
+	full bool
+}
+
+// newMatchPipeline returns an empty pipeline for the fill loop name.
+func newMatchPipeline(name string, cfg pipelineConfig, priority pipelinePriority) *matchPipeline {
+	p := &matchPipeline{name: name, done: make(chan struct{}), cfg: cfg, priority: priority}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// startMatchPipeline starts grinding for need. Generation failures back
+// off in the matcher, so reporting them is all that is left to the
+// inserter; derivation halting ends the pipeline.
+func startMatchPipeline(ctx context.Context, m *matcher, cfg pipelineConfig, priority pipelinePriority, need []string, maint *maintenanceSwitch) *matchPipeline {
+	ctx, cancel := context.WithCancel(ctx)
+	p := newMatchPipeline(m.loop.name, cfg, priority)
+	p.cancel = cancel
+	p.Retarget(need)
+	go func() {
+		defer close(p.done)
+		defer func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.closed = true
+			p.cond.Broadcast()
+		}()
+		var backoff time.Duration
+		for {
+			f, ok := m.next(ctx, func() []string { return *p.need.Load() })
+			if !ok || !p.put(ctx, f) {
+				return
+			}
+			switch {
+			case errors.Is(f.err, errDerivationHalted):
+				return
+			case f.err != nil:
+				backoff = generationBackoff(backoff)
+				maint.Sleep(ctx, backoff)
+			default:
+				backoff = 0
+			}
+		}
+	}()
+	return p
+}
+
+// put queues f once there is room for it, or if it is urgent once the
+// pipeline is not full. Urgent finds are not counted against depth, so
+// queueing them never makes other finds wait longer for room. It returns
+// false, dropping f, if ctx ends first.
+func (p *matchPipeline) put(ctx context.Context, f found) bool {
+	cost := p.priority.cost(f)
+	urgent := p.priority.isUrgent(cost)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	blocked := func() bool { return p.full || !urgent && p.held >= p.cfg.Depth }
+	if blocked() {
+		// Wakes the wait below once the cycle ends
+		stop := context.AfterFunc(ctx, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.cond.Broadcast()
+		})
+		defer stop()
+	}
+	for blocked() && ctx.Err() == nil {
+		p.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if !urgent {
+		p.held++
+	}
+	p.seq++
+	heap.Push(&p.queue, queuedFind{f: f, cost: cost, seq: p.seq})
+	pipelineBuffered.WithLabelValues(p.name).Set(float64(len(p.queue)))
+	if p.cfg.MaxBuffered > 0 && len(p.queue) >= p.cfg.MaxBuffered {
+		p.full = true
+		pipelineFull.WithLabelValues(p.name).Set(1)
+		pipelineFullTotal.WithLabelValues(p.name).Inc()
+		log.Printf("ALERT %d found keys for %s are waiting to be stored; pausing generation until %d remain\n",
+			len(p.queue), p.name, p.cfg.ResumeBuffered)
+	}
+	p.cond.Broadcast()
+	return true
+}
+
+// Next takes the costliest find queued, waiting for one. It returns false
+// once the matcher has stopped and every find it queued has been taken.
+func (p *matchPipeline) Next() (found, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.queue) == 0 {
+		return found{}, false
+	}
+	q := heap.Pop(&p.queue).(queuedFind)
+	if !p.priority.isUrgent(q.cost) {
+		p.held--
+	}
+	pipelineBuffered.WithLabelValues(p.name).Set(float64(len(p.queue)))
+	if p.full && len(p.queue) <= p.cfg.ResumeBuffered {
+		p.full = false
+		pipelineFull.WithLabelValues(p.name).Set(0)
+		log.Printf("Found keys for %s drained to %d, resuming generation\n", p.name, len(p.queue))
+	}
+	p.cond.Broadcast()
+	return q.f, true
+}
+
+// Retarget points the matcher at the patterns now below target.
+func (p *matchPipeline) Retarget(need []string) {
+	if p == nil {
+		return
+	}
+	need = append([]string(nil), need...)
+	p.need.Store(&need)
+}
+
+// Stop ends the pipeline and waits for the matcher, recording the keys it
+// had found but the inserter never took under reason, if set.
+func (p *matchPipeline) Stop(discards *discardLedger, reason string) {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, q := range p.queue {
+		if q.f.err == nil && reason != "" {
+			discards.Record(reason, q.f.kp.Pattern, q.f.kp.Pub, q.f.kp.Attempts)
+		}
+	}
+	p.queue, p.held, p.full = nil, 0, false
+	pipelineBuffered.WithLabelValues(p.name).Set(0)
+	pipelineFull.WithLabelValues(p.name).Set(0)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testPipeline is a pipeline with no matcher, fed by put directly.
+func testPipeline(depth int, priority pipelinePriority) *matchPipeline {
+	return newMatchPipeline("test", pipelineConfig{Depth: depth}, priority)
+}
+
+func find(pattern, pub string) found {
+	return found{kp: Keypair{Pattern: pattern, Pub: pub}}
+}
+
+func TestPipelinePriorityAuto(t *testing.T) {
+	pr := newPipelinePriority([]pattern{{Suffix: "ab"}, {Suffix: "abc"}, {Suffix: "abcd"}}, -1)
+	if !(pr.costs["ab"] < pr.costs["abc"] && pr.costs["abc"] < pr.costs["abcd"]) {
+		t.Fatalf("costs not ordered by length: %v", pr.costs)
+	}
+	for name, want := range map[string]bool{"ab": false, "abc": true, "abcd": true} {
+		if got := pr.isUrgent(pr.costs[name]); got != want {
+			t.Errorf("isUrgent(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	single := newPipelinePriority([]pattern{{Suffix: "abcd"}}, -1)
+	if single.isUrgent(single.costs["abcd"]) {
+		t.Error("a lone pattern should never be urgent")
+	}
+	off := newPipelinePriority([]pattern{{Suffix: "ab"}, {Suffix: "abcd"}}, 0)
+	if off.isUrgent(off.costs["abcd"]) {
+		t.Error("PIPELINE_URGENT_ATTEMPTS=0 should make nothing urgent")
+	}
+}
+
+// TestPipelineMixedBurst queues a burst of cheap finds around rarer ones and
+// checks the inserter gets the costliest first, in the order found among
+// equals, with generation failures last.
+func TestPipelineMixedBurst(t *testing.T) {
+	pr := newPipelinePriority([]pattern{{Suffix: "ab"}, {Suffix: "abc"}, {Suffix: "abcd"}}, 0)
+	p := testPipeline(100, pr)
+	ctx := context.Background()
+	burst := []found{
+		find("ab", "cheap1"), find("ab", "cheap2"), find("abc", "mid1"), {err: errors.New("entropy")},
+		find("ab", "cheap3"), find("abcd", "rare1"), find("ab", "cheap4"), find("abc", "mid2"), find("abcd", "rare2"),
+	}
+	for _, f := range burst {
+		if !p.put(ctx, f) {
+			t.Fatal("put failed")
+		}
+	}
+	want := []string{"rare1", "rare2", "mid1", "mid2", "cheap1", "cheap2", "cheap3", "cheap4", "error"}
+	for i, w := range want {
+		f, ok := p.Next()
+		if !ok {
+			t.Fatalf("queue ended after %d finds", i)
+		}
+		got := f.kp.Pub
+		if f.err != nil {
+			got = "error"
+		}
+		if got != w {
+			t.Fatalf("find %d = %s, want %s", i, got, w)
+		}
+	}
+}
+
+// TestPipelineUrgentSkipsDepth fills the buffer with cheap finds and checks
+// an urgent find is queued at once, goes out first, and does not hold back
+// the cheap find waiting for room.
+func TestPipelineUrgentSkipsDepth(t *testing.T) {
+	p := testPipeline(2, newPipelinePriority([]pattern{{Suffix: "ab"}, {Suffix: "abcd"}}, -1))
+	ctx := context.Background()
+	p.put(ctx, find("ab", "cheap1"))
+	p.put(ctx, find("ab", "cheap2"))
+
+	waiting := make(chan bool, 1)
+	go func() { waiting <- p.put(ctx, find("ab", "cheap3")) }()
+	select {
+	case <-waiting:
+		t.Fatal("a cheap find was queued past the depth")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	queued := make(chan bool, 1)
+	go func() { queued <- p.put(ctx, find("abcd", "rare")) }()
+	select {
+	case ok := <-queued:
+		if !ok {
+			t.Fatal("urgent put failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("an urgent find waited for room")
+	}
+
+	if f, _ := p.Next(); f.kp.Pub != "rare" {
+		t.Fatalf("first find = %s, want rare", f.kp.Pub)
+	}
+	// Taking the urgent find frees no room; taking a cheap one does
+	if f, _ := p.Next(); f.kp.Pub != "cheap1" {
+		t.Fatalf("second find = %s, want cheap1", f.kp.Pub)
+	}
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatal("the waiting cheap find was not queued once there was room")
+	}
+	for _, w := range []string{"cheap2", "cheap3"} {
+		if f, _ := p.Next(); f.kp.Pub != w {
+			t.Fatalf("find = %s, want %s", f.kp.Pub, w)
+		}
+	}
+}
+
+func TestPipelinePutCancelled(t *testing.T) {
+	p := testPipeline(1, newPipelinePriority([]pattern{{Suffix: "ab"}}, -1))
+	ctx, cancel := context.WithCancel(context.Background())
+	p.put(ctx, find("ab", "cheap1"))
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if p.put(ctx, find("ab", "cheap2")) {
+		t.Fatal("put into a full buffer succeeded after the cycle ended")
+	}
+}
+
+// queued is how many finds p holds and whether it is full.
+func queued(p *matchPipeline) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue), p.full
+}
+
+// TestPipelineMaxBufferedHysteresis checks a full pipeline blocks even
+// urgent finds and only takes more once drained to ResumeBuffered.
+func TestPipelineMaxBufferedHysteresis(t *testing.T) {
+	pr := newPipelinePriority([]pattern{{Suffix: "ab"}, {Suffix: "abcd"}}, -1)
+	p := newMatchPipeline("hysteresis", pipelineConfig{Depth: 2, MaxBuffered: 5, ResumeBuffered: 2}, pr)
+	ctx := context.Background()
+	for i := range 5 {
+		if !p.put(ctx, find("abcd", "rare"+strconv.Itoa(i))) {
+			t.Fatal("put failed")
+		}
+	}
+
+	queuedOne := make(chan bool, 1)
+	go func() { queuedOne <- p.put(ctx, find("abcd", "blocked")) }()
+	for _, left := range []int{4, 3} {
+		p.Next()
+		select {
+		case <-queuedOne:
+			t.Fatalf("an urgent find was queued at %d buffered, above the resume mark", left)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if testutil.ToFloat64(pipelineFull.WithLabelValues("hysteresis")) != 1 {
+		t.Error("keygen_pipeline_full is not set while paused")
+	}
+	p.Next()
+	select {
+	case <-queuedOne:
+	case <-time.After(time.Second):
+		t.Fatal("the find was not queued once drained to the resume mark")
+	}
+	if n, full := queued(p); n != 3 || full {
+		t.Fatalf("after resuming: %d queued, full %v; want 3, false", n, full)
+	}
+	if testutil.ToFloat64(pipelineFull.WithLabelValues("hysteresis")) != 0 {
+		t.Error("keygen_pipeline_full is still set after resuming")
+	}
+}
+
+// TestPipelineOutage simulates a database hanging for an hour, with the
+// storage_latency fault holding the inserter's insert, while an easy
+// pattern keeps finding urgent keys. Unstored keys must stop at the cap and
+// generation pick up again by itself once the database recovers.
+func TestPipelineOutage(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC))
+	faults := newFaultInjector()
+	faults.set(fault{Kind: faultStorageLatency, Probability: 1, Latency: time.Hour, Until: c.Now().Add(2 * time.Hour)})
+
+	// Every find is urgent, so depth bounds nothing and only the cap holds
+	pr := newPipelinePriority([]pattern{{Suffix: "ab"}}, 1)
+	p := newMatchPipeline("outage", pipelineConfig{Depth: 1, MaxBuffered: 8, ResumeBuffered: 3}, pr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const total = 40
+	var found, stored atomic.Int64
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		p.mu.Lock()
+		p.closed = true
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		wg.Wait()
+	})
+	peak := 0
+	var mu sync.Mutex
+	done := make(chan struct{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for stored.Load() < total {
+			if _, ok := p.Next(); !ok {
+				return
+			}
+			faults.delay(ctx, faultStorageLatency)
+			stored.Add(1)
+			n, _ := queued(p)
+			mu.Lock()
+			peak = max(peak, n)
+			mu.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total && p.put(ctx, find("ab", "key"+strconv.Itoa(i))); i++ {
+			found.Add(1)
+		}
+	}()
+
+	// The inserter takes the first key and hangs; the matcher fills the buffer
+	c.BlockUntil(t, 1)
+	deadline := time.Now().Add(time.Second)
+	for n, full := queued(p); !full; n, full = queued(p) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pipeline never filled: %d queued", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// The inserter may take the first key before or after the cap is
+	// reached, but past it the matcher finds nothing more
+	if n, _ := queued(p); n < 7 || n > 8 || found.Load() != int64(n)+1 {
+		t.Fatalf("during the outage %d keys were found and %d buffered; want the cap of 8 reached and one in the hung insert", found.Load(), n)
+	}
+	if testutil.ToFloat64(pipelineFull.WithLabelValues("outage")) != 1 {
+		t.Error("keygen_pipeline_full is not set during the outage")
+	}
+
+	// The database recovers: the hung insert returns and later ones are instant
+	faults.clear("", "test")
+	c.Advance(time.Hour)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("only %d of %d keys stored after the outage", stored.Load(), total)
+	}
+	if found.Load() != total {
+		t.Fatalf("generation did not resume: %d of %d found", found.Load(), total)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > 8 {
+		t.Errorf("%d keys were buffered at once, past the cap of 8", peak)
+	}
+	if n, full := queued(p); n != 0 || full {
+		t.Errorf("after draining: %d queued, full %v", n, full)
+	}
+}
+
+// TestMatcherWaitsWithNothingToGrind asks for a key with every pattern at
+// its quota: the matcher waits between asks instead of spinning.
+func TestMatcherWaitsWithNothingToGrind(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	var asked atomic.Int32
+	need := func() []string { asked.Add(1); return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		_, ok := (&matcher{}).next(ctx, need)
+		done <- ok
+	}()
+
+	c.BlockUntil(t, 1)
+	if n := asked.Load(); n != 1 {
+		t.Fatalf("asked %d times before the first wait, want 1", n)
+	}
+	c.Advance(matcherIdleWait)
+	c.BlockUntil(t, 1)
+	if n := asked.Load(); n != 2 {
+		t.Fatalf("asked %d times after one wait, want 2", n)
+	}
+	cancel()
+	if <-done {
+		t.Fatal("next found a key after the cycle ended")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+
+	"solana-key-gen/keygen"
+)
+
+// matchPredicate is a match rule the pattern syntax cannot express, such as
+// a customer's scoring function, ground for by MATCH_MODE=predicate
+// patterns named "@name". Match has the contract of keygen.Pattern.Match,
+// which the suffix, prefix, contains and edit patterns implement too: it
+// sees each candidate address and must not keep it. Attempts is the
+// expected candidates per match, which targets and estimates need and a
+// predicate cannot be inspected for.
+type matchPredicate struct {
+	Name     string
+	Attempts float64
+	Match    func(addr string) bool
+	// Source is "builtin" or the WASM module's path.
+	Source string
+}
+
+// defaultPredicateAttempts stands in for a predicate's unknown Attempts.
+const defaultPredicateAttempts = 1e6
+
+var (
+	predicatesMu sync.Mutex
+	predicates   = map[string]matchPredicate{}
+)
+
+// registerPredicate makes p available as "@"+p.Name. Compiled-in predicates
+// call it from an init function; they run in-process like the built-in
+// patterns, so unlike WASM ones they are neither sandboxed nor timed.
+func registerPredicate(p matchPredicate) error {
+	predicatesMu.Lock()
+	defer predicatesMu.Unlock()
+	if p.Name == "" || strings.ContainsAny(p.Name, ",: ") {
+		return fmt.Errorf("invalid predicate name %q", p.Name)
+	}
+	if _, dup := predicates[p.Name]; dup {
+		return fmt.Errorf("predicate %q registered twice", p.Name)
+	}
+	if p.Attempts <= 0 {
+		p.Attempts = defaultPredicateAttempts
+	}
+	predicates[p.Name] = p
+	return nil
+}
+
+func lookupPredicate(name string) (matchPredicate, bool) {
+	predicatesMu.Lock()
+	defer predicatesMu.Unlock()
+	p, ok := predicates[name]
+	return p, ok
+}
+
+// parsePredicateName returns the predicate of a "@name" pattern name.
+func parsePredicateName(name string) (string, bool) {
+	return strings.CutPrefix(name, "@")
+}
+
+// parsePredicatePatterns parses PREDICATES, "name" or "name:target"
+// entries naming registered predicates.
+func parsePredicatePatterns(spec string) ([]pattern, error) {
+	var out []pattern
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, target := entry, 0
+		if n, t, ok := strings.Cut(entry, ":"); ok {
+			var err error
+			if target, err = strconv.Atoi(t); err != nil || target < 1 {
+				return nil, fmt.Errorf("invalid target in %q", entry)
+			}
+			name = n
+		}
+		if _, ok := lookupPredicate(name); !ok {
+			return nil, fmt.Errorf("unknown predicate %q; register it or load it with PREDICATE_WASM", name)
+		}
+		out = append(out, pattern{Predicate: name, Target: target, Source: "env:PREDICATES"})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("MATCH_MODE=predicate needs PREDICATES")
+	}
+	return out, nil
+}
+
+// predicatePattern is the generator pattern for predicate name. An unknown
+// predicate, e.g. on an agent without the coordinator's PREDICATE_WASM,
+// never matches.
+func predicatePattern(name string) keygen.Pattern {
+	p, ok := lookupPredicate(name)
+	if !ok {
+		log.Printf("Predicate %q is not registered here, it will never match\n", name)
+		return keygen.Pattern{Name: "@" + name, Match: func(string) bool { return false }}
+	}
+	return keygen.Pattern{Name: "@" + name, Match: p.Match}
+}
+
+// WASM predicates are modules without imports, so they can reach nothing
+// but their own memory, limited to wasmMemoryPages of 64 KiB. A module
+// exports
+//
+//	memory
+//	addr_buf() -> i32               where the host writes each address
+//	match(len i32) -> i32           nonzero if the address matches
+//	expected_attempts() -> f64      optional, for targets and estimates
+//
+// Every call is limited to PREDICATE_TIMEOUT; one that overruns, or traps,
+// counts as no match and its instance is replaced.
+const wasmMemoryPages = 16
+
+// wasmPredicate pools instances of one compiled module, one per concurrent
+// caller, so generator workers never share an instance.
+type wasmPredicate struct {
+	name    string
+	rt      wazero.Runtime
+	mod     wazero.CompiledModule
+	timeout time.Duration
+	pool    sync.Pool
+}
+
+// wasmInstance is one instantiated module. Its context is cancelled by
+// the timer when a call overruns, which closes the module for good.
+type wasmInstance struct {
+	mod    api.Module
+	match  api.Function
+	buf    uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+	stack  [1]uint64
+}
+
+// loadWASMPredicates compiles PREDICATE_WASM entries of the form
+// "name=path.wasm" and registers them.
+func loadWASMPredicates(ctx context.Context, spec string, timeout time.Duration) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("want name=path.wasm in %q", entry)
+		}
+		p, err := loadWASMPredicate(ctx, name, path, timeout)
+		if err != nil {
+			return fmt.Errorf("predicate %q: %w", name, err)
+		}
+		if err := registerPredicate(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadWASMPredicate(ctx context.Context, name, path string, timeout time.Duration) (matchPredicate, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return matchPredicate{}, err
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmMemoryPages))
+	mod, err := rt.CompileModule(ctx, code)
+	if err != nil {
+		rt.Close(ctx)
+		return matchPredicate{}, err
+	}
+	if imports := mod.ImportedFunctions(); len(imports) > 0 {
+		rt.Close(ctx)
+		module, fn, _ := imports[0].Import()
+		return matchPredicate{}, fmt.Errorf("imports %s.%s; predicates may not import anything", module, fn)
+	}
+	w := &wasmPredicate{name: name, rt: rt, mod: mod, timeout: timeout}
+
+	// Instantiating once checks the exports and reads expected_attempts
+	inst, err := w.instantiate(ctx)
+	if err != nil {
+		rt.Close(ctx)
+		return matchPredicate{}, err
+	}
+	attempts := 0.0
+	if fn := inst.mod.ExportedFunction("expected_attempts"); fn != nil {
+		res, err := fn.Call(inst.ctx)
+		if err != nil || len(res) != 1 {
+			rt.Close(ctx)
+			return matchPredicate{}, fmt.Errorf("expected_attempts: %v", err)
+		}
+		attempts = api.DecodeF64(res[0])
+	} else {
+		log.Printf("WARN predicate %q exports no expected_attempts, assuming %.3g attempts per key\n", name, defaultPredicateAttempts)
+	}
+	w.pool.Put(inst)
+	return matchPredicate{Name: name, Attempts: attempts, Match: w.Match, Source: path}, nil
+}
+
+func (w *wasmPredicate) instantiate(ctx context.Context) (*wasmInstance, error) {
+	ictx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	mod, err := w.rt.InstantiateModule(ictx, w.mod, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	inst := &wasmInstance{mod: mod, match: mod.ExportedFunction("match"), ctx: ictx, cancel: cancel}
+	addrBuf := mod.ExportedFunction("addr_buf")
+	if inst.match == nil || addrBuf == nil || mod.Memory() == nil {
+		mod.Close(ictx)
+		cancel()
+		return nil, errors.New("module must export memory, addr_buf and match")
+	}
+	res, err := addrBuf.Call(ictx)
+	if err != nil || len(res) != 1 {
+		mod.Close(ictx)
+		cancel()
+		return nil, fmt.Errorf("addr_buf: %v", err)
+	}
+	inst.buf = api.DecodeU32(res[0])
+	inst.timer = time.AfterFunc(time.Hour, cancel)
+	inst.timer.Stop()
+	return inst, nil
+}
+
+// Match runs the module's match on addr within the timeout.
+func (w *wasmPredicate) Match(addr string) bool {
+	inst, _ := w.pool.Get().(*wasmInstance)
+	if inst == nil {
+		var err error
+		if inst, err = w.instantiate(context.Background()); err != nil {
+			predicateFailuresTotal.WithLabelValues(w.name, "instantiate").Inc()
+			return false
+		}
+	}
+	// Write copies, so a read-only view of addr is enough
+	if !inst.mod.Memory().Write(inst.buf, unsafe.Slice(unsafe.StringData(addr), len(addr))) {
+		predicateFailuresTotal.WithLabelValues(w.name, "trap").Inc()
+		w.discard(inst)
+		return false
+	}
+	inst.stack[0] = api.EncodeI32(int32(len(addr)))
+	inst.timer.Reset(w.timeout)
+	err := inst.match.CallWithStack(inst.ctx, inst.stack[:])
+	if !inst.timer.Stop() {
+		predicateFailuresTotal.WithLabelValues(w.name, "timeout").Inc()
+		w.discard(inst)
+		return false
+	}
+	if err != nil {
+		predicateFailuresTotal.WithLabelValues(w.name, "trap").Inc()
+		w.discard(inst)
+		return false
+	}
+	matched := api.DecodeI32(inst.stack[0]) != 0
+	w.pool.Put(inst)
+	return matched
+}
+
+func (w *wasmPredicate) discard(inst *wasmInstance) {
+	inst.mod.Close(context.Background())
+	inst.cancel()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// prewarmPoll is how often a running fill notices prewarms set or
+// cancelled elsewhere; between cycles they are reread every cycle.
+const prewarmPoll = 5 * time.Second
+
+// PoolPrewarm raises a pattern's target to Target, once: it ends when the
+// pool reaches it, at Until, or when cancelled, and the pattern's own
+// target applies again. At most one per pattern.
+type PoolPrewarm struct {
+	Pattern   string     `gorm:"column:pattern;primaryKey" json:"pattern"`
+	Target    int64      `gorm:"column:target;not null" json:"target"`
+	Until     *time.Time `gorm:"column:until" json:"until,omitempty"`
+	StartedAt time.Time  `gorm:"column:started_at" json:"started_at"`
+	StartedBy string     `gorm:"column:started_by" json:"started_by,omitempty"`
+}
+
+func (PoolPrewarm) TableName() string { return "pool_prewarm" }
+
+// status is how GET /v1/stats describes the prewarm of a pool of n.
+func (p PoolPrewarm) status(n int64) string {
+	return fmt.Sprintf("prewarm in progress (built %d/%d)", n, p.Target)
+}
+
+// SetPrewarm starts a prewarm, replacing any the pattern already has.
+func (s *gormStore) SetPrewarm(ctx context.Context, p PoolPrewarm) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&p).Error
+	return ctxError(ctx, "set prewarm", err)
+}
+
+// EndPrewarm removes pattern's prewarm. With startedAt set, only the
+// prewarm started then is removed, so ending a finished one cannot remove
+// a newer one set meanwhile.
+func (s *gormStore) EndPrewarm(ctx context.Context, pattern string, startedAt *time.Time) (bool, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	q := db.Where("pattern = ?", pattern)
+	if startedAt != nil {
+		q = q.Where("started_at = ?", *startedAt)
+	}
+	res := q.Delete(&PoolPrewarm{})
+	return res.RowsAffected > 0, ctxError(ctx, "end prewarm", res.Error)
+}
+
+func (s *gormStore) Prewarms(ctx context.Context) ([]PoolPrewarm, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var out []PoolPrewarm
+	err := db.Order("pattern").Find(&out).Error
+	return out, ctxError(ctx, "prewarms", err)
+}
+
+// prewarmBook caches the prewarms for the fill loop and ends those that
+// are built or expired. A nil book prewarms nothing.
+type prewarmBook struct {
+	store *gormStore
+
+	mu     sync.Mutex
+	active map[string]PoolPrewarm
+	loaded time.Time
+}
+
+func newPrewarmBook(store *gormStore) *prewarmBook {
+	return &prewarmBook{store: store, active: map[string]PoolPrewarm{}}
+}
+
+// Refresh reloads the prewarms and ends each one whose pool, by counts,
+// is built or whose Until has passed.
+func (b *prewarmBook) Refresh(ctx context.Context, counts map[string]int64) error {
+	if b == nil {
+		return nil
+	}
+	all, err := b.store.Prewarms(ctx)
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	active := make(map[string]PoolPrewarm, len(all))
+	ended := map[string]bool{}
+	for _, p := range all {
+		n, counted := counts[p.Pattern]
+		var why string
+		switch {
+		case p.Until != nil && !p.Until.After(now):
+			why = fmt.Sprintf("expired at %s, built %d/%d", p.Until.Format(time.RFC3339), n, p.Target)
+		case counted && n >= p.Target:
+			why = fmt.Sprintf("done, built %d/%d", n, p.Target)
+		}
+		if why == "" {
+			active[p.Pattern] = p
+			continue
+		}
+		// Another instance may end it first; either way it is over
+		if _, err := b.store.EndPrewarm(ctx, p.Pattern, &p.StartedAt); err != nil {
+			return err
+		}
+		log.Printf("Prewarm of %q %s\n", p.Pattern, why)
+		ended[p.Pattern] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, p := range active {
+		if old, ok := b.active[name]; !ok || !old.StartedAt.Equal(p.StartedAt) {
+			log.Printf("Prewarming %q to %d unpicked keys\n", name, p.Target)
+		}
+	}
+	for name := range b.active {
+		if _, ok := active[name]; !ok && !ended[name] {
+			log.Printf("Prewarm of %q cancelled, back to its own target\n", name)
+		}
+	}
+	b.active, b.loaded = active, now
+	return nil
+}
+
+// Poll is Refresh at most every prewarmPoll, for use mid-fill. It reports
+// whether the prewarms were reloaded.
+func (b *prewarmBook) Poll(ctx context.Context, counts map[string]int64) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	due := clock.Now().Sub(b.loaded) >= prewarmPoll
+	b.mu.Unlock()
+	if !due {
+		return false
+	}
+	if err := b.Refresh(ctx, counts); err != nil {
+		log.Println("Error reading prewarms:", err)
+		return false
+	}
+	return true
+}
+
+// Apply returns patterns with each prewarmed target raised to its
+// prewarm's.
+func (b *prewarmBook) Apply(patterns []pattern) []pattern {
+	if b == nil {
+		return patterns
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]pattern, len(patterns))
+	for i, p := range patterns {
+		if pw, ok := b.active[p.Name()]; ok && pw.Target > int64(p.Target) {
+			p.Target = int(pw.Target)
+		}
+		out[i] = p
+	}
+	return out
+}
+
+// prewarmRequest is the body of POST /v1/admin/prewarm: a pattern and
+// either Count, an absolute target, or Add, keys on top of the pattern's
+// own target. Until defaults to the end of the pattern's campaign window.
+type prewarmRequest struct {
+	Pattern string `json:"pattern"`
+	Count   int64  `json:"count,omitempty"`
+	Add     int64  `json:"add,omitempty"`
+	Until   string `json:"until,omitempty"`
+}
+
+func (s *server) handlePrewarmList(w http.ResponseWriter, r *http.Request) {
+	prewarms, err := s.store.Prewarms(r.Context())
+	if err != nil {
+		log.Println("Error reading prewarms:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read prewarms", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"prewarms": prewarms})
+}
+
+// handlePrewarm serves POST /v1/admin/prewarm. A prewarm that would take
+// the pattern past its lifetime quota is refused rather than left to stall
+// at the cap. Fill loops pick it up on their next cycle, or within
+// prewarmPoll of a running fill.
+func (s *server) handlePrewarm(w http.ResponseWriter, r *http.Request) {
+	var req prewarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Pattern == "" {
+		writeError(w, http.StatusBadRequest, "invalid_body", `request body must be JSON with a "pattern"`, nil)
+		return
+	}
+	var p *pattern
+	for i := range s.patterns {
+		if s.patterns[i].Name() == req.Pattern {
+			p = &s.patterns[i]
+		}
+	}
+	if p == nil {
+		writeError(w, http.StatusNotFound, "unknown_pattern", "no such pattern is configured", nil)
+		return
+	}
+	if (req.Count > 0) == (req.Add > 0) || req.Count < 0 || req.Add < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_prewarm", `give one of "count", a target, or "add", keys on top of the pattern's target`, nil)
+		return
+	}
+	target := cmp.Or(req.Count, int64(p.Target)+req.Add)
+	if target <= int64(p.Target) {
+		writeError(w, http.StatusBadRequest, "invalid_prewarm", fmt.Sprintf("count must be above %q's target of %d", p.Name(), p.Target), nil)
+		return
+	}
+	until := p.ValidUntil
+	if req.Until != "" {
+		t, err := parseCampaignTime(req.Until)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_until", "until must be an RFC 3339 time or a date", nil)
+			return
+		}
+		until = t
+	}
+	if until != nil && !until.After(clock.Now()) {
+		writeError(w, http.StatusBadRequest, "invalid_until", "until must be in the future", nil)
+		return
+	}
+
+	unpicked, err := s.store.CountUnpicked(r.Context(), p.Name())
+	if err == nil {
+		var stats []PatternStat
+		if stats, err = s.store.PatternStats(r.Context()); err == nil {
+			for _, st := range stats {
+				if st.Pattern != p.Name() || st.MaxTotalKeys == nil {
+					continue
+				}
+				if left := *st.MaxTotalKeys - st.Generated; target-unpicked > left {
+					writeError(w, http.StatusConflict, "prewarm_exceeds_quota", fmt.Sprintf("building %d more keys would pass %q's lifetime quota, which allows %d more",
+						target-unpicked, p.Name(), max(0, left)), map[string]any{"max_total_keys": *st.MaxTotalKeys, "generated": st.Generated})
+					return
+				}
+			}
+		}
+	}
+	if err != nil {
+		log.Println("Error checking prewarm against the quota:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to check the pattern's quota", nil)
+		return
+	}
+
+	pw := PoolPrewarm{Pattern: p.Name(), Target: target, Until: until, StartedAt: clock.Now().UTC().Truncate(time.Microsecond),
+		StartedBy: tokenFromContext(r.Context()).Name}
+	if err := s.store.SetPrewarm(r.Context(), pw); err != nil {
+		log.Println("Error setting prewarm:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to set prewarm", nil)
+		return
+	}
+	audit(r.Context(), "prewarm_set", "pattern="+pw.Pattern+" target="+strconv.FormatInt(target, 10))
+	writeJSON(w, http.StatusOK, map[string]any{"prewarm": pw, "unpicked": unpicked, "status": pw.status(unpicked)})
+}
+
+// handlePrewarmCancel serves DELETE /v1/admin/prewarm?pattern=. Keys
+// already built stay in the pool; a running fill stops building for it
+// within prewarmPoll, dropping keys it finds past the pattern's own target
+// as surplus.
+func (s *server) handlePrewarmCancel(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("pattern")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "invalid_pattern", "pattern is required", nil)
+		return
+	}
+	ended, err := s.store.EndPrewarm(r.Context(), name, nil)
+	if err != nil {
+		log.Println("Error cancelling prewarm:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to cancel prewarm", nil)
+		return
+	}
+	if !ended {
+		writeError(w, http.StatusNotFound, "no_prewarm", "the pattern has no prewarm in progress", nil)
+		return
+	}
+	audit(r.Context(), "prewarm_cancel", "pattern="+name)
+	writeJSON(w, http.StatusOK, map[string]any{"pattern": name, "status": "cancelled"})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// poolProfile is a named set of pool policies patterns can share instead
+// of repeating each knob, e.g. small just-in-time pools for cheap patterns
+// and deep ones for expensive patterns. Zero fields leave the global
+// setting in place.
+type poolProfile struct {
+	Name         string
+	Target       int     // unpicked keys to keep, as in SUFFIXES' pattern:target
+	LowPool      float64 // low_pool watermark, as in LOW_POOL_FRACTION
+	Workers      int     // dedicated workers, as in WORKERS_PER_PATTERN
+	MaxTotalKeys int64   // lifetime cap, as in PATTERN_QUOTAS
+}
+
+// parsePoolProfiles parses PATTERN_PROFILES: semicolon-separated
+// "name:knob=value,..." profiles with knobs target, low_pool, workers and
+// max_total_keys.
+func parsePoolProfiles(spec string) (map[string]poolProfile, error) {
+	out := map[string]poolProfile{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, knobs, _ := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("profile without a name in %q", entry)
+		}
+		if _, dup := out[name]; dup {
+			return nil, fmt.Errorf("profile %q defined twice", name)
+		}
+		pr := poolProfile{Name: name}
+		for _, kv := range strings.Split(knobs, ",") {
+			kv = strings.TrimSpace(kv)
+			if kv == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("profile %q: want knob=value in %q", name, kv)
+			}
+			var err error
+			switch k {
+			case "target":
+				pr.Target, err = strconv.Atoi(v)
+				if err == nil && pr.Target < 1 {
+					err = errors.New("must be positive")
+				}
+			case "low_pool":
+				pr.LowPool, err = strconv.ParseFloat(v, 64)
+				if err == nil && (pr.LowPool <= 0 || pr.LowPool > 1) {
+					err = errors.New("must be in (0, 1]")
+				}
+			case "workers":
+				pr.Workers, err = strconv.Atoi(v)
+				if err == nil && pr.Workers < 1 {
+					err = errors.New("must be positive")
+				}
+			case "max_total_keys":
+				pr.MaxTotalKeys, err = strconv.ParseInt(v, 10, 64)
+				if err == nil && pr.MaxTotalKeys < 1 {
+					err = errors.New("must be positive")
+				}
+			default:
+				return nil, fmt.Errorf("profile %q: unknown knob %q, want target, low_pool, workers or max_total_keys", name, k)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: invalid %s %q: %w", name, k, v, err)
+			}
+		}
+		out[name] = pr
+	}
+	return out, nil
+}
+
+// applyPoolProfiles assigns profiles to patterns from PATTERN_PROFILE
+// entries of the form "pattern=profile". A profile's target only applies
+// to patterns without one of their own; its workers and max_total_keys are
+// recorded on the pattern for addProfileWorkers and addProfileQuotas.
+func applyPoolProfiles(spec string, profiles map[string]poolProfile, patterns []pattern) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, profile, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("want pattern=profile in %q", entry)
+		}
+		pr, ok := profiles[profile]
+		if !ok {
+			return fmt.Errorf("pattern %q references undefined profile %q", name, profile)
+		}
+		found := false
+		for i := range patterns {
+			p := &patterns[i]
+			if p.Name() != name {
+				continue
+			}
+			found = true
+			p.Profile = pr.Name
+			if p.Target == 0 {
+				p.Target = pr.Target
+			}
+			p.LowPool, p.profileWorkers, p.profileQuota = pr.LowPool, pr.Workers, pr.MaxTotalKeys
+		}
+		if !found {
+			return fmt.Errorf("profile for unknown pattern %q", name)
+		}
+	}
+	return nil
+}
+
+// addProfileWorkers adds the profile worker pool sizes of patterns not
+// sized by WORKERS_PER_PATTERN, which wins.
+func addProfileWorkers(patterns []pattern, sizes map[string]int) {
+	for _, p := range patterns {
+		if _, set := sizes[p.Name()]; !set && p.profileWorkers > 0 {
+			sizes[p.Name()] = p.profileWorkers
+		}
+	}
+}
+
+// addProfileQuotas adds the profile caps of patterns not capped by
+// PATTERN_QUOTAS, which wins.
+func addProfileQuotas(patterns []pattern, caps map[string]int64) {
+	for _, p := range patterns {
+		if _, set := caps[p.Name()]; !set && p.profileQuota > 0 {
+			caps[p.Name()] = p.profileQuota
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"filippo.io/edwards25519"
+	"github.com/mr-tron/base58/base58"
+)
+
+// pubkeyError describes why an externally supplied public key was rejected.
+type pubkeyError struct {
+	Input      string
+	Problem    string
+	Suggestion string
+}
+
+func (e *pubkeyError) Error() string {
+	msg := fmt.Sprintf("invalid public key %q: %s", e.Input, e.Problem)
+	if e.Suggestion != "" {
+		msg += fmt.Sprintf(" (did you mean %s?)", e.Suggestion)
+	}
+	return msg
+}
+
+// validatePublicKey checks that s is a base58 encoding of exactly 32 bytes
+// and, when onCurve is set, that the bytes are a valid ed25519 point.
+func validatePublicKey(s string, onCurve bool) error {
+	if s == "" {
+		return &pubkeyError{Input: s, Problem: "empty"}
+	}
+	for i, r := range s {
+		if !isBase58(r) {
+			return &pubkeyError{Input: s, Problem: fmt.Sprintf("character %q at position %d is not base58", r, i)}
+		}
+	}
+	b, err := base58.Decode(s)
+	if err != nil {
+		return &pubkeyError{Input: s, Problem: "not valid base58"}
+	}
+	if len(b) != 32 {
+		return &pubkeyError{Input: s, Problem: fmt.Sprintf("decodes to %d bytes, want 32", len(b))}
+	}
+	if onCurve {
+		if _, err := new(edwards25519.Point).SetBytes(b); err != nil {
+			return &pubkeyError{Input: s, Problem: "not on the ed25519 curve"}
+		}
+	}
+	return nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func isBase58(r rune) bool {
+	for _, c := range base58Alphabet {
+		if r == c {
+			return true
+		}
+	}
+	return false
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// closestKey returns the candidate within maxDist edits of s, if any.
+func closestKey(s string, candidates []string, maxDist int) string {
+	best, bestDist := "", maxDist+1
+	for _, c := range candidates {
+		if d := levenshtein(s, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
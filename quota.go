@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// PatternStat is a pattern's lifetime generation counter and optional cap.
+// Generated only ever grows: keys later picked, expired or purged still
+// count, which is what a compute budget needs.
+type PatternStat struct {
+	Pattern      string    `gorm:"column:pattern;primaryKey" json:"pattern"`
+	Generated    int64     `gorm:"column:generated;not null;default:0" json:"generated"`
+	MaxTotalKeys *int64    `gorm:"column:max_total_keys" json:"max_total_keys"`
+	UpdatedAt    time.Time `gorm:"column:updated_at" json:"updated_at"`
+	UpdatedBy    string    `gorm:"column:updated_by" json:"updated_by,omitempty"`
+}
+
+func (PatternStat) TableName() string { return "pattern_stats" }
+
+// parsePatternQuotas parses PATTERN_QUOTAS entries of the form
+// "pattern=max_total_keys".
+func parsePatternQuotas(spec string, patterns []pattern) (map[string]int64, error) {
+	out := map[string]int64{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("want pattern=max_total_keys in %q", entry)
+		}
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("max_total_keys in %q must be a positive integer", entry)
+		}
+		found := false
+		for _, p := range patterns {
+			found = found || p.Name() == name
+		}
+		if !found {
+			return nil, fmt.Errorf("quota for unknown pattern %q", name)
+		}
+		out[name] = n
+	}
+	return out, nil
+}
+
+// CountGenerated adds one to pattern's lifetime counter.
+func (s *gormStore) CountGenerated(ctx context.Context, pattern string) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+	err := db.Exec(`INSERT INTO pattern_stats (pattern, generated, updated_at) VALUES (?, 1, now())
+		ON CONFLICT (pattern) DO UPDATE SET generated = pattern_stats.generated + 1`, pattern).Error
+	return ctxError(ctx, "count generated", err)
+}
+
+// SeedQuotas stores caps for patterns that have none yet. Caps already
+// stored, including ones an admin changed, are left alone.
+func (s *gormStore) SeedQuotas(ctx context.Context, caps map[string]int64) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	for pattern, n := range caps {
+		err := db.Exec(`INSERT INTO pattern_stats (pattern, generated, max_total_keys, updated_at, updated_by)
+			VALUES (?, 0, ?, now(), 'env:PATTERN_QUOTAS')
+			ON CONFLICT (pattern) DO UPDATE SET max_total_keys = ?, updated_at = now(), updated_by = 'env:PATTERN_QUOTAS'
+			WHERE pattern_stats.max_total_keys IS NULL`, pattern, n, n).Error
+		if err != nil {
+			return ctxError(ctx, "seed quotas", err)
+		}
+	}
+	return nil
+}
+
+// SetQuota sets pattern's cap, or removes it if max is nil.
+func (s *gormStore) SetQuota(ctx context.Context, pattern string, max *int64, actor string) (PatternStat, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	st := PatternStat{Pattern: pattern, MaxTotalKeys: max, UpdatedAt: clock.Now(), UpdatedBy: actor}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "pattern"}},
+		DoUpdates: clause.AssignmentColumns([]string{"max_total_keys", "updated_at", "updated_by"}),
+	}).Create(&st).Error
+	if err == nil {
+		err = db.Where("pattern = ?", pattern).Take(&st).Error
+	}
+	return st, ctxError(ctx, "set quota", err)
+}
+
+func (s *gormStore) PatternStats(ctx context.Context) ([]PatternStat, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var out []PatternStat
+	err := db.Order("pattern").Find(&out).Error
+	return out, ctxError(ctx, "pattern stats", err)
+}
+
+// quotaBook caches the pattern stats for the fill loop, which refreshes it
+// each cycle and counts its own inserts in between. A nil book caps
+// nothing.
+type quotaBook struct {
+	store    *gormStore
+	alertURL string
+
+	mu       sync.Mutex
+	stats    map[string]PatternStat
+	notified map[string]bool
+}
+
+func newQuotaBook(store *gormStore, alertURL string) *quotaBook {
+	return &quotaBook{store: store, alertURL: alertURL, stats: map[string]PatternStat{}, notified: map[string]bool{}}
+}
+
+// Refresh reloads the stats, so caps raised at runtime take effect.
+func (q *quotaBook) Refresh(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	stats, err := q.store.PatternStats(ctx)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats = make(map[string]PatternStat, len(stats))
+	for _, st := range stats {
+		q.stats[st.Pattern] = st
+		if !q.reached(st.Pattern) {
+			q.notified[st.Pattern] = false
+			patternQuotaReached.WithLabelValues(st.Pattern).Set(0)
+		}
+	}
+	return nil
+}
+
+// Counted notes one more key generated for pattern.
+func (q *quotaBook) Counted(pattern string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	st := q.stats[pattern]
+	st.Generated++
+	q.stats[pattern] = st
+	q.mu.Unlock()
+}
+
+// Admit counts one more key for pattern if it is still under its cap,
+// reporting whether it was; a key it admits but that is then not stored is
+// given back with Uncount. Checking and counting at once keeps concurrent
+// agent finds from overshooting the cap together.
+func (q *quotaBook) Admit(ctx context.Context, pattern string) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	ok := !q.reached(pattern)
+	if ok {
+		st := q.stats[pattern]
+		st.Generated++
+		q.stats[pattern] = st
+	}
+	q.mu.Unlock()
+	if !ok {
+		// Notifies, once, that the cap is reached
+		q.Allowed(ctx, []string{pattern})
+	}
+	return ok
+}
+
+// Uncount gives back a key Admit counted.
+func (q *quotaBook) Uncount(pattern string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	st := q.stats[pattern]
+	st.Generated--
+	q.stats[pattern] = st
+	q.mu.Unlock()
+}
+
+// reached must be called with q.mu held.
+func (q *quotaBook) reached(pattern string) bool {
+	st := q.stats[pattern]
+	return st.MaxTotalKeys != nil && st.Generated >= *st.MaxTotalKeys
+}
+
+// Allowed returns the patterns of names still under their cap, notifying
+// once for each pattern that has reached it.
+func (q *quotaBook) Allowed(ctx context.Context, names []string) []string {
+	if q == nil {
+		return names
+	}
+	var out []string
+	var capped []PatternStat
+	q.mu.Lock()
+	for _, n := range names {
+		if !q.reached(n) {
+			out = append(out, n)
+			continue
+		}
+		if !q.notified[n] {
+			q.notified[n] = true
+			capped = append(capped, q.stats[n])
+		}
+	}
+	q.mu.Unlock()
+
+	for _, st := range capped {
+		n := st.Pattern
+		patternQuotaReached.WithLabelValues(n).Set(1)
+		log.Printf("ALERT quota reached: %q has generated %d of its %d lifetime keys, no longer generating for it\n",
+			n, st.Generated, *st.MaxTotalKeys)
+		if q.alertURL != "" {
+			payload := map[string]any{"event": "quota_reached", "pattern": n, "generated": st.Generated,
+				"max_total_keys": *st.MaxTotalKeys, "at": clock.Now()}
+			if err := postAlert(ctx, q.alertURL, payload); err != nil {
+				log.Println("Error sending quota alert:", err)
+			}
+		}
+	}
+	return out
+}
+
+// handleQuotaList serves GET /v1/admin/quotas.
+func (s *server) handleQuotaList(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.store.PatternStats(r.Context())
+	if err != nil {
+		log.Println("Error reading pattern stats:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to read quotas", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"quotas": stats})
+}
+
+// handleQuotaSet serves POST /v1/admin/quotas, setting a pattern's
+// max_total_keys; null removes the cap. The fill loop picks it up on its
+// next cycle.
+func (s *server) handleQuotaSet(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pattern      string `json:"pattern"`
+		MaxTotalKeys *int64 `json:"max_total_keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Pattern == "" {
+		writeError(w, http.StatusBadRequest, "invalid_body", `request body must be JSON with a "pattern"`, nil)
+		return
+	}
+	if req.MaxTotalKeys != nil && *req.MaxTotalKeys < 1 {
+		writeError(w, http.StatusBadRequest, "invalid_max_total_keys", "max_total_keys must be positive, or null for no cap", nil)
+		return
+	}
+	known := false
+	for _, p := range s.patterns {
+		known = known || p.Name() == req.Pattern
+	}
+	if !known {
+		writeError(w, http.StatusNotFound, "unknown_pattern", "no such pattern is configured", nil)
+		return
+	}
+
+	st, err := s.store.SetQuota(r.Context(), req.Pattern, req.MaxTotalKeys, tokenFromContext(r.Context()).Name)
+	if err != nil {
+		log.Println("Error setting quota:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to set quota", nil)
+		return
+	}
+	limit := "none"
+	if req.MaxTotalKeys != nil {
+		limit = strconv.FormatInt(*req.MaxTotalKeys, 10)
+	}
+	audit(r.Context(), "quota_set", "pattern="+req.Pattern+" max_total_keys="+limit)
+	writeJSON(w, http.StatusOK, st)
+}
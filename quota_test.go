@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestQuotaAdmit checks concurrent finds cannot overshoot a cap together
+// and that a find given back frees its place.
+func TestQuotaAdmit(t *testing.T) {
+	limit := int64(5)
+	q := newQuotaBook(nil, "")
+	q.stats["ponz"] = PatternStat{Pattern: "ponz", Generated: 2, MaxTotalKeys: &limit}
+
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if q.Admit(context.Background(), "ponz") {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := admitted.Load(); got != 3 {
+		t.Fatalf("admitted %d finds, want 3 under a cap of 5 with 2 generated", got)
+	}
+
+	q.Uncount("ponz")
+	if !q.Admit(context.Background(), "ponz") {
+		t.Fatal("a given-back place was not admitted")
+	}
+	if q.Admit(context.Background(), "ponz") {
+		t.Fatal("admitted past the cap")
+	}
+	if !q.Admit(context.Background(), "uncapped") {
+		t.Fatal("a pattern without a cap was refused")
+	}
+	var none *quotaBook
+	if !none.Admit(context.Background(), "ponz") {
+		t.Fatal("a nil book refused a find")
+	}
+}
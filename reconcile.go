@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// keyState is what the pool knows about one expected public key.
+type keyState struct {
+	PublicKey      string `json:"public_key"`
+	Status         string `json:"status"` // present, picked, quarantined, migrated or missing
+	MatchedPattern string `json:"matched_pattern,omitempty"`
+}
+
+// KeyStates looks up each public key in pubs, in batches, and reports its
+// state in the same order. Private keys are never read.
+func (s *gormStore) KeyStates(ctx context.Context, pubs []string) ([]keyState, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	type row struct {
+		PublicKey      string
+		IsPicked       bool
+		Quarantined    bool
+		MigratedTo     *string
+		MatchedPattern string
+	}
+	found := make(map[string]row, len(pubs))
+	for start := 0; start < len(pubs); start += 1000 {
+		var rows []row
+		err := db.Model(&TokenKey{}).
+			Select("public_key", "is_picked", "quarantined", "migrated_to", "matched_pattern").
+			Where("public_key IN ?", pubs[start:min(start+1000, len(pubs))]).
+			Scan(&rows).Error
+		if err != nil {
+			return nil, ctxError(ctx, "key states", err)
+		}
+		for _, r := range rows {
+			found[r.PublicKey] = r
+		}
+	}
+
+	out := make([]keyState, 0, len(pubs))
+	for _, pub := range pubs {
+		r, ok := found[pub]
+		st := keyState{PublicKey: pub, Status: "missing", MatchedPattern: r.MatchedPattern}
+		switch {
+		case !ok:
+		case r.Quarantined:
+			st.Status = "quarantined"
+		case r.MigratedTo != nil:
+			st.Status = "migrated"
+		case r.IsPicked:
+			st.Status = "picked"
+		default:
+			st.Status = "present"
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// readExpectedKeys reads one public key per line, skipping blank lines,
+// "#" comments and repeats. Every key must be a valid address.
+func readExpectedKeys(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompressReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var pubs []string
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		pub := strings.TrimSpace(sc.Text())
+		if pub == "" || strings.HasPrefix(pub, "#") || seen[pub] {
+			continue
+		}
+		if err := validatePublicKey(pub, true); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		seen[pub] = true
+		pubs = append(pubs, pub)
+	}
+	return pubs, sc.Err()
+}
+
+// cmdReconcileExpected implements the "reconcile-expected" subcommand. It
+// exits with an error if any expected key is missing from the pool.
+func cmdReconcileExpected(ctx context.Context, store *gormStore, args []string) error {
+	fs := flag.NewFlagSet("reconcile-expected", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	onlyMissing := fs.Bool("missing", false, "only list missing keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: reconcile-expected [-json] [-missing] <file>")
+	}
+
+	pubs, err := readExpectedKeys(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	states, err := store.KeyStates(ctx, pubs)
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	shown := states[:0:0]
+	for _, st := range states {
+		counts[st.Status]++
+		if !*onlyMissing || st.Status == "missing" {
+			shown = append(shown, st)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]any{"keys": shown, "counts": counts}); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "PUBLIC KEY\tSTATUS\tPATTERN")
+		for _, st := range shown {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", st.PublicKey, st.Status, st.MatchedPattern)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d expected: %d present, %d picked, %d quarantined, %d migrated, %d missing\n",
+			len(states), counts["present"], counts["picked"], counts["quarantined"], counts["migrated"], counts["missing"])
+	}
+
+	if counts["missing"] > 0 {
+		return fmt.Errorf("%d expected keys are missing from the pool", counts["missing"])
+	}
+	return nil
+}
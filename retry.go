@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// dbAttempts is how many times a statement runs before a transient
+	// failure is returned to the caller.
+	dbAttempts = 5
+
+	retryBaseDelay = 20 * time.Millisecond
+	retryMaxDelay  = time.Second
+)
+
+// retryable reports whether err is a Postgres failure that succeeds on a
+// plain retry: a serialization failure or a deadlock abort.
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+// uniqueViolation reports whether err is a Postgres unique violation of
+// the public_key or private_key constraint, that is a duplicate key, as
+// opposed to any other failed insert.
+func uniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" &&
+		(strings.Contains(pgErr.ConstraintName, "public_key") || strings.Contains(pgErr.ConstraintName, "private_key"))
+}
+
+// labelViolation reports whether err is a unique violation of the label
+// index: the key is new, but its label was taken.
+func labelViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && strings.Contains(pgErr.ConstraintName, "label")
+}
+
+// withRetry runs fn, retrying transient Postgres failures with capped,
+// jittered exponential backoff. Retries are counted under op.
+func withRetry(ctx context.Context, op string, fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt == dbAttempts {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", op, attempt, err)
+		}
+		dbRetriesTotal.WithLabelValues(op).Inc()
+
+		// full jitter keeps colliding transactions from retrying in lockstep
+		select {
+		case <-ctx.Done():
+			return err
+		case <-clock.After(rand.N(delay) + time.Millisecond):
+		}
+		delay = min(2*delay, retryMaxDelay)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// rngWindow is how long conflict and insert counts accumulate before the
+// rate starts over.
+const rngWindow = time.Hour
+
+// rngMonitor watches the rate of inserts rejected as duplicates. With a
+// working RNG a freshly generated key never repeats, so a conflict rate
+// above threshold means the entropy source is broken and its keys may be
+// predictable. The alarm latches until restart: a failed RNG does not heal.
+// A nil monitor watches nothing.
+type rngMonitor struct {
+	threshold float64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	inserts     int64
+	conflicts   int64
+	suspect     bool
+}
+
+func newRNGMonitor(threshold float64) *rngMonitor {
+	return &rngMonitor{threshold: threshold, windowStart: clock.Now()}
+}
+
+// Observe records one insert attempt of a generated key and whether it
+// conflicted with a stored one.
+func (m *rngMonitor) Observe(conflict bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if clock.Now().Sub(m.windowStart) > rngWindow {
+		m.windowStart, m.inserts, m.conflicts = clock.Now(), 0, 0
+	}
+	m.inserts++
+	if !conflict {
+		return
+	}
+	m.conflicts++
+	rate := float64(m.conflicts) / float64(m.inserts)
+	if rate > m.threshold {
+		if !m.suspect {
+			rngSuspect.Set(1)
+		}
+		m.suspect = true
+		log.Printf("ALERT RNG: %d of %d generated keys in the last %v were already stored (%.4f%%, above RNG_CONFLICT_THRESHOLD %.4f%%); "+
+			"the entropy source may be broken and its keys predictable, stop generating and investigate\n",
+			m.conflicts, m.inserts, rngWindow, 100*rate, 100*m.threshold)
+	}
+}
+
+// Suspect reports whether the conflict rate has ever exceeded the threshold.
+func (m *rngMonitor) Suspect() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.suspect
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestRunBadConfig checks that Run reports configuration errors instead of
+// exiting, and leaves the process environment alone.
+func TestRunBadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"invalid suffix", map[string]string{"SUFFIXES": "p0nz"}, "invalid pattern configuration"},
+		{"invalid target", map[string]string{"SUFFIXES": "ponz:0"}, "invalid SUFFIXES"},
+		{"target above maximum", map[string]string{"SUFFIXES": "ponz:100000001"}, "above the 100000000 maximum"},
+		{"unknown match mode", map[string]string{"SUFFIXES": "ponz", "MATCH_MODE": "exact,bogus"}, `unknown MATCH_MODE "bogus"`},
+		{"profile without config file", map[string]string{"PROFILE": "prod", "CONFIG_FILE": ""}, "needs a CONFIG_FILE"},
+		{"no database", map[string]string{"SUFFIXES": "ponz", "DATABASE_URL": ""}, "DATABASE_URL environment variable is not set"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Run(context.Background(), Config{Env: tc.env})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Run = %v, want an error containing %q", err, tc.want)
+			}
+			for name, val := range tc.env {
+				if got, ok := os.LookupEnv(name); ok && got == val && val != "" {
+					t.Errorf("Run set %s in the process environment", name)
+				}
+			}
+		})
+	}
+}
+
+// TestRunDemo starts the in-memory demo through Run and stops it by
+// cancelling the context.
+func TestRunDemo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, Config{Demo: true, Env: map[string]string{"DATABASE_URL": ""}}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned before being stopped: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run = %v after cancel, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not stop after its context was cancelled")
+	}
+}
+
+func TestRunDemoRefusesDatabase(t *testing.T) {
+	err := Run(context.Background(), Config{Demo: true, Env: map[string]string{"DATABASE_URL": "postgres://localhost/x"}})
+	if err == nil || !strings.Contains(err.Error(), "DATABASE_URL") {
+		t.Fatalf("Run = %v, want a refusal naming DATABASE_URL", err)
+	}
+}
+
+// testFillConfig is a fill loop configuration storing into store with one
+// worker and none of the optional components.
+func testFillConfig(store KeyStore) fillConfig {
+	return fillConfig{
+		Store:    store,
+		Sleep:    time.Second,
+		Workers:  1,
+		Breaker:  newCircuitBreaker("test", 5, time.Second),
+		Freeze:   &freezeSwitch{},
+		Maint:    newMaintenanceSwitch(false, ""),
+		Stream:   newKeyStream(),
+		AuditLog: nopAuditLogger{},
+	}
+}
+
+// cancellingStore cancels the fill loop's context when counted holding n
+// keys, as a SIGTERM arriving mid-fill would, with the next key perhaps
+// already found.
+type cancellingStore struct {
+	*memStore
+	n      int64
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStore) CountUnpicked(ctx context.Context, pattern string) (int64, error) {
+	c, err := s.memStore.CountUnpicked(ctx, pattern)
+	if c >= s.n {
+		s.cancel()
+	}
+	return c, err
+}
+
+// duplicateStore fails every insert as a STRICT_INSERT store does a public
+// key it already holds, and cancels the fill loop's context at the first
+// count after one.
+type duplicateStore struct {
+	*memStore
+	inserts atomic.Int64
+	cancel  context.CancelFunc
+}
+
+func (s *duplicateStore) Insert(ctx context.Context, key *TokenKey) (bool, error) {
+	s.inserts.Add(1)
+	return false, fmt.Errorf("%w: %s", ErrDuplicateKey, key.PublicKey)
+}
+
+func (s *duplicateStore) CountUnpicked(ctx context.Context, pattern string) (int64, error) {
+	if s.inserts.Load() > 0 {
+		s.cancel()
+	}
+	return s.memStore.CountUnpicked(ctx, pattern)
+}
+
+// TestFillStopsOnStrictDuplicate checks a STRICT_INSERT conflict ends the
+// fill at the first duplicate, is counted as one, and does not trip the
+// circuit breaker as a database failure would.
+func TestFillStopsOnStrictDuplicate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &duplicateStore{memStore: newMemStore(), cancel: cancel}
+	fc := testFillConfig(store)
+	fc.Sleep = time.Millisecond
+	fc.Breaker = newCircuitBreaker("test", 1, time.Minute)
+	conflicts := insertConflictsTotal.WithLabelValues("*")
+	before := testutil.ToFloat64(conflicts)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		maintainUnpickedKeys(ctx, fc, []pattern{{Any: true, Target: 5}}, newFillGovernor(1).Loop("*", 0))
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the fill loop did not stop")
+	}
+
+	if n := store.inserts.Load(); n != 1 {
+		t.Errorf("%d inserts attempted, want the fill to stop at the first duplicate", n)
+	}
+	if got := testutil.ToFloat64(conflicts) - before; got != 1 {
+		t.Errorf("%v conflicts counted, want 1", got)
+	}
+	if st := fc.Breaker.State(); st != breakerClosed {
+		t.Errorf("breaker state = %v, want closed", st)
+	}
+}
+
+// TestFillStopsOnShutdown cancels the fill loop's parent context once the
+// third of five keys is stored: the loop returns without storing another,
+// even one already waiting in the pipeline.
+func TestFillStopsOnShutdown(t *testing.T) {
+	for _, depth := range []int{0, 8} {
+		ctx, cancel := context.WithCancel(context.Background())
+		store := &cancellingStore{memStore: newMemStore(), n: 3, cancel: cancel}
+		fc := testFillConfig(store)
+		fc.Pipeline.Depth = depth
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			maintainUnpickedKeys(ctx, fc, []pattern{{Any: true, Target: 5}}, newFillGovernor(1).Loop("*", 0))
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("pipeline depth %d: the fill loop did not stop after its context was cancelled", depth)
+		}
+		cancel()
+		if n, err := store.memStore.CountUnpicked(context.Background(), "*"); err != nil || n != 3 {
+			t.Errorf("pipeline depth %d: %d keys stored (%v), want the 3 stored before shutdown", depth, n, err)
+		}
+	}
+}
+
+// lateStore is the pool as an instance sees it while another fills it:
+// after its first count, every count and insert waits until the pool
+// holds target keys.
+type lateStore struct {
+	*memStore
+	target int64
+	counts atomic.Int64
+}
+
+func (s *lateStore) waitFull(ctx context.Context, pattern string) {
+	for ctx.Err() == nil {
+		if n, _ := s.memStore.CountUnpicked(ctx, pattern); n >= s.target {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *lateStore) CountUnpicked(ctx context.Context, pattern string) (int64, error) {
+	if s.counts.Add(1) > 1 {
+		s.waitFull(ctx, pattern)
+	}
+	return s.memStore.CountUnpicked(ctx, pattern)
+}
+
+func (s *lateStore) Insert(ctx context.Context, key *TokenKey) (bool, error) {
+	s.waitFull(ctx, key.MatchedPattern)
+	return s.memStore.Insert(ctx, key)
+}
+
+// TestFillOverlap runs two fill loops against one store, as the old and
+// new instance of a rolling deploy do, and checks they stop at the target.
+// With the generation lease only one fills; without it, the late one finds
+// the pool filled behind its back when it rechecks before inserting, and
+// abandons its key.
+func TestFillOverlap(t *testing.T) {
+	const target = 20
+	for _, tc := range []struct {
+		name string
+		ttl  time.Duration
+		late bool
+	}{
+		{"lease", time.Minute, false},
+		{"recheck", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			store := newMemStore()
+			stores := []KeyStore{store, store}
+			if tc.late {
+				stores[1] = &lateStore{memStore: store, target: target}
+			}
+			var wg sync.WaitGroup
+			for i, holder := range []string{"old", "new"} {
+				fc := testFillConfig(stores[i])
+				fc.Lease = fillLease{Holder: holder, TTL: tc.ttl}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					maintainUnpickedKeys(ctx, fc, []pattern{{Any: true, Target: target}}, newFillGovernor(1).Loop("*", 0))
+				}()
+			}
+
+			deadline := time.Now().Add(10 * time.Second)
+			for n, _ := store.CountUnpicked(ctx, "*"); n < target; n, _ = store.CountUnpicked(ctx, "*") {
+				if time.Now().After(deadline) {
+					t.Fatalf("the pool only reached %d of %d", n, target)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			// Give the other loop the chance to overshoot
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			wg.Wait()
+			if n, _ := store.CountUnpicked(context.Background(), "*"); n != target {
+				t.Fatalf("the two loops stored %d keys, want %d", n, target)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ScannerState is the progress of a job walking the whole key table, so a
+// restart resumes its scan where it left off instead of starting over and
+// never reaching the tail. A scan generation covers the keys created
+// before StartedAt; keys inserted during it are left to the next one.
+type ScannerState struct {
+	Scanner    string    `gorm:"column:scanner;primaryKey"`
+	Generation int64     `gorm:"column:generation;not null"`
+	StartedAt  time.Time `gorm:"column:started_at;not null"`
+	// Cursor is the last public key processed in this generation, "" for
+	// none yet.
+	Cursor    string    `gorm:"column:last_key;not null;default:''"`
+	UpdatedAt time.Time `gorm:"column:updated_at"`
+	// CompletedGeneration is the last generation scanned to the end, at
+	// CompletedAt; 0 and nil before the first.
+	CompletedGeneration int64      `gorm:"column:completed_generation;not null;default:0"`
+	CompletedAt         *time.Time `gorm:"column:completed_at"`
+}
+
+func (ScannerState) TableName() string { return "scanner_state" }
+
+// ScanState returns scanner's progress, starting generation 1 if it has
+// never run or a new generation if the last one was completed.
+func (s *gormStore) ScanState(ctx context.Context, scanner string) (ScannerState, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var st ScannerState
+	err := db.Where("scanner = ?", scanner).Take(&st).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		st = ScannerState{Scanner: scanner}
+	} else if err != nil {
+		return ScannerState{}, ctxError(ctx, "read scanner state", err)
+	}
+	if st.Generation == 0 || st.CompletedGeneration == st.Generation {
+		st.Generation++
+		st.StartedAt, st.Cursor = clock.Now().UTC(), ""
+		err = db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&st).Error
+	}
+	return st, ctxError(ctx, "start scan generation", err)
+}
+
+// SaveScanCursor records that scanner's generation has processed every key
+// up to cursor, or, with done, all of them.
+func (s *gormStore) SaveScanCursor(ctx context.Context, st ScannerState, cursor string, done bool) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	updates := map[string]any{"last_key": cursor, "updated_at": clock.Now().UTC()}
+	if done {
+		updates["completed_generation"] = st.Generation
+		updates["completed_at"] = clock.Now().UTC()
+	}
+	err := db.Model(&ScannerState{}).Where("scanner = ? AND generation = ?", st.Scanner, st.Generation).Updates(updates).Error
+	return ctxError(ctx, "save scanner cursor", err)
+}
+
+// ScanStates lists every scanner's progress, for GET /v1/stats.
+func (s *gormStore) ScanStates(ctx context.Context) ([]ScannerState, error) {
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Query)
+	defer cancel()
+	var states []ScannerState
+	err := db.Order("scanner").Find(&states).Error
+	return states, ctxError(ctx, "list scanner states", err)
+}
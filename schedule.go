@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// scheduleWindow is a span of time a scheduled pattern is ground in; a nil
+// bound is open.
+type scheduleWindow struct {
+	From, Until *time.Time
+}
+
+// start is w's beginning, the zero time if it is open.
+func (w scheduleWindow) start() time.Time {
+	if w.From == nil {
+		return time.Time{}
+	}
+	return *w.From
+}
+
+func (w scheduleWindow) contains(t time.Time) bool {
+	return (w.From == nil || !t.Before(*w.From)) && (w.Until == nil || t.Before(*w.Until))
+}
+
+// activeAt reports whether p is ground for at t: always without a schedule,
+// otherwise only inside one of its windows.
+func (p pattern) activeAt(t time.Time) bool {
+	return len(p.Schedule) == 0 || slices.ContainsFunc(p.Schedule, func(w scheduleWindow) bool { return w.contains(t) })
+}
+
+// parseSchedule applies PATTERN_SCHEDULE entries of the form
+// "pattern@from/until" to patterns, e.g. "xmas@2026-12-01/2027-01-01".
+// from and until are RFC 3339 times or dates and either may be left empty
+// for an open window; a pattern may have several. At most one scheduled
+// pattern is active at a time, so windows may touch but not overlap.
+func parseSchedule(spec string, patterns []pattern) error {
+	type named struct {
+		pattern string
+		scheduleWindow
+	}
+	var all []named
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, window, ok := strings.Cut(entry, "@")
+		f, u, ok2 := strings.Cut(window, "/")
+		if !ok || !ok2 {
+			return fmt.Errorf("want pattern@from/until in %q", entry)
+		}
+		var w scheduleWindow
+		var err error
+		if w.From, err = parseCampaignTime(f); err != nil {
+			return fmt.Errorf("invalid from in %q: %w", entry, err)
+		}
+		if w.Until, err = parseCampaignTime(u); err != nil {
+			return fmt.Errorf("invalid until in %q: %w", entry, err)
+		}
+		if w.From != nil && w.Until != nil && !w.Until.After(*w.From) {
+			return fmt.Errorf("window in %q ends before it starts", entry)
+		}
+		i := slices.IndexFunc(patterns, func(p pattern) bool { return p.Name() == name })
+		if i < 0 {
+			return fmt.Errorf("schedule names unknown pattern %q", name)
+		}
+		patterns[i].Schedule = append(patterns[i].Schedule, w)
+		all = append(all, named{name, w})
+	}
+
+	slices.SortFunc(all, func(a, b named) int { return a.start().Compare(b.start()) })
+	for i := 1; i < len(all); i++ {
+		prev, next := all[i-1], all[i]
+		if prev.Until == nil || next.From == nil || prev.Until.After(*next.From) {
+			return fmt.Errorf("windows of %q and %q overlap; which one is active would be ambiguous", prev.pattern, next.pattern)
+		}
+	}
+	return nil
+}
+
+// nextScheduleChange is the first window boundary of patterns after t, or
+// zero if there is none.
+func nextScheduleChange(patterns []pattern, t time.Time) time.Time {
+	var next time.Time
+	for _, p := range patterns {
+		for _, w := range p.Schedule {
+			for _, b := range []*time.Time{w.From, w.Until} {
+				if b != nil && b.After(t) && (next.IsZero() || b.Before(next)) {
+					next = *b
+				}
+			}
+		}
+	}
+	return next
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// snapshotSchemaVersion must be bumped whenever TokenKey changes shape.
+// Snapshots back to minSnapshotSchemaVersion are restored, with what their
+// version lacks filled in by upgradeSnapshot:
+//
+//   - 8 added checksums, recomputed for older snapshots and checked for
+//     newer ones
+//   - 9 added migrated_to; older snapshots predate transfers, so none of
+//     their keys was transferred
+//   - 10 added metadata, which older keys have none of and newer ones must
+//     hold as JSON
+//   - 11 added cluster; keys without one, which older snapshots' all are,
+//     are labelled with CLUSTER as LabelUnclustered would
+//   - 12 added private_key_digest, recomputed for every key as a snapshot
+//     taken before the backfill may lack it
+const (
+	snapshotSchemaVersion    = 12
+	minSnapshotSchemaVersion = 7
+)
+
+type snapshotFile struct {
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	Checksum      string    `json:"checksum"`
+	// Compression is how Data was compressed before it was encrypted: ""
+	// or "gzip" (COMPRESS). Checksum is of the uncompressed data.
+	Compression string `json:"compression,omitempty"`
+	Data        []byte `json:"data"`
+}
+
+type snapshotData struct {
+	// Version is the file's schema version.
+	Version   int        `json:"-"`
+	TokenKeys []TokenKey `json:"token_key"`
+}
+
+// writeSnapshot dumps the pool inside a repeatable-read transaction so the
+// file reflects a single point in time, then compresses it as compress
+// says and encrypts it to path.
+func writeSnapshot(ctx context.Context, db *gorm.DB, key []byte, path, compress string) (int, error) {
+	db = db.WithContext(ctx)
+	var data snapshotData
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Order("created_at").Find(&data.TokenKeys).Error
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("read pool: %w", err)
+	}
+
+	plain, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(plain)
+	// Compressed before sealing: ciphertext does not compress
+	var buf bytes.Buffer
+	zw := compressWriter(&buf, compress)
+	if _, err := zw.Write(plain); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	sealed, err := seal(key, buf.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("encrypt snapshot: %w", err)
+	}
+
+	out, err := json.Marshal(snapshotFile{
+		SchemaVersion: snapshotSchemaVersion,
+		CreatedAt:     clock.Now().UTC(),
+		Checksum:      hex.EncodeToString(sum[:]),
+		Compression:   compress,
+		Data:          sealed,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0o600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	return len(data.TokenKeys), nil
+}
+
+func readSnapshot(key []byte, path string) (snapshotData, error) {
+	var data snapshotData
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return data, err
+	}
+	var f snapshotFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return data, fmt.Errorf("parse snapshot: %w", err)
+	}
+	if f.SchemaVersion < minSnapshotSchemaVersion || f.SchemaVersion > snapshotSchemaVersion {
+		return data, fmt.Errorf("snapshot schema version %d is not one this build restores (%d to %d); restore it with a binary of the matching version",
+			f.SchemaVersion, minSnapshotSchemaVersion, snapshotSchemaVersion)
+	}
+
+	plain, err := unseal(key, f.Data)
+	if err != nil {
+		return data, fmt.Errorf("decrypt snapshot (wrong ENCRYPTION_KEY?): %w", err)
+	}
+	switch f.Compression {
+	case "":
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(plain))
+		if err != nil {
+			return data, fmt.Errorf("decompress snapshot: %w", err)
+		}
+		if plain, err = io.ReadAll(zr); err != nil {
+			return data, fmt.Errorf("decompress snapshot: %w", err)
+		}
+	default:
+		return data, fmt.Errorf("snapshot uses unknown compression %q", f.Compression)
+	}
+	sum := sha256.Sum256(plain)
+	if hex.EncodeToString(sum[:]) != f.Checksum {
+		return data, fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	if err := json.Unmarshal(plain, &data); err != nil {
+		return data, fmt.Errorf("parse snapshot data: %w", err)
+	}
+	data.Version = f.SchemaVersion
+	return data, nil
+}
+
+// upgradeSnapshot fills in the columns data's version predates and checks
+// the ones it records, for restoring on an instance with ENCRYPTION_KEY key
+// serving cluster.
+func upgradeSnapshot(data *snapshotData, key []byte, cluster string) error {
+	for i := range data.TokenKeys {
+		k := &data.TokenKeys[i]
+		priv, err := openPrivateKey(key, k.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("snapshot key %s: %w", k.PublicKey, err)
+		}
+		k.PrivateKeyDigest = privateKeyDigest(key, priv)
+		want := keyChecksum(k.PublicKey)
+		switch {
+		case data.Version < 8:
+			k.Checksum = want
+		case k.Checksum != want:
+			return fmt.Errorf("snapshot key %s has checksum %q, want %s", k.PublicKey, k.Checksum, want)
+		}
+		if k.Metadata != nil && !json.Valid([]byte(*k.Metadata)) {
+			return fmt.Errorf("snapshot key %s has metadata that is not JSON", k.PublicKey)
+		}
+		if k.Cluster == "" {
+			k.Cluster = cluster
+		}
+		if cluster != "" && k.Cluster != cluster {
+			return &clusterError{Declared: cluster, Cluster: k.Cluster, Key: k.PublicKey}
+		}
+	}
+	return nil
+}
+
+// restoreSnapshot loads a snapshot into the pool. With replace set the
+// existing pool is deleted first; otherwise rows are merged and existing
+// public keys are left untouched. Keys are restored for cluster, the
+// instance's CLUSTER. Returns the number of rows inserted.
+func restoreSnapshot(ctx context.Context, db *gorm.DB, key []byte, path string, replace bool, cluster string) (int64, error) {
+	data, err := readSnapshot(key, path)
+	if err != nil {
+		return 0, err
+	}
+	if err := upgradeSnapshot(&data, key, cluster); err != nil {
+		return 0, err
+	}
+
+	var inserted int64
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if replace {
+			if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&TokenKey{}).Error; err != nil {
+				return fmt.Errorf("clear pool: %w", err)
+			}
+		}
+		if len(data.TokenKeys) == 0 {
+			return nil
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(data.TokenKeys, 500)
+		inserted = res.RowsAffected
+		return res.Error
+	})
+	return inserted, err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// snapshotAt writes keys as a snapshot of schema version version, sealed
+// with key, and returns its path.
+func snapshotAt(t *testing.T, key []byte, version int, keys []TokenKey) string {
+	t.Helper()
+	plain, err := json.Marshal(snapshotData{TokenKeys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(plain)
+	out, err := json.Marshal(snapshotFile{SchemaVersion: version, Checksum: hex.EncodeToString(sum[:]), Data: sealed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := os.WriteFile(path, out, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	key := make([]byte, 32)
+	pub := testPub("k1")
+	tests := []struct {
+		version  int
+		checksum string
+		// wantErr is part of the error expected, "" for none
+		wantErr string
+	}{
+		{minSnapshotSchemaVersion - 1, "", "is not one this build restores"},
+		{7, "", ""},
+		{7, "bogus", ""},
+		{8, keyChecksum(pub), ""},
+		{8, "", "has checksum"},
+		{8, "deadbeef", "has checksum"},
+		{9, keyChecksum(pub), ""},
+		{10, keyChecksum(pub), ""},
+		{11, keyChecksum(pub), ""},
+		{12, keyChecksum(pub), ""},
+		{snapshotSchemaVersion, keyChecksum(pub), ""},
+		{snapshotSchemaVersion + 1, keyChecksum(pub), "is not one this build restores"},
+	}
+	for _, tt := range tests {
+		path := snapshotAt(t, key, tt.version, []TokenKey{{PublicKey: pub, PrivateKey: testPriv("k1"), Checksum: tt.checksum}})
+		data, err := readSnapshot(key, path)
+		if err == nil {
+			err = upgradeSnapshot(&data, key, "")
+		}
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("v%d with checksum %q: %v", tt.version, tt.checksum, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("v%d with checksum %q = %v, want an error with %q", tt.version, tt.checksum, err, tt.wantErr)
+		case err == nil && (data.Version != tt.version || data.TokenKeys[0].Checksum != keyChecksum(pub)):
+			t.Errorf("v%d restores as v%d with checksum %q, want %s", tt.version, data.Version, data.TokenKeys[0].Checksum, keyChecksum(pub))
+		}
+	}
+}
+
+// TestSnapshotKeepsTransfers checks a transferred key is restored as
+// transferred, not back into the pool.
+func TestSnapshotKeepsTransfers(t *testing.T) {
+	key := make([]byte, 32)
+	transfer := "b4a1e7e2-2b1c-4d55-9a53-5f0c0e1b6a01"
+	path := snapshotAt(t, key, snapshotSchemaVersion, []TokenKey{{PublicKey: testPub("k1"), PrivateKey: testPriv("k1"),
+		Checksum: keyChecksum(testPub("k1")), IsPicked: true, MigratedTo: &transfer}})
+	data, err := readSnapshot(key, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upgradeSnapshot(&data, key, ""); err != nil {
+		t.Fatal(err)
+	}
+	if k := data.TokenKeys[0]; k.MigratedTo == nil || *k.MigratedTo != transfer || !k.IsPicked {
+		t.Fatalf("restored %+v, want it still transferred by %s", k, transfer)
+	}
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	key := make([]byte, 32)
+	for _, tt := range []struct {
+		metadata string
+		ok       bool
+	}{{`{"order":7}`, true}, {`[1,2]`, true}, {`{"order":`, false}} {
+		meta := tt.metadata
+		path := snapshotAt(t, key, snapshotSchemaVersion, []TokenKey{{PublicKey: testPub("k1"), PrivateKey: testPriv("k1"),
+			Checksum: keyChecksum(testPub("k1")), Metadata: &meta}})
+		data, err := readSnapshot(key, path)
+		if err == nil {
+			err = upgradeSnapshot(&data, key, "")
+		}
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("metadata %s restores with %v, want it accepted %v", tt.metadata, err, tt.ok)
+		}
+		if err == nil && *data.TokenKeys[0].Metadata != tt.metadata {
+			t.Errorf("metadata %s restores as %s", tt.metadata, *data.TokenKeys[0].Metadata)
+		}
+	}
+}
+
+// TestSnapshotClusters restores keys with and without a cluster on
+// instances with and without CLUSTER.
+func TestSnapshotClusters(t *testing.T) {
+	key := make([]byte, 32)
+	tests := []struct {
+		version       int
+		keyCluster    string
+		instance      string
+		want, wantErr string
+	}{
+		{10, "", "", "", ""},
+		{10, "", "devnet", "devnet", ""},
+		{11, "", "devnet", "devnet", ""},
+		{11, "devnet", "devnet", "devnet", ""},
+		{11, "devnet", "", "devnet", ""},
+		{11, "mainnet-beta", "devnet", "", "is for mainnet-beta, not devnet"},
+	}
+	for _, tt := range tests {
+		path := snapshotAt(t, key, tt.version, []TokenKey{{PublicKey: testPub("k1"), PrivateKey: testPriv("k1"),
+			Checksum: keyChecksum(testPub("k1")), Cluster: tt.keyCluster}})
+		data, err := readSnapshot(key, path)
+		if err == nil {
+			err = upgradeSnapshot(&data, key, tt.instance)
+		}
+		name := fmt.Sprintf("v%d key for %q on %q", tt.version, tt.keyCluster, tt.instance)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s = %v, want an error with %q", name, err, tt.wantErr)
+		case err == nil && data.TokenKeys[0].Cluster != tt.want:
+			t.Errorf("%s restores for %q, want %q", name, data.TokenKeys[0].Cluster, tt.want)
+		}
+	}
+}
+
+// TestSnapshotDigests checks restored keys get the digest of their private
+// key, whatever the snapshot held, sealed or not.
+func TestSnapshotDigests(t *testing.T) {
+	key := make([]byte, 32)
+	sealed, err := sealPrivateKey(key, testPriv("k2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := privateKeyDigest(nil, testPriv("k1"))
+	for _, version := range []int{11, 12} {
+		path := snapshotAt(t, key, version, []TokenKey{
+			{PublicKey: testPub("k1"), PrivateKey: testPriv("k1"), Checksum: keyChecksum(testPub("k1")), PrivateKeyDigest: stale},
+			{PublicKey: testPub("k2"), PrivateKey: sealed, Checksum: keyChecksum(testPub("k2"))},
+		})
+		data, err := readSnapshot(key, path)
+		if err == nil {
+			err = upgradeSnapshot(&data, key, "")
+		}
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		for i, name := range []string{"k1", "k2"} {
+			got, want := data.TokenKeys[i].PrivateKeyDigest, privateKeyDigest(key, testPriv(name))
+			if got == nil || *got != *want {
+				t.Errorf("v%d key %s restores with digest %v, want %s", version, name, got, *want)
+			}
+		}
+	}
+}
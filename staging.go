@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"solana-key-gen/keygen"
+)
+
+// stagingName is what a staging table may be called; it is interpolated
+// into DDL, so it must be a plain identifier.
+var stagingName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+func checkStagingName(name string) error {
+	if !stagingName.MatchString(name) {
+		return fmt.Errorf("staging table %q must be a lowercase identifier", name)
+	}
+	if name == (TokenKey{}).TableName() {
+		return errors.New("staging table cannot be the live table")
+	}
+	return nil
+}
+
+// CreateStaging creates the staging table name with token_key's columns,
+// defaults and indexes, if it does not exist yet.
+func (s *gormStore) CreateStaging(ctx context.Context, name string) error {
+	if err := checkStagingName(name); err != nil {
+		return err
+	}
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS "` + name + `" (LIKE token_key INCLUDING ALL)`).Error
+	return ctxError(ctx, "create staging table", err)
+}
+
+// staged returns a store writing to the staging table name instead of
+// token_key. Only Insert and CountUnpicked are meant to be used on it.
+func (s *gormStore) staged(name string) *gormStore {
+	staged := newGormStore(s.db.Table(name).Session(&gorm.Session{}), s.timeouts, s.encKey)
+	staged.strictInsert = s.strictInsert
+	staged.labels = s.labels
+	staged.cluster = s.cluster
+	return staged
+}
+
+// Promote moves every key in the staging table name into token_key and
+// drops it, in one transaction. Unless keepLive is set, the live unpicked
+// keys are deleted first, so the pool switches from the old patterns to the
+// staged ones at once. The live table is locked against picks for the
+// duration; they wait and then see the staged keys rather than an empty pool.
+func (s *gormStore) Promote(ctx context.Context, name string, keepLive bool) (promoted, replaced int64, err error) {
+	if err := checkStagingName(name); err != nil {
+		return 0, 0, err
+	}
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE token_key IN EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		if !keepLive {
+			res := tx.Exec("DELETE FROM token_key WHERE is_picked = false")
+			if res.Error != nil {
+				return res.Error
+			}
+			replaced = res.RowsAffected
+		}
+		res := tx.Exec(`INSERT INTO token_key SELECT * FROM "` + name + `" ON CONFLICT DO NOTHING`)
+		if res.Error != nil {
+			return res.Error
+		}
+		promoted = res.RowsAffected
+		return tx.Exec(`DROP TABLE "` + name + `"`).Error
+	})
+	return promoted, replaced, ctxError(ctx, "promote staging table", err)
+}
+
+// fillStaging generates keys into the staging store until every pattern has
+// its target of unpicked keys there. It is the one-shot counterpart of
+// maintainUnpickedKeys, without hooks, key files or the stream: staged keys
+// are not live yet.
+func fillStaging(ctx context.Context, staging *gormStore, patterns []pattern, workers int, genOpts []keygen.Option) error {
+	byName := make(map[string]pattern, len(patterns))
+	counts := make(map[string]int64, len(patterns))
+	for _, p := range patterns {
+		byName[p.Name()] = p
+		c, err := staging.CountUnpicked(ctx, p.Name())
+		if err != nil {
+			return err
+		}
+		counts[p.Name()] = c
+	}
+
+	weights := newWeightedSampler(patterns)
+	for need := deficient(patterns, counts); len(need) > 0; need = deficient(patterns, counts) {
+		if weights != nil {
+			need = []string{weights.sample()}
+		}
+		kp, err := generateVanityKeypair(ctx, need, workers, genOpts...)
+		if err != nil {
+			return err
+		}
+		p := byName[kp.Pattern]
+		inserted, err := staging.Insert(ctx, &TokenKey{
+			ID:             uuid.NewString(),
+			PrivateKey:     kp.Priv,
+			PublicKey:      kp.Pub,
+			MatchedPattern: kp.Pattern,
+			QualityScore:   qualityScore(kp.Pattern),
+			Campaign:       p.Campaign,
+			ValidFrom:      p.ValidFrom,
+			ValidUntil:     p.ValidUntil,
+		})
+		if err != nil {
+			return err
+		}
+		if inserted {
+			counts[kp.Pattern]++
+			log.Printf("Staged key: %s | Staged for %q: %d / %d\n", kp.Pub, kp.Pattern, counts[kp.Pattern], p.Target)
+		}
+	}
+	return nil
+}
+
+// cmdStage implements the "stage" subcommand: generate a pool for the
+// configured PATTERNS into a staging table, for a later promote.
+func cmdStage(ctx context.Context, store *gormStore, args []string, patterns []pattern, workers int, genOpts []keygen.Option) error {
+	fs := flag.NewFlagSet("stage", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: stage <table>")
+	}
+	name := fs.Arg(0)
+	if err := store.CreateStaging(ctx, name); err != nil {
+		return err
+	}
+	if err := fillStaging(ctx, store.staged(name), patterns, workers, genOpts); err != nil {
+		return err
+	}
+	log.Printf("Staging table %s is at target; run promote %s to make it live\n", name, name)
+	return nil
+}
+
+// cmdPromote implements the "promote" subcommand.
+func cmdPromote(ctx context.Context, store *gormStore, args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ContinueOnError)
+	keepLive := fs.Bool("keep-live", false, "keep the live unpicked keys alongside the staged ones")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: promote [-keep-live] <table>")
+	}
+	promoted, replaced, err := store.Promote(ctx, fs.Arg(0), *keepLive)
+	if err != nil {
+		return err
+	}
+	log.Printf("Promoted %d keys from %s, replacing %d live unpicked keys\n", promoted, fs.Arg(0), replaced)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// stallMonitor notices generation that has stopped producing keys: a fill
+// loop below target for longer than threshold with no key found meanwhile,
+// be it wedged, starved of entropy or grinding a pattern too hard to find.
+// Any found key, from any loop or agent, resets it. Loops at target, paused
+// or waiting on another instance's lease are not generating and cannot
+// stall. A nil monitor watches nothing.
+type stallMonitor struct {
+	threshold time.Duration
+
+	mu        sync.Mutex
+	lastFound time.Time
+	// grinding maps each loop below target to when it started generating.
+	grinding map[string]time.Time
+	alerted  bool
+}
+
+func newStallMonitor(threshold time.Duration) *stallMonitor {
+	return &stallMonitor{threshold: threshold, grinding: map[string]time.Time{}}
+}
+
+// Start records that loop is below target and generating. The loop stays
+// so, across fill cycles that end without reaching target, until Stop.
+func (m *stallMonitor) Start(loop string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.grinding[loop]; !ok {
+		m.grinding[loop] = clock.Now()
+	}
+}
+
+// Stop records that loop stopped generating, at target or otherwise.
+func (m *stallMonitor) Stop(loop string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.grinding, loop)
+}
+
+// Found records a found key.
+func (m *stallMonitor) Found() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastFound = clock.Now()
+	if m.alerted {
+		log.Println("Generation stall over: found a key")
+	}
+	m.alerted = false
+}
+
+// LastFound is when the last key was found, false before the first.
+func (m *stallMonitor) LastFound() (time.Time, bool) {
+	if m == nil {
+		return time.Time{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastFound, !m.lastFound.IsZero()
+}
+
+// Stalled reports whether a loop has been below target for longer than
+// the threshold without a key found, and why. The first report of a stall
+// is logged as an ALERT.
+func (m *stallMonitor) Stalled() (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stalled []string
+	var since time.Time
+	for loop, start := range m.grinding {
+		// The clock starts when the loop fell below target or at the last
+		// find, whichever is later
+		from := start
+		if m.lastFound.After(from) {
+			from = m.lastFound
+		}
+		if clock.Now().Sub(from) > m.threshold {
+			stalled = append(stalled, loop)
+			if since.IsZero() || from.Before(since) {
+				since = from
+			}
+		}
+	}
+	if len(stalled) == 0 {
+		return "", false
+	}
+	slices.Sort(stalled)
+	found := "no key found since startup"
+	if !m.lastFound.IsZero() {
+		found = fmt.Sprintf("last key found %v ago", clock.Now().Sub(m.lastFound).Round(time.Second))
+	}
+	reason := fmt.Sprintf("below target for %q with no key found in %v (%s), over STALL_THRESHOLD %v",
+		stalled, clock.Now().Sub(since).Round(time.Second), found, m.threshold)
+	if !m.alerted {
+		log.Printf("ALERT generation stalled: %s\n", reason)
+	}
+	m.alerted = true
+	return reason, true
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// LastInsert returns when the newest key was stored, or the zero time if
+// the pool is empty.
+func (s *gormStore) LastInsert(ctx context.Context) (time.Time, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var last *time.Time
+	err := db.Model(&TokenKey{}).Select("max(created_at)").Row().Scan(&last)
+	if err != nil || last == nil {
+		return time.Time{}, ctxError(ctx, "last insert", err)
+	}
+	return *last, nil
+}
+
+// standby watches a primary instance and only generates once the primary
+// stops making progress: nothing inserted for StallAfter while some pattern
+// is below target. Holding a lease is not progress, since a wedged primary
+// can keep renewing one. Once leading it holds on for at least MinHold and
+// then steps down as soon as the pool is back at target.
+type standby struct {
+	Store      *gormStore
+	Patterns   []pattern
+	Lease      fillLease
+	Poll       time.Duration
+	StallAfter time.Duration
+	MinHold    time.Duration
+	AlertURL   string
+
+	// Fill runs the fill loop until its context is done.
+	Fill func(ctx context.Context)
+}
+
+// Run watches and takes over until ctx is done.
+func (s *standby) Run(ctx context.Context) {
+	log.Printf("Standby: watching the primary, taking over after %v without inserts while below target\n", s.StallAfter)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(s.Poll):
+		}
+
+		stalled, why, err := s.primaryStalled(ctx)
+		if err != nil {
+			log.Println("Standby: error checking the primary:", err)
+			continue
+		}
+		if stalled {
+			s.lead(ctx, why)
+		}
+	}
+}
+
+// primaryStalled reports whether the primary appears stuck, and why.
+func (s *standby) primaryStalled(ctx context.Context) (bool, string, error) {
+	need, err := s.deficient(ctx)
+	if err != nil || len(need) == 0 {
+		return false, "", err
+	}
+	last, err := s.Store.LastInsert(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	if last.IsZero() {
+		return true, fmt.Sprintf("pool is empty and below target for %v", need), nil
+	}
+	if idle := clock.Now().Sub(last); idle >= s.StallAfter {
+		return true, fmt.Sprintf("no inserts for %v while below target for %v", idle.Round(time.Second), need), nil
+	}
+	return false, "", nil
+}
+
+func (s *standby) deficient(ctx context.Context) ([]string, error) {
+	counts := make(map[string]int64, len(s.Patterns))
+	for _, p := range s.Patterns {
+		n, err := s.Store.CountUnpicked(ctx, p.Name())
+		if err != nil {
+			return nil, err
+		}
+		counts[p.Name()] = n
+	}
+	return deficient(s.Patterns, counts), nil
+}
+
+// lead seizes the fill lease and generates until the hold time has passed
+// and the pool is back at target, or ctx is done.
+func (s *standby) lead(ctx context.Context, why string) {
+	if s.Lease.TTL > 0 {
+		prev, err := s.Store.StealLease(ctx, fillLeaseName, s.Lease.Holder, s.Lease.TTL)
+		if err != nil {
+			log.Println("Standby: error seizing the generation lease, staying in standby:", err)
+			return
+		}
+		log.Printf("Standby: seized the generation lease from %q\n", prev)
+	}
+	log.Printf("Standby: primary stalled (%s), taking over generation\n", why)
+	standbyTakeoversTotal.Inc()
+	standbyLeading.Set(1)
+	s.alert(ctx, "takeover", why)
+
+	fillCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Fill(fillCtx)
+	}()
+
+	since := clock.Now()
+	every := s.Poll
+	if s.Lease.TTL > 0 {
+		every = min(every, s.Lease.TTL/3)
+	}
+	renew := time.NewTicker(every)
+	defer renew.Stop()
+	for ctx.Err() == nil && !s.canStepDown(ctx, since) {
+		select {
+		case <-ctx.Done():
+		case <-renew.C:
+			// Keep the lease through the hold, even between fills, so a
+			// wedged primary cannot grab it back and flap
+			if s.Lease.TTL > 0 && clock.Now().Sub(since) < s.MinHold {
+				if _, err := s.Store.StealLease(ctx, fillLeaseName, s.Lease.Holder, s.Lease.TTL); err != nil {
+					log.Println("Standby: error renewing the generation lease:", err)
+				}
+			}
+		}
+	}
+
+	stop()
+	<-done
+	standbyLeading.Set(0)
+	if ctx.Err() != nil {
+		return
+	}
+	if s.Lease.TTL > 0 {
+		if err := s.Store.ReleaseLease(ctx, fillLeaseName, s.Lease.Holder); err != nil {
+			log.Println("Standby: error releasing the generation lease:", err)
+		}
+	}
+	held := clock.Now().Sub(since).Round(time.Second)
+	log.Printf("Standby: pool back at target after leading for %v, stepping down\n", held)
+	s.alert(ctx, "step_down", fmt.Sprintf("pool back at target after leading for %v", held))
+}
+
+// canStepDown reports whether leadership has been held for MinHold and the
+// pool is back at target.
+func (s *standby) canStepDown(ctx context.Context, since time.Time) bool {
+	if clock.Now().Sub(since) < s.MinHold {
+		return false
+	}
+	need, err := s.deficient(ctx)
+	return err == nil && len(need) == 0
+}
+
+// alert posts a standby transition to AlertURL, if set.
+func (s *standby) alert(ctx context.Context, event, detail string) {
+	if s.AlertURL == "" {
+		return
+	}
+	payload := map[string]any{"event": event, "holder": s.Lease.Holder, "detail": detail, "at": clock.Now()}
+	if err := postAlert(ctx, s.AlertURL, payload); err != nil {
+		log.Println("Standby: error sending alert:", err)
+	}
+}
+
+// postAlert POSTs payload as JSON to url, giving up after 10 seconds.
+func postAlert(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("alert returned " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mr-tron/base58/base58"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrPoolEmpty   = errors.New("no unpicked keys available")
+	ErrKeyNotFound = errors.New("key not found or already picked")
+	ErrCorruptKey  = errors.New("stored private key does not match its public key")
+	// ErrDuplicateKey is a conflicting insert under STRICT_INSERT.
+	ErrDuplicateKey = errors.New("key already stored")
+)
+
+// dbTimeouts bounds how long each kind of statement may run. Zero means no
+// limit beyond the caller's context.
+type dbTimeouts struct {
+	Count  time.Duration
+	Insert time.Duration
+	Pick   time.Duration
+	Query  time.Duration
+}
+
+// gormStore is the Postgres-backed key pool. With encKey set, private keys
+// are encrypted at rest.
+type gormStore struct {
+	db       *gorm.DB
+	timeouts dbTimeouts
+	encKey   []byte
+
+	// discards, if set, records expired and quarantined keys.
+	discards *discardLedger
+	// pgx, if set (DB_ENGINE=pgx), serves Pick, Insert and CountUnpicked.
+	pgx *pgxpool.Pool
+	// strictInsert (STRICT_INSERT) makes Insert fail with ErrDuplicateKey on
+	// a conflict instead of reporting it as not inserted.
+	strictInsert bool
+	// outbox (WEBHOOK_URL) records each key's lifecycle events for the
+	// webhook sink.
+	outbox bool
+	// labels (KEY_LABEL_TEMPLATE), if set, labels every inserted key.
+	labels *keyLabeler
+	// read (READ_DATABASE_URL), if set, is a replica serving unpicked
+	// counts, stats and listings. It may lag db, so what it serves is
+	// slightly stale; nothing written reads through it.
+	read *gorm.DB
+	// fresh moves reads back to the primary after an admin mutation.
+	fresh *readFreshness
+	// cluster (CLUSTER), if set, labels every stored key without one.
+	cluster string
+}
+
+func newGormStore(db *gorm.DB, timeouts dbTimeouts, encKey []byte) *gormStore {
+	return &gormStore{db: db, timeouts: timeouts, encKey: encKey}
+}
+
+// session returns a handle bound to ctx, limited to d if d is set.
+func (s *gormStore) session(ctx context.Context, d time.Duration) (*gorm.DB, context.Context, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	if d > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+	}
+	return s.db.WithContext(ctx), ctx, cancel
+}
+
+// readSession is session on the read replica, or the primary without one
+// or shortly after an admin mutation (see readFreshness).
+func (s *gormStore) readSession(ctx context.Context, d time.Duration) (*gorm.DB, context.Context, context.CancelFunc) {
+	db, ctx, cancel := s.session(ctx, d)
+	if !s.readsPrimary(ctx) {
+		db = s.read.WithContext(ctx)
+	}
+	return db, ctx, cancel
+}
+
+// ctxError wraps err with ctx's error when the context ended, so callers
+// can tell a cancelled or timed-out statement apart from a failed one.
+func ctxError(ctx context.Context, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cerr := ctx.Err(); cerr != nil && !errors.Is(err, cerr) {
+		return fmt.Errorf("%s: %w (%v)", op, cerr, err)
+	}
+	return err
+}
+
+// migrate brings the schema up to date and attributes rows created before
+// matched_pattern existed to the longest configured pattern they match.
+func migrate(ctx context.Context, db *gorm.DB, patterns []pattern) error {
+	db = db.WithContext(ctx)
+	if err := db.AutoMigrate(&TokenKey{}, &PickResult{}, &AppFlag{}, &GenerationLease{}, &PoolHistory{}, &DiscardedKey{}, &PatternStat{}, &CounterCheckpoint{}, &KeyTransfer{}, &KeyEvent{}, &KeyEventSeq{}, &KeyEventDeadLetter{}, &ParkedKey{}, &ScannerState{}, &PoolPrewarm{}, &SchemaVersion{}, &HookRun{}); err != nil {
+		return err
+	}
+
+	sorted := slices.Clone(patterns)
+	slices.SortFunc(sorted, func(a, b pattern) int { return len(b.text()) - len(a.text()) })
+	for _, p := range sorted {
+		// LIKE cannot express a fuzzy match or a predicate; such keys stay unattributed
+		if p.Fuzzy || p.Predicate != "" || p.Any {
+			continue
+		}
+		like := "%" + p.Suffix
+		if p.Prefix != "" {
+			like = p.Prefix + "%"
+		}
+		if p.Contains {
+			like = "%" + p.Suffix + "%"
+		}
+		err := db.Model(&TokenKey{}).
+			Where("(matched_pattern IS NULL OR matched_pattern = '') AND public_key LIKE ?", like).
+			Update("matched_pattern", p.Name()).Error
+		if err != nil {
+			return ctxError(ctx, "backfill matched_pattern", err)
+		}
+	}
+	// Expression index for searching by the short display form
+	err := db.Exec("CREATE INDEX IF NOT EXISTS idx_token_key_short ON token_key (left(public_key, 4), right(public_key, 4))").Error
+	if err != nil {
+		return ctxError(ctx, "create short form index", err)
+	}
+	err = db.Model(&TokenKey{}).Where("address_length = 0").
+		Update("address_length", gorm.Expr("length(public_key)")).Error
+	if err != nil {
+		return ctxError(ctx, "backfill address_length", err)
+	}
+	if err := migrateLabelSequences(db, patterns); err != nil {
+		return ctxError(ctx, "create label sequences", err)
+	}
+	if err := migratePickResultKey(db); err != nil {
+		return ctxError(ctx, "widen pick_result primary key", err)
+	}
+	if err := backfillChecksums(db); err != nil {
+		return ctxError(ctx, "backfill checksum", err)
+	}
+	// Same as qualityScore: bits of difficulty of the matched pattern's text
+	err = db.Model(&TokenKey{}).Where("quality_score = 0 AND matched_pattern <> ''").
+		Update("quality_score", gorm.Expr("length(rtrim(matched_pattern, '*')) * ln(58) / ln(2)")).Error
+	if err != nil {
+		return ctxError(ctx, "backfill quality_score", err)
+	}
+	return ctxError(ctx, "record schema version", recordSchema(db))
+}
+
+// migratePickResultKey widens the primary key of a pick_result table made
+// when it was the idempotency key alone to the idempotency key and actor.
+func migratePickResultKey(db *gorm.DB) error {
+	var cols int64
+	err := db.Raw(`SELECT count(*) FROM information_schema.key_column_usage
+		WHERE table_name = 'pick_result' AND constraint_name = 'pick_result_pkey'`).Scan(&cols).Error
+	if err != nil || cols != 1 {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("UPDATE pick_result SET actor = '' WHERE actor IS NULL").Error; err != nil {
+			return err
+		}
+		return tx.Exec("ALTER TABLE pick_result DROP CONSTRAINT pick_result_pkey, ADD PRIMARY KEY (idempotency_key, actor)").Error
+	})
+}
+
+// backfillChecksums sets the checksum of rows inserted before it existed.
+// Postgres has no CRC-32, so it is computed here a batch at a time.
+func backfillChecksums(db *gorm.DB) error {
+	for {
+		var rows []TokenKey
+		err := db.Select("id, public_key").Where("checksum IS NULL OR checksum = ''").Limit(1000).Find(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, r := range rows {
+				if err := tx.Model(&TokenKey{}).Where("id = ?", r.ID).Update("checksum", keyChecksum(r.PublicKey)).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CheckEncryption fails fast when the pool holds encrypted keys that could
+// not be decrypted later: no ENCRYPTION_KEY, or one that does not open them.
+// With required set, a missing key is an error even on an empty pool.
+func (s *gormStore) CheckEncryption(ctx context.Context, required bool) error {
+	if required && s.encKey == nil {
+		return errors.New("ENCRYPTION_REQUIRED is set but ENCRYPTION_KEY is not")
+	}
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var sample []string
+	err := db.Model(&TokenKey{}).Where("private_key LIKE ?", encryptedPrefix+"%").
+		Limit(1).Pluck("private_key", &sample).Error
+	if err != nil {
+		return ctxError(ctx, "check encryption", err)
+	}
+	if len(sample) == 0 {
+		return nil
+	}
+	if s.encKey == nil {
+		var n int64
+		db.Model(&TokenKey{}).Where("private_key LIKE ?", encryptedPrefix+"%").Count(&n)
+		return fmt.Errorf("%d stored keys are encrypted but ENCRYPTION_KEY is not set; set the key they were written with", n)
+	}
+	_, err = openPrivateKey(s.encKey, sample[0])
+	return err
+}
+
+// digestBatch is how many keys BackfillDigests reads at a time.
+const digestBatch = 500
+
+// BackfillDigests sets the private_key_digest of the keys stored before it
+// existed, or with another ENCRYPTION_KEY setting, returning how many it
+// set. A key whose digest another row already holds shares its private key:
+// it is quarantined and left without one.
+func (s *gormStore) BackfillDigests(ctx context.Context) (int64, error) {
+	db, ctx, cancel := s.session(ctx, 0)
+	defer cancel()
+
+	var set int64
+	last := ""
+	for {
+		tx := db.Model(&TokenKey{}).Select("id", "public_key", "private_key").
+			Where("private_key_digest IS NULL OR private_key_digest NOT LIKE ?", digestPrefix(s.encKey)+"%")
+		if last != "" {
+			tx = tx.Where("id > ?", last)
+		}
+		var rows []TokenKey
+		if err := tx.Order("id").Limit(digestBatch).Find(&rows).Error; err != nil {
+			return set, ctxError(ctx, "backfill private key digests", err)
+		}
+		for _, r := range rows {
+			priv, err := openPrivateKey(s.encKey, r.PrivateKey)
+			if err != nil {
+				return set, fmt.Errorf("key %s: %w", r.PublicKey, err)
+			}
+			err = db.Model(&TokenKey{}).Where("id = ?", r.ID).Update("private_key_digest", privateKeyDigest(s.encKey, priv)).Error
+			if privateKeyViolation(err) {
+				log.Printf("ALERT CRITICAL inconsistency: stored key %s has the private key of another stored key; quarantining it\n", r.PublicKey)
+				if _, err := s.Quarantine(ctx, r.PublicKey); err != nil {
+					log.Printf("Error quarantining key %s: %v\n", r.PublicKey, err)
+				}
+				continue
+			}
+			if err != nil {
+				return set, ctxError(ctx, "backfill private key digests", err)
+			}
+			set++
+		}
+		if len(rows) < digestBatch {
+			return set, nil
+		}
+		last = rows[len(rows)-1].ID
+	}
+}
+
+// open decrypts key's private key in place and checks it still belongs to
+// key.PublicKey. Keys that do not are quarantined and never served.
+func (s *gormStore) open(ctx context.Context, key *TokenKey) error {
+	priv, err := openPrivateKey(s.encKey, key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if pub, err := publicKeyFromPrivate(priv); err != nil || pub != key.PublicKey {
+		problem := "embedded public key differs"
+		if err != nil {
+			problem = err.Error()
+		}
+		s.quarantine(ctx, key, problem)
+		key.PrivateKey = ""
+		return fmt.Errorf("key %s: %w", key.ID, ErrCorruptKey)
+	}
+	key.PrivateKey = priv
+	return nil
+}
+
+// quarantine takes a corrupt key out of the pool for good. It runs even if
+// ctx was cancelled, so a disconnecting client cannot leave the row pickable.
+func (s *gormStore) quarantine(ctx context.Context, key *TokenKey, problem string) {
+	corruptKeysTotal.Inc()
+	log.Printf("ALERT: quarantining corrupt key %s: %s\n", key.ID, problem)
+	db, ctx, cancel := s.session(context.WithoutCancel(ctx), s.timeouts.Query)
+	defer cancel()
+	err := db.Model(&TokenKey{}).Where("id = ?", key.ID).
+		Updates(map[string]any{"quarantined": true, "is_picked": true}).Error
+	if err != nil {
+		log.Printf("Error quarantining key %s: %v\n", key.ID, ctxError(ctx, "quarantine", err))
+		return
+	}
+	s.discards.Record(discardCorrupt, key.MatchedPattern, key.PublicKey, 0)
+	s.logEvent(ctx, eventQuarantined, key.MatchedPattern, key.PublicKey)
+}
+
+func (s *gormStore) CountUnpicked(ctx context.Context, pattern string) (int64, error) {
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Count)
+	defer cancel()
+
+	var c int64
+	var err error
+	if s.pgx != nil && s.readsPrimary(ctx) {
+		c, err = s.pgxCountUnpicked(ctx, pattern)
+	} else {
+		err = db.Model(&TokenKey{}).Where("is_picked = false AND matched_pattern = ?", pattern).Count(&c).Error
+	}
+	return c, ctxError(ctx, "count unpicked", err)
+}
+
+// ExpireUnpicked deletes unpicked keys created before cutoff, or whose
+// validity window has ended, and returns how many were deleted per pattern.
+// Picked keys are never touched; a row being picked concurrently is
+// re-checked after the pick commits.
+func (s *gormStore) ExpireUnpicked(ctx context.Context, cutoff time.Time) (map[string]int64, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var rows []struct{ MatchedPattern, PublicKey string }
+	err := db.Raw(`DELETE FROM token_key WHERE is_picked = false
+		AND (created_at < ? OR valid_until <= now()) RETURNING matched_pattern, public_key`, cutoff).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, ctxError(ctx, "expire keys", err)
+	}
+	expired := map[string]int64{}
+	for _, r := range rows {
+		expired[r.MatchedPattern]++
+		s.discards.Record(discardExpired, r.MatchedPattern, r.PublicKey, 0)
+		s.logEvent(ctx, eventExpired, r.MatchedPattern, r.PublicKey)
+	}
+	return expired, nil
+}
+
+// Purge deletes every unpicked key, or with all set every key, and returns
+// how many rows were deleted.
+func (s *gormStore) Purge(ctx context.Context, all bool) (int64, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	tx := db.Where("is_picked = false")
+	if all {
+		tx = db.Where("true")
+	}
+	res := tx.Delete(&TokenKey{})
+	return res.RowsAffected, ctxError(ctx, "purge keys", res.Error)
+}
+
+// Insert stores key, returning false if its public key already exists, or
+// ErrDuplicateKey with strictInsert. A key whose private key is stored
+// under another public key is parked instead (see parkConflict).
+func (s *gormStore) Insert(ctx context.Context, key *TokenKey) (bool, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+
+	row := *key
+	row.Cluster = cmp.Or(row.Cluster, s.cluster)
+	row.AddressLength = len(row.PublicKey)
+	row.Checksum = keyChecksum(row.PublicKey)
+	var err error
+	if row.PrivateKey, err = sealPrivateKey(s.encKey, key.PrivateKey); err != nil {
+		return false, err
+	}
+	row.PrivateKeyDigest = privateKeyDigest(s.encKey, key.PrivateKey)
+	allocated := row.Label == nil
+	if allocated {
+		if row.Label, err = s.allocateLabel(db, row.MatchedPattern); err != nil {
+			return false, ctxError(ctx, "insert key", err)
+		}
+	}
+	var inserted bool
+	insert := func() (err error) {
+		if s.pgx != nil {
+			inserted, err = s.pgxInsert(ctx, &row)
+			return err
+		}
+		tx := db
+		if !s.strictInsert {
+			tx = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "public_key"}},
+				DoNothing: true,
+			})
+		}
+		res := tx.Create(&row)
+		inserted = res.RowsAffected > 0
+		return res.Error
+	}
+	err = withRetry(ctx, "insert", insert)
+	// A label left by another template or an unsynced restore is skipped:
+	// numbering moves on until a free one comes up
+	for attempt := 1; allocated && attempt < labelAttempts && labelViolation(err); attempt++ {
+		log.Printf("WARN label %s already taken, allocating another", *row.Label)
+		if row.Label, err = s.allocateLabel(db, row.MatchedPattern); err != nil {
+			return false, ctxError(ctx, "insert key", err)
+		}
+		err = withRetry(ctx, "insert", insert)
+	}
+	if privateKeyViolation(err) {
+		return false, s.parkConflict(ctx, db, row)
+	}
+	if uniqueViolation(err) {
+		err = fmt.Errorf("%w: %s: %w", ErrDuplicateKey, key.PublicKey, err)
+	}
+	key.CreatedAt = row.CreatedAt
+	if err == nil && inserted {
+		key.Label = row.Label
+		if err := s.CountGenerated(ctx, key.MatchedPattern); err != nil {
+			log.Println("Error counting generated key:", err)
+		}
+		s.logEvent(ctx, eventGenerated, key.MatchedPattern, key.PublicKey)
+	}
+	return inserted, ctxError(ctx, "insert key", err)
+}
+
+// pickFilter narrows which unpicked key a pick may claim.
+type pickFilter struct {
+	PublicKey     string
+	Label         string
+	Pattern       string
+	Campaign      string
+	AddressLength int
+	// Cluster, if set, is the cluster the caller declared; only keys
+	// labelled with it are claimed.
+	Cluster string
+	// ByQuality picks the highest-scoring key instead of the oldest.
+	ByQuality bool
+	// Restrict is the picking token's restriction, if any.
+	Restrict *keyRestriction
+	// Metadata, if set, is attached to the claimed key in the same
+	// statement, replacing any it had.
+	Metadata *string
+}
+
+// Pick atomically marks one matching unpicked key as picked and returns
+// it. SKIP LOCKED lets concurrent pickers claim different rows.
+func (s *gormStore) Pick(ctx context.Context, f pickFilter) (TokenKey, error) {
+	ctx, span := tracer.Start(ctx, "db.pick", trace.WithAttributes(attribute.String("pool", f.Pattern)))
+	defer span.End()
+	db, ctx, cancel := s.session(ctx, s.timeouts.Pick)
+	defer cancel()
+
+	start := clock.Now()
+	var key TokenKey
+	err := withRetry(ctx, "pick", func() (err error) {
+		if s.pgx != nil {
+			key, err = s.pgxPick(ctx, f)
+		} else {
+			key, err = pickTx(db, f)
+		}
+		return err
+	})
+	observePick(clock.Now().Sub(start))
+	if err != nil && !errors.Is(err, ErrPoolEmpty) && !errors.Is(err, ErrKeyNotFound) {
+		span.SetStatus(codes.Error, err.Error())
+		return TokenKey{}, ctxError(ctx, "pick key", err)
+	}
+	if err == nil {
+		err = s.open(ctx, &key)
+	}
+	if err == nil {
+		s.logEvent(ctx, eventPicked, key.MatchedPattern, key.PublicKey)
+	}
+	return key, err
+}
+
+// pickTx claims one key matching f using db, which may be a transaction.
+func pickTx(db *gorm.DB, f pickFilter) (TokenKey, error) {
+	sql, args := planPick(f).claim("*")
+	var key TokenKey
+	res := db.Raw(sql, args...).Scan(&key)
+	if res.Error != nil {
+		return TokenKey{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return TokenKey{}, pickMiss(f)
+	}
+	return key, nil
+}
+
+// pickMiss is the error for a pick that matched no key.
+func pickMiss(f pickFilter) error {
+	if f.PublicKey != "" || f.Label != "" {
+		return ErrKeyNotFound
+	}
+	return ErrPoolEmpty
+}
+
+// SimilarKeys returns pool keys sharing the first or last four characters
+// with pub, the cheap pre-filter for typo suggestions.
+func (s *gormStore) SimilarKeys(ctx context.Context, pub string) ([]string, error) {
+	if len(pub) < 8 {
+		return nil, nil
+	}
+	db, ctx, cancel := s.readSession(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var keys []string
+	err := db.Model(&TokenKey{}).
+		Where("public_key LIKE ? OR public_key LIKE ?", pub[:4]+"%", "%"+pub[len(pub)-4:]).
+		Limit(1000).
+		Pluck("public_key", &keys).Error
+	return keys, ctxError(ctx, "similar keys", err)
+}
+
+// Import stores an externally generated key. The public key is derived
+// from the private key; if the caller also supplied one it must match.
+// meta is attached to the key, if set. Returns the derived public key and
+// false if it was already in the pool.
+func (s *gormStore) Import(ctx context.Context, priv, pub string, meta *string, patterns []pattern) (string, bool, error) {
+	derived, err := publicKeyFromPrivate(priv)
+	if err != nil {
+		return "", false, err
+	}
+	if pub != "" && pub != derived {
+		return "", false, &pubkeyError{Input: pub, Problem: "does not match the private key", Suggestion: derived}
+	}
+	if err := validatePublicKey(derived, true); err != nil {
+		return "", false, err
+	}
+
+	stored, err := sealPrivateKey(s.encKey, priv)
+	if err != nil {
+		return "", false, err
+	}
+
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+	row := TokenKey{
+		ID:             uuid.NewString(),
+		PrivateKey:     stored,
+		PublicKey:      derived,
+		MatchedPattern: matchPattern(derived, patterns),
+		AddressLength:  len(derived),
+		Checksum:       keyChecksum(derived),
+		Cluster:        s.cluster,
+		Metadata:       meta,
+	}
+	row.PrivateKeyDigest = privateKeyDigest(s.encKey, priv)
+	row.QualityScore = qualityScore(row.MatchedPattern)
+	if row.Label, err = s.allocateLabel(db, row.MatchedPattern); err != nil {
+		return "", false, ctxError(ctx, "import key", err)
+	}
+	var inserted bool
+	err = withRetry(ctx, "import", func() error {
+		res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&row)
+		inserted = res.RowsAffected > 0
+		return res.Error
+	})
+	if err == nil && inserted {
+		s.logEvent(ctx, eventImported, row.MatchedPattern, derived)
+	}
+	return derived, inserted, ctxError(ctx, "import key", err)
+}
+
+// publicKeyFromPrivate checks a base58 64-byte private key is consistent
+// with its seed and returns its base58 public key.
+func publicKeyFromPrivate(priv string) (string, error) {
+	b, err := base58.Decode(priv)
+	if err != nil || len(b) != ed25519.PrivateKeySize {
+		return "", errors.New("private key must be base58 of 64 bytes")
+	}
+	seeded := ed25519.NewKeyFromSeed(b[:ed25519.SeedSize])
+	if !bytes.Equal(seeded, b) {
+		return "", errors.New("private key's embedded public half does not match its seed")
+	}
+	return base58.Encode(b[ed25519.SeedSize:]), nil
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mr-tron/base58/base58"
+)
+
+// conformanceStore is what the storage conformance suite exercises: the
+// fill loop's KeyStore plus picking, release and quarantine.
+type conformanceStore interface {
+	KeyStore
+	Pick(ctx context.Context, f pickFilter) (TokenKey, error)
+	Release(ctx context.Context, pub string) (bool, error)
+	Quarantine(ctx context.Context, pub string) (bool, error)
+}
+
+// testPriv and testPub are the base58 keypair named name, the same on every
+// call. The keys are real, as stores check them when opening picked keys.
+func testPriv(name string) string {
+	seed := sha256.Sum256([]byte(name))
+	return base58.Encode(ed25519.NewKeyFromSeed(seed[:]))
+}
+
+func testPub(name string) string {
+	seed := sha256.Sum256([]byte(name))
+	return base58.Encode(ed25519.NewKeyFromSeed(seed[:]).Public().(ed25519.PublicKey))
+}
+
+// storeOptions configure a store built for one conformance test.
+type storeOptions struct {
+	StrictInsert bool
+	// Encrypted stores private keys sealed, as with ENCRYPTION_KEY. Stores
+	// without encryption at rest ignore it.
+	Encrypted bool
+}
+
+// testEncKey is the ENCRYPTION_KEY of encrypted test stores.
+var testEncKey = bytes.Repeat([]byte{7}, 32)
+
+// storeFactory returns an empty store for one test.
+type storeFactory func(t *testing.T, opts storeOptions) conformanceStore
+
+// checkReadYourWrites inserts key into s and checks, without waiting, that
+// it is counted as unpicked under its pattern and can be picked and
+// released: what the fill loop and a consumer racing it rely on, whatever
+// caches or counters a backend keeps.
+func checkReadYourWrites(t *testing.T, s conformanceStore, key *TokenKey) {
+	t.Helper()
+	ctx := context.Background()
+	count := func(want int64) {
+		t.Helper()
+		if got, err := s.CountUnpicked(ctx, key.MatchedPattern); err != nil || got != want {
+			t.Fatalf("CountUnpicked(%s) = %d, %v; want %d", key.MatchedPattern, got, err, want)
+		}
+	}
+	before, err := s.CountUnpicked(ctx, key.MatchedPattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted, err := s.Insert(ctx, key); err != nil || !inserted {
+		t.Fatalf("Insert(%s) = %v, %v; want true, nil", key.PublicKey, inserted, err)
+	}
+	count(before + 1)
+	got, err := s.Pick(ctx, pickFilter{PublicKey: key.PublicKey})
+	if err != nil || got.PrivateKey != key.PrivateKey {
+		t.Fatalf("Pick of the key just inserted = %s, %v; want it with its private key", got.PublicKey, err)
+	}
+	count(before)
+	if ok, err := s.Release(ctx, key.PublicKey); err != nil || !ok {
+		t.Fatalf("Release = %v, %v; want true", ok, err)
+	}
+	count(before + 1)
+}
+
+// runStoreConformance checks that a store behaves as the fill loop and the
+// API expect of every backend. Each subtest gets a fresh, empty store.
+func runStoreConformance(t *testing.T, newStore storeFactory) {
+	ctx := context.Background()
+	key := func(name, pattern string) *TokenKey {
+		return &TokenKey{ID: uuid.NewString(), PublicKey: testPub(name), PrivateKey: testPriv(name), MatchedPattern: pattern}
+	}
+	insert := func(t *testing.T, s conformanceStore, keys ...*TokenKey) {
+		t.Helper()
+		for _, k := range keys {
+			inserted, err := s.Insert(ctx, k)
+			if err != nil || !inserted {
+				t.Fatalf("Insert(%s) = %v, %v; want true, nil", k.PublicKey, inserted, err)
+			}
+		}
+	}
+	count := func(t *testing.T, s conformanceStore, pattern string, want int64) {
+		t.Helper()
+		got, err := s.CountUnpicked(ctx, pattern)
+		if err != nil || got != want {
+			t.Fatalf("CountUnpicked(%s) = %d, %v; want %d", pattern, got, err, want)
+		}
+	}
+
+	t.Run("CountByPattern", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		count(t, s, "ab", 0)
+		insert(t, s, key("k1", "ab"), key("k2", "ab"), key("k3", "cd"))
+		count(t, s, "ab", 2)
+		count(t, s, "cd", 1)
+		u, err := s.Usage(ctx)
+		if err != nil || u.Rows != 3 {
+			t.Fatalf("Usage = %+v, %v; want 3 rows", u, err)
+		}
+	})
+
+	t.Run("ReadYourWrites", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		insert(t, s, key("k1", "ab"))
+		checkReadYourWrites(t, s, key("k2", "ab"))
+		checkReadYourWrites(t, s, key("k3", "cd"))
+	})
+
+	t.Run("DuplicatePublicKey", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		insert(t, s, key("k1", "ab"))
+		inserted, err := s.Insert(ctx, key("k1", "ab"))
+		if err != nil || inserted {
+			t.Fatalf("second Insert = %v, %v; want false, nil", inserted, err)
+		}
+		count(t, s, "ab", 1)
+	})
+
+	t.Run("DuplicatePublicKeyStrict", func(t *testing.T) {
+		s := newStore(t, storeOptions{StrictInsert: true})
+		insert(t, s, key("k1", "ab"))
+		if _, err := s.Insert(ctx, key("k1", "ab")); !errors.Is(err, ErrDuplicateKey) {
+			t.Fatalf("second Insert error = %v; want ErrDuplicateKey", err)
+		}
+		count(t, s, "ab", 1)
+	})
+
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("PrivateKeyConflict/encrypted=%v", encrypted), func(t *testing.T) {
+			s := newStore(t, storeOptions{Encrypted: encrypted})
+			insert(t, s, key("k1", "ab"))
+			other := key("k2", "ab")
+			other.PrivateKey = testPriv("k1")
+			if _, err := s.Insert(ctx, other); !errors.Is(err, ErrPrivateKeyConflict) {
+				t.Fatalf("Insert error = %v; want ErrPrivateKeyConflict", err)
+			}
+			if _, err := s.Pick(ctx, pickFilter{PublicKey: testPub("k2")}); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("the conflicting key was stored in the pool: %v", err)
+			}
+		})
+	}
+
+	t.Run("PickOldestFirst", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		for _, pub := range []string{"k1", "k2", "k3"} {
+			insert(t, s, key(pub, "ab"))
+			// Distinct creation times on every backend
+			time.Sleep(2 * time.Millisecond)
+		}
+		for _, want := range []string{"k1", "k2", "k3"} {
+			k, err := s.Pick(ctx, pickFilter{Pattern: "ab"})
+			if err != nil || k.PublicKey != testPub(want) || !k.IsPicked {
+				t.Fatalf("Pick = %s (picked %v), %v; want %s", k.PublicKey, k.IsPicked, err, want)
+			}
+		}
+		if _, err := s.Pick(ctx, pickFilter{Pattern: "ab"}); !errors.Is(err, ErrPoolEmpty) {
+			t.Fatalf("Pick from an empty pool = %v; want ErrPoolEmpty", err)
+		}
+		count(t, s, "ab", 0)
+	})
+
+	t.Run("PickByQuality", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		for i, score := range []float64{1, 3, 2} {
+			k := key(fmt.Sprintf("k%d", i), "ab")
+			k.QualityScore = score
+			insert(t, s, k)
+		}
+		k, err := s.Pick(ctx, pickFilter{Pattern: "ab", ByQuality: true})
+		if err != nil || k.PublicKey != testPub("k1") {
+			t.Fatalf("Pick by quality = %s, %v; want k1", k.PublicKey, err)
+		}
+	})
+
+	t.Run("PickNamedKey", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		insert(t, s, key("k1", "ab"), key("k2", "ab"))
+		k, err := s.Pick(ctx, pickFilter{PublicKey: testPub("k2")})
+		if err != nil || k.PublicKey != testPub("k2") {
+			t.Fatalf("Pick(k2) = %s, %v", k.PublicKey, err)
+		}
+		if _, err := s.Pick(ctx, pickFilter{PublicKey: testPub("k2")}); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("picking k2 again = %v; want ErrKeyNotFound", err)
+		}
+		if _, err := s.Pick(ctx, pickFilter{PublicKey: testPub("missing")}); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("picking a missing key = %v; want ErrKeyNotFound", err)
+		}
+	})
+
+	t.Run("PickWindow", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+		early, late := key("early", "ab"), key("late", "ab")
+		early.ValidFrom = &future
+		late.ValidUntil = &past
+		insert(t, s, early, late)
+		if _, err := s.Pick(ctx, pickFilter{Pattern: "ab"}); !errors.Is(err, ErrPoolEmpty) {
+			t.Fatalf("picked a key outside its window: %v", err)
+		}
+	})
+
+	t.Run("ConcurrentPicks", func(t *testing.T) {
+		const keys, pickers = 20, 80
+		s := newStore(t, storeOptions{})
+		for i := range keys {
+			insert(t, s, key(fmt.Sprintf("k%d", i), "ab"))
+		}
+		var mu sync.Mutex
+		seen := map[string]bool{}
+		var wg sync.WaitGroup
+		for range pickers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				k, err := s.Pick(ctx, pickFilter{Pattern: "ab"})
+				if errors.Is(err, ErrPoolEmpty) {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					t.Errorf("Pick: %v", err)
+					return
+				}
+				if seen[k.PublicKey] {
+					t.Errorf("%s picked twice", k.PublicKey)
+				}
+				seen[k.PublicKey] = true
+			}()
+		}
+		wg.Wait()
+		if len(seen) != keys {
+			t.Fatalf("%d distinct keys picked, want %d", len(seen), keys)
+		}
+		count(t, s, "ab", 0)
+	})
+
+	t.Run("ReleaseAndQuarantine", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		insert(t, s, key("k1", "ab"), key("k2", "ab"))
+		if ok, err := s.Release(ctx, testPub("k1")); err != nil || ok {
+			t.Fatalf("Release of an unpicked key = %v, %v; want false", ok, err)
+		}
+		if _, err := s.Pick(ctx, pickFilter{PublicKey: testPub("k1")}); err != nil {
+			t.Fatal(err)
+		}
+		count(t, s, "ab", 1)
+		if ok, err := s.Release(ctx, testPub("k1")); err != nil || !ok {
+			t.Fatalf("Release = %v, %v; want true", ok, err)
+		}
+		count(t, s, "ab", 2)
+
+		if ok, err := s.Quarantine(ctx, testPub("k2")); err != nil || !ok {
+			t.Fatalf("Quarantine = %v, %v; want true", ok, err)
+		}
+		count(t, s, "ab", 1)
+		if ok, err := s.Release(ctx, testPub("k2")); err != nil || ok {
+			t.Fatalf("Release of a quarantined key = %v, %v; want false", ok, err)
+		}
+		if _, err := s.Pick(ctx, pickFilter{PublicKey: testPub("k2")}); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("picked a quarantined key: %v", err)
+		}
+		if ok, err := s.Quarantine(ctx, testPub("missing")); err != nil || ok {
+			t.Fatalf("Quarantine of a missing key = %v, %v; want false", ok, err)
+		}
+	})
+
+	t.Run("ExpireUnpicked", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		insert(t, s, key("k1", "ab"), key("k2", "ab"), key("k3", "cd"))
+		if _, err := s.Pick(ctx, pickFilter{PublicKey: testPub("k1")}); err != nil {
+			t.Fatal(err)
+		}
+		expired, err := s.ExpireUnpicked(ctx, time.Now().Add(time.Hour))
+		if err != nil || expired["ab"] != 1 || expired["cd"] != 1 {
+			t.Fatalf("ExpireUnpicked = %v, %v; want ab:1 cd:1", expired, err)
+		}
+		if ok, err := s.Release(ctx, testPub("k1")); err != nil || !ok {
+			t.Fatalf("the picked key was expired: %v, %v", ok, err)
+		}
+		none, err := s.ExpireUnpicked(ctx, time.Now().Add(-time.Hour))
+		if err != nil || len(none) != 0 {
+			t.Fatalf("ExpireUnpicked before any key = %v, %v; want none", none, err)
+		}
+	})
+
+	t.Run("Lease", func(t *testing.T) {
+		s := newStore(t, storeOptions{})
+		ok, err := s.AcquireLease(ctx, "fill", "a", time.Minute)
+		if err != nil || !ok {
+			t.Fatalf("first AcquireLease = %v, %v", ok, err)
+		}
+		if ok, err := s.AcquireLease(ctx, "fill", "b", time.Minute); err != nil || ok {
+			t.Fatalf("AcquireLease of a held lease = %v, %v; want false", ok, err)
+		}
+		if ok, err := s.AcquireLease(ctx, "fill", "a", time.Minute); err != nil || !ok {
+			t.Fatalf("renewal = %v, %v; want true", ok, err)
+		}
+		if ok, err := s.AcquireLease(ctx, "other", "b", time.Minute); err != nil || !ok {
+			t.Fatalf("AcquireLease of another name = %v, %v; want true", ok, err)
+		}
+		if err := s.ReleaseLease(ctx, "fill", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := s.AcquireLease(ctx, "fill", "b", time.Minute); ok {
+			t.Fatal("releasing someone else's lease freed it")
+		}
+		if err := s.ReleaseLease(ctx, "fill", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.AcquireLease(ctx, "fill", "b", time.Minute); err != nil || !ok {
+			t.Fatalf("AcquireLease after release = %v, %v; want true", ok, err)
+		}
+	})
+}
+
+func TestMemStoreConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T, opts storeOptions) conformanceStore {
+		s := newMemStore()
+		s.strictInsert = opts.StrictInsert
+		return s
+	})
+}
+
+// testDatabase connects to TEST_DATABASE_URL and migrates it, skipping the
+// test without one. The database is emptied before each use, so it must be
+// one kept for tests.
+func testDatabase(t testing.TB) *gormStore {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := connectDB("TEST_DATABASE_URL", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(context.Background(), db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("TRUNCATE token_key, generation_lease, parked_key, pattern_stats, key_transfer, hook_run, pick_result, scanner_state").Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return newGormStore(db, dbTimeouts{}, nil)
+}
+
+func TestGormStoreConformance(t *testing.T) {
+	if os.Getenv("TEST_DATABASE_URL") == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	runStoreConformance(t, func(t *testing.T, opts storeOptions) conformanceStore {
+		s := testDatabase(t)
+		s.strictInsert = opts.StrictInsert
+		if opts.Encrypted {
+			s.encKey = testEncKey
+		}
+		return s
+	})
+}
+
+// TestPgxStoreConformance runs the suite with DB_ENGINE=pgx, which picks,
+// inserts and counts on its own pool.
+func TestPgxStoreConformance(t *testing.T) {
+	if os.Getenv("TEST_DATABASE_URL") == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	runStoreConformance(t, func(t *testing.T, opts storeOptions) conformanceStore {
+		s := testDatabase(t)
+		pool, err := newPgxPool(context.Background(), os.Getenv("TEST_DATABASE_URL"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(pool.Close)
+		s.pgx = pool
+		s.strictInsert = opts.StrictInsert
+		if opts.Encrypted {
+			s.encKey = testEncKey
+		}
+		return s
+	})
+}
+
+// BenchmarkPickLatency picks concurrently through GORM and through
+// DB_ENGINE=pgx, reporting each engine's p99 pick latency.
+func BenchmarkPickLatency(b *testing.B) {
+	for _, engine := range []string{"gorm", "pgx"} {
+		b.Run(engine, func(b *testing.B) {
+			s := testDatabase(b)
+			if engine == "pgx" {
+				pool, err := newPgxPool(context.Background(), os.Getenv("TEST_DATABASE_URL"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(pool.Close)
+				s.pgx = pool
+			}
+			rows := make([]TokenKey, b.N)
+			for i := range rows {
+				name := fmt.Sprintf("bench%d", i)
+				rows[i] = TokenKey{ID: uuid.NewString(), PublicKey: testPub(name), PrivateKey: testPriv(name), MatchedPattern: "ab"}
+			}
+			if err := s.db.CreateInBatches(rows, 1000).Error; err != nil {
+				b.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			latencies := make([]time.Duration, 0, b.N)
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					start := time.Now()
+					if _, err := s.Pick(context.Background(), pickFilter{Pattern: "ab"}); err != nil {
+						b.Error(err)
+						return
+					}
+					d := time.Since(start)
+					mu.Lock()
+					latencies = append(latencies, d)
+					mu.Unlock()
+				}
+			})
+			b.StopTimer()
+			if len(latencies) > 0 {
+				slices.Sort(latencies)
+				b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-us")
+			}
+		})
+	}
+}
+
+// TestParkConflictEncrypted inserts, with ENCRYPTION_KEY set, a key with
+// the private key of a stored one: the stored key is found by digest and
+// quarantined, and the new one parked.
+func TestParkConflictEncrypted(t *testing.T) {
+	s := testDatabase(t)
+	s.encKey = testEncKey
+	ctx := context.Background()
+	if _, err := s.Insert(ctx, &TokenKey{ID: uuid.NewString(), PublicKey: testPub("k1"), PrivateKey: testPriv("k1"), MatchedPattern: "ab"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.Insert(ctx, &TokenKey{ID: uuid.NewString(), PublicKey: testPub("k2"), PrivateKey: testPriv("k1"), MatchedPattern: "ab"})
+	if !errors.Is(err, ErrPrivateKeyConflict) {
+		t.Fatalf("Insert error = %v; want ErrPrivateKeyConflict", err)
+	}
+	var parked ParkedKey
+	if err := s.db.First(&parked, "public_key = ?", testPub("k2")).Error; err != nil {
+		t.Fatalf("the conflicting key was not parked: %v", err)
+	}
+	if parked.ConflictsWith != testPub("k1") {
+		t.Errorf("parked key conflicts with %q, want %s", parked.ConflictsWith, testPub("k1"))
+	}
+	var stored TokenKey
+	if err := s.db.First(&stored, "public_key = ?", testPub("k1")).Error; err != nil || !stored.Quarantined {
+		t.Errorf("stored key quarantined = %v (%v), want true", stored.Quarantined, err)
+	}
+}
+
+// TestBackfillDigests sets the digest of keys stored without one, sealed
+// or not, and quarantines a key sharing another's private key.
+func TestBackfillDigests(t *testing.T) {
+	s := testDatabase(t)
+	s.encKey = testEncKey
+	ctx := context.Background()
+	sealed, err := sealPrivateKey(testEncKey, testPriv("k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []TokenKey{
+		{ID: "00000000-0000-0000-0000-000000000001", PublicKey: testPub("k1"), PrivateKey: sealed},
+		{ID: "00000000-0000-0000-0000-000000000002", PublicKey: testPub("k2"), PrivateKey: testPriv("k2"),
+			PrivateKeyDigest: privateKeyDigest(nil, testPriv("k2"))},
+		{ID: "00000000-0000-0000-0000-000000000003", PublicKey: testPub("k3"), PrivateKey: sealed},
+	}
+	if err := s.db.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.BackfillDigests(ctx); err != nil || n != 2 {
+		t.Fatalf("BackfillDigests = %d, %v; want 2", n, err)
+	}
+	var got []TokenKey
+	if err := s.db.Order("id").Find(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []*string{privateKeyDigest(testEncKey, testPriv("k1")), privateKeyDigest(testEncKey, testPriv("k2")), nil} {
+		if d := got[i].PrivateKeyDigest; (d == nil) != (want == nil) || d != nil && *d != *want {
+			t.Errorf("key %s has digest %v, want %v", got[i].PublicKey, d, want)
+		}
+	}
+	if !got[2].Quarantined {
+		t.Error("the key sharing k1's private key was not quarantined")
+	}
+	if n, err := s.BackfillDigests(ctx); err != nil || n != 0 {
+		t.Fatalf("a second BackfillDigests = %d, %v; want 0", n, err)
+	}
+}
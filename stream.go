@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamBuffer is how many keys a subscriber may fall behind by before
+// further keys are dropped for it.
+const streamBuffer = 64
+
+// keyStream fans newly stored keys out to stream subscribers. Publishing
+// never blocks: slow subscribers miss keys rather than stall generation.
+type keyStream struct {
+	mu     sync.Mutex
+	subs   map[chan TokenKey]struct{}
+	closed bool
+}
+
+func newKeyStream() *keyStream {
+	return &keyStream{subs: map[chan TokenKey]struct{}{}}
+}
+
+// Subscribe returns a channel of new keys, closed when the stream is
+// closed, and a function to unsubscribe.
+func (st *keyStream) Subscribe() (<-chan TokenKey, func()) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ch := make(chan TokenKey, streamBuffer)
+	if st.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	st.subs[ch] = struct{}{}
+	return ch, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if _, ok := st.subs[ch]; ok {
+			delete(st.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (st *keyStream) Publish(key TokenKey) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for ch := range st.subs {
+		select {
+		case ch <- key:
+		default:
+			streamDroppedTotal.Inc()
+		}
+	}
+}
+
+// Close ends every subscription, letting stream handlers return on shutdown.
+func (st *keyStream) Close() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.closed = true
+	for ch := range st.subs {
+		delete(st.subs, ch)
+		close(ch)
+	}
+}
+
+type streamEvent struct {
+	ID             string    `json:"id"`
+	PublicKey      string    `json:"public_key"`
+	PrivateKey     string    `json:"private_key,omitempty"`
+	MatchedPattern string    `json:"matched_pattern"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// handleKeyStream sends a Server-Sent Event per newly generated key. Private
+// keys are only included with include_private_key=true and an admin token;
+// streamed keys are not picked and stay in the pool. A restricted token is
+// sent only the keys within its restriction.
+func (s *server) handleKeyStream(w http.ResponseWriter, r *http.Request) {
+	withPrivate := r.URL.Query().Get("include_private_key") == "true"
+	if withPrivate && !tokenFromContext(r.Context()).Has(scopeAdmin) {
+		writeError(w, http.StatusForbidden, "forbidden", "include_private_key requires the admin scope", nil)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives HTTP_WRITE_TIMEOUT by design
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("Key stream cannot clear the write deadline:", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Println("Key stream does not support flushing:", err)
+		return
+	}
+
+	restrict := tokenFromContext(r.Context()).Restrict
+	keys, unsubscribe := s.stream.Subscribe()
+	defer unsubscribe()
+	audit(r.Context(), "key_stream", fmt.Sprintf("include_private_key=%v", withPrivate))
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			// A comment keeps idle connections from being reaped by proxies
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			if !restrict.Allows(key.MatchedPattern, key.Campaign) {
+				continue
+			}
+			ev := streamEvent{ID: key.ID, PublicKey: key.PublicKey, MatchedPattern: key.MatchedPattern, CreatedAt: key.CreatedAt}
+			if withPrivate {
+				ev.PrivateKey = key.PrivateKey
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: key\nid: %s\ndata: %s\n\n", key.ID, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
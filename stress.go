@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// stressResult is what ctl stress measured.
+type stressResult struct {
+	Picks      int            `json:"picks"`
+	Duplicates []string       `json:"duplicates"`
+	Errors     map[string]int `json:"errors"`
+	Seconds    float64        `json:"seconds"`
+	PerSecond  float64        `json:"picks_per_second"`
+	P50Millis  float64        `json:"p50_ms"`
+	P95Millis  float64        `json:"p95_ms"`
+	MaxMillis  float64        `json:"max_ms"`
+}
+
+// ctlStress implements "ctl stress": concurrent pickers against a running
+// instance for a while, reporting throughput, errors by code and any
+// public key handed out twice. Every pick consumes a real key, so it asks
+// for confirmation like other mutating commands and fails if any key was
+// duplicated.
+func ctlStress(ctx context.Context, c *ctlClient, args []string) error {
+	var o ctlOptions
+	fs := ctlFlags("stress", &o)
+	concurrency := fs.Int("concurrency", 8, "concurrent pickers")
+	duration := fs.Duration("duration", 30*time.Second, "how long to pick for")
+	var req pickRequest
+	fs.StringVar(&req.Pattern, "pattern", "", "pick from this pattern")
+	fs.StringVar(&req.Campaign, "campaign", "", "pick from this campaign")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *concurrency < 1 || *duration <= 0 {
+		return errors.New("-concurrency and -duration must be positive")
+	}
+	if err := o.confirm(fmt.Sprintf("pick and consume keys for %v with %d concurrent pickers", *duration, *concurrency)); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+	var (
+		mu        sync.Mutex
+		seen      = map[string]bool{}
+		res       = stressResult{Errors: map[string]int{}}
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				t := time.Now()
+				var resp struct {
+					PublicKey string `json:"public_key"`
+				}
+				err := c.do(ctx, http.MethodPost, "/v1/pick", req, &resp)
+				d := time.Since(t)
+				if ctx.Err() != nil {
+					return
+				}
+
+				mu.Lock()
+				var apiErr *ctlAPIError
+				switch {
+				case errors.As(err, &apiErr):
+					res.Errors[apiErr.Code]++
+				case err != nil:
+					res.Errors["transport"]++
+				default:
+					res.Picks++
+					latencies = append(latencies, d)
+					if seen[resp.PublicKey] {
+						res.Duplicates = append(res.Duplicates, resp.PublicKey)
+					}
+					seen[resp.PublicKey] = true
+				}
+				mu.Unlock()
+				// Back off on an empty pool rather than hammering it
+				if apiErr != nil && apiErr.Status == http.StatusServiceUnavailable {
+					select {
+					case <-ctx.Done():
+					case <-time.After(time.Second):
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	res.Seconds = time.Since(start).Seconds()
+	res.PerSecond = float64(res.Picks) / res.Seconds
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+		res.P50Millis = ms(latencies[(len(latencies)*50+99)/100-1])
+		res.P95Millis = ms(latencies[(len(latencies)*95+99)/100-1])
+		res.MaxMillis = ms(latencies[len(latencies)-1])
+	}
+
+	if o.json {
+		if err := printJSON(res); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "picks\t%d in %.1fs (%.1f/s)\n", res.Picks, res.Seconds, res.PerSecond)
+		fmt.Fprintf(tw, "latency\tp50 %.1fms, p95 %.1fms, max %.1fms\n", res.P50Millis, res.P95Millis, res.MaxMillis)
+		for code, n := range res.Errors {
+			fmt.Fprintf(tw, "error %s\t%d\n", code, n)
+		}
+		fmt.Fprintf(tw, "duplicates\t%d\n", len(res.Duplicates))
+		for _, pub := range res.Duplicates {
+			fmt.Fprintf(tw, "\t%s\n", pub)
+		}
+		tw.Flush()
+	}
+	if len(res.Duplicates) > 0 {
+		return fmt.Errorf("%d keys were handed out more than once", len(res.Duplicates))
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrNotSwappable = errors.New("the picked key is no longer held by this pick")
+
+// Swap trades the key delivered for idemKey to actor for a fresh one in a
+// single transaction: the replacement is claimed first, with the same
+// pattern and campaign unless f says otherwise, then the old key is
+// released, or quarantined if reason is set, and the pick result is pointed
+// at the replacement so later lookups return it.
+func (s *gormStore) Swap(ctx context.Context, idemKey, actor string, f pickFilter, quarantine bool, retention time.Duration) (old, key TokenKey, err error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Pick)
+	defer cancel()
+
+	err = withRetry(ctx, "swap", func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var pr PickResult
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("idempotency_key = ? AND actor = ?", idemKey, actor).Take(&pr).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrResultNotFound
+			}
+			if err != nil {
+				return err
+			}
+			if pr.Purged || pr.TokenKeyID == nil || clock.Now().Sub(pr.CreatedAt) > retention {
+				return ErrResultExpired
+			}
+
+			err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id = ? AND is_picked = true AND quarantined = false", *pr.TokenKeyID).Take(&old).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotSwappable
+			}
+			if err != nil {
+				return err
+			}
+
+			// Claiming before releasing keeps the old key out of the running
+			if f.Pattern == "" {
+				f.Pattern = old.MatchedPattern
+			}
+			if f.Campaign == "" {
+				f.Campaign = old.Campaign
+			}
+			if key, err = pickTx(tx, f); err != nil {
+				return err
+			}
+
+			update := map[string]any{"is_picked": false}
+			if quarantine {
+				update = map[string]any{"quarantined": true}
+			}
+			if err := tx.Model(&TokenKey{}).Where("id = ?", old.ID).Updates(update).Error; err != nil {
+				return err
+			}
+			event := eventReleased
+			if quarantine {
+				event = eventQuarantined
+			}
+			if err := s.recordEvent(tx, event, old.MatchedPattern, old.PublicKey); err != nil {
+				return err
+			}
+			if err := s.recordEvent(tx, eventPicked, key.MatchedPattern, key.PublicKey); err != nil {
+				return err
+			}
+			return tx.Model(&PickResult{}).Where("idempotency_key = ? AND actor = ?", idemKey, actor).
+				Update("token_key_id", key.ID).Error
+		})
+	})
+	if err != nil && !errors.Is(err, ErrPoolEmpty) && !errors.Is(err, ErrResultNotFound) &&
+		!errors.Is(err, ErrResultExpired) && !errors.Is(err, ErrNotSwappable) {
+		err = ctxError(ctx, "swap key", err)
+	}
+	if err == nil {
+		if quarantine {
+			s.discards.Record(discardQuarantine, old.MatchedPattern, old.PublicKey, 0)
+		}
+		err = s.open(ctx, &key)
+	}
+	return old, key, err
+}
+
+type swapRequest struct {
+	// IdempotencyKey is the Idempotency-Key the key was picked with; it is
+	// the claim on that key and keeps naming the pick after the swap.
+	IdempotencyKey string `json:"idempotency_key"`
+	// Reason, when set, quarantines the key being swapped out instead of
+	// releasing it.
+	Reason   string `json:"reason"`
+	Pattern  string `json:"pattern"`
+	Campaign string `json:"campaign"`
+	// Cluster is as for a pick: the replacement's cluster, required with
+	// CLUSTER set.
+	Cluster string `json:"cluster"`
+}
+
+type swapResponse struct {
+	keyResponse
+	SwappedPublicKey string `json:"swapped_public_key"`
+	SwapID           string `json:"swap_id"`
+}
+
+// handleSwap serves POST /v1/swap. Only picks made with an Idempotency-Key
+// can be swapped, and only by the token that made them.
+func (s *server) handleSwap(w http.ResponseWriter, r *http.Request) {
+	var req swapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IdempotencyKey == "" {
+		writeError(w, http.StatusBadRequest, "invalid_body", `request body must be JSON with an "idempotency_key"`, nil)
+		return
+	}
+
+	cluster, ok := s.declaredCluster(w, r, req.Cluster)
+	if !ok {
+		return
+	}
+
+	restrict := tokenFromContext(r.Context()).Restrict
+	if restrict.Excludes(req.Pattern, req.Campaign) {
+		writeRestricted(w, restrict)
+		return
+	}
+
+	f := pickFilter{Pattern: req.Pattern, Campaign: req.Campaign, Cluster: cluster, Restrict: restrict}
+	old, key, err := s.store.Swap(r.Context(), req.IdempotencyKey, tokenFromContext(r.Context()).Name, f, req.Reason != "", s.pickRetention)
+	switch {
+	case errors.Is(err, ErrResultNotFound):
+		writeError(w, http.StatusNotFound, "result_not_found", err.Error(), nil)
+		return
+	case errors.Is(err, ErrResultExpired):
+		writeError(w, http.StatusGone, "result_expired", err.Error(), nil)
+		return
+	case errors.Is(err, ErrNotSwappable):
+		writeError(w, http.StatusConflict, "not_swappable", err.Error(), nil)
+		return
+	case errors.Is(err, ErrPoolEmpty):
+		wait := s.retryAfter(f.Pattern)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		writeError(w, http.StatusServiceUnavailable, "pool_empty", "no replacement key available; the picked key was kept", nil)
+		return
+	case errors.Is(err, ErrCorruptKey):
+		writeError(w, http.StatusInternalServerError, "corrupt_key", "the replacement key was corrupt and has been quarantined, swap again", nil)
+		return
+	case err != nil:
+		log.Println("Error swapping key:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to swap key", nil)
+		return
+	}
+
+	// Both halves carry the swap_id so the audit log links them
+	swapID := uuid.NewString()
+	if req.Reason != "" {
+		audit(r.Context(), "quarantine", "public_key="+old.PublicKey+" swap_id="+swapID+" reason="+strconv.Quote(req.Reason))
+	} else {
+		audit(r.Context(), "release", "public_key="+old.PublicKey+" swap_id="+swapID)
+	}
+	audit(r.Context(), "pick", "public_key="+key.PublicKey+labelDetail(key)+" swap_id="+swapID+" idempotency_key="+req.IdempotencyKey)
+	s.logPick(r.Context(), key)
+
+	writeJSON(w, http.StatusOK, swapResponse{
+		keyResponse:      newKeyResponse(key),
+		SwappedPublicKey: old.PublicKey,
+		SwapID:           swapID,
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestFillCycleSpans runs a fill cycle against an in-memory exporter and
+// checks it traces the cycle, each generation and each insert under it.
+func TestFillCycleSpans(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prev)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &cancellingStore{memStore: newMemStore(), n: 3, cancel: cancel}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		maintainUnpickedKeys(ctx, testFillConfig(store), []pattern{{Any: true, Target: 5}}, newFillGovernor(1).Loop("*", 0))
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the fill loop did not stop")
+	}
+
+	spans := exp.GetSpans()
+	i := slices.IndexFunc(spans, func(s tracetest.SpanStub) bool { return s.Name == "fill_cycle" })
+	if i < 0 {
+		t.Fatalf("no fill_cycle span among %d spans", len(spans))
+	}
+	cycle := spans[i]
+	if attrs := cycle.Attributes; len(attrs) == 0 || attrs[0].Key != "pools" || !slices.Equal(attrs[0].Value.AsStringSlice(), []string{"*"}) {
+		t.Errorf("fill_cycle attributes = %v, want pools [*]", attrs)
+	}
+	counts := map[string]int{}
+	for _, s := range spans {
+		if s.Parent.SpanID() == cycle.SpanContext.SpanID() {
+			counts[s.Name]++
+		}
+	}
+	if counts["generate"] < 3 || counts["db.insert"] != 3 {
+		t.Fatalf("spans under the fill cycle = %v, want a generate for each of the 3 db.insert", counts)
+	}
+}
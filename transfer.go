@@ -0,0 +1,722 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Key transfers seed a new instance's pool from a trusted peer's. A key
+// is never pickable in both pools: the source takes the transferred keys
+// out of its pool (migrated_to set, is_picked true) in the same statement
+// that hands them over, and only puts them back if the destination aborts.
+// The destination stores them and flips its side of the transfer to
+// stored in one database transaction, so it holds either all of a batch or
+// none of it, and then commits the transfer at the source. Any step can
+// fail in between; the keys are then in no pool, never in two, until
+// reconcile-transfers settles the transfer one way or the other.
+//
+// Source states are exported, committed and aborted. Destination states
+// are receiving, stored, committed, aborting and aborted; receiving only
+// leaves for stored or aborting under the row's lock, which is what stops
+// reconciliation from returning keys a late store is about to keep.
+const (
+	transferExported  = "exported"
+	transferCommitted = "committed"
+	transferAborted   = "aborted"
+	transferReceiving = "receiving"
+	transferStored    = "stored"
+	transferAborting  = "aborting"
+)
+
+// maxTransferKeys bounds one transfer, so a batch fits one response.
+const maxTransferKeys = 1000
+
+// KeyTransfer is one side of a transfer: direction out on the source, with
+// Peer the destination's token name, and in on the destination, with Peer
+// the source's PEER_URL.
+type KeyTransfer struct {
+	ID        string    `gorm:"type:uuid;primaryKey"`
+	Direction string    `gorm:"column:direction;index"`
+	Peer      string    `gorm:"column:peer"`
+	Pattern   string    `gorm:"column:pattern"`
+	State     string    `gorm:"column:state;index"`
+	Keys      int       `gorm:"column:key_count"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime"`
+	UpdatedAt time.Time `gorm:"column:updated_at;autoUpdateTime"`
+}
+
+func (KeyTransfer) TableName() string { return "key_transfer" }
+
+var (
+	ErrTransferNotFound     = errors.New("transfer not found")
+	errTransferNotReceiving = errors.New("transfer is no longer receiving, reconcile-transfers has aborted it")
+)
+
+// transferStateError is a transfer that cannot move to the requested state
+// from the one it is in.
+type transferStateError struct {
+	ID, State string
+}
+
+func (e *transferStateError) Error() string {
+	return fmt.Sprintf("transfer %s is already %s", e.ID, e.State)
+}
+
+// transferredKey is one key as it travels between instances, in plaintext
+// inside the sealed payload.
+type transferredKey struct {
+	PrivateKey     string     `json:"private_key"`
+	PublicKey      string     `json:"public_key"`
+	MatchedPattern string     `json:"matched_pattern"`
+	QualityScore   float64    `json:"quality_score"`
+	Campaign       string     `json:"campaign,omitempty"`
+	Cluster        string     `json:"cluster,omitempty"`
+	ValidFrom      *time.Time `json:"valid_from,omitempty"`
+	ValidUntil     *time.Time `json:"valid_until,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// ExportTransfer takes up to count unpicked keys, of pattern if set, out
+// of the pool for transfer id to peer and returns them decrypted. Asking
+// again for an exported transfer returns the same keys, so a destination
+// that lost the response can retry; keys quarantined as corrupt on the way
+// are left out. A transfer belongs to its peer: to any other it is not
+// found.
+func (s *gormStore) ExportTransfer(ctx context.Context, id, peer, pattern string, count int) ([]TokenKey, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	var keys []TokenKey
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var t KeyTransfer
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND direction = 'out'", id).Take(&t).Error
+		switch {
+		case err == nil:
+			if t.Peer != peer {
+				return ErrTransferNotFound
+			}
+			if t.State != transferExported {
+				return &transferStateError{ID: id, State: t.State}
+			}
+			return tx.Where("migrated_to = ? AND quarantined = false", id).Find(&keys).Error
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+
+		where, args := "is_picked = false AND (valid_until IS NULL OR valid_until > now())", []any{id}
+		if pattern != "" {
+			where += " AND matched_pattern = ?"
+			args = append(args, pattern)
+		}
+		args = append(args, count)
+		err = tx.Raw(`UPDATE token_key SET is_picked = true, migrated_to = ?
+			WHERE id IN (
+				SELECT id FROM token_key WHERE `+where+`
+				ORDER BY created_at LIMIT ? FOR UPDATE SKIP LOCKED
+			) RETURNING *`, args...).Scan(&keys).Error
+		if err != nil {
+			return err
+		}
+		t = KeyTransfer{ID: id, Direction: "out", Peer: peer, Pattern: pattern, State: transferExported, Keys: len(keys)}
+		return tx.Create(&t).Error
+	})
+	var stateErr *transferStateError
+	if errors.As(err, &stateErr) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ctxError(ctx, "export transfer", err)
+	}
+
+	out := keys[:0]
+	for _, k := range keys {
+		if err := s.open(ctx, &k); err != nil {
+			if !errors.Is(err, ErrCorruptKey) {
+				return nil, err
+			}
+			continue
+		}
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+// CloseTransfer commits an exported transfer, or aborts it and returns its
+// keys to the pool. Repeating the same close is a no-op. Only the peer the
+// transfer was exported to can close it.
+func (s *gormStore) CloseTransfer(ctx context.Context, id, peer string, commit bool) (KeyTransfer, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	want := transferAborted
+	if commit {
+		want = transferCommitted
+	}
+	var t KeyTransfer
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND direction = 'out'", id).Take(&t).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) || err == nil && t.Peer != peer {
+			return ErrTransferNotFound
+		}
+		if err != nil || t.State == want {
+			return err
+		}
+		if t.State != transferExported {
+			return &transferStateError{ID: id, State: t.State}
+		}
+		if !commit {
+			// Quarantined keys stay out, as they would have anyway
+			err := tx.Model(&TokenKey{}).Where("migrated_to = ? AND quarantined = false", id).
+				Updates(map[string]any{"is_picked": false, "migrated_to": nil}).Error
+			if err != nil {
+				return err
+			}
+		}
+		t.State = want
+		return tx.Model(&t).Update("state", want).Error
+	})
+	var stateErr *transferStateError
+	if errors.Is(err, ErrTransferNotFound) || errors.As(err, &stateErr) {
+		return t, err
+	}
+	return t, ctxError(ctx, "close transfer", err)
+}
+
+// Transfers lists transfers in direction, only those in state if set.
+func (s *gormStore) Transfers(ctx context.Context, direction, state string) ([]KeyTransfer, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+
+	tx := db.Where("direction = ?", direction)
+	if state != "" {
+		tx = tx.Where("state = ?", state)
+	}
+	var out []KeyTransfer
+	err := tx.Order("created_at").Find(&out).Error
+	return out, ctxError(ctx, "list transfers", err)
+}
+
+// BeginTransfer records an incoming transfer before it is requested, so a
+// seed that dies mid-transfer leaves a trace for reconcile-transfers.
+func (s *gormStore) BeginTransfer(ctx context.Context, id, peer, pattern string) error {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+	err := db.Create(&KeyTransfer{ID: id, Direction: "in", Peer: peer, Pattern: pattern, State: transferReceiving}).Error
+	return ctxError(ctx, "begin transfer", err)
+}
+
+// TransferState is the state of incoming transfer id.
+func (s *gormStore) TransferState(ctx context.Context, id string) (string, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var t KeyTransfer
+	err := db.Where("id = ? AND direction = 'in'", id).Take(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrTransferNotFound
+	}
+	return t.State, ctxError(ctx, "transfer state", err)
+}
+
+// MoveTransfer moves incoming transfer id from state from to to,
+// reporting false if it was not in from.
+func (s *gormStore) MoveTransfer(ctx context.Context, id, from, to string) (bool, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	res := db.Model(&KeyTransfer{}).Where("id = ? AND direction = 'in' AND state = ?", id, from).Update("state", to)
+	return res.RowsAffected > 0, ctxError(ctx, "update transfer", res.Error)
+}
+
+// StoreTransfer stores the keys of incoming transfer id and marks it
+// stored in one transaction, returning how many were new. It fails
+// without storing anything if the transfer is no longer receiving or a key
+// is labelled with a cluster other than CLUSTER.
+func (s *gormStore) StoreTransfer(ctx context.Context, id string, keys []transferredKey) (int, error) {
+	rows := make([]TokenKey, 0, len(keys))
+	for _, k := range keys {
+		pub, err := publicKeyFromPrivate(k.PrivateKey)
+		if err != nil || pub != k.PublicKey {
+			return 0, fmt.Errorf("transferred key %s does not match its private key", k.PublicKey)
+		}
+		// A peer on another cluster is refused rather than mixing its keys in
+		if k.Cluster != "" && s.cluster != "" && k.Cluster != s.cluster {
+			clusterMismatchesTotal.WithLabelValues("transfer").Inc()
+			return 0, &clusterError{Declared: s.cluster, Cluster: k.Cluster, Key: k.PublicKey}
+		}
+		stored, err := sealPrivateKey(s.encKey, k.PrivateKey)
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, TokenKey{
+			ID:               uuid.NewString(),
+			PrivateKey:       stored,
+			PrivateKeyDigest: privateKeyDigest(s.encKey, k.PrivateKey),
+			PublicKey:        pub,
+			MatchedPattern:   k.MatchedPattern,
+			AddressLength:    len(pub),
+			Checksum:         keyChecksum(pub),
+			QualityScore:     k.QualityScore,
+			Campaign:         k.Campaign,
+			Cluster:          cmp.Or(k.Cluster, s.cluster),
+			ValidFrom:        k.ValidFrom,
+			ValidUntil:       k.ValidUntil,
+			CreatedAt:        k.CreatedAt,
+		})
+	}
+
+	db, ctx, cancel := s.session(ctx, s.timeouts.Insert)
+	defer cancel()
+	var inserted int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&KeyTransfer{}).Where("id = ? AND direction = 'in' AND state = ?", id, transferReceiving).
+			Updates(map[string]any{"state": transferStored, "key_count": len(rows)})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errTransferNotReceiving
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		res = tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "public_key"}}, DoNothing: true}).Create(&rows)
+		inserted = int(res.RowsAffected)
+		return res.Error
+	})
+	if errors.Is(err, errTransferNotReceiving) {
+		return 0, err
+	}
+	return inserted, ctxError(ctx, "store transfer", err)
+}
+
+// transferRequest is the body of POST /v1/transfers.
+type transferRequest struct {
+	TransferID string `json:"transfer_id"`
+	Count      int    `json:"count"`
+	Pattern    string `json:"pattern"`
+}
+
+// transferResponse carries a transfer's keys as base64 of the JSON
+// []transferredKey sealed with TRANSFER_KEY, on top of TLS, so they are
+// never readable by a proxy terminating it.
+type transferResponse struct {
+	TransferID string `json:"transfer_id"`
+	State      string `json:"state"`
+	Keys       int    `json:"keys"`
+	Sealed     string `json:"sealed,omitempty"`
+}
+
+func writeTransferError(w http.ResponseWriter, err error) {
+	var stateErr *transferStateError
+	switch {
+	case errors.Is(err, ErrTransferNotFound):
+		writeError(w, http.StatusNotFound, "transfer_not_found", err.Error(), nil)
+	case errors.As(err, &stateErr):
+		writeError(w, http.StatusConflict, "transfer_"+stateErr.State, err.Error(), map[string]any{"state": stateErr.State})
+	default:
+		log.Println("Error handling transfer:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "transfer failed", nil)
+	}
+}
+
+// handleTransferExport serves POST /v1/transfers: up to count unpicked
+// keys (at most maxTransferKeys), of pattern if set, handed to the calling
+// instance and taken out of this pool, as ExportTransfer.
+func (s *server) handleTransferExport(w http.ResponseWriter, r *http.Request) {
+	var req transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "request body must be JSON", nil)
+		return
+	}
+	if uuid.Validate(req.TransferID) != nil {
+		writeError(w, http.StatusBadRequest, "invalid_transfer_id", "transfer_id must be a UUID", nil)
+		return
+	}
+	if req.Count < 1 || req.Count > maxTransferKeys {
+		writeError(w, http.StatusBadRequest, "invalid_count", fmt.Sprintf("count must be between 1 and %d", maxTransferKeys), nil)
+		return
+	}
+
+	keys, err := s.store.ExportTransfer(r.Context(), req.TransferID, tokenFromContext(r.Context()).Name, req.Pattern, req.Count)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	payload := make([]transferredKey, len(keys))
+	for i, k := range keys {
+		payload[i] = transferredKey{
+			PrivateKey:     k.PrivateKey,
+			PublicKey:      k.PublicKey,
+			MatchedPattern: k.MatchedPattern,
+			QualityScore:   k.QualityScore,
+			Campaign:       k.Campaign,
+			Cluster:        k.Cluster,
+			ValidFrom:      k.ValidFrom,
+			ValidUntil:     k.ValidUntil,
+			CreatedAt:      k.CreatedAt,
+		}
+	}
+	plain, err := json.Marshal(payload)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	sealed, err := seal(s.transferKey, plain)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	audit(r.Context(), "transfer_export", fmt.Sprintf("transfer=%s keys=%d pattern=%q", req.TransferID, len(keys), req.Pattern))
+	writeJSON(w, http.StatusOK, transferResponse{
+		TransferID: req.TransferID,
+		State:      transferExported,
+		Keys:       len(keys),
+		Sealed:     base64.StdEncoding.EncodeToString(sealed),
+	})
+}
+
+// handleTransferClose serves POST /v1/transfers/{id}/commit and /abort.
+func (s *server) handleTransferClose(commit bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		t, err := s.store.CloseTransfer(r.Context(), id, tokenFromContext(r.Context()).Name, commit)
+		if err != nil {
+			writeTransferError(w, err)
+			return
+		}
+		audit(r.Context(), "transfer_"+t.State, fmt.Sprintf("transfer=%s keys=%d", id, t.Keys))
+		writeJSON(w, http.StatusOK, transferResponse{TransferID: id, State: t.State, Keys: t.Keys})
+	}
+}
+
+// handleTransferList serves GET /v1/transfers?state=exported: this
+// instance's outgoing transfers.
+func (s *server) handleTransferList(w http.ResponseWriter, r *http.Request) {
+	transfers, err := s.store.Transfers(r.Context(), "out", r.URL.Query().Get("state"))
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	out := make([]transferResponse, len(transfers))
+	for i, t := range transfers {
+		out[i] = transferResponse{TransferID: t.ID, State: t.State, Keys: t.Keys}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"transfers": out})
+}
+
+// peer is the source instance a transfer pulls from.
+type peer struct {
+	url    string
+	client *ctlClient
+	key    []byte
+}
+
+// newPeer reads PEER_URL and PEER_TOKEN, a token with the export scope on
+// the peer. transferKey is TRANSFER_KEY, which the peer must share. The
+// peer must be reached over HTTPS unless PEER_INSECURE=true.
+func newPeer(transferKey []byte) (*peer, error) {
+	base, token := strings.TrimRight(getenv("PEER_URL"), "/"), getenv("PEER_TOKEN")
+	if base == "" || token == "" {
+		return nil, errors.New("PEER_URL and PEER_TOKEN must be set")
+	}
+	if transferKey == nil {
+		return nil, errors.New("TRANSFER_KEY must be set, to the same key as on the peer")
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PEER_URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		if getenv("PEER_INSECURE") != "true" {
+			return nil, errors.New("PEER_URL must be https (PEER_INSECURE=true to allow plain HTTP)")
+		}
+		log.Printf("WARN transferring keys from %s without TLS\n", u.Host)
+	}
+	return &peer{
+		url:    base,
+		client: &ctlClient{base: base, token: token, http: &http.Client{Timeout: time.Minute}},
+		key:    transferKey,
+	}, nil
+}
+
+// export requests transfer id, retrying transport errors with the same id
+// so the peer hands over the same keys, and opens the payload.
+func (p *peer) export(ctx context.Context, id, pattern string, count int) ([]transferredKey, error) {
+	var resp transferResponse
+	var err error
+	for attempt := range 3 {
+		if attempt > 0 && !sleepCtx(ctx, time.Duration(attempt)*2*time.Second) {
+			break
+		}
+		err = p.client.do(ctx, http.MethodPost, "/v1/transfers", transferRequest{TransferID: id, Count: count, Pattern: pattern}, &resp)
+		var apiErr *ctlAPIError
+		if err == nil || errors.As(err, &apiErr) || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(resp.Sealed)
+	if err != nil {
+		return nil, fmt.Errorf("transfer payload: %w", err)
+	}
+	plain, err := unseal(p.key, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("transfer payload does not open with TRANSFER_KEY: %w", err)
+	}
+	var keys []transferredKey
+	if err := json.Unmarshal(plain, &keys); err != nil {
+		return nil, fmt.Errorf("transfer payload: %w", err)
+	}
+	return keys, nil
+}
+
+// close commits or aborts transfer id at the peer. A transfer the peer
+// never recorded counts as aborted.
+func (p *peer) close(ctx context.Context, id string, commit bool) error {
+	action := "abort"
+	if commit {
+		action = "commit"
+	}
+	err := p.client.do(ctx, http.MethodPost, "/v1/transfers/"+id+"/"+action, nil, nil)
+	var apiErr *ctlAPIError
+	if !commit && errors.As(err, &apiErr) && apiErr.Code == "transfer_not_found" {
+		return nil
+	}
+	return err
+}
+
+// abortTransfer gives up incoming transfer id, first locally, so that no
+// store can follow, then at the peer, which returns the keys to its pool.
+// A transfer left aborting is finished by reconcile-transfers.
+func abortTransfer(ctx context.Context, store *gormStore, p *peer, id string) error {
+	if _, err := store.MoveTransfer(ctx, id, transferReceiving, transferAborting); err != nil {
+		return err
+	}
+	if err := p.close(ctx, id, false); err != nil {
+		return fmt.Errorf("transfer %s left aborting, run reconcile-transfers: %w", id, err)
+	}
+	_, err := store.MoveTransfer(ctx, id, transferAborting, transferAborted)
+	return err
+}
+
+// cmdSeed implements the "seed" subcommand: pull -count unpicked keys from
+// PEER_URL in transfers of -batch keys, until the count is reached or the
+// peer runs out.
+func cmdSeed(ctx context.Context, store *gormStore, args []string, transferKey []byte) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	count := fs.Int("count", 0, "keys to pull from the peer")
+	batch := fs.Int("batch", maxTransferKeys, "keys per transfer")
+	pattern := fs.String("pattern", "", "only pull keys of this pattern")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 || *batch < 1 || *batch > maxTransferKeys {
+		return fmt.Errorf("usage: seed -count N [-batch 1..%d] [-pattern P]", maxTransferKeys)
+	}
+	p, err := newPeer(transferKey)
+	if err != nil {
+		return err
+	}
+
+	var total, stored int
+	for total < *count {
+		n := min(*batch, *count-total)
+		id := uuid.NewString()
+		if err := store.BeginTransfer(ctx, id, p.url, *pattern); err != nil {
+			return err
+		}
+		keys, err := p.export(ctx, id, *pattern, n)
+		if err == nil {
+			var inserted int
+			if inserted, err = store.StoreTransfer(ctx, id, keys); err == nil {
+				total += len(keys)
+				stored += inserted
+			}
+		}
+		if err != nil {
+			if abortErr := abortTransfer(ctx, store, p, id); abortErr != nil {
+				log.Println("Error aborting transfer:", abortErr)
+			}
+			return fmt.Errorf("transfer %s: %w", id, err)
+		}
+
+		// The keys are safely here; a failed commit only leaves the peer's
+		// record open, which reconcile-transfers closes
+		if err := p.close(ctx, id, true); err != nil {
+			log.Printf("WARN transfer %s stored but not committed at the peer, run reconcile-transfers: %v\n", id, err)
+		} else if _, err := store.MoveTransfer(ctx, id, transferStored, transferCommitted); err != nil {
+			log.Println("Error recording transfer commit:", err)
+		}
+		log.Printf("Transfer %s: %d keys received, %d new\n", id, len(keys), stored)
+		if len(keys) < n {
+			log.Printf("The peer has no more unpicked keys to give\n")
+			break
+		}
+	}
+	log.Printf("Seeded %d keys from %s (%d already present)\n", stored, p.url, total-stored)
+	return nil
+}
+
+// transferReconciliation is what reconcile-transfers found and did for one
+// transfer.
+type transferReconciliation struct {
+	TransferID string `json:"transfer_id"`
+	Local      string `json:"local_state"`
+	Peer       string `json:"peer_state"`
+	Action     string `json:"action"`
+	Error      string `json:"error,omitempty"`
+}
+
+// cmdReconcileTransfers implements the "reconcile-transfers" subcommand,
+// run on the destination. Every transfer still open on either side is
+// committed at the peer if its keys were stored here and aborted on both
+// sides otherwise, returning the keys to the peer's pool. Transfers the
+// peer exported to another instance are only reported, as are keys in
+// both pools, which only a peer-side abort by hand can cause.
+func cmdReconcileTransfers(ctx context.Context, store *gormStore, args []string, transferKey []byte) error {
+	fs := flag.NewFlagSet("reconcile-transfers", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	dryRun := fs.Bool("dry-run", false, "only report what would be done")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	p, err := newPeer(transferKey)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Transfers []transferResponse `json:"transfers"`
+	}
+	if err := p.client.do(ctx, http.MethodGet, "/v1/transfers", nil, &resp); err != nil {
+		return fmt.Errorf("listing the peer's transfers: %w", err)
+	}
+	local, err := store.Transfers(ctx, "in", "")
+	if err != nil {
+		return err
+	}
+	peerStates := map[string]string{}
+	for _, t := range resp.Transfers {
+		peerStates[t.TransferID] = t.State
+	}
+
+	var out []transferReconciliation
+	for _, t := range local {
+		peerState := peerStates[t.ID]
+		delete(peerStates, t.ID)
+		if peerState != transferExported && (t.State == transferCommitted || t.State == transferAborted) {
+			// Closed on both sides, unless a committed transfer was aborted on
+			// the peer since
+			if t.State != transferCommitted || peerState != transferAborted {
+				continue
+			}
+		}
+		rec := transferReconciliation{TransferID: t.ID, Local: t.State, Peer: peerState}
+		rec.Action, err = reconcileTransfer(ctx, store, p, t.ID, t.State, peerState, *dryRun)
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		out = append(out, rec)
+	}
+	for _, t := range resp.Transfers {
+		if peerStates[t.TransferID] == transferExported {
+			out = append(out, transferReconciliation{TransferID: t.TransferID, Peer: t.State, Action: "none: exported to another instance"})
+		}
+	}
+
+	failed := 0
+	for _, rec := range out {
+		if rec.Error != "" {
+			failed++
+		}
+	}
+	if *asJSON {
+		if err := printJSON(map[string]any{"transfers": out, "dry_run": *dryRun}); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TRANSFER\tLOCAL\tPEER\tACTION\tERROR")
+		for _, rec := range out {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", rec.TransferID, rec.Local, rec.Peer, rec.Action, rec.Error)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d transfers could not be settled", failed)
+	}
+	return nil
+}
+
+// reconcileTransfer settles one incoming transfer in local state given
+// the peer's state, "" if the peer never recorded it, and returns the
+// action taken.
+func reconcileTransfer(ctx context.Context, store *gormStore, p *peer, id, local, peerState string, dryRun bool) (string, error) {
+	kept := local == transferStored || local == transferCommitted
+	switch {
+	case kept && peerState == transferAborted:
+		return "none", errors.New("keys are in both pools: the peer aborted a transfer stored here; quarantine them on one side")
+	case kept && peerState == "":
+		return "none", errors.New("keys stored here but the peer has no record of the transfer")
+	case !kept && peerState == transferCommitted:
+		return "none", errors.New("the peer committed a transfer never stored here; its keys are in neither pool")
+	}
+	if dryRun {
+		if kept {
+			return "commit", nil
+		}
+		return "abort", nil
+	}
+
+	if !kept {
+		// Taking the row from receiving stops a late store; if one just won
+		// the race, the keys are here and the transfer is committed instead
+		moved, err := store.MoveTransfer(ctx, id, transferReceiving, transferAborting)
+		if err != nil {
+			return "abort", err
+		}
+		if !moved && local == transferReceiving {
+			if local, err = store.TransferState(ctx, id); err != nil {
+				return "abort", err
+			}
+			kept = local == transferStored || local == transferCommitted
+		}
+	}
+	if kept {
+		if peerState == transferExported {
+			if err := p.close(ctx, id, true); err != nil {
+				return "commit", err
+			}
+		}
+		_, err := store.MoveTransfer(ctx, id, local, transferCommitted)
+		return "commit", err
+	}
+	if peerState == transferExported {
+		if err := p.close(ctx, id, false); err != nil {
+			return "abort", err
+		}
+	}
+	_, err := store.MoveTransfer(ctx, id, transferAborting, transferAborted)
+	return "abort", err
+}
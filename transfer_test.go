@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestTransferBelongsToPeer checks one peer cannot fetch or close a
+// transfer exported to another.
+func TestTransferBelongsToPeer(t *testing.T) {
+	s := testDatabase(t)
+	ctx := context.Background()
+	priv, pub := agentKey(t)
+	if _, err := s.Insert(ctx, &TokenKey{ID: uuid.NewString(), PublicKey: pub, PrivateKey: priv, MatchedPattern: "ab"}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.NewString()
+	keys, err := s.ExportTransfer(ctx, id, "peer-a", "", 10)
+	if err != nil || len(keys) != 1 || keys[0].PublicKey != pub {
+		t.Fatalf("ExportTransfer = %v, %v; want the one key", keys, err)
+	}
+	if _, err := s.ExportTransfer(ctx, id, "peer-b", "", 10); !errors.Is(err, ErrTransferNotFound) {
+		t.Fatalf("another peer's ExportTransfer = %v, want ErrTransferNotFound", err)
+	}
+	if _, err := s.CloseTransfer(ctx, id, "peer-b", false); !errors.Is(err, ErrTransferNotFound) {
+		t.Fatalf("another peer's CloseTransfer = %v, want ErrTransferNotFound", err)
+	}
+	if keys, err := s.ExportTransfer(ctx, id, "peer-a", "", 10); err != nil || len(keys) != 1 {
+		t.Fatalf("retried ExportTransfer = %v, %v; want the same key", keys, err)
+	}
+	if tr, err := s.CloseTransfer(ctx, id, "peer-a", true); err != nil || tr.State != transferCommitted {
+		t.Fatalf("CloseTransfer = %+v, %v; want committed", tr, err)
+	}
+}
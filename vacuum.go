@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// tableStats is a snapshot of the pool table's bloat.
+type tableStats struct {
+	LiveRows int64
+	DeadRows int64
+	Bytes    int64
+}
+
+func (s *gormStore) TableStats(ctx context.Context) (tableStats, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Count)
+	defer cancel()
+
+	var st tableStats
+	err := db.Raw(`SELECT n_live_tup, n_dead_tup, pg_total_relation_size(relid)
+		FROM pg_stat_user_tables WHERE relname = 'token_key'`).
+		Row().Scan(&st.LiveRows, &st.DeadRows, &st.Bytes)
+	return st, ctxError(ctx, "table stats", err)
+}
+
+// Vacuum reclaims dead rows left by picks and deletes and refreshes the
+// planner statistics. It only runs on Postgres and takes no statement
+// timeout, since it can take a while on a bloated table.
+func (s *gormStore) Vacuum(ctx context.Context) error {
+	if name := s.db.Dialector.Name(); name != "postgres" {
+		return errors.New("vacuum is only supported on postgres, not " + name)
+	}
+	db, ctx, cancel := s.session(ctx, 0)
+	defer cancel()
+	return ctxError(ctx, "vacuum", db.Exec("VACUUM (ANALYZE) token_key").Error)
+}
+
+// vacuumJob is the vacuum job: it vacuums the pool table, logging its
+// bloat before and after.
+func vacuumJob(store *gormStore) func(context.Context) error {
+	return func(ctx context.Context) error {
+		before, err := store.TableStats(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Vacuuming token_key: %d live rows, %d dead rows, %d bytes\n", before.LiveRows, before.DeadRows, before.Bytes)
+		start := clock.Now()
+		if err := store.Vacuum(ctx); err != nil {
+			return err
+		}
+		after, err := store.TableStats(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Vacuumed token_key in %v: %d live rows, %d dead rows, %d bytes\n", clock.Now().Sub(start).Round(time.Millisecond), after.LiveRows, after.DeadRows, after.Bytes)
+		return nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// A build without them falls back to the VCS data Go embeds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+// schemaVersion is the database schema this binary migrates to. Bump it
+// whenever migrate makes a change an older binary would misuse, such as a
+// column it would not write or a constraint it would not expect. Version
+// 2 keys pick_result by idempotency key and actor; version 3 adds
+// token_key.private_key_digest, which older binaries leave unset.
+const schemaVersion = 3
+
+// SchemaVersion records that a binary migrated the database to Version.
+type SchemaVersion struct {
+	Version    int       `gorm:"primaryKey;autoIncrement:false;column:version"`
+	AppVersion string    `gorm:"column:app_version"`
+	AppliedAt  time.Time `gorm:"column:applied_at;autoCreateTime"`
+}
+
+func (SchemaVersion) TableName() string { return "schema_version" }
+
+// errSchemaTooNew means the database was migrated by a newer binary.
+var errSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// buildInfo describes the running binary, for GET /v1/version and the
+// startup banner.
+type buildInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	BuildTime     string `json:"build_time,omitempty"`
+	GoVersion     string `json:"go_version"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version(), SchemaVersion: schemaVersion}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildTime == "":
+				b.BuildTime = s.Value
+			}
+		}
+	}
+	return b
+}
+
+func (b buildInfo) String() string {
+	c := b.Commit
+	if len(c) > 12 {
+		c = c[:12]
+	}
+	return fmt.Sprintf("solana-key-gen %s (commit %s, built %s, %s, schema %d)", b.Version, cmp.Or(c, "unknown"), cmp.Or(b.BuildTime, "unknown"), b.GoVersion, b.SchemaVersion)
+}
+
+// dbSchemaVersion is the newest schema version recorded in db, or 0 if no
+// binary has recorded one yet.
+func dbSchemaVersion(ctx context.Context, db *gorm.DB) (int, error) {
+	db = db.WithContext(ctx)
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return 0, nil
+	}
+	var v int
+	err := db.Model(&SchemaVersion{}).Select("coalesce(max(version), 0)").Row().Scan(&v)
+	return v, ctxError(ctx, "read schema version", err)
+}
+
+// checkSchema returns the schema version of the database name, or
+// errSchemaTooNew, naming both versions, if a newer binary migrated it.
+// An older schema is fine: migrate brings it up to schemaVersion.
+func checkSchema(ctx context.Context, db *gorm.DB, name string) (int, error) {
+	v, err := dbSchemaVersion(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	if v > schemaVersion {
+		return v, fmt.Errorf("%w: %s is at schema version %d but %s only knows up to %d; deploy a binary built for schema %d or newer",
+			errSchemaTooNew, name, v, currentBuild().Version, schemaVersion, v)
+	}
+	return v, nil
+}
+
+// readOnlyCommands are the subcommands and MODEs that only read the
+// database, so still run with SCHEMA_MISMATCH=read-only. Serving ("") runs
+// too, in maintenance mode.
+var readOnlyCommands = map[string]bool{
+	"": true, "list": true, "export-keygen-dir": true, "reconcile-expected": true,
+	"generate": true, "standby": true, "snapshot": true, "check-consistency": true,
+}
+
+// refuseWrites returns an error naming cmd or mode if one would write to a
+// database schemaErr, if set, made read-only. repair is -repair, which
+// makes check-consistency write.
+func refuseWrites(schemaErr error, cmd, mode string, repair bool) error {
+	if schemaErr == nil {
+		return nil
+	}
+	switch {
+	case !readOnlyCommands[cmd]:
+		return fmt.Errorf("%s writes to the database, refused: %w", cmd, schemaErr)
+	case !readOnlyCommands[mode]:
+		return fmt.Errorf("MODE=%s writes to the database, refused: %w", mode, schemaErr)
+	case mode == "check-consistency" && repair:
+		return fmt.Errorf("check-consistency -repair writes to the database, refused: %w", schemaErr)
+	}
+	return nil
+}
+
+// recordSchema marks db as migrated to schemaVersion by this binary.
+func recordSchema(db *gorm.DB) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&SchemaVersion{Version: schemaVersion, AppVersion: version}).Error
+}
+
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		buildInfo
+		DBSchemaVersion int `json:"db_schema_version"`
+	}{currentBuild(), s.dbSchema})
+}
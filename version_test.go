@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCheckSchema runs checkSchema against schema_version holding an older,
+// the same and a newer schema than this binary's.
+func TestCheckSchema(t *testing.T) {
+	store := testDatabase(t)
+	ctx := context.Background()
+	tests := []struct {
+		recorded []int
+		// wantErr is part of the error expected, "" for none
+		wantErr string
+	}{
+		{nil, ""},
+		{[]int{1}, ""},
+		{[]int{1, schemaVersion}, ""},
+		{[]int{schemaVersion, schemaVersion + 1}, fmt.Sprintf("at schema version %d but %s only knows up to %d", schemaVersion+1, version, schemaVersion)},
+	}
+	t.Cleanup(func() { store.db.Exec("DELETE FROM schema_version WHERE version > ?", schemaVersion) })
+	for _, tt := range tests {
+		if err := store.db.Exec("DELETE FROM schema_version").Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range tt.recorded {
+			if err := store.db.Create(&SchemaVersion{Version: v, AppVersion: "fixture"}).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := checkSchema(ctx, store.db, "DATABASE_URL")
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("schema versions %v: %v", tt.recorded, err)
+		case tt.wantErr != "" && (!errors.Is(err, errSchemaTooNew) || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("schema versions %v = %v, want errSchemaTooNew with %q", tt.recorded, err, tt.wantErr)
+		}
+	}
+	if err := recordSchema(store.db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRefuseWrites checks which subcommands and MODEs run with
+// SCHEMA_MISMATCH=read-only against a schema newer than the binary.
+func TestRefuseWrites(t *testing.T) {
+	tooNew := fmt.Errorf("%w: fixture", errSchemaTooNew)
+	tests := []struct {
+		cmd, mode string
+		repair    bool
+		refused   bool
+	}{
+		{"", "", false, false},
+		{"", "generate", false, false},
+		{"", "standby", false, false},
+		{"list", "", false, false},
+		{"export-keygen-dir", "", false, false},
+		{"reconcile-expected", "", false, false},
+		{"", "snapshot", false, false},
+		{"", "check-consistency", false, false},
+		{"", "check-consistency", true, true},
+		{"", "restore-snapshot", false, true},
+		{"stage", "", false, true},
+		{"promote", "", false, true},
+		{"seed", "", false, true},
+		{"reconcile-transfers", "", false, true},
+	}
+	for _, tt := range tests {
+		err := refuseWrites(tooNew, tt.cmd, tt.mode, tt.repair)
+		if refused := err != nil; refused != tt.refused || refused && !errors.Is(err, errSchemaTooNew) {
+			t.Errorf("command %q, MODE %q, repair %v: %v, want refused %v", tt.cmd, tt.mode, tt.repair, err, tt.refused)
+		}
+		if err := refuseWrites(nil, tt.cmd, tt.mode, tt.repair); err != nil {
+			t.Errorf("command %q, MODE %q refused on a current schema: %v", tt.cmd, tt.mode, err)
+		}
+	}
+}
+
+// TestMaintenanceStaysOnForNewerSchema tries to lift the maintenance mode
+// SCHEMA_MISMATCH=read-only entered.
+func TestMaintenanceStaysOnForNewerSchema(t *testing.T) {
+	s := &server{maintenance: newMaintenanceSwitch(true, ""), schemaTooNew: fmt.Errorf("%w: fixture", errSchemaTooNew)}
+	w := httptest.NewRecorder()
+	s.handleMaintenance(w, httptest.NewRequest(http.MethodPost, "/v1/admin/maintenance", strings.NewReader(`{"enabled":false}`)))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "schema_read_only") {
+		t.Errorf("lifting maintenance = %d %s, want 409 schema_read_only", w.Code, w.Body)
+	}
+	if !s.maintenance.Active() {
+		t.Error("maintenance was lifted on a read-only schema")
+	}
+}
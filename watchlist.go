@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58/base58"
+)
+
+// watchlist holds external address lists (WATCHLIST: exchange hot wallets,
+// sanctioned address feeds, ...) that no key of ours should ever appear in.
+// A hit means something is badly wrong with generation: it raises an
+// ALERT and quarantines the key.
+//
+// Only an 8-byte fingerprint of each address is kept, sorted, so a list of
+// millions costs a few tens of megabytes. A fingerprint hit is confirmed by
+// streaming the source again for the exact address; a source that cannot
+// be re-read counts the hit as confirmed rather than miss one. A source
+// that fails to refresh keeps its previous entries.
+type watchlist struct {
+	sources  []string
+	alertURL string
+	client   *http.Client
+
+	mu       sync.RWMutex
+	sets     map[string][]uint64
+	loadedAt map[string]time.Time
+}
+
+// newWatchlist loads sources, comma-separated file paths or http(s) URLs.
+// A source that fails here is retried at the next refresh.
+func newWatchlist(ctx context.Context, sources []string, alertURL string) *watchlist {
+	w := &watchlist{sources: sources, alertURL: alertURL,
+		client: &http.Client{Timeout: 5 * time.Minute}, sets: map[string][]uint64{}, loadedAt: map[string]time.Time{}}
+	w.Refresh(ctx)
+	return w
+}
+
+// Refresh reloads every source.
+func (w *watchlist) Refresh(ctx context.Context) {
+	for _, src := range w.sources {
+		var fps []uint64
+		invalid, err := w.scan(ctx, src, func(addr []byte) bool {
+			fps = append(fps, fingerprint(addr))
+			return true
+		})
+		if err != nil {
+			watchlistRefreshFailuresTotal.WithLabelValues(src).Inc()
+			w.mu.RLock()
+			last, ok := w.loadedAt[src]
+			w.mu.RUnlock()
+			stale := "never loaded"
+			if ok {
+				stale = fmt.Sprintf("keeping the list loaded %v ago", clock.Now().Sub(last).Round(time.Second))
+			}
+			log.Printf("WARN failed to load watchlist %s, %s: %v\n", src, stale, err)
+			continue
+		}
+		slices.Sort(fps)
+		fps = slices.Clip(slices.Compact(fps))
+		w.mu.Lock()
+		w.sets[src] = fps
+		w.loadedAt[src] = clock.Now()
+		w.mu.Unlock()
+		watchlistEntries.WithLabelValues(src).Set(float64(len(fps)))
+		if invalid > 0 {
+			log.Printf("WARN watchlist %s: skipped %d entries that are not base58 addresses\n", src, invalid)
+		}
+		log.Printf("Loaded %d watchlist addresses from %s\n", len(fps), src)
+	}
+}
+
+// Listed reports whether pub is on a watchlist, and which.
+func (w *watchlist) Listed(ctx context.Context, pub string) (string, bool) {
+	if w == nil {
+		return "", false
+	}
+	addr, err := base58.Decode(pub)
+	if err != nil || len(addr) != 32 {
+		return "", false
+	}
+	fp := fingerprint(addr)
+	var candidates []string
+	w.mu.RLock()
+	for _, src := range w.sources {
+		if _, ok := slices.BinarySearch(w.sets[src], fp); ok {
+			candidates = append(candidates, src)
+		}
+	}
+	w.mu.RUnlock()
+
+	for _, src := range candidates {
+		var exact bool
+		_, err := w.scan(ctx, src, func(a []byte) bool {
+			exact = bytes.Equal(a, addr)
+			return !exact
+		})
+		if exact || err != nil {
+			if err != nil {
+				log.Printf("WARN could not confirm watchlist fingerprint hit for %s in %s, treating it as a hit: %v\n", pub, src, err)
+			}
+			return src, true
+		}
+	}
+	return "", false
+}
+
+// Hit raises the alert for pub found in source by where: "generated" for
+// a new key, caught before insert, or "sweep" for a stored one.
+func (w *watchlist) Hit(ctx context.Context, pub, source, where string) {
+	watchlistHitsTotal.WithLabelValues(where).Inc()
+	log.Printf("ALERT CRITICAL watchlist hit: generated address %s appears in %s (%s); quarantining it. Check the RNG and generator immediately\n",
+		pub, source, where)
+	if w.alertURL != "" {
+		payload := map[string]any{"event": "watchlist_hit", "public_key": pub, "source": source, "found_by": where, "at": clock.Now()}
+		if err := postAlert(context.WithoutCancel(ctx), w.alertURL, payload); err != nil {
+			log.Println("Error sending watchlist alert:", err)
+		}
+	}
+}
+
+// Job is the watchlist job: it refreshes the lists, except on its first
+// run as newWatchlist has just loaded them, then sweeps the whole table.
+func (w *watchlist) Job(store *gormStore) func(context.Context) error {
+	loaded := true
+	return func(ctx context.Context) error {
+		if !loaded {
+			w.Refresh(ctx)
+		}
+		loaded = false
+		if err := w.sweep(ctx, store); err != nil && ctx.Err() == nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// sweep screens every stored public key, picked or not, quarantining hits.
+// It resumes the scan a restart interrupted; keys created since its
+// generation began are screened by the next one.
+func (w *watchlist) sweep(ctx context.Context, store *gormStore) error {
+	st, err := store.ScanState(ctx, "watchlist")
+	if err != nil {
+		return err
+	}
+	start := clock.Now()
+	after := st.Cursor
+	var checked, hits int
+	for {
+		page, err := store.PublicKeysAfter(ctx, after, st.StartedAt, 5000)
+		if err != nil {
+			return err
+		}
+		for _, pub := range page {
+			if src, ok := w.Listed(ctx, pub); ok {
+				hits++
+				w.Hit(ctx, pub, src, "sweep")
+				if _, err := store.Quarantine(ctx, pub); err != nil {
+					log.Printf("Error quarantining watchlisted key %s: %v\n", pub, err)
+				}
+			}
+		}
+		checked += len(page)
+		done := len(page) < 5000
+		if len(page) > 0 {
+			after = page[len(page)-1]
+		}
+		if err := store.SaveScanCursor(ctx, st, after, done); err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	resumed := ""
+	if st.Cursor != "" {
+		resumed = ", resumed after " + st.Cursor
+	}
+	log.Printf("Watchlist sweep %d checked %d keys in %v%s, %d hits\n", st.Generation, checked, clock.Now().Sub(start).Round(time.Millisecond), resumed, hits)
+	return nil
+}
+
+// PublicKeysAfter returns up to n public keys after after, in order, of
+// the keys created before before.
+func (s *gormStore) PublicKeysAfter(ctx context.Context, after string, before time.Time, n int) ([]string, error) {
+	db, ctx, cancel := s.session(ctx, s.timeouts.Query)
+	defer cancel()
+	var keys []string
+	err := db.Model(&TokenKey{}).Where("public_key > ? AND created_at < ?", after, before).Order("public_key").Limit(n).
+		Pluck("public_key", &keys).Error
+	return keys, ctxError(ctx, "list public keys", err)
+}
+
+// fingerprint is the first 8 bytes of a decoded address.
+func fingerprint(addr []byte) uint64 { return binary.BigEndian.Uint64(addr) }
+
+// scan streams src's addresses to fn, decoded, until fn returns false,
+// and counts entries that are not addresses. Sources may be gzipped and
+// hold either a JSON array of strings or text: one entry per line, or CSV
+// whose first field is the address (a header line counts as invalid),
+// with blank lines and "#" comments ignored.
+func (w *watchlist) scan(ctx context.Context, src string, fn func([]byte) bool) (int, error) {
+	r, err := w.open(ctx, src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	pr := bufio.NewReaderSize(r, 64<<10)
+	if magic, _ := pr.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(pr)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		pr = bufio.NewReaderSize(gz, 64<<10)
+	}
+
+	var invalid int
+	add := func(entry string) bool {
+		addr, err := base58.Decode(entry)
+		if err != nil || len(addr) != 32 {
+			invalid++
+			return true
+		}
+		return fn(addr)
+	}
+
+	first, err := firstByte(pr)
+	if err != nil {
+		return 0, err
+	}
+	if first == '[' {
+		dec := json.NewDecoder(pr)
+		if _, err := dec.Token(); err != nil {
+			return invalid, err
+		}
+		for dec.More() {
+			var entry string
+			if err := dec.Decode(&entry); err != nil {
+				return invalid, err
+			}
+			if !add(strings.TrimSpace(entry)) {
+				return invalid, nil
+			}
+		}
+		return invalid, nil
+	}
+
+	sc := bufio.NewScanner(pr)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, _, _ := strings.Cut(line, ",")
+		if !add(strings.Trim(strings.TrimSpace(entry), `"`)) {
+			return invalid, nil
+		}
+	}
+	return invalid, sc.Err()
+}
+
+// firstByte is the first byte of r past whitespace and a UTF-8 byte order
+// mark, left unread; 0 for an empty source.
+func firstByte(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if strings.IndexByte(" \t\r\n\xef\xbb\xbf", b[0]) < 0 {
+			return b[0], nil
+		}
+		r.ReadByte()
+	}
+}
+
+func (w *watchlist) open(ctx context.Context, src string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return os.Open(src)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", src, resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSweepResumesFromCursor interrupts a watchlist sweep part way, as a
+// restart would, and checks the next run screens only the rest of that
+// generation before a new one starts over from the beginning.
+func TestSweepResumesFromCursor(t *testing.T) {
+	store := testDatabase(t)
+	ctx := context.Background()
+	began := time.Now().Add(-time.Hour).UTC()
+
+	var pubs []string
+	for _, name := range []string{"k1", "k2", "k3", "k4"} {
+		pubs = append(pubs, testPub(name))
+	}
+	slices.Sort(pubs)
+	rows := []TokenKey{
+		{ID: "00000000-0000-0000-0000-000000000001", PublicKey: pubs[0], PrivateKey: "p1", CreatedAt: began.Add(-time.Minute)},
+		{ID: "00000000-0000-0000-0000-000000000002", PublicKey: pubs[1], PrivateKey: "p2", CreatedAt: began.Add(-time.Minute)},
+		{ID: "00000000-0000-0000-0000-000000000003", PublicKey: pubs[2], PrivateKey: "p3", CreatedAt: began.Add(-time.Minute)},
+		// Created while the interrupted generation was running
+		{ID: "00000000-0000-0000-0000-000000000004", PublicKey: pubs[3], PrivateKey: "p4", CreatedAt: began.Add(time.Minute)},
+	}
+	if err := store.db.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	interrupted := ScannerState{Scanner: "watchlist", Generation: 1, StartedAt: began, Cursor: pubs[1]}
+	if err := store.db.Create(&interrupted).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(src, []byte(strings.Join(pubs, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w := newWatchlist(ctx, []string{src}, "")
+	quarantined := func() []string {
+		var keys []string
+		if err := store.db.Model(&TokenKey{}).Where("quarantined").Order("public_key").Pluck("public_key", &keys).Error; err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	if err := w.sweep(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	if got := quarantined(); !slices.Equal(got, pubs[2:3]) {
+		t.Fatalf("resumed sweep quarantined %v, want only %v", got, pubs[2:3])
+	}
+	st, err := store.ScanState(ctx, "watchlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Generation != 2 || st.CompletedGeneration != 1 || st.Cursor != "" || st.CompletedAt == nil {
+		t.Fatalf("state after the resumed sweep = %+v, want generation 1 completed and 2 started", st)
+	}
+
+	if err := w.sweep(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	if got := quarantined(); !slices.Equal(got, pubs) {
+		t.Fatalf("next generation quarantined %v, want all of %v", got, pubs)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parsePatternWeights applies PATTERN_WEIGHTS entries of the form
+// "pattern=weight" to patterns. Once any weight is set, every pattern must
+// have one.
+func parsePatternWeights(spec string, patterns []pattern) error {
+	set := 0
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("want pattern=weight in %q", entry)
+		}
+		w, err := strconv.ParseFloat(val, 64)
+		if err != nil || w <= 0 {
+			return fmt.Errorf("weight in %q must be a positive number", entry)
+		}
+
+		found := false
+		for i := range patterns {
+			if patterns[i].Name() == name {
+				patterns[i].Weight = w
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("weight for unknown pattern %q", name)
+		}
+		set++
+	}
+	if set == 0 {
+		return nil
+	}
+	for _, p := range patterns {
+		if p.Weight == 0 {
+			return fmt.Errorf("pattern %q has no weight; weighted mode needs one for every pattern", p.Name())
+		}
+	}
+	return nil
+}
+
+// weightedSampler picks a pattern name with probability proportional to
+// its weight.
+type weightedSampler struct {
+	names []string
+	cum   []float64 // running total of the weights, ending in the sum
+}
+
+// newWeightedSampler returns a sampler over the weighted patterns, or nil
+// if none are weighted.
+func newWeightedSampler(patterns []pattern) *weightedSampler {
+	s := &weightedSampler{}
+	var total float64
+	for _, p := range patterns {
+		if p.Weight <= 0 {
+			continue
+		}
+		total += p.Weight
+		s.names = append(s.names, p.Name())
+		s.cum = append(s.cum, total)
+	}
+	if len(s.names) == 0 {
+		return nil
+	}
+	return s
+}
+
+// pick maps u in [0, 1) onto a name.
+func (s *weightedSampler) pick(u float64) string {
+	x := u * s.cum[len(s.cum)-1]
+	i := sort.Search(len(s.cum), func(i int) bool { return s.cum[i] > x })
+	return s.names[min(i, len(s.names)-1)]
+}
+
+func (s *weightedSampler) sample() string { return s.pick(rand.Float64()) }